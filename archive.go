@@ -0,0 +1,371 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The archive module reads and writes zip and tar archives (optionally
+// gzipped), the format is picked from the file extension: .zip, .tar,
+// .tar.gz or .tgz
+//
+//   archive.list(path)                 array of {name, size, dir}
+//   archive.extract(path, dest)        extract everything into dest, returns the names
+//   archive.create(path, files, base)  archive the files (and directories), with
+//                                      names relative to base if given
+//
+// Entries that would end up outside of dest when extracted (absolute
+// names, '..' components, links) are rejected. The paths are checked
+// against the capabilities of the VM.
+
+const (
+	archiveZip = iota
+	archiveTar
+	archiveTarGz
+)
+
+func archiveModule() *Object {
+	return newModule(map[string]GoFunc{
+		"list":    archiveList,
+		"extract": archiveExtract,
+		"create":  archiveCreate,
+	})
+}
+
+func archiveFormat(path string) int {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTarGz
+	}
+	panic(fmt.Sprintf("archive: unknown archive format '%s'", path))
+}
+
+func archiveError(err error) {
+	panic("archive: " + err.Error())
+}
+
+// an entry as seen by list and extract
+type archiveEntry struct {
+	name string
+	size int64
+	dir  bool
+	link bool
+	open func() (io.ReadCloser, error)
+}
+
+// call fn for every entry in the archive
+func walkArchive(path string, fn func(e *archiveEntry)) {
+	if archiveFormat(path) == archiveZip {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			archiveError(err)
+		}
+		defer zr.Close()
+
+		for _, f := range zr.File {
+			mode := f.Mode()
+			fn(&archiveEntry{
+				name: f.Name,
+				size: int64(f.UncompressedSize64),
+				dir:  mode.IsDir(),
+				link: mode&os.ModeSymlink != 0,
+				open: f.Open,
+			})
+		}
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		archiveError(err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if archiveFormat(path) == archiveTarGz {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			archiveError(err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			archiveError(err)
+		}
+		fn(&archiveEntry{
+			name: hdr.Name,
+			size: hdr.Size,
+			dir:  hdr.Typeflag == tar.TypeDir,
+			link: hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink,
+			open: func() (io.ReadCloser, error) {
+				return nopReadCloser{tr}, nil
+			},
+		})
+	}
+}
+
+type nopReadCloser struct {
+	io.Reader
+}
+
+func (nopReadCloser) Close() error { return nil }
+
+func archiveList(call *FuncCall) {
+	path := call.stringArg(0)
+	call.VM.CheckRead(path)
+	list := Array{}
+	walkArchive(path, func(e *archiveEntry) {
+		list = append(list, NewObject(nil, map[string]Value{
+			"name": String(e.name),
+			"size": Number(e.size),
+			"dir":  Bool(e.dir),
+		}))
+	})
+	call.PushReturnValue(&list)
+}
+
+// whether name stays inside the directory it's extracted to
+func isLocalArchiveName(name string) bool {
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") || filepath.IsAbs(name) {
+		return false
+	}
+	clean := path.Clean(strings.Replace(name, "\\", "/", -1))
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// safeArchivePath returns the path where name should be extracted
+// inside dest, or an error if it would escape dest
+func safeArchivePath(dest, name string) (string, error) {
+	if !isLocalArchiveName(name) {
+		return "", fmt.Errorf("illegal path '%s' in archive", name)
+	}
+	return filepath.Join(dest, filepath.FromSlash(name)), nil
+}
+
+func extractEntry(e *archiveEntry, target string) error {
+	if e.dir {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	r, err := e.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func archiveExtract(call *FuncCall) {
+	path, dest := call.stringArg(0), call.stringArg(1)
+	call.VM.CheckRead(path)
+	call.VM.CheckWrite(dest)
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		archiveError(err)
+	}
+
+	names := Array{}
+	walkArchive(path, func(e *archiveEntry) {
+		if e.link {
+			archiveError(fmt.Errorf("refusing to extract link '%s'", e.name))
+		}
+		target, err := safeArchivePath(dest, e.name)
+		if err != nil {
+			archiveError(err)
+		}
+		if err := extractEntry(e, target); err != nil {
+			archiveError(err)
+		}
+		names = append(names, String(e.name))
+	})
+	call.PushReturnValue(&names)
+}
+
+// archiveWriter abstracts zip.Writer and tar.Writer for create
+type archiveWriter interface {
+	add(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// the files/compressors under the archive writer, closed after it
+type archiveClosers []io.Closer
+
+func (c archiveClosers) closeAll(err error) error {
+	for i := len(c) - 1; i >= 0; i-- {
+		if cerr := c[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+	closers archiveClosers
+}
+
+func (w *zipArchiveWriter) add(name string, info os.FileInfo, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	} else {
+		hdr.Method = zip.Deflate
+	}
+	fw, err := w.CreateHeader(hdr)
+	if err != nil || r == nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (w *zipArchiveWriter) Close() error {
+	return w.closers.closeAll(w.Writer.Close())
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+	closers archiveClosers
+}
+
+func (w *tarArchiveWriter) add(name string, info os.FileInfo, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := w.WriteHeader(hdr); err != nil || r == nil {
+		return err
+	}
+	_, err = io.Copy(w.Writer, r)
+	return err
+}
+
+func (w *tarArchiveWriter) Close() error {
+	return w.closers.closeAll(w.Writer.Close())
+}
+
+func newArchiveWriter(path string) (archiveWriter, error) {
+	format := archiveFormat(path)
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case archiveZip:
+		return &zipArchiveWriter{zip.NewWriter(file), archiveClosers{file}}, nil
+	case archiveTarGz:
+		gz := gzip.NewWriter(file)
+		return &tarArchiveWriter{tar.NewWriter(gz), archiveClosers{file, gz}}, nil
+	default:
+		return &tarArchiveWriter{tar.NewWriter(file), archiveClosers{file}}, nil
+	}
+}
+
+func addToArchive(w archiveWriter, path, base string) error {
+	return filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(p)
+		if base != "" {
+			if name, err = filepath.Rel(base, p); err != nil {
+				return err
+			}
+		}
+		// like tar, store absolute paths without the leading '/'
+		name = strings.TrimLeft(filepath.ToSlash(name), "/")
+		if name == "." || name == "" {
+			return nil
+		}
+		if !isLocalArchiveName(name) {
+			return fmt.Errorf("'%s' is outside of the archive base", p)
+		}
+
+		if !info.Mode().IsRegular() {
+			if info.IsDir() {
+				return w.add(name, info, nil)
+			}
+			// skip links, devices...
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return w.add(name, info, f)
+	})
+}
+
+func archiveCreate(call *FuncCall) {
+	path := call.stringArg(0)
+	if call.NumArgs < 2 {
+		argTypeError(1, "array", Nil{})
+	}
+	arr, ok := call.Args[1].(*Array)
+	if !ok {
+		argTypeError(1, "array", call.Args[1])
+	}
+	base := call.optStringArg(2, "")
+	call.VM.CheckWrite(path)
+	for _, v := range *arr {
+		call.VM.CheckRead(v.String())
+	}
+
+	w, err := newArchiveWriter(path)
+	if err != nil {
+		archiveError(err)
+	}
+	for _, v := range *arr {
+		if err := addToArchive(w, v.String(), base); err != nil {
+			w.Close()
+			archiveError(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		archiveError(err)
+	}
+}
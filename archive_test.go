@@ -0,0 +1,167 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveNames(t *testing.T) {
+	names := map[string]bool{
+		"a.txt":          true,
+		"dir/a.txt":      true,
+		"dir/../a.txt":   true,
+		"./a.txt":        true,
+		"../a.txt":       false,
+		"dir/../../a":    false,
+		"..":             false,
+		"/etc/passwd":    false,
+		"\\windows\\a":   false,
+		"dir\\..\\..\\a": false,
+	}
+
+	for name, expected := range names {
+		if isLocalArchiveName(name) != expected {
+			t.Errorf("isLocalArchiveName(%q) should be %v", name, expected)
+		}
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yo-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("alpha"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("beta!"), 0644)
+
+	for _, ext := range []string{".zip", ".tar", ".tgz", ".tar.gz"} {
+		path := filepath.Join(dir, "files"+ext)
+		dest := filepath.Join(dir, "dest"+ext)
+		source := fmt.Sprintf(`
+			archive.create(%q, [%q], %q)
+			var list = [[e.name, e.size, e.dir] for e in archive.list(%q)]
+			return list, archive.extract(%q, %q)`,
+			path, src, src, path, path, dest)
+		res := runString(t, NewVM(), source)
+		if want := "[[[a.txt 5 false] [sub/ 0 true] [sub/b.txt 5 false]] [a.txt sub/ sub/b.txt]]"; fmt.Sprint(res) != want {
+			t.Errorf("%s: expected %s, got %v", ext, want, res)
+		}
+		for name, content := range map[string]string{"a.txt": "alpha", "sub/b.txt": "beta!"} {
+			data, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+			if err != nil || string(data) != content {
+				t.Errorf("%s: expected %s to be %q, got %q %v", ext, name, content, data, err)
+			}
+		}
+	}
+}
+
+// an archive entry written by the tests, with data for the files
+type testEntry struct {
+	name     string
+	typeflag byte // tar.TypeReg, tar.TypeSymlink or tar.TypeLink
+	data     string
+}
+
+func writeTestArchive(t *testing.T, path string, entries []testEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if strings.HasSuffix(path, ".zip") {
+		zw := zip.NewWriter(f)
+		for _, e := range entries {
+			hdr := &zip.FileHeader{Name: e.name}
+			hdr.SetMode(0644)
+			if e.typeflag != tar.TypeReg {
+				hdr.SetMode(os.ModeSymlink | 0777)
+			}
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, e.data)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	var w io.Writer = f
+	if strings.HasSuffix(path, ".tgz") {
+		gz := gzip.NewWriter(f)
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644}
+		if e.typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.data))
+		} else {
+			hdr.Linkname = e.data
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, e.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveExtractRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yo-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		ext   string
+		entry testEntry
+		err   string
+	}{
+		{".zip", testEntry{"../evil", tar.TypeReg, "x"}, "archive: illegal path '../evil' in archive"},
+		{".tar", testEntry{"../evil", tar.TypeReg, "x"}, "archive: illegal path '../evil' in archive"},
+		{".tgz", testEntry{"sub/../../evil", tar.TypeReg, "x"}, "archive: illegal path 'sub/../../evil' in archive"},
+		{".tar", testEntry{"/evil", tar.TypeReg, "x"}, "archive: illegal path '/evil' in archive"},
+		{".zip", testEntry{"evil", tar.TypeSymlink, "/etc/passwd"}, "archive: refusing to extract link 'evil'"},
+		{".tar", testEntry{"evil", tar.TypeSymlink, ".."}, "archive: refusing to extract link 'evil'"},
+		{".tgz", testEntry{"evil", tar.TypeLink, "/etc/passwd"}, "archive: refusing to extract link 'evil'"},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, fmt.Sprintf("bad%d%s", i, test.ext))
+		dest := filepath.Join(dir, fmt.Sprintf("dest%d", i))
+		writeTestArchive(t, path, []testEntry{{"ok.txt", tar.TypeReg, "ok"}, test.entry})
+
+		code, err := CompileReader(strings.NewReader(fmt.Sprintf("archive.extract(%q, %q)", path, dest)), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewVM().run(code)
+		if rerr, ok := err.(*RuntimeError); !ok || rerr.Message != test.err {
+			t.Errorf("%s %s: expected %q, got %v", test.ext, test.entry.name, test.err, err)
+		}
+		if _, err := os.Lstat(filepath.Join(dest, "evil")); !os.IsNotExist(err) {
+			t.Errorf("%s %s: expected no link extracted, got %v", test.ext, test.entry.name, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+			t.Errorf("%s %s: expected nothing outside of dest, got %v", test.ext, test.entry.name, err)
+		}
+	}
+}
@@ -4,7 +4,9 @@
 
 package ast
 
-import ()
+import (
+	"fmt"
+)
 
 type (
 	Node interface {
@@ -12,7 +14,15 @@ type (
 	}
 
 	NodeInfo struct {
-		Line int
+		Line int // the line reported in errors about the node
+
+		// range of the node in the source, End is just past it's last character
+		Start, End Position
+	}
+
+	// Position is a place in the source, Column counts characters from 1.
+	Position struct {
+		Line, Column int
 	}
 
 	//
@@ -59,11 +69,26 @@ type (
 		Fields []*ObjectField
 	}
 
+	// Comprehension is an array comprehension, [Value for ...], or an
+	// object comprehension, {Key: Value for ...}, if Key is not nil.
+	// The loop has no body.
+	Comprehension struct {
+		NodeInfo
+		Key   Node
+		Value Node
+		Loop  *ForIteratorStmt
+	}
+
 	Function struct {
 		NodeInfo
-		Name Node
-		Args []Node
-		Body Node
+		Name       Node
+		Args       []Node
+		ArgTypes   []*Id // type annotation of each argument, nil if there's none
+		ReturnType *Id
+		Requires   []Node // conditions checked when it's called
+		Ensures    []Node // conditions checked when it returns, with it's first result as 'result'
+		Body       Node
+		Doc        string // the /// comment before a named function
 	}
 
 	Selector struct {
@@ -84,6 +109,15 @@ type (
 		End   Node
 	}
 
+	// Range is a range of numbers, Start..End or Start..End by Step,
+	// Step is nil if it has none.
+	Range struct {
+		NodeInfo
+		Start Node
+		End   Node
+		Step  Node
+	}
+
 	KwArg struct {
 		NodeInfo
 		Key   string
@@ -95,12 +129,30 @@ type (
 		Arg Node
 	}
 
+	// ObjectUnpack is the value of '{a, b: c} := obj', the fields Keys
+	// of Value are unpacked into the names at the left of the assignment.
+	ObjectUnpack struct {
+		NodeInfo
+		Keys  []string
+		Value Node
+	}
+
 	CallExpr struct {
 		NodeInfo
 		Left Node
 		Args []Node
 	}
 
+	// Template is a template literal, `text ${expr} text`, with one
+	// more part than expressions. A tagged template, tag`...`, calls
+	// Tag with the array of parts and the array of values.
+	Template struct {
+		NodeInfo
+		Tag   Node
+		Parts []string
+		Exprs []Node
+	}
+
 	PostfixExpr struct {
 		NodeInfo
 		Op   Token
@@ -136,6 +188,7 @@ type (
 		IsConst bool
 		Left    []*Id
 		Right   []Node
+		Doc     string // the /// comment before the declaration
 	}
 
 	Assignment struct {
@@ -185,6 +238,75 @@ type (
 		Body Node
 	}
 
+	// ArrayPattern matches an array with as many elements as Elements,
+	// or at least as many if it has a Rest, which is bound to an array
+	// of the elements after them. The elements are patterns too: an
+	// *Id binds a name to the element (_ binds nothing), an
+	// *ArrayPattern or an *ObjectPattern matches it's parts and any
+	// other expression is compared to it.
+	ArrayPattern struct {
+		NodeInfo
+		Elements []Node
+		Rest     *Id
+	}
+
+	// ObjectPattern matches an object that has all the keys of Fields,
+	// whose values match the patterns of the fields as in ArrayPattern.
+	// A field without a Value, {name}, binds the name of it's key.
+	ObjectPattern struct {
+		NodeInfo
+		Fields []*ObjectField
+	}
+
+	// MatchCase is a case of a match. A pattern, an *ArrayPattern or
+	// an *ObjectPattern, is the only value of it's case and the names
+	// it binds are visible in Body.
+	MatchCase struct {
+		NodeInfo
+		Values []Node // empty in the else case
+		Body   Node
+	}
+
+	// MatchStmt matches Value against the values of the cases. In a
+	// type switch, match type(Value), the cases are type names or
+	// prototypes, and Name is bound to Value in all of them.
+	MatchStmt struct {
+		NodeInfo
+		Name   *Id
+		Value  Node
+		Cases  []*MatchCase
+		IsType bool
+	}
+
+	// WithStmt calls the close method of the value of Name
+	// when Body is left, even by an error
+	WithStmt struct {
+		NodeInfo
+		Name  *Id
+		Value Node
+		Body  Node
+	}
+
+	// ProtoField is a field of a prototype, Type and
+	// Value are nil if it has no annotation or default
+	ProtoField struct {
+		NodeInfo
+		Name  *Id
+		Type  *Id
+		Value Node
+	}
+
+	// ProtoDecl declares Name as a prototype whose
+	// instances are created by calling it, Parent is
+	// nil if it doesn't inherit from another prototype
+	ProtoDecl struct {
+		NodeInfo
+		Name   *Id
+		Parent Node
+		Fields []*ProtoField
+		Doc    string // the /// comment before the declaration
+	}
+
 	RecoverBlock struct {
 		NodeInfo
 		Id    *Id
@@ -201,6 +323,10 @@ type (
 	Block struct {
 		NodeInfo
 		Nodes []Node
+
+		// the "key: value" lines between "---" at the start
+		// of a file, only in the root block
+		FrontMatter map[string]string
 	}
 )
 
@@ -236,6 +362,10 @@ func (node *Object) Accept(v Visitor, data interface{}) {
 	v.VisitObject(node, data)
 }
 
+func (node *Comprehension) Accept(v Visitor, data interface{}) {
+	v.VisitComprehension(node, data)
+}
+
 func (node *Function) Accept(v Visitor, data interface{}) {
 	v.VisitFunction(node, data)
 }
@@ -252,6 +382,10 @@ func (node *Slice) Accept(v Visitor, data interface{}) {
 	v.VisitSlice(node, data)
 }
 
+func (node *Range) Accept(v Visitor, data interface{}) {
+	v.VisitRange(node, data)
+}
+
 func (node *KwArg) Accept(v Visitor, data interface{}) {
 	v.VisitKwArg(node, data)
 }
@@ -260,10 +394,18 @@ func (node *VarArg) Accept(v Visitor, data interface{}) {
 	v.VisitVarArg(node, data)
 }
 
+func (node *ObjectUnpack) Accept(v Visitor, data interface{}) {
+	v.VisitObjectUnpack(node, data)
+}
+
 func (node *CallExpr) Accept(v Visitor, data interface{}) {
 	v.VisitCallExpr(node, data)
 }
 
+func (node *Template) Accept(v Visitor, data interface{}) {
+	v.VisitTemplate(node, data)
+}
+
 func (node *PostfixExpr) Accept(v Visitor, data interface{}) {
 	v.VisitPostfixExpr(node, data)
 }
@@ -312,6 +454,26 @@ func (node *ForStmt) Accept(v Visitor, data interface{}) {
 	v.VisitForStmt(node, data)
 }
 
+func (node *ArrayPattern) Accept(v Visitor, data interface{}) {
+	v.VisitArrayPattern(node, data)
+}
+
+func (node *ObjectPattern) Accept(v Visitor, data interface{}) {
+	v.VisitObjectPattern(node, data)
+}
+
+func (node *MatchStmt) Accept(v Visitor, data interface{}) {
+	v.VisitMatchStmt(node, data)
+}
+
+func (node *WithStmt) Accept(v Visitor, data interface{}) {
+	v.VisitWithStmt(node, data)
+}
+
+func (node *ProtoDecl) Accept(v Visitor, data interface{}) {
+	v.VisitProtoDecl(node, data)
+}
+
 func (node *RecoverBlock) Accept(v Visitor, data interface{}) {
 	v.VisitRecoverBlock(node, data)
 }
@@ -324,12 +486,54 @@ func (node *Block) Accept(v Visitor, data interface{}) {
 	v.VisitBlock(node, data)
 }
 
+// Line returns the line where the node starts, 0 if it's unknown
+func Line(node Node) int {
+	if n, ok := node.(interface {
+		line() int
+	}); ok {
+		return n.line()
+	}
+	return 0
+}
+
+func (info *NodeInfo) line() int {
+	return info.Line
+}
+
+// Info returns the NodeInfo of node, the zero value if it has none
+func Info(node Node) NodeInfo {
+	if n, ok := node.(interface {
+		info() *NodeInfo
+	}); ok {
+		return *n.info()
+	}
+	return NodeInfo{}
+}
+
+func (info *NodeInfo) info() *NodeInfo {
+	return info
+}
+
+// IsValid tells if the position was set by the parser
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+func (pos Position) String() string {
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
 // return true if the given node is a statement
 func IsStmt(node Node) bool {
-	switch node.(type) {
+	switch n := node.(type) {
 	case *Assignment, *IfStmt, *ForStmt, *ForIteratorStmt,
-		*BranchStmt, *ReturnStmt, *Declaration:
+		*MatchStmt, *WithStmt, *ProtoDecl, *BranchStmt, *ReturnStmt, *Declaration,
+		*TryRecoverStmt, *PanicStmt:
 		return true
+	case *Function:
+		// 'func name() {}' declares a variable
+		_, ok := n.Name.(*Id)
+		return ok
 	default:
 		return false
 	}
@@ -0,0 +1,157 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package ast
+
+// Inspect traverses the tree in depth-first order, calling fn for each
+// node (nil nodes are skipped). If fn returns false, the children of
+// the node are not visited.
+func Inspect(node Node, fn func(Node) bool) {
+	if isNilNode(node) || !fn(node) {
+		return
+	}
+	for _, child := range Children(node) {
+		Inspect(child, fn)
+	}
+}
+
+// Children returns the direct children of node in source order
+func Children(node Node) []Node {
+	var res []Node
+	add := func(nodes ...Node) {
+		for _, n := range nodes {
+			if !isNilNode(n) {
+				res = append(res, n)
+			}
+		}
+	}
+
+	switch t := node.(type) {
+	case *Array:
+		add(t.Elements...)
+	case *ObjectField:
+		add(t.Value)
+	case *Object:
+		for _, f := range t.Fields {
+			add(f)
+		}
+	case *Comprehension:
+		add(t.Key, t.Value, t.Loop)
+	case *Function:
+		add(t.Name)
+		add(t.Args...)
+		add(t.Requires...)
+		add(t.Ensures...)
+		add(t.Body)
+	case *Selector:
+		add(t.Left)
+	case *Subscript:
+		add(t.Left, t.Right)
+	case *Slice:
+		add(t.Start, t.End)
+	case *Range:
+		add(t.Start, t.End, t.Step)
+	case *KwArg:
+		add(t.Value)
+	case *VarArg:
+		add(t.Arg)
+	case *ObjectUnpack:
+		add(t.Value)
+	case *CallExpr:
+		add(t.Left)
+		add(t.Args...)
+	case *Template:
+		add(t.Tag)
+		add(t.Exprs...)
+	case *PostfixExpr:
+		add(t.Left)
+	case *UnaryExpr:
+		add(t.Right)
+	case *BinaryExpr:
+		add(t.Left, t.Right)
+	case *TernaryExpr:
+		add(t.Cond, t.Then, t.Else)
+	case *Declaration:
+		for _, id := range t.Left {
+			add(id)
+		}
+		add(t.Right...)
+	case *Assignment:
+		add(t.Left...)
+		add(t.Right...)
+	case *ReturnStmt:
+		add(t.Values...)
+	case *PanicStmt:
+		add(t.Err)
+	case *IfStmt:
+		if t.Init != nil {
+			add(t.Init)
+		}
+		add(t.Cond, t.Body, t.Else)
+	case *ForIteratorStmt:
+		add(t.Key)
+		if t.Value != nil {
+			add(t.Value)
+		}
+		add(t.Collection, t.When, t.Body)
+	case *ForStmt:
+		if t.Init != nil {
+			add(t.Init)
+		}
+		add(t.Cond, t.Step, t.Body)
+	case *ArrayPattern:
+		add(t.Elements...)
+		if t.Rest != nil {
+			add(t.Rest)
+		}
+	case *ObjectPattern:
+		for _, f := range t.Fields {
+			add(f)
+		}
+	case *MatchStmt:
+		if t.Name != nil {
+			add(t.Name)
+		}
+		add(t.Value)
+		for _, c := range t.Cases {
+			add(c.Values...)
+			add(c.Body)
+		}
+	case *WithStmt:
+		add(t.Name, t.Value, t.Body)
+	case *ProtoDecl:
+		add(t.Name, t.Parent)
+		for _, f := range t.Fields {
+			add(f.Name, f.Value)
+		}
+	case *RecoverBlock:
+		if t.Id != nil {
+			add(t.Id)
+		}
+		add(t.Block)
+	case *TryRecoverStmt:
+		add(t.Try)
+		if t.Recover != nil {
+			add(t.Recover)
+		}
+		if t.Finally != nil {
+			add(t.Finally)
+		}
+	case *Block:
+		add(t.Nodes...)
+	}
+	return res
+}
+
+// nodes are stored in fields of interface type, which may hold
+// nil pointers of a concrete type (e.g. a nil *Block)
+func isNilNode(node Node) bool {
+	switch t := node.(type) {
+	case nil:
+		return true
+	case *Block:
+		return t == nil
+	case *Id:
+		return t == nil
+	}
+	return false
+}
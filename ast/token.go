@@ -28,9 +28,14 @@ const (
 	TokenPanic
 	TokenReturn
 	TokenNot
-	TokenIn
+	TokenMatch
+	TokenWith
+	TokenProto
 	TokenId
 	TokenString
+	TokenRawString
+	TokenRune
+	TokenTemplate
 	TokenInt
 	TokenFloat
 
@@ -60,6 +65,8 @@ const (
 	TokenLteq
 	TokenGt
 	TokenGteq
+	TokenIn
+	TokenIs
 
 	TokenPlus
 	TokenMinus
@@ -82,8 +89,10 @@ const (
 	TokenSemicolon
 	TokenComma
 	TokenDot
+	TokenDotdot
 	TokenDotdotdot
 	TokenBang
+	TokenHash
 	TokenQuestion
 	TokenLparen
 	TokenRparen
@@ -117,6 +126,10 @@ var (
 		"return":      TokenReturn,
 		"not":         TokenNot,
 		"in":          TokenIn,
+		"is":          TokenIs,
+		"match":       TokenMatch,
+		"with":        TokenWith,
+		"proto":       TokenProto,
 	}
 
 	// descriptive representation of tokens
@@ -142,8 +155,15 @@ var (
 		TokenReturn:      "return",
 		TokenNot:         "not",
 		TokenIn:          "in",
+		TokenIs:          "is",
+		TokenMatch:       "match",
+		TokenWith:        "with",
+		TokenProto:       "proto",
 		TokenId:          "identifier",
 		TokenString:      "string",
+		TokenRawString:   "raw string",
+		TokenRune:        "rune",
+		TokenTemplate:    "template",
 		TokenInt:         "int",
 		TokenFloat:       "float",
 		TokenPlus:        "+",
@@ -180,8 +200,10 @@ var (
 		TokenSemicolon:   ";",
 		TokenComma:       ",",
 		TokenDot:         ".",
+		TokenDotdot:      "..",
 		TokenDotdotdot:   "...",
 		TokenBang:        "!",
+		TokenHash:        "#",
 		TokenLparen:      "(",
 		TokenRparen:      ")",
 		TokenLbrack:      "[",
@@ -196,12 +218,17 @@ var (
 		10,
 		20,
 		30, 30,
-		40, 40, 40, 40,
+		40, 40, 40, 40, 40, 40,
 		50, 50, 50, 50,
 		60, 60, 60, 60, 60, 60, 60,
 	}
 )
 
+func IsKeyword(tok Token) bool {
+	t, ok := keywords[strings[tok]]
+	return ok && t == tok
+}
+
 func IsAssignOp(tok Token) bool {
 	return tok >= assignOpBegin && tok <= assignOpEnd
 }
@@ -220,7 +247,7 @@ func IsPostfixOp(tok Token) bool {
 
 func IsUnaryOp(tok Token) bool {
 	return IsPostfixOp(tok) ||
-		(tok == TokenNot || tok == TokenBang || tok == TokenMinus || tok == TokenPlus || tok == TokenTilde)
+		(tok == TokenNot || tok == TokenBang || tok == TokenMinus || tok == TokenPlus || tok == TokenTilde || tok == TokenHash)
 }
 
 func CompoundOp(tok Token) Token {
@@ -15,13 +15,17 @@ type Visitor interface {
 	VisitArray(node *Array, data interface{})
 	VisitObjectField(node *ObjectField, data interface{})
 	VisitObject(node *Object, data interface{})
+	VisitComprehension(node *Comprehension, data interface{})
 	VisitFunction(node *Function, data interface{})
 	VisitSelector(node *Selector, data interface{})
 	VisitSubscript(node *Subscript, data interface{})
 	VisitSlice(node *Slice, data interface{})
+	VisitRange(node *Range, data interface{})
 	VisitKwArg(node *KwArg, data interface{})
 	VisitVarArg(node *VarArg, data interface{})
+	VisitObjectUnpack(node *ObjectUnpack, data interface{})
 	VisitCallExpr(node *CallExpr, data interface{})
+	VisitTemplate(node *Template, data interface{})
 	VisitPostfixExpr(node *PostfixExpr, data interface{})
 	VisitUnaryExpr(node *UnaryExpr, data interface{})
 	VisitBinaryExpr(node *BinaryExpr, data interface{})
@@ -34,6 +38,11 @@ type Visitor interface {
 	VisitIfStmt(node *IfStmt, data interface{})
 	VisitForIteratorStmt(node *ForIteratorStmt, data interface{})
 	VisitForStmt(node *ForStmt, data interface{})
+	VisitArrayPattern(node *ArrayPattern, data interface{})
+	VisitObjectPattern(node *ObjectPattern, data interface{})
+	VisitMatchStmt(node *MatchStmt, data interface{})
+	VisitWithStmt(node *WithStmt, data interface{})
+	VisitProtoDecl(node *ProtoDecl, data interface{})
 	VisitRecoverBlock(node *RecoverBlock, data interface{})
 	VisitTryRecoverStmt(node *TryRecoverStmt, data interface{})
 	VisitBlock(node *Block, data interface{})
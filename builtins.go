@@ -2,14 +2,28 @@ package yo
 
 import (
 	"fmt"
+	"math"
 )
 
 func defineBuiltins(vm *VM) {
+	vm.Define("abs", GoFunc(builtinAbs))
 	vm.Define("append", GoFunc(builtinAppend))
+	vm.Define("assert", GoFunc(builtinAssert))
+	vm.Define("bool", GoFunc(builtinBool))
+	vm.Define("int", GoFunc(builtinInt))
 	vm.Define("isnumber", GoFunc(builtinIsNumber))
 	vm.Define("len", GoFunc(builtinLen))
+	vm.Define("max", GoFunc(builtinMax))
+	vm.Define("min", GoFunc(builtinMin))
+	vm.Define("number", GoFunc(builtinNumber))
 	vm.Define("println", GoFunc(builtinPrintln))
+	vm.Define("str", GoFunc(builtinStr))
+	vm.Define("string", GoFunc(builtinStr)) // the old name of str
 	vm.Define("type", GoFunc(builtinType))
+
+	vm.Define("archive", archiveModule())
+	vm.Define("compress", compressModule())
+	vm.Define("uuid", uuidModule())
 }
 
 func builtinAppend(call *FuncCall) {
@@ -24,6 +38,135 @@ func builtinAppend(call *FuncCall) {
 	call.PushReturnValue(ptr)
 }
 
+// assert(cond, message) panics if cond is false, the calls are
+// removed by the compiler with CompileOptions.StripAssertions
+func builtinAssert(call *FuncCall) {
+	if call.NumArgs == uint(0) {
+		panic("assert expects a condition")
+	}
+	if call.Args[0].ToBool() {
+		return
+	}
+	if call.NumArgs > 1 {
+		panic("assertion failed: " + call.VM.Format(call.Args[1]))
+	}
+	panic("assertion failed")
+}
+
+// conversions
+//
+//   bool(v)    false for nil and false, true for anything else
+//   number(v)  numbers are returned as is, strings are parsed (decimal,
+//              hex, octal or float) and booleans are 1 or 0
+//   int(v)     like number(v), truncated towards zero, int(v, mode)
+//              rounds with another mode (see numeric.go)
+//   str(v)     the string representation of any value
+//
+// number and int panic when the value can't be converted (nil, arrays,
+// objects, funcs, strings that are not numbers, and for int: inf, nan
+// and with OverflowError values out of the range of int64).
+// The compiler folds calls with constant arguments using the same rules.
+
+func toNumber(v Value) (Number, error) {
+	switch v.Type() {
+	case ValueNumber:
+		return v.(Number), nil
+	case ValueString:
+		n, err := parseNumber(v.String())
+		if err != nil {
+			return 0, fmt.Errorf("cannot convert \"%s\" to number", v.String())
+		}
+		return Number(n), nil
+	case ValueBool:
+		if v.ToBool() {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("cannot convert %s to number", v.Type())
+}
+
+func toInt(v Value) (Number, error) {
+	return roundInt(v, "trunc")
+}
+
+func roundInt(v Value, mode string) (Number, error) {
+	round, ok := roundings[mode]
+	if !ok {
+		return 0, fmt.Errorf("unknown rounding mode \"%s\"", mode)
+	}
+	n, err := toNumber(v)
+	if err != nil {
+		return 0, err
+	}
+	f := float64(n)
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("cannot convert %v to int", f)
+	}
+	return Number(round(f)), nil
+}
+
+func convertArg(call *FuncCall, name string) Value {
+	if call.NumArgs == uint(0) {
+		panic(name + " expects 1 argument")
+	}
+	return call.Args[0]
+}
+
+func builtinBool(call *FuncCall) {
+	call.PushReturnValue(Bool(convertArg(call, "bool").ToBool()))
+}
+
+func builtinNumber(call *FuncCall) {
+	n, err := toNumber(convertArg(call, "number"))
+	if err != nil {
+		panic("number: " + err.Error())
+	}
+	call.PushReturnValue(n)
+}
+
+func builtinInt(call *FuncCall) {
+	mode := "trunc"
+	if call.NumArgs > 1 {
+		mode = call.Args[1].String()
+	}
+	n, err := roundInt(convertArg(call, "int"), mode)
+	if err == nil {
+		var f float64
+		f, err = call.VM.intRange(float64(n))
+		n = Number(f)
+	}
+	if err != nil {
+		panic("int: " + err.Error())
+	}
+	call.PushReturnValue(n)
+}
+
+func builtinStr(call *FuncCall) {
+	call.PushReturnValue(String(convertArg(call, "str").String()))
+}
+
+func builtinAbs(call *FuncCall) {
+	call.PushReturnValue(Number(math.Abs(call.numberArg(0))))
+}
+
+// min and max of any number of numbers, at least one
+func numberFold(call *FuncCall, fn func(a, b float64) float64) {
+	res := call.numberArg(0)
+	for i := uint(1); i < call.NumArgs; i++ {
+		res = fn(res, call.numberArg(i))
+	}
+	call.PushReturnValue(Number(res))
+}
+
+func builtinMin(call *FuncCall) {
+	numberFold(call, math.Min)
+}
+
+func builtinMax(call *FuncCall) {
+	numberFold(call, math.Max)
+}
+
 func builtinIsNumber(call *FuncCall) {
 	if call.NumArgs <= uint(0) {
 		call.PushReturnValue(Bool(false))
@@ -32,18 +175,26 @@ func builtinIsNumber(call *FuncCall) {
 	}
 }
 
+// builtinLen is the # operator for the builtin types, the
+// __len method of objects can only be called by the operator
 func builtinLen(call *FuncCall) {
 	if call.NumArgs == uint(0) {
 		panic("len expects 1 argument")
-	} else {
-		n := len(*(call.Args[0].(*Array)))
-		call.PushReturnValue(Number(n))
 	}
+	v := call.Args[0]
+	if _, ok := method(v, "__len"); ok {
+		panic("bad argument #1 to len (object with a __len method, use the # operator)")
+	}
+	n, ok := length(v)
+	if !ok {
+		argTypeError(0, "string, array or object", v)
+	}
+	call.PushReturnValue(Number(n))
 }
 
 func builtinPrintln(call *FuncCall) {
 	for i := uint(0); i < call.NumArgs; i++ {
-		fmt.Printf("%v", call.Args[i])
+		fmt.Print(call.VM.Format(call.Args[i]))
 	}
 
 	fmt.Println()
@@ -56,3 +207,56 @@ func builtinType(call *FuncCall) {
 		call.PushReturnValue(String(call.Args[0].Type().String()))
 	}
 }
+
+// newModule creates an object holding the given native functions,
+// which is how groups of related builtins are exposed to scripts.
+func newModule(funcs map[string]GoFunc) *Object {
+	fields := make(map[string]Value, len(funcs))
+	for name, fn := range funcs {
+		fields[name] = fn
+	}
+	return NewObject(nil, fields)
+}
+
+// argument helpers for native functions, they panic with a
+// descriptive message if the argument has the wrong type
+
+func argTypeError(i uint, expected string, got Value) {
+	panic(fmt.Sprintf("bad argument #%d (expected %s, got %s)", i+1, expected, got.Type()))
+}
+
+func (c *FuncCall) stringArg(i uint) string {
+	if i >= c.NumArgs {
+		argTypeError(i, "string", Nil{})
+	}
+	s, ok := c.Args[i].assertString()
+	if !ok {
+		argTypeError(i, "string", c.Args[i])
+	}
+	return s
+}
+
+func (c *FuncCall) optStringArg(i uint, def string) string {
+	if i >= c.NumArgs || c.Args[i].Type() == ValueNil {
+		return def
+	}
+	return c.stringArg(i)
+}
+
+func (c *FuncCall) numberArg(i uint) float64 {
+	if i >= c.NumArgs {
+		argTypeError(i, "number", Nil{})
+	}
+	f, ok := c.Args[i].assertFloat64()
+	if !ok {
+		argTypeError(i, "number", c.Args[i])
+	}
+	return f
+}
+
+func (c *FuncCall) optNumberArg(i uint, def float64) float64 {
+	if i >= c.NumArgs || c.Args[i].Type() == ValueNil {
+		return def
+	}
+	return c.numberArg(i)
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConversions(t *testing.T) {
+	// the constants and the variables give the same results
+	source := `
+		var values = [nil, false, 0, "", [], "12.5", true, "-3.7"]
+		return [bool(v) for v in values],
+			[number(v) for v in values[5:]], [int(v) for v in values[5:]], [str(v) for v in values[:4]],
+			bool(nil), bool(0), number("12.5"), number(true), int("-3.7"), int(2.5, "round"), str(1.5), string(5)`
+	res := runString(t, NewVM(), source)
+	want := "[[false false true true true true true true] [12.5 1 -3.7] [12 1 -3] [nil false 0 ] false true 12.5 1 -3 3 1.5 5]"
+	if got := fmt.Sprint(res); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	errors := map[string]string{
+		`number("x")`:       `number: cannot convert "x" to number`,
+		`number([])`:        `number: cannot convert array to number`,
+		`int("abc")`:        `int: cannot convert "abc" to number`,
+		`int(2.5, "bogus")`: `int: unknown rounding mode "bogus"`,
+		`int(1 / 0)`:        `int: cannot convert +Inf to int`,
+		`bool()`:            `bool expects 1 argument`,
+		`str()`:             `str expects 1 argument`,
+	}
+	for source, want := range errors {
+		code, err := CompileReader(strings.NewReader("var v = "+source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewVM().run(code)
+		if rerr, ok := err.(*RuntimeError); !ok || rerr.Message != want {
+			t.Errorf("%s: expected %q, got %v", source, want, err)
+		}
+	}
+
+	// the calls are not folded, the names may hold other functions
+	custom := "str = func(v) -> \"custom\"\nvar y = 2\nreturn str(1), str(y)"
+	if got := fmt.Sprint(runString(t, NewVM(), custom)); got != "[custom custom]" {
+		t.Errorf("reassigned str: expected [custom custom], got %s", got)
+	}
+	vm := NewVM()
+	vm.Define("number", GoFunc(func(call *FuncCall) { call.PushReturnValue(String("host")) }))
+	if got := fmt.Sprint(runString(t, vm, "return number(\"1\")")); got != "[host]" {
+		t.Errorf("host number: expected [host], got %s", got)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// A script lists the files it depends on in the "requires" key of
+// it's front matter, separated by commas and relative to the script:
+//
+//   ---
+//   requires: util.yo, lib/strings.yo
+//   ---
+//
+// Bundle follows the requires from an entry script and builds all the
+// files into a single Program (see Builder), with each file after the
+// ones it requires, so a deployment ships a single artifact, written
+// with Program.Save and read back with LoadProgram.
+
+// Requires returns the files required by the front matter of root,
+// as written in the script.
+func Requires(root ast.Node) []string {
+	block, ok := root.(*ast.Block)
+	if !ok {
+		return nil
+	}
+	var res []string
+	for _, name := range strings.Split(block.FrontMatter["requires"], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// Bundle builds the program made by entry and the files it requires,
+// directly or not. The files are read with load, ioutil.ReadFile if
+// it's nil. Files required by more than one file are included once,
+// and files that require each other are an ErrRequireCycle.
+func Bundle(entry string, opts CompileOptions, load func(path string) ([]byte, error)) (*Program, error) {
+	if load == nil {
+		load = ioutil.ReadFile
+	}
+	r := bundler{
+		load:   load,
+		b:      NewBuilder(opts),
+		states: make(map[string]int),
+	}
+	if err := r.add(filepath.Clean(entry), nil); err != nil {
+		return nil, err
+	}
+	return r.b.Build()
+}
+
+// the states of the files while bundling
+const (
+	bundleVisiting = iota + 1 // the requires are being added
+	bundleDone
+)
+
+type bundler struct {
+	load   func(path string) ([]byte, error)
+	b      *Builder
+	states map[string]int
+}
+
+// add adds the files required by path and then path itself to the
+// builder, stack is the chain of files requiring path
+func (r *bundler) add(path string, stack []string) error {
+	switch r.states[path] {
+	case bundleDone:
+		return nil
+	case bundleVisiting:
+		// the cycle starts at the first time path was required
+		i := len(stack) - 1
+		for stack[i] != path {
+			i--
+		}
+		cycle := append(stack[i:], path)
+		msg := fmt.Sprintf("require cycle: %s", strings.Join(cycle, " -> "))
+		return &CompileError{Code: ErrRequireCycle, Line: 1, File: stack[len(stack)-1], Message: msg}
+	}
+	r.states[path] = bundleVisiting
+
+	source, err := r.load(path)
+	if err != nil {
+		if len(stack) > 0 {
+			return fmt.Errorf("%s: cannot read required file: %w", stack[len(stack)-1], err)
+		}
+		return err
+	}
+	root, err := parse.ParseFile(source, path)
+	if err != nil {
+		return err
+	}
+
+	stack = append(stack, path)
+	for _, name := range Requires(root) {
+		dep := filepath.Join(filepath.Dir(path), filepath.FromSlash(name))
+		if err := r.add(dep, stack); err != nil {
+			return err
+		}
+	}
+	r.states[path] = bundleDone
+	r.b.files = append(r.b.files, builderFile{path, root})
+	return nil
+}
+
+const programMagic = "yoprog\x04"
+
+// ErrBadProgram is returned by LoadProgram when the data is not
+// a program written by Program.Save, or is corrupted.
+var ErrBadProgram = errors.New("invalid program")
+
+// Save writes the compiled code of p to w, in the same
+// format used for the functions in the snapshots of globals.
+func (p *Program) Save(w io.Writer) error {
+	e := snapEncoder{
+		w:         bufio.NewWriter(w),
+		refs:      make(map[interface{}]int),
+		bytecodes: make(map[*Bytecode]int),
+		upvalues:  make(map[*upvalue]int),
+	}
+	e.w.WriteString(programMagic)
+	e.bytecode(p.Main)
+	e.uint(len(p.Files))
+	for _, f := range p.Files {
+		e.string(f.Name)
+		e.uint(int(f.Start))
+		e.uint(int(f.End))
+		e.uint(len(f.Lines))
+		for _, l := range f.Lines {
+			e.uint(int(l.Instr))
+			e.uint(int(l.Line))
+		}
+	}
+	return e.w.Flush()
+}
+
+// LoadProgram reads a program written by Program.Save.
+func LoadProgram(r io.Reader) (p *Program, err error) {
+	d := snapDecoder{r: bufio.NewReader(r)}
+	defer func() {
+		if e := recover(); e != nil {
+			if e != errSnapshotData {
+				panic(e)
+			}
+			p, err = nil, ErrBadProgram
+		}
+	}()
+
+	magic := make([]byte, len(programMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != programMagic {
+		return nil, ErrBadProgram
+	}
+	p = &Program{Main: d.bytecode()}
+	for n := d.uint(); n > 0; n-- {
+		f := ProgramFile{Name: d.string(), Start: uint32(d.uint()), End: uint32(d.uint())}
+		for n := d.uint(); n > 0; n-- {
+			f.Lines = append(f.Lines, LineInfo{Instr: uint32(d.uint()), Line: uint16(d.uint())})
+		}
+		p.Files = append(p.Files, f)
+	}
+	return p, nil
+}
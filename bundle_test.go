@@ -0,0 +1,83 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func mapLoader(files map[string]string) func(string) ([]byte, error) {
+	return func(path string) ([]byte, error) {
+		if source, ok := files[path]; ok {
+			return []byte(source), nil
+		}
+		return nil, os.ErrNotExist
+	}
+}
+
+func TestBundle(t *testing.T) {
+	files := map[string]string{
+		"main.yo":        "---\nrequires: lib/math.yo, lib/strings.yo\n---\nreturn square(3), greet(\"yo\"), order",
+		"lib/math.yo":    "---\nrequires: base.yo\n---\nfunc square(x) -> x * x\nappend(order, \"math\")",
+		"lib/strings.yo": "---\nrequires: base.yo\n---\nfunc greet(s) -> #s\nappend(order, \"strings\")",
+		"lib/base.yo":    "var order = [\"base\"]",
+	}
+	p, err := Bundle("main.yo", CompileOptions{}, mapLoader(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range p.Files {
+		names = append(names, f.Name)
+	}
+	want := "[lib/base.yo lib/math.yo lib/strings.yo main.yo]"
+	if got := fmt.Sprint(names); got != want {
+		t.Errorf("expected files %s, got %s", want, got)
+	}
+
+	// the saved program runs like the original
+	var buf bytes.Buffer
+	if err := p.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadProgram(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file, line := loaded.Position(loaded.Files[3].Start); file != "main.yo" || line != 4 {
+		t.Errorf("unexpected position %s:%d", file, line)
+	}
+	res, err := NewVM().run(loaded.Main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []string{"9", "2", "[base math strings]"}
+	for i, w := range results {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+
+	files["lib/base.yo"] = "---\nrequires: ../main.yo\n---\nvar order = []"
+	_, err = Bundle("main.yo", CompileOptions{}, mapLoader(files))
+	var cerr *CompileError
+	if !errors.As(err, &cerr) || cerr.Code != ErrRequireCycle || cerr.File != "lib/base.yo" {
+		t.Errorf("expected a require cycle, got %v", err)
+	} else if cerr.Message != "require cycle: main.yo -> lib/math.yo -> lib/base.yo -> main.yo" {
+		t.Errorf("unexpected message %q", cerr.Message)
+	}
+
+	delete(files, "lib/strings.yo")
+	files["lib/base.yo"] = ""
+	if _, err := Bundle("main.yo", CompileOptions{}, mapLoader(files)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing file, got %v", err)
+	}
+
+	if _, err := LoadProgram(bytes.NewReader([]byte("yoprog"))); !errors.Is(err, ErrBadProgram) {
+		t.Errorf("expected ErrBadProgram, got %v", err)
+	}
+}
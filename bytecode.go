@@ -2,6 +2,8 @@
 
 package yo
 
+import "sort"
+
 type LineInfo struct {
 	Instr uint32 // the instruction index
 	Line  uint16
@@ -16,18 +18,200 @@ type Bytecode struct {
 	NumCode   uint32
 	NumLines  uint32
 	NumFuncs  uint32
+	NumRegs   uint32 // how many registers the code needs
 	Consts    []Value
 	Code      []uint32
 	Lines     []LineInfo
 	Funcs     []*Bytecode
+	Upvals    []UpvalueDesc // the free variables of the function
+	Locals    []LocalInfo   // debug information of the local variables
+
+	// the names of the parameters, in the order of their registers,
+	// matched by the keyword arguments of the calls to the function
+	// (the variadic parameter is not named, it can't be a keyword)
+	Params []string
+
+	// whether the function has a variadic parameter, in the register
+	// after Params, holding an array of the other positional arguments
+	Variadic bool
+
+	// the calls with keyword arguments, sorted by Instr
+	Keywords []KeywordInfo
+
+	// static information for analysis tools (see Metrics)
+	Name     string // name of the function, empty for main or anonymous functions
+	Line     int    // line where the function is defined
+	NumStmts uint32 // statements in the body, not counting nested functions
+	MaxDepth uint32 // deepest nesting of blocks in the body
+
+	// Shareable is set by the compiler if the free variables of the
+	// function are never assigned, so it's closures can be shared by
+	// many VMs (see Share)
+	Shareable bool
+
+	consts   []register  // Consts ready to be loaded into registers (see prepare)
+	keys     []string    // the strings of Consts, the keys of OpGetField and OpSetField
+	handlers []opHandler // predecoded Code, only used by the threaded dispatch
+
+	// the code is run by many VMs at the same time (see Share and
+	// Dedup), so it's never changed, the instructions are not quickened
+	frozen bool
 }
 
 const (
 	bytecodeMaxConsts = 0xffff
 )
 
+// UpvalueKind tells where a closure finds one of it's free variables
+// when it's created
+type UpvalueKind uint8
+
+const (
+	// a register of the enclosing function, shared through an upvalue
+	// that keeps the value when the variable goes out of scope
+	UpvalueRegister UpvalueKind = iota
+
+	// a register of the enclosing function, read directly from the stack
+	// since the closure never outlives the call that created it (see escape.go)
+	UpvalueStack
+
+	// an upvalue of the enclosing function
+	UpvalueParent
+)
+
+// LocalInfo describes a local variable for debugging
+type LocalInfo struct {
+	Name    string
+	Reg     int
+	StartPC uint32 // the first instruction where the variable is in scope
+	EndPC   uint32 // the first instruction after the variable's scope
+}
+
+// KeywordInfo names the keyword arguments of a call, they are
+// the last arguments of the call after the positional ones
+type KeywordInfo struct {
+	Instr uint32 // the index of the call instruction
+	Names []string
+}
+
+type UpvalueDesc struct {
+	Name  string
+	Kind  UpvalueKind
+	Index int // register or upvalue of the enclosing function, depending on Kind
+}
+
 func newBytecode(source string) *Bytecode {
 	return &Bytecode{
 		Source: source,
 	}
 }
+
+// set NumRegs from the registers used by the code
+func (b *Bytecode) countRegisters() {
+	b.NumRegs = 0
+	for _, instr := range b.Code {
+		if n := uint32(highestRegister(instr) + 1); n > b.NumRegs {
+			b.NumRegs = n
+		}
+	}
+}
+
+// prepare converts the constants of b and it's functions to the
+// representation used by the VM before they run, so loading them
+// doesn't need any conversion. Equal strings across all the functions
+// are replaced by the same value from strings.
+func (b *Bytecode) prepare(strings map[string]Value) {
+	if b.consts != nil || len(b.Consts) == 0 && len(b.Funcs) == 0 {
+		return
+	}
+	b.consts = make([]register, len(b.Consts))
+	b.keys = make([]string, len(b.Consts))
+	for i, c := range b.Consts {
+		if s, ok := c.(String); ok {
+			if interned, ok := strings[string(s)]; ok {
+				c = interned
+				if !b.frozen {
+					b.Consts[i] = interned
+				}
+			} else {
+				strings[string(s)] = c
+			}
+			b.keys[i] = string(s)
+		}
+		b.consts[i].set(c)
+	}
+	for _, f := range b.Funcs {
+		f.prepare(strings)
+	}
+}
+
+// freeze marks b and the functions defined in it as run by many VMs
+func (b *Bytecode) freeze() {
+	b.frozen = true
+	for _, f := range b.Funcs {
+		f.freeze()
+	}
+}
+
+// LineAt returns the source line of the instruction at pc
+func (b *Bytecode) LineAt(pc int) int {
+	line := 0
+	for _, l := range b.Lines {
+		if int(l.Instr) > pc {
+			break
+		}
+		line = int(l.Line)
+	}
+	return line
+}
+
+// KeywordsAt returns the names of the keyword arguments of the
+// call at pc, or nil if it has none
+func (b *Bytecode) KeywordsAt(pc int) []string {
+	i := sort.Search(len(b.Keywords), func(i int) bool {
+		return int(b.Keywords[i].Instr) >= pc
+	})
+	if i < len(b.Keywords) && int(b.Keywords[i].Instr) == pc {
+		return b.Keywords[i].Names
+	}
+	return nil
+}
+
+// LineRange returns the first and last lines with code in the function,
+// not counting the nested functions
+func (b *Bytecode) LineRange() (first, last int) {
+	for i, l := range b.Lines {
+		if i == 0 || int(l.Line) < first {
+			first = int(l.Line)
+		}
+		if int(l.Line) > last {
+			last = int(l.Line)
+		}
+	}
+	return
+}
+
+// LocalsAt returns the local variables in scope at the instruction pc,
+// in the order they were declared
+func (b *Bytecode) LocalsAt(pc int) []LocalInfo {
+	var res []LocalInfo
+	for _, l := range b.Locals {
+		if uint32(pc) >= l.StartPC && uint32(pc) < l.EndPC {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// LocalName returns the name of the local variable stored
+// in the register reg at the instruction pc
+func (b *Bytecode) LocalName(reg, pc int) (string, bool) {
+	name, found := "", false
+	for _, l := range b.Locals {
+		if l.Reg == reg && uint32(pc) >= l.StartPC && uint32(pc) < l.EndPC {
+			// the innermost declaration wins
+			name, found = l.Name, true
+		}
+	}
+	return name, found
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"testing"
+
+	"github.com/glhrmfrts/yo/parse"
+)
+
+func TestLocals(t *testing.T) {
+	source := `
+		var a = 1
+		if a > 0 {
+			var b = a + 1
+			println(b)
+		}
+		var c = 3
+	`
+	root, err := parse.ParseFile([]byte(source), "locals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := Compile(root, "locals")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scopes := make(map[string][]int)
+	for pc := range code.Code {
+		for _, l := range code.LocalsAt(pc) {
+			scopes[l.Name] = append(scopes[l.Name], pc)
+		}
+	}
+	if len(scopes["a"]) == 0 || len(scopes["b"]) == 0 || len(scopes["c"]) == 0 {
+		t.Fatalf("missing locals: %v", scopes)
+	}
+	last := scopes["b"][len(scopes["b"])-1]
+	if scopes["c"][0] <= last {
+		t.Errorf("'b' is still in scope where 'c' is")
+	}
+
+	for _, l := range code.Locals {
+		if name, ok := code.LocalName(l.Reg, int(l.StartPC)); !ok || name != l.Name {
+			t.Errorf("LocalName(%d, %d) = %q, expected %q", l.Reg, l.StartPC, name, l.Name)
+		}
+	}
+	if first, last := code.LineRange(); last-first != 5 {
+		t.Errorf("LineRange() = %d, %d, expected 6 lines", first, last)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"sync"
+
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// BytecodeVersion is the version of the compiled code, it changes
+// with the instructions or the layout of Bytecode, so the code
+// cached by older versions is compiled again.
+const BytecodeVersion = 5
+
+// Cache stores compiled code, keyed by the hash of the source and
+// the options it was compiled with (see CompileOptions.Cache). The
+// data is opaque, so the cache can be kept anywhere, like on disk or
+// in a database shared by many processes, and it must be safe for
+// concurrent use.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Put(key string, data []byte)
+}
+
+// CompileSource parses and compiles source, unless the same source
+// was compiled with the same options before and is in opts.Cache.
+// The warnings of the code found in the cache are not reported again.
+func CompileSource(source []byte, filename string, opts CompileOptions) (*Bytecode, error) {
+	finished := compileStarted(opts, filename)
+	var key string
+	if opts.Cache != nil {
+		key = cacheKey(source, filename, opts)
+		if data, ok := opts.Cache.Get(key); ok {
+			if b, err := decodeCached(data); err == nil {
+				if opts.Dedup != nil {
+					b = opts.Dedup.Add(b)
+				}
+				finished(nil, true)
+				return b, nil
+			}
+		}
+	}
+
+	root, err := parse.ParseFile(source, filename)
+	if err != nil {
+		finished(err, false)
+		return nil, err
+	}
+	b, err := compileRoot(root, filename, opts)
+	finished(err, false)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Cache != nil {
+		opts.Cache.Put(key, encodeCached(b))
+	}
+	return b, nil
+}
+
+// CompileFile is like CompileSource, with the source read from path.
+func CompileFile(path string, opts CompileOptions) (*Bytecode, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return CompileSource(source, path, opts)
+}
+
+// cacheKey returns the hash of everything that changes the code
+// compiled from source, including the whole profile
+func cacheKey(source []byte, filename string, opts CompileOptions) string {
+	h := sha256.New()
+	var buf [binary.MaxVarintLen64]byte
+	strip := 0
+	if opts.StripAssertions {
+		strip = 1
+	}
+	for _, n := range []int{BytecodeVersion, opts.OptLevel, strip, len(filename)} {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(n))])
+	}
+	h.Write([]byte(filename))
+	h.Write(source)
+	if opts.Profile != nil && opts.OptLevel > 0 {
+		opts.Profile.Write(h)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+const cacheMagic = "yocode"
+
+// encodeCached returns the data of b stored in a cache, in the
+// format of the functions of snapshots with the version before it
+func encodeCached(b *Bytecode) []byte {
+	var buf bytes.Buffer
+	e := snapEncoder{
+		w:         bufio.NewWriter(&buf),
+		refs:      make(map[interface{}]int),
+		bytecodes: make(map[*Bytecode]int),
+		upvalues:  make(map[*upvalue]int),
+	}
+	e.w.WriteString(cacheMagic)
+	e.uint(BytecodeVersion)
+	e.bytecode(b)
+	e.w.Flush()
+	return buf.Bytes()
+}
+
+// decodeCached returns the code in data, the data of other versions
+// is rejected in case the cache was filled by an older program
+func decodeCached(data []byte) (b *Bytecode, err error) {
+	if !bytes.HasPrefix(data, []byte(cacheMagic)) {
+		return nil, errSnapshotData
+	}
+	d := snapDecoder{r: bufio.NewReader(bytes.NewReader(data[len(cacheMagic):]))}
+	defer func() {
+		if e := recover(); e != nil {
+			if e != errSnapshotData {
+				panic(e)
+			}
+			b, err = nil, errSnapshotData
+		}
+	}()
+	if d.uint() != BytecodeVersion {
+		return nil, errSnapshotData
+	}
+	return d.bytecode(), nil
+}
+
+// LRUCache is a Cache in memory that keeps the code of the last
+// compiled sources, up to a maximum size.
+type LRUCache struct {
+	maxBytes int
+	size     int
+
+	mu      sync.Mutex
+	order   *list.List // of *lruEntry, from the most recently used
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	data []byte
+}
+
+// NewLRUCache returns a cache that removes the least recently used
+// code when it's data is larger than maxBytes.
+func NewLRUCache(maxBytes int) *LRUCache {
+	return &LRUCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).data, true
+}
+
+func (c *LRUCache) Put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry)
+		c.size += len(data) - len(entry.data)
+		entry.data = data
+		c.order.MoveToFront(el)
+	} else {
+		c.entries[key] = c.order.PushFront(&lruEntry{key, data})
+		c.size += len(data)
+	}
+	for c.size > c.maxBytes && c.order.Len() > 0 {
+		entry := c.order.Remove(c.order.Back()).(*lruEntry)
+		delete(c.entries, entry.key)
+		c.size -= len(entry.data)
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"testing"
+)
+
+// countingCache counts the hits of the cache it wraps
+type countingCache struct {
+	Cache
+	hits int
+}
+
+func (c *countingCache) Get(key string) ([]byte, bool) {
+	data, ok := c.Cache.Get(key)
+	if ok {
+		c.hits++
+	}
+	return data, ok
+}
+
+func TestCompileCache(t *testing.T) {
+	cache := &countingCache{Cache: NewLRUCache(1 << 20)}
+	opts := CompileOptions{Cache: cache}
+	source := []byte("func f(x) -> x * 2\nreturn [f(n) for n in [1, 2, 3]]")
+
+	for i := 0; i < 2; i++ {
+		b, err := CompileSource(source, "test.yo", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := NewVM().run(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].String() != "[2 4 6]" {
+			t.Errorf("(%d) unexpected result %v", i, res[0])
+		}
+		if cache.hits != i {
+			t.Errorf("(%d) expected %d hits, got %d", i, i, cache.hits)
+		}
+	}
+
+	// other options, file names and versions are other entries
+	opts.OptLevel = 1
+	CompileSource(source, "test.yo", opts)
+	CompileSource(source, "other.yo", opts)
+	if cache.hits != 1 {
+		t.Errorf("expected other keys, got %d hits", cache.hits)
+	}
+	key := cacheKey(source, "test.yo", opts)
+	data, _ := cache.Get(key)
+	data[len(cacheMagic)] = BytecodeVersion + 1
+	if _, err := decodeCached(data); err == nil {
+		t.Errorf("expected the code of another version to be rejected")
+	}
+	if _, err := CompileSource(source, "test.yo", opts); err != nil {
+		t.Errorf("expected the source to be compiled again, got %v", err)
+	}
+
+	if _, err := CompileSource([]byte("return ("), "bad.yo", opts); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := NewLRUCache(10)
+	c.Put("a", []byte("aaaa"))
+	c.Put("b", []byte("bbbb"))
+	c.Get("a")
+	c.Put("c", []byte("cccc"))
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("expected b to be removed")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("expected a to be kept")
+	}
+	c.Put("a", []byte("aaaaaaaaaaaa"))
+	if c.Len() != 0 {
+		t.Errorf("expected an entry larger than the cache to be removed, got %d entries", c.Len())
+	}
+}
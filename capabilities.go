@@ -0,0 +1,141 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Capabilities limits what the native modules can do on behalf of
+// the scripts of a VM. A VM without capabilities is not limited, the
+// zero Capabilities allows nothing.
+type Capabilities struct {
+	// the directories whose files (and subdirectories) can be read
+	// or written, the ones that can be written can also be read
+	FSRead  []string
+	FSWrite []string
+
+	// the hosts that can be connected to, "*.example.com"
+	// matches all the subdomains of example.com
+	NetHosts []string
+
+	Exec bool // run other programs
+	Env  bool // read and change environment variables
+}
+
+// PermissionError is raised by the native functions when the
+// capabilities of the VM don't allow an operation. It's an error of the
+// program like the others, a try can recover it, and it's the Err of
+// the *RuntimeError with the position of the call that raised it.
+type PermissionError struct {
+	Op     string // "read", "write", "net", "exec" or "env"
+	Target string // the path, host, program or variable
+}
+
+func (err *PermissionError) Error() string {
+	return fmt.Sprintf("permission denied: %s '%s'", err.Op, err.Target)
+}
+
+// SetCapabilities limits the native modules of the VM to caps,
+// nil removes the limits.
+func (vm *VM) SetCapabilities(caps *Capabilities) {
+	vm.caps = caps
+}
+
+// The checks are for native functions, they raise a *PermissionError
+// if the capabilities of the VM don't allow the operation.
+
+// CheckRead checks that the file or directory path can be read.
+func (vm *VM) CheckRead(path string) {
+	if vm.caps != nil && !underAny(path, vm.caps.FSRead) && !underAny(path, vm.caps.FSWrite) {
+		panic(&PermissionError{"read", path})
+	}
+}
+
+// CheckWrite checks that the file or directory path can be written.
+func (vm *VM) CheckWrite(path string) {
+	if vm.caps != nil && !underAny(path, vm.caps.FSWrite) {
+		panic(&PermissionError{"write", path})
+	}
+}
+
+// CheckNet checks that host, with or without a port, can be connected to.
+func (vm *VM) CheckNet(host string) {
+	if vm.caps == nil {
+		return
+	}
+	name := host
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		name = host[:i]
+	}
+	name = strings.ToLower(strings.Trim(name, "[]"))
+	for _, allowed := range vm.caps.NetHosts {
+		allowed = strings.ToLower(allowed)
+		if name == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(name, allowed[1:]) {
+			return
+		}
+	}
+	panic(&PermissionError{"net", host})
+}
+
+// CheckExec checks that the program name can be run.
+func (vm *VM) CheckExec(name string) {
+	if vm.caps != nil && !vm.caps.Exec {
+		panic(&PermissionError{"exec", name})
+	}
+}
+
+// CheckEnv checks that the environment variable name can be used.
+func (vm *VM) CheckEnv(name string) {
+	if vm.caps != nil && !vm.caps.Env {
+		panic(&PermissionError{"env", name})
+	}
+}
+
+// underAny returns whether path is one of dirs or inside of one, once
+// the symbolic links are resolved, paths that cannot be made absolute
+// are in none
+func underAny(path string, dirs []string) bool {
+	abs, err := resolvePath(path)
+	if err != nil {
+		return false
+	}
+	for _, dir := range dirs {
+		d, err := resolvePath(dir)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(d, abs); err == nil && isLocalArchiveName(filepath.ToSlash(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath returns the absolute path with the symbolic links
+// resolved, for a file that doesn't exist yet the links of the closest
+// parent directory that does are resolved
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir, rest := abs, ""
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs, nil
+		}
+		dir, rest = parent, filepath.Join(filepath.Base(dir), rest)
+	}
+}
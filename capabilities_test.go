@@ -0,0 +1,151 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yo-caps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := filepath.Join(dir, "data")
+	out := filepath.Join(dir, "out")
+	os.Mkdir(data, 0755)
+	os.Mkdir(out, 0755)
+	ioutil.WriteFile(filepath.Join(data, "a.txt"), []byte("a"), 0644)
+
+	vm := NewVM()
+	vm.SetCapabilities(&Capabilities{FSRead: []string{data}, FSWrite: []string{out}})
+	run := func(src string) error {
+		code, err := CompileReader(strings.NewReader(src), "test", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = vm.run(code)
+		return err
+	}
+
+	create := fmt.Sprintf("archive.create(%q, [%q], %q)", filepath.Join(out, "a.zip"), filepath.Join(data, "a.txt"), data)
+	if err := run(create); err != nil {
+		t.Fatal(err)
+	}
+	list := fmt.Sprintf("return len(archive.list(%q))", filepath.Join(out, "a.zip"))
+	if err := run(list); err != nil {
+		t.Fatal(err)
+	}
+
+	denied := []struct {
+		src    string
+		op     string
+		target string
+	}{
+		{fmt.Sprintf("archive.create(%q, [%q])", filepath.Join(data, "b.zip"), filepath.Join(data, "a.txt")), "write", filepath.Join(data, "b.zip")},
+		{fmt.Sprintf("archive.create(%q, [%q])", filepath.Join(out, "b.zip"), dir), "read", dir},
+		{fmt.Sprintf("archive.extract(%q, %q)", filepath.Join(out, "a.zip"), data), "write", data},
+		{fmt.Sprintf("\n\narchive.list(%q)", filepath.Join(data, "../x.zip")), "read", filepath.Join(data, "../x.zip")},
+	}
+	for i, d := range denied {
+		err := run(d.src)
+		var perr *PermissionError
+		if !errors.As(err, &perr) || perr.Op != d.op || perr.Target != d.target {
+			t.Errorf("(%d) expected permission error (%s %s), got %v", i, d.op, d.target, err)
+		}
+	}
+	if err := run(denied[3].src); err == nil || !strings.HasPrefix(err.Error(), "test:3: ") {
+		t.Errorf("expected the position of the call, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "b.zip")); !os.IsNotExist(err) {
+		t.Errorf("expected no archive created, got %v", err)
+	}
+
+	// the links are followed, to the place they point to
+	secret := filepath.Join(dir, "secret")
+	os.Mkdir(secret, 0755)
+	ioutil.WriteFile(filepath.Join(secret, "key"), []byte("k"), 0644)
+	if err := os.Symlink(secret, filepath.Join(data, "link")); err != nil {
+		t.Skip(err)
+	}
+	os.Symlink(data, filepath.Join(out, "link"))
+	os.Symlink(out, filepath.Join(dir, "outlink"))
+	links := []struct {
+		check   func(vm *VM, path string)
+		path    string
+		allowed bool
+	}{
+		{(*VM).CheckRead, filepath.Join(data, "link", "key"), false},
+		{(*VM).CheckRead, filepath.Join(data, "link"), false},
+		{(*VM).CheckWrite, filepath.Join(out, "link", "new.zip"), false},
+		{(*VM).CheckWrite, filepath.Join(out, "link", "new", "a.txt"), false},
+		{(*VM).CheckWrite, filepath.Join(dir, "outlink", "new.zip"), true},
+		{(*VM).CheckRead, filepath.Join(dir, "outlink", "link", "a.txt"), true},
+	}
+	for _, l := range links {
+		if got := permitted(func() { l.check(vm, l.path) }); got != l.allowed {
+			t.Errorf("%s: expected allowed %v", l.path, l.allowed)
+		}
+	}
+	vm.SetCapabilities(&Capabilities{FSWrite: []string{filepath.Join(dir, "outlink")}})
+	if !permitted(func() { vm.CheckWrite(filepath.Join(out, "b.zip")) }) {
+		t.Errorf("expected the directory of a link to be allowed")
+	}
+
+	// and can be recovered by the program
+	vm.SetCapabilities(&Capabilities{})
+	recovered := fmt.Sprintf("try { archive.list(%q) } recover e { return e.message }", filepath.Join(out, "a.zip"))
+	code, err := CompileReader(strings.NewReader(recovered), "test", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := vm.run(code)
+	if want := fmt.Sprintf("[permission denied: read '%s']", filepath.Join(out, "a.zip")); err != nil || fmt.Sprint(res) != want {
+		t.Errorf("expected %s, got %v %v", want, res, err)
+	}
+
+	caps := &Capabilities{NetHosts: []string{"example.com", "*.yo.dev"}}
+	vm.SetCapabilities(caps)
+	hosts := map[string]bool{
+		"example.com":      true,
+		"EXAMPLE.com:8080": true,
+		"api.example.com":  false,
+		"a.b.yo.dev:443":   true,
+		"yo.dev":           false,
+		"[::1]:80":         false,
+	}
+	for host, allowed := range hosts {
+		if got := permitted(func() { vm.CheckNet(host) }); got != allowed {
+			t.Errorf("CheckNet(%q) should be %v", host, allowed)
+		}
+	}
+	if permitted(func() { vm.CheckExec("ls") }) || permitted(func() { vm.CheckEnv("HOME") }) {
+		t.Errorf("expected exec and env to be denied")
+	}
+	caps.Exec, caps.Env = true, true
+	if !permitted(func() { vm.CheckExec("ls") }) || !permitted(func() { vm.CheckEnv("HOME") }) {
+		t.Errorf("expected exec and env to be allowed")
+	}
+	vm.SetCapabilities(nil)
+	if !permitted(func() { vm.CheckWrite("/") }) {
+		t.Errorf("expected no limits")
+	}
+}
+
+// permitted returns whether fn runs without a permission error
+func permitted(fn func()) (ok bool) {
+	defer func() {
+		if _, denied := recover().(*PermissionError); denied {
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
@@ -6,15 +6,64 @@ import (
 	"fmt"
 	"github.com/glhrmfrts/yo/ast"
 	"math"
+	"strings"
 )
 
 type (
+	// CompileError is a semantic error in a syntactically valid
+	// program. Every CompileError matches ErrSemantic and it's
+	// Code with errors.Is.
 	CompileError struct {
+		Code    ErrorCode
 		Line    int
 		File    string
 		Message string
 	}
 
+	// CompileWarning is something that is legal but most likely
+	// a mistake, it doesn't stop the compilation.
+	CompileWarning struct {
+		Line    int
+		File    string
+		Message string
+	}
+
+	// CompileOptions controls the optional parts of the compilation.
+	CompileOptions struct {
+		// Warn is called for each warning found, if it's nil
+		// the analysis passes that only produce warnings are skipped.
+		Warn func(w *CompileWarning)
+
+		// OptLevel enables optimizations, 0 disables them all
+		// and higher levels give more room for inlining (see inline.go).
+		OptLevel int
+
+		// MaxSourceSize is the maximum size in bytes of the source
+		// read by CompileReader, 0 means no limit.
+		MaxSourceSize int
+
+		// Cache keeps the code compiled by CompileSource and CompileFile,
+		// to skip compiling the same source again.
+		Cache Cache
+
+		// Profile is the profile of previous runs of the program (see
+		// VM.SetProfile), it guides the optimizations enabled by OptLevel.
+		Profile *Profile
+
+		// Dedup stores the compiled functions and constants once
+		// across all the programs compiled with it.
+		Dedup *Dedup
+
+		// StripAssertions removes the calls to assert and the requires
+		// and ensures clauses of the functions, for release builds
+		// that don't pay for the checks.
+		StripAssertions bool
+
+		// Events is called with the CompileStarted and CompileFinished
+		// events of the compilation (see Event).
+		Events func(e Event)
+	}
+
 	// holds registers for a expression
 	exprdata struct {
 		propagate bool
@@ -41,6 +90,7 @@ type (
 		continues      []uint32
 		breakTarget    uint32
 		continueTarget uint32
+		closes         bool // whether the body has variables captured in upvalues
 	}
 
 	// lexical block structure for compiler
@@ -51,13 +101,50 @@ type (
 		loop     *loopInfo
 		bytecode *Bytecode
 		parent   *compilerBlock
+
+		// whether a variable of the block is captured in an upvalue,
+		// which must be closed when leaving the block
+		captured bool
+
+		// indexes of the block's variables in Bytecode.Locals
+		locals []int
+
+		// only for try blocks, compiled again by the jumps out of it
+		finally *ast.Block
+
+		// only for function blocks
+		upvals     []*nameInfo // the variables referenced by Bytecode.Upvals
+		frameLocal bool        // whether the function doesn't escape (see escape.go)
+		method     string      // the name of the object of a method, func Object.name()
+		ensures    []ast.Node  // checked by each return, nil if stripped
+		contract   string      // the name of the function in the errors of the contracts
+		lastLabel  uint32      // the last position that is a jump target
 	}
 
 	compiler struct {
+		depth    int // nesting of blocks in the current function
 		lastLine int
 		filename string
 		mainFunc *Bytecode
 		block    *compilerBlock
+		warn     func(w *CompileWarning)
+		optLevel int
+		assigned map[string]bool // the names assigned anywhere, see assignedNames
+		inlines  map[*nameInfo]*inlineFunc
+		numeric  map[ast.Node]bool // from inferTypes
+
+		profile  *Profile // nil if the optimizations are disabled
+		hotCalls int64    // the calls of a site of the profile to be hot
+		dedup    *Dedup
+		strip    bool // CompileOptions.StripAssertions
+
+		frameLocal map[*ast.Function]bool // from frameLocalFuncs
+		hoisted    map[*ast.Function]int  // registers of the function declarations
+		folded     map[ast.Node]Value     // only set by FoldedConstants
+
+		// the statement being compiled in a block and the ones after it
+		stmt ast.Node
+		rest []ast.Node
 	}
 )
 
@@ -73,6 +160,8 @@ const (
 	kBlockContextFunc blockContext = iota
 	kBlockContextLoop
 	kBlockContextBranch
+	kBlockContextWith
+	kBlockContextTry
 )
 
 // How much registers an array can use at one time
@@ -83,6 +172,10 @@ func (err *CompileError) Error() string {
 	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Message)
 }
 
+func (w *CompileWarning) String() string {
+	return fmt.Sprintf("%s:%d: warning: %s", w.File, w.Line, w.Message)
+}
+
 // compilerBlock
 
 func newCompilerBlock(bytecode *Bytecode, context blockContext, parent *compilerBlock) *compilerBlock {
@@ -95,34 +188,78 @@ func newCompilerBlock(bytecode *Bytecode, context blockContext, parent *compiler
 }
 
 func (b *compilerBlock) nameInfo(name string) (*nameInfo, bool) {
-	var closures int
 	block := b
 	for block != nil {
 		info, ok := block.names[name]
 		if ok {
-			if closures > 0 && info.scope == kScopeLocal {
-				info.scope = kScopeClosure
-			}
 			return info, true
 		}
-		if block.context == kBlockContextFunc {
-			closures++
-		}
 		block = block.parent
 	}
 
 	return nil, false
 }
 
+// funcBlock returns the block of the function containing b
+func (b *compilerBlock) funcBlock() *compilerBlock {
+	for b.context != kBlockContextFunc {
+		b = b.parent
+	}
+	return b
+}
+
 func (b *compilerBlock) addNameInfo(name string, info *nameInfo) {
 	info.block = b
 	b.names[name] = info
+	if !info.isConst {
+		f := b.bytecode
+		b.locals = append(b.locals, len(f.Locals))
+		f.Locals = append(f.Locals, LocalInfo{Name: name, Reg: info.reg, StartPC: f.NumCode})
+	}
+}
+
+// the variables of the block go out of scope
+func (b *compilerBlock) endLocals() {
+	f := b.bytecode
+	for _, i := range b.locals {
+		f.Locals[i].EndPC = f.NumCode
+	}
 }
 
 // compiler
 
-func (c *compiler) error(line int, msg string) {
-	panic(&CompileError{Line: line, File: c.filename, Message: msg})
+func (c *compiler) error(line int, code ErrorCode, msg string) {
+	panic(&CompileError{Code: code, Line: line, File: c.filename, Message: msg})
+}
+
+// assert reports a violation of the compiler's invariants
+func (c *compiler) assert(cond bool, msg string) {
+	if !cond {
+		c.error(c.lastLine, ErrInternal, internalErrorMessage(msg))
+	}
+}
+
+func internalErrorMessage(cause interface{}) string {
+	return fmt.Sprintf("internal compiler error: %v (please report this bug)", cause)
+}
+
+// recoverError converts a panic during the compilation into an error,
+// panics other than CompileErrors are bugs in the compiler
+func recoverError(c *compiler, r interface{}) *CompileError {
+	if cerr, ok := r.(*CompileError); ok {
+		return cerr
+	}
+	cerr := &CompileError{Code: ErrInternal, Message: internalErrorMessage(r)}
+	if c != nil {
+		cerr.Line, cerr.File = c.lastLine, c.filename
+	}
+	return cerr
+}
+
+func (c *compiler) warning(line int, msg string) {
+	if c.warn != nil {
+		c.warn(&CompileWarning{Line: line, File: c.filename, Message: msg})
+	}
 }
 
 func (c *compiler) emitInstruction(instr uint32, line int) int {
@@ -172,13 +309,32 @@ func (c *compiler) modifyAsBx(index int, op Opcode, a, b int) bool {
 }
 
 func (c *compiler) newLabel() uint32 {
-	return c.block.bytecode.NumCode
+	label := c.block.bytecode.NumCode
+	c.block.funcBlock().lastLabel = label
+	return label
 }
 
+// labelOffset returns the offset of a jump from label-1
+// to the next instruction, which becomes a jump target
 func (c *compiler) labelOffset(label uint32) int {
+	c.newLabel()
 	return int(c.block.bytecode.NumCode - label)
 }
 
+// emitLoadnil emits R(a) ... R(b) = nil, extending the previous
+// instruction instead if it sets the registers right below a to nil
+func (c *compiler) emitLoadnil(a, b, line int) {
+	f := c.block.bytecode
+	if n := f.NumCode; n > 0 && c.block.funcBlock().lastLabel != n {
+		prev := f.Code[n-1]
+		if OpGetOpcode(prev) == OpLoadnil && int(OpGetB(prev))+1 == a {
+			c.modifyInstruction(int(n-1), OpNewAB(OpLoadnil, int(OpGetA(prev)), b))
+			return
+		}
+	}
+	c.emitAB(OpLoadnil, a, b, line)
+}
+
 func (c *compiler) genRegister() int {
 	id := c.block.register
 	c.block.register++
@@ -187,13 +343,13 @@ func (c *compiler) genRegister() int {
 
 func (c *compiler) declareLocalVar(name string, reg int) {
 	if _, ok := c.block.names[name]; ok {
-		c.error(c.lastLine, fmt.Sprintf("cannot redeclare '%s'", name))
+		c.error(c.lastLine, ErrRedeclared, fmt.Sprintf("cannot redeclare '%s'", name))
 	}
 	c.block.addNameInfo(name, &nameInfo{false, nil, reg, kScopeLocal, c.block})
 }
 
 func (c *compiler) enterBlock(context blockContext) {
-	assert(c.block != nil, "c.block enterBlock")
+	c.assert(c.block != nil, "c.block enterBlock")
 	block := newCompilerBlock(c.block.bytecode, context, c.block)
 	block.register = c.block.register
 
@@ -207,6 +363,9 @@ func (c *compiler) enterBlock(context blockContext) {
 
 func (c *compiler) leaveBlock() {
 	block := c.block
+	if block.captured || (block.context == kBlockContextLoop && block.loop.closes) {
+		c.emitAB(OpClose, block.parent.register, 0, c.lastLine)
+	}
 	if block.context == kBlockContextLoop {
 		loop := block.loop
 		for _, index := range loop.breaks {
@@ -216,21 +375,86 @@ func (c *compiler) leaveBlock() {
 			c.modifyAsBx(int(index), OpJmp, 0, int(loop.continueTarget-index-1))
 		}
 	}
+	block.endLocals()
 	c.block = block.parent
 }
 
-func (c *compiler) insideLoop() bool {
-	block := c.block
-	for block != nil {
-		if block.context == kBlockContextLoop {
-			return true
+// nameScope returns the scope of a variable as seen from the current block
+func (c *compiler) nameScope(info *nameInfo) scope {
+	if info.block.bytecode != c.block.bytecode {
+		return kScopeClosure
+	}
+	return info.scope
+}
+
+// upvalue returns the index of the upvalue of the function containing
+// block that refers to the variable info, adding it if needed
+func (c *compiler) upvalue(block *compilerBlock, name string, info *nameInfo) int {
+	fb := block.funcBlock()
+	for i, u := range fb.upvals {
+		if u == info {
+			return i
+		}
+	}
+
+	desc := UpvalueDesc{Name: name}
+	parent := fb.parent.funcBlock()
+	if info.block.bytecode == parent.bytecode {
+		desc.Index = info.reg
+		if fb.frameLocal {
+			desc.Kind = UpvalueStack
+		} else {
+			desc.Kind = UpvalueRegister
+			c.markCaptured(info)
+		}
+	} else {
+		desc.Kind = UpvalueParent
+		desc.Index = c.upvalue(fb.parent, name, info)
+
+		// the closure shares the upvalue of the enclosing function,
+		// so it can't be read from the stack anymore
+		if parentDesc := &parent.bytecode.Upvals[desc.Index]; parentDesc.Kind == UpvalueStack {
+			parentDesc.Kind = UpvalueRegister
+			c.markCaptured(info)
 		}
-		if block.context == kBlockContextFunc {
+	}
+
+	fb.upvals = append(fb.upvals, info)
+	fb.bytecode.Upvals = append(fb.bytecode.Upvals, desc)
+	return len(fb.upvals) - 1
+}
+
+// shareable tells if none of the free variables of b is assigned,
+// by name in the whole program to keep it simple
+func (c *compiler) shareable(b *Bytecode) bool {
+	for _, u := range b.Upvals {
+		if c.assigned[u.Name] {
 			return false
 		}
-		block = block.parent
 	}
-	return false
+	return true
+}
+
+func (c *compiler) markCaptured(info *nameInfo) {
+	info.block.captured = true
+	if info.block.loop != nil {
+		info.block.loop.closes = true
+	}
+}
+
+// enclosingLoop returns the nearest loop enclosing the current block
+// through the branch and with blocks, nil if there's none in the
+// current function
+func (c *compiler) enclosingLoop() *loopInfo {
+	for block := c.block; block != nil; block = block.parent {
+		switch block.context {
+		case kBlockContextLoop:
+			return block.loop
+		case kBlockContextFunc:
+			return nil
+		}
+	}
+	return nil
 }
 
 // Add a constant to the current bytecodetype's constant pool
@@ -244,7 +468,7 @@ func (c *compiler) addConst(value Value) int {
 		}
 	}
 	if f.NumConsts > bytecodeMaxConsts-1 {
-		c.error(0, "too many constants") // should never happen
+		c.error(0, ErrTooManyConstants, "too many constants") // should never happen
 	}
 	f.Consts = append(f.Consts, value)
 	f.NumConsts++
@@ -253,6 +477,19 @@ func (c *compiler) addConst(value Value) int {
 
 // Try to "constant fold" an expression
 func (c *compiler) constFold(node ast.Node) (Value, bool) {
+	value, ok := c.fold(node)
+	if ok && c.folded != nil {
+		switch node.(type) {
+		case *ast.Number, *ast.Bool, *ast.String:
+			// literals are not folded
+		default:
+			c.folded[node] = value
+		}
+	}
+	return value, ok
+}
+
+func (c *compiler) fold(node ast.Node) (Value, bool) {
 	switch t := node.(type) {
 	case *ast.Number:
 		return Number(t.Value), true
@@ -265,30 +502,22 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 		if ok && info.isConst {
 			return info.value, true
 		}
-	case *ast.CallExpr:
-		id, ok := t.Left.(*ast.Id)
-		if ok && len(t.Args) == 1 {
-			rv, ok := c.constFold(t.Args[0])
-			if !ok {
-				return nil, false
-			}
-			if id.Value == "string" {
-				return String(rv.String()), true
-			} else if id.Value == "number" {
-				switch rv.Type() {
-				case ValueNumber:
-					return rv, true
-				case ValueString:
-					n, err := parseNumber(rv.String())
-					if err != nil {
-						return nil, false
-					}
-					return Number(n), true
+	case *ast.Template:
+		if t.Tag != nil {
+			return nil, false
+		}
+		var buf strings.Builder
+		for i, part := range t.Parts {
+			buf.WriteString(part)
+			if i < len(t.Exprs) {
+				value, ok := c.constFold(t.Exprs[i])
+				if !ok {
+					return nil, false
 				}
-			} else if id.Value == "bool" {
-				return Bool(rv.ToBool()), true
+				buf.WriteString(value.String())
 			}
 		}
+		return String(buf.String()), true
 	case *ast.UnaryExpr:
 		if t.Op == ast.TokenMinus {
 			val, ok := c.constFold(t.Right)
@@ -297,6 +526,12 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 				return Number(-f64), true
 			}
 			return nil, false
+		} else if t.Op == ast.TokenHash {
+			val, ok := c.constFold(t.Right)
+			if str, isStr := val.(String); ok && isStr {
+				return Number(len(str)), true
+			}
+			return nil, false
 		} else {
 			// 'not' operator
 			val, ok := c.constFold(t.Right)
@@ -306,11 +541,37 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 			}
 			return nil, false
 		}
+	case *ast.TernaryExpr:
+		cond, ok := c.constFold(t.Cond)
+		if !ok {
+			return nil, false
+		}
+		return c.constFold(takenBranch(t, cond))
 	case *ast.BinaryExpr:
+		if t.Op == ast.TokenAmpamp || t.Op == ast.TokenPipepipe {
+			// the right side doesn't have to be constant
+			// when the left one decides the result
+			left, ok := c.constFold(t.Left)
+			if !ok {
+				return nil, false
+			}
+			if decidesLogic(t.Op, left) {
+				return left, true
+			}
+			return c.constFold(t.Right)
+		}
+		if t.Op == ast.TokenIs {
+			typ, isType := typeTest(t)
+			if left, ok := c.constFold(t.Left); ok && isType {
+				return Bool(typeCompatible(typ, left.Type())), true
+			}
+			return nil, false
+		}
 		left, leftOk := c.constFold(t.Left)
 		right, rightOk := c.constFold(t.Right)
 		if leftOk && rightOk {
 			var ret Value
+			var op Opcode // of the arithmetic that may overflow
 			if left.Type() != right.Type() {
 				if t.Op == ast.TokenEqeq {
 					return Bool(false), true
@@ -324,21 +585,21 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 			lf64, ok := left.assertFloat64()
 			rf64, _ := right.assertFloat64()
 			if !ok {
-				goto boolOps
+				goto stringOps
 			}
 
 			// first check all arithmetic/relational operations
 			switch t.Op {
 			case ast.TokenPlus:
-				ret = Number(lf64 + rf64)
+				ret, op = Number(lf64 + rf64), OpAdd
 			case ast.TokenMinus:
-				ret = Number(lf64 - rf64)
+				ret, op = Number(lf64 - rf64), OpSub
 			case ast.TokenTimes:
-				ret = Number(lf64 * rf64)
+				ret, op = Number(lf64 * rf64), OpMul
 			case ast.TokenDiv:
 				ret = Number(lf64 / rf64)
 			case ast.TokenTimestimes:
-				ret = Number(math.Pow(lf64, rf64))
+				ret, op = Number(math.Pow(lf64, rf64)), OpPow
 			case ast.TokenLt:
 				ret = Bool(lf64 < rf64)
 			case ast.TokenLteq:
@@ -350,25 +611,14 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 			case ast.TokenEqeq:
 				ret = Bool(lf64 == rf64)
 			}
+			if _, overflow, _ := intArith(op, lf64, rf64); overflow {
+				// left to the overflow mode of the VM
+				return nil, false
+			}
 			if ret != nil {
 				return ret, true
 			}
 
-		boolOps:
-			// not arithmetic/relational, maybe logic?
-			lb, ok := left.assertBool()
-			rb, _ := right.assertBool()
-			if !ok {
-				goto stringOps
-			}
-
-			switch t.Op {
-			case ast.TokenAmpamp:
-				return Bool(lb && rb), true
-			case ast.TokenPipepipe:
-				return Bool(lb || rb), true
-			}
-
 		stringOps:
 			ls, ok := left.assertString()
 			rs, _ := right.assertString()
@@ -391,27 +641,98 @@ func (c *compiler) constFold(node ast.Node) (Value, bool) {
 				return Bool(ls == rs), true
 			case ast.TokenBangeq:
 				return Bool(ls != rs), true
+			case ast.TokenIn:
+				return Bool(strings.Contains(rs, ls)), true
 			}
 		}
 	}
 	return nil, false
 }
 
+// following returns the statements after stmt in it's block, nil
+// if it's not being compiled as a statement of a block
+func (c *compiler) following(stmt ast.Node) []ast.Node {
+	if c.stmt == stmt {
+		return c.rest
+	}
+	return nil
+}
+
+// assignedNext returns which of the names are assigned by the
+// assignments right after their declaration in rest, before
+// anything can read them
+func assignedNext(names []*ast.Id, rest []ast.Node) map[string]bool {
+	pending := make(map[string]bool, len(names))
+	for _, id := range names {
+		pending[id.Value] = true
+	}
+	assigned := make(map[string]bool)
+	for _, stmt := range rest {
+		node, ok := stmt.(*ast.Assignment)
+		if !ok || node.Op != ast.TokenEq {
+			break
+		}
+		for _, value := range node.Right {
+			if refersTo(value, pending) {
+				return assigned
+			}
+		}
+		valueCount := len(node.Right)
+		_, isCall := node.Right[valueCount-1].(*ast.CallExpr)
+		isUnpack := unpacks(node.Right[valueCount-1])
+		for i, left := range node.Left {
+			id, ok := left.(*ast.Id)
+			if !ok {
+				return assigned
+			}
+			if pending[id.Value] && (i < valueCount || isCall || isUnpack) {
+				assigned[id.Value] = true
+				delete(pending, id.Value)
+			}
+		}
+	}
+	return assigned
+}
+
+// whether any of the names appear in node
+func refersTo(node ast.Node, names map[string]bool) bool {
+	found := false
+	ast.Inspect(node, func(node ast.Node) bool {
+		if id, ok := node.(*ast.Id); ok && names[id.Value] {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
 // declare local variables
 // assignments are done in sequence, since the registers are created as needed
-func (c *compiler) declare(names []*ast.Id, values []ast.Node) {
+// unpacks returns whether value is an array or an object unpacked
+// into the names of a declaration or an assignment, starting at the
+// name of value
+func unpacks(value ast.Node) bool {
+	switch value.(type) {
+	case *ast.VarArg, *ast.ObjectUnpack:
+		return true
+	}
+	return false
+}
+
+func (c *compiler) declare(names []*ast.Id, values []ast.Node, rest []ast.Node) {
 	var isCall, isUnpack bool
 	nameCount, valueCount := len(names), len(values)
 	if valueCount > 0 {
 		_, isCall = values[valueCount-1].(*ast.CallExpr)
-		_, isUnpack = values[valueCount-1].(*ast.VarArg)
+		isUnpack = unpacks(values[valueCount-1])
 	}
-	start := c.block.register
+	first := c.block.register
+	start := first
 	end := start + nameCount - 1
 	for i, id := range names {
 		_, ok := c.block.names[id.Value]
 		if ok {
-			c.error(id.NodeInfo.Line, fmt.Sprintf("cannot redeclare '%s'", id.Value))
+			c.error(id.NodeInfo.Line, ErrRedeclared, fmt.Sprintf("cannot redeclare '%s'", id.Value))
 		}
 		reg := c.genRegister()
 
@@ -419,31 +740,60 @@ func (c *compiler) declare(names []*ast.Id, values []ast.Node) {
 		if i == valueCount-1 && (isCall || isUnpack) {
 			// last expression receives all the remaining registers
 			// in case it's a function call with multiple return values
-			rem := i + 1
-			for rem < nameCount {
-				// reserve the registers
-				id := names[rem]
-				_, ok := c.block.names[id.Value]
-				if ok {
-					c.error(id.NodeInfo.Line, fmt.Sprintf("cannot redeclare '%s'", id.Value))
-				}
+			for range names[i+1:] {
 				end = c.genRegister()
-				c.block.addNameInfo(id.Value, &nameInfo{false, nil, end, kScopeLocal, c.block})
-				rem++
 			}
 			exprdata.regb, start = end, end+1
 			values[i].Accept(c, &exprdata)
+
+			// none of the variables are visible to the expression
+			c.block.addNameInfo(id.Value, &nameInfo{false, nil, reg, kScopeLocal, c.block})
+			for j, id := range names[i+1:] {
+				if _, ok := c.block.names[id.Value]; ok {
+					c.error(id.NodeInfo.Line, ErrRedeclared, fmt.Sprintf("cannot redeclare '%s'", id.Value))
+				}
+				c.block.addNameInfo(id.Value, &nameInfo{false, nil, reg + j + 1, kScopeLocal, c.block})
+			}
+			break
 		} else if i < valueCount {
 			values[i].Accept(c, &exprdata)
+			c.nameFunc(values[i], id)
 			start = reg + 1
 		}
 
 		// add name info after the value (the variable should not be visible to it's own initializer)
 		c.block.addNameInfo(id.Value, &nameInfo{false, nil, reg, kScopeLocal, c.block})
 	}
-	if end >= start {
-		// variables without initializer are set to nil
-		c.emitAB(OpLoadnil, start, end, names[0].NodeInfo.Line)
+	if end < start {
+		return
+	}
+	// variables without initializer are set to nil, unless
+	// they are assigned right after the declaration
+	assigned := assignedNext(names[start-first:], rest)
+	for reg := start; reg <= end; reg++ {
+		if assigned[names[reg-first].Value] {
+			continue
+		}
+		from := reg
+		for reg < end && !assigned[names[reg+1-first].Value] {
+			reg++
+		}
+		c.emitLoadnil(from, reg, names[0].NodeInfo.Line)
+	}
+}
+
+// nameFunc gives the name of the variable to an anonymous function
+// just compiled as it's value, like 'var f = func() {}' or a top-level
+// function hoisted by hoistTopLevel, so it shows up in the tracebacks
+func (c *compiler) nameFunc(value, left ast.Node) {
+	fn, ok := value.(*ast.Function)
+	id, isId := left.(*ast.Id)
+	if !ok || !isId || fn.Name != nil {
+		return
+	}
+	parent := c.block.bytecode
+	if parent.NumFuncs > 0 && parent.Funcs[parent.NumFuncs-1].Name == "" {
+		parent.Funcs[parent.NumFuncs-1].Name = id.Value
 	}
 }
 
@@ -455,17 +805,15 @@ func (c *compiler) assignmentHelper(left ast.Node, assignReg int, valueReg int)
 		if !ok {
 			scope = kScopeGlobal
 		} else {
-			scope = info.scope
+			scope = c.nameScope(info)
 		}
 		switch scope {
 		case kScopeLocal:
 			c.emitAB(OpMove, info.reg, valueReg, v.NodeInfo.Line)
-		case kScopeClosure, kScopeGlobal:
-			op := OpSetglobal
-			if scope == kScopeClosure {
-				op = OpSetFree
-			}
-			c.emitABx(op, valueReg, c.addConst(String(v.Value)), v.NodeInfo.Line)
+		case kScopeClosure:
+			c.emitABx(OpSetFree, valueReg, c.upvalue(c.block, v.Value, info), v.NodeInfo.Line)
+		case kScopeGlobal:
+			c.emitABx(OpSetglobal, valueReg, c.addConst(String(v.Value)), v.NodeInfo.Line)
 		}
 	case *ast.Subscript:
 		arrData := exprdata{true, assignReg, assignReg}
@@ -480,41 +828,316 @@ func (c *compiler) assignmentHelper(left ast.Node, assignReg int, valueReg int)
 		objData := exprdata{true, assignReg, assignReg}
 		v.Left.Accept(c, &objData)
 		objReg := objData.regb
-		key := OpConstOffset + c.addConst(String(v.Value))
+		key := c.addConst(String(v.Value))
 
-		c.emitABC(OpSetIndex, objReg, key, valueReg, v.NodeInfo.Line)
+		c.emitABC(OpSetField, objReg, key, valueReg, v.NodeInfo.Line)
 	}
 }
 
-func (c *compiler) branchConditionHelper(cond, then, else_ ast.Node, reg int) {
-	ternaryData := exprdata{true, reg + 1, reg + 1}
+// branchConditionHelper compiles the branches of a ternary or an if,
+// if value is set the value of the branch taken goes to reg (nil
+// for an if without else)
+func (c *compiler) branchConditionHelper(cond, then, else_ ast.Node, reg int, value bool) {
+	condReg := reg + 1
+	if c.block.register > condReg {
+		condReg = c.block.register
+	}
+	ternaryData := exprdata{true, condReg, condReg}
 	cond.Accept(c, &ternaryData)
 	condr := ternaryData.regb
-	jmpInstr := c.emitAsBx(OpJmpfalse, condr, 0, c.lastLine)
+
+	jmpOp := OpJmpfalse
+	if else_ != nil && c.likelyFalse(c.lastLine) {
+		// the else branch comes first, so the usual case doesn't jump
+		jmpOp = OpJmptrue
+		then, else_ = else_, then
+	}
+	jmpInstr := c.emitAsBx(jmpOp, condr, 0, c.lastLine)
 	thenLabel := c.newLabel()
 
-	ternaryData = exprdata{false, reg, reg}
-	then.Accept(c, &ternaryData)
-	c.modifyAsBx(jmpInstr, OpJmpfalse, condr, c.labelOffset(thenLabel))
+	branch := func(node ast.Node) {
+		// each arm of an if has it's own scope and registers
+		if _, ok := node.(*ast.Block); ok {
+			c.enterBlock(kBlockContextBranch)
+			defer c.leaveBlock()
+		}
+		if value {
+			node.Accept(c, &exprdata{false, reg, reg})
+		} else {
+			node.Accept(c, nil)
+		}
+	}
+	if value && else_ == nil {
+		else_ = &ast.Nil{NodeInfo: ast.NodeInfo{Line: c.lastLine}}
+	}
+
+	branch(then)
 
-	if else_ != nil {
+	if else_ == nil {
+		c.modifyAsBx(jmpInstr, jmpOp, condr, c.labelOffset(thenLabel))
+	} else {
 		successInstr := c.emitAsBx(OpJmp, 0, 0, c.lastLine)
+		c.modifyAsBx(jmpInstr, jmpOp, condr, c.labelOffset(thenLabel))
 
 		elseLabel := c.newLabel()
-		ternaryData = exprdata{false, reg, reg}
-		else_.Accept(c, &ternaryData)
+		branch(else_)
 
 		c.modifyAsBx(successInstr, OpJmp, 0, c.labelOffset(elseLabel))
 	}
 }
 
+// warn about duplicate cases and, when the cases are a closed set of
+// values (true and false, or every type in a type switch), about an
+// else that is never taken. Missing cases are reported only for bools,
+// a type switch usually handles just the types it cares about.
+func (c *compiler) checkMatchCases(node *ast.MatchStmt) {
+	type seenCase struct {
+		value Value
+		line  int
+	}
+	var seen []seenCase
+	var hasElse bool
+	var elseLine int
+	allBool := true
+	for _, mc := range node.Cases {
+		if len(mc.Values) == 0 {
+			if hasElse {
+				c.error(mc.NodeInfo.Line, ErrMultipleElse, "multiple else cases in match")
+			}
+			hasElse, elseLine = true, mc.NodeInfo.Line
+			continue
+		}
+		for _, v := range mc.Values {
+			value, ok := c.matchCaseValue(node, v)
+			if !ok {
+				allBool = false
+				continue
+			}
+			if value.Type() != ValueBool {
+				allBool = false
+			}
+			for _, prev := range seen {
+				if prev.value.Type() == value.Type() && prev.value == value {
+					c.warning(mc.NodeInfo.Line, fmt.Sprintf("duplicate case %s in match (previous at line %d)", c.matchCaseName(node, value), prev.line))
+				}
+			}
+			seen = append(seen, seenCase{value, mc.NodeInfo.Line})
+		}
+	}
+
+	var closed []Value
+	switch {
+	case node.IsType:
+		for _, name := range []string{"nil", "bool", "number", "string", "func", "array", "object", "chan", "range"} {
+			closed = append(closed, String(name))
+		}
+	case allBool && len(seen) > 0:
+		closed = []Value{Bool(true), Bool(false)}
+	default:
+		return
+	}
+	var missing []Value
+	for _, value := range closed {
+		found := false
+		for _, prev := range seen {
+			if prev.value == value || prev.value == String("any") {
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, value)
+		}
+	}
+	if hasElse && len(missing) == 0 {
+		c.warning(elseLine, "else case of match is never taken, the other cases cover every value")
+	} else if !hasElse && !node.IsType {
+		for _, value := range missing {
+			c.warning(node.NodeInfo.Line, fmt.Sprintf("match is not exhaustive, missing case %s", value))
+		}
+	}
+}
+
+// matchCaseValue returns the value a case compares to, the name of the
+// type in a type switch, false if it's not known at compile time
+func (c *compiler) matchCaseValue(node *ast.MatchStmt, v ast.Node) (Value, bool) {
+	if node.IsType {
+		// instances of prototypes are not a closed set
+		typ, ok := testedType(v)
+		return String(typeName(typ)), ok
+	}
+	return c.constFold(v)
+}
+
+func (c *compiler) matchCaseName(node *ast.MatchStmt, value Value) string {
+	if node.IsType {
+		return value.String()
+	}
+	return matchCaseString(value)
+}
+
+// whether node refers to a named constant, conditions like 'if DEBUG'
+// are intentional and shouldn't be reported as always true/false
+func refersToConst(node ast.Node) bool {
+	switch t := node.(type) {
+	case *ast.Id:
+		return true
+	case *ast.UnaryExpr:
+		return refersToConst(t.Right)
+	case *ast.BinaryExpr:
+		return refersToConst(t.Left) || refersToConst(t.Right)
+	case *ast.CallExpr:
+		for _, arg := range t.Args {
+			if refersToConst(arg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether the left operand of && or || is the result
+func decidesLogic(op ast.Token, left Value) bool {
+	return left.ToBool() == (op == ast.TokenPipepipe)
+}
+
+// takenBranch returns the branch of node taken with the constant cond
+func takenBranch(node *ast.TernaryExpr, cond Value) ast.Node {
+	if cond.ToBool() {
+		return node.Then
+	}
+	return node.Else
+}
+
+func (c *compiler) checkConstCondition(cond ast.Node, what string) {
+	value, ok := c.constFold(cond)
+	if ok && !refersToConst(cond) {
+		c.warning(ast.Line(cond), fmt.Sprintf("%s is always %t", what, value.ToBool()))
+	}
+}
+
+// whether a and b are the same expression, used to find
+// pointless ternaries
+func sameExpr(a, b ast.Node) bool {
+	switch a := a.(type) {
+	case *ast.Nil:
+		_, ok := b.(*ast.Nil)
+		return ok
+	case *ast.Bool:
+		b, ok := b.(*ast.Bool)
+		return ok && a.Value == b.Value
+	case *ast.Number:
+		b, ok := b.(*ast.Number)
+		return ok && a.Value == b.Value
+	case *ast.String:
+		b, ok := b.(*ast.String)
+		return ok && a.Value == b.Value
+	case *ast.Id:
+		b, ok := b.(*ast.Id)
+		return ok && a.Value == b.Value
+	case *ast.Selector:
+		b, ok := b.(*ast.Selector)
+		return ok && a.Value == b.Value && sameExpr(a.Left, b.Left)
+	case *ast.Subscript:
+		b, ok := b.(*ast.Subscript)
+		return ok && sameExpr(a.Left, b.Left) && sameExpr(a.Right, b.Right)
+	case *ast.UnaryExpr:
+		b, ok := b.(*ast.UnaryExpr)
+		return ok && a.Op == b.Op && sameExpr(a.Right, b.Right)
+	case *ast.BinaryExpr:
+		b, ok := b.(*ast.BinaryExpr)
+		return ok && a.Op == b.Op && sameExpr(a.Left, b.Left) && sameExpr(a.Right, b.Right)
+	case *ast.CallExpr:
+		b, ok := b.(*ast.CallExpr)
+		if !ok || len(a.Args) != len(b.Args) || !sameExpr(a.Left, b.Left) {
+			return false
+		}
+		for i := range a.Args {
+			if !sameExpr(a.Args[i], b.Args[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func matchCaseString(value Value) string {
+	if value.Type() == ValueString {
+		return fmt.Sprintf("%q", value.String())
+	}
+	return value.String()
+}
+
+// functionReturnGuard emits the return of a function whose end
+// can be reached, after the last statement or by a jump
 func (c *compiler) functionReturnGuard() {
-	last := c.block.bytecode.Code[c.block.bytecode.NumCode-1]
-	if OpGetOpcode(last) != OpReturn {
+	f := c.block.bytecode
+	if f.NumCode == 0 || OpGetOpcode(f.Code[f.NumCode-1]) != OpReturn || c.block.lastLabel == f.NumCode {
+		if c.block.ensures != nil {
+			c.VisitReturnStmt(&ast.ReturnStmt{NodeInfo: ast.NodeInfo{Line: c.lastLine}}, nil)
+			return
+		}
 		c.emitAB(OpReturn, 0, 0, c.lastLine)
 	}
 }
 
+// contractName returns the name of a function in the errors of
+// it's contracts, with a leading space
+func contractName(name ast.Node) string {
+	switch name := name.(type) {
+	case *ast.Id:
+		return " of " + name.Value
+	case *ast.Selector:
+		if obj, ok := name.Left.(*ast.Id); ok {
+			return " of " + obj.Value + "." + name.Value
+		}
+		return " of " + name.Value
+	}
+	return ""
+}
+
+// check emits the code raising an error with message if cond is false,
+// like panic does, followed by the value of detail if given:
+//
+//   jmptrue   cond -> ok
+//   loadconst R(A) message
+//   panic     R(A)
+// ok:
+func (c *compiler) check(cond ast.Node, message string, detail ...ast.Node) {
+	line := ast.Info(cond).Line
+	reg := c.block.register
+	condData := exprdata{true, reg, reg}
+	cond.Accept(c, &condData)
+	jmpInstr := c.emitAsBx(OpJmptrue, condData.regb, 0, line)
+	label := c.newLabel()
+	if len(detail) > 0 {
+		c.emitABx(OpLoadconst, reg, c.addConst(String(message+": ")), line)
+		detailData := exprdata{false, reg + 1, reg + 1}
+		detail[0].Accept(c, &detailData)
+		c.emitABC(OpConcat, reg, reg, reg+1, line)
+	} else {
+		c.emitABx(OpLoadconst, reg, c.addConst(String(message)), line)
+	}
+	c.emitAB(OpPanic, reg, 0, line)
+	c.modifyAsBx(jmpInstr, OpJmptrue, condData.regb, c.labelOffset(label))
+}
+
+// ensures emits the checks of the ensures clauses of the function,
+// with 'result' bound to R(reg), or nil if the function returns no
+// values
+func (c *compiler) ensures(fn *compilerBlock, reg, nvalues int, line int) {
+	c.enterBlock(kBlockContextBranch)
+	defer c.leaveBlock()
+	if nvalues == 0 {
+		reg = c.genRegister()
+		c.emitLoadnil(reg, reg, line)
+	}
+	c.declareLocalVar("result", reg)
+	for _, cond := range fn.ensures {
+		c.check(cond, "postcondition"+fn.contract+" failed")
+	}
+}
+
 //
 // visitor interface
 //
@@ -524,7 +1147,7 @@ func (c *compiler) VisitNil(node *ast.Nil, data interface{}) {
 	expr, ok := data.(*exprdata)
 	if ok {
 		rega, regb = expr.rega, expr.regb
-		if rega > regb {
+		if rega > regb || expr.propagate {
 			regb = rega
 		}
 	} else {
@@ -532,6 +1155,9 @@ func (c *compiler) VisitNil(node *ast.Nil, data interface{}) {
 		regb = rega
 	}
 	c.emitAB(OpLoadnil, rega, regb, node.NodeInfo.Line)
+	if ok && expr.propagate {
+		expr.regb = rega
+	}
 }
 
 func (c *compiler) VisitBool(node *ast.Bool, data interface{}) {
@@ -580,6 +1206,9 @@ func (c *compiler) VisitString(node *ast.String, data interface{}) {
 }
 
 func (c *compiler) VisitId(node *ast.Id, data interface{}) {
+	if node.Value == "super" {
+		node = c.super(node)
+	}
 	var reg int
 	var scope scope = -1
 	expr, exprok := data.(*exprdata)
@@ -596,7 +1225,7 @@ func (c *compiler) VisitId(node *ast.Id, data interface{}) {
 		}
 		c.emitABx(OpLoadconst, reg, c.addConst(info.value), node.NodeInfo.Line)
 	} else if ok {
-		scope = info.scope
+		scope = c.nameScope(info)
 	} else {
 		// assume global if it can't be found in the lexical scope
 		scope = kScopeGlobal
@@ -609,58 +1238,123 @@ func (c *compiler) VisitId(node *ast.Id, data interface{}) {
 		}
 		c.emitAB(OpMove, reg, info.reg, node.NodeInfo.Line)
 	case kScopeClosure, kScopeGlobal:
-		op := OpLoadglobal
 		if scope == kScopeClosure {
-			op = OpLoadFree
+			c.emitABx(OpLoadFree, reg, c.upvalue(c.block, node.Value, info), node.NodeInfo.Line)
+		} else {
+			c.emitABx(OpLoadglobal, reg, c.addConst(String(node.Value)), node.NodeInfo.Line)
 		}
-		c.emitABx(op, reg, c.addConst(String(node.Value)), node.NodeInfo.Line)
 		if exprok && expr.propagate {
 			expr.regb = reg
 		}
 	}
 }
 
-func (c *compiler) VisitArray(node *ast.Array, data interface{}) {
-	var reg int
-	expr, exprok := data.(*exprdata)
+// super returns the hidden variable holding the parent of the
+// prototype of the method being compiled (see VisitProtoDecl), if
+// 'super' is not declared as a variable
+func (c *compiler) super(node *ast.Id) *ast.Id {
+	if _, ok := c.block.nameInfo(node.Value); ok {
+		return node
+	}
+	fn := c.block
+	for fn.context != kBlockContextFunc {
+		fn = fn.parent
+	}
+	if fn.method == "" {
+		return node
+	}
+	name := parentName(fn.method)
+	if _, ok := c.block.nameInfo(name); !ok {
+		c.error(node.NodeInfo.Line, ErrNoParent, fmt.Sprintf("'super' used in a method of %s, which has no parent prototype", fn.method))
+		return node
+	}
+	return &ast.Id{Value: name, NodeInfo: node.NodeInfo}
+}
+
+// parentName returns the name of the variable holding the parent
+// of the prototype named proto, which can't clash with a name of the
+// source
+func parentName(proto string) string {
+	return proto + ".super"
+}
+
+func (c *compiler) VisitArray(node *ast.Array, data interface{}) {
+	var reg int
+	expr, exprok := data.(*exprdata)
 	if exprok {
 		reg = expr.rega
 	} else {
 		reg = c.genRegister()
 	}
-	length := len(node.Elements)
+	if len(node.Elements) == 1 {
+		if vararg, ok := node.Elements[0].(*ast.VarArg); ok {
+			if call, ok := vararg.Arg.(*ast.CallExpr); ok {
+				// all the results of a call, [f()...]
+				c.call(call, reg, 0)
+				if exprok && expr.propagate {
+					expr.regb = reg
+				}
+				return
+			}
+		}
+	}
 	c.emitAB(OpArray, reg, 0, node.NodeInfo.Line)
 
-	times := length/kArrayMaxRegisters + 1
-	for t := 0; t < times; t++ {
-		start, end := t*kArrayMaxRegisters, (t+1)*kArrayMaxRegisters
-		end = int(math.Min(float64(end-start), float64(length-start)))
-		if end == 0 {
-			break
+	// the elements are appended kArrayMaxRegisters at a time, and
+	// the spread ones, [a, rest..., b], with all their elements
+	pending := 0
+	flush := func() {
+		if pending > 0 {
+			c.emitAB(OpAppend, reg, pending, node.NodeInfo.Line)
+			pending = 0
+		}
+	}
+	for _, el := range node.Elements {
+		if spread, ok := el.(*ast.VarArg); ok {
+			flush()
+			c.emitAB(OpAppendArray, reg, c.spreadValue(spread, reg+1), spread.NodeInfo.Line)
+			continue
 		}
-		for i := 0; i < end; i++ {
-			el := node.Elements[start+i]
-			exprdata := exprdata{false, reg + i + 1, reg + i + 1}
-			el.Accept(c, &exprdata)
+		exprdata := exprdata{false, reg + pending + 1, reg + pending + 1}
+		el.Accept(c, &exprdata)
+		pending++
+		if pending == kArrayMaxRegisters {
+			flush()
 		}
-		c.emitAB(OpAppend, reg, end, node.NodeInfo.Line)
 	}
+	flush()
 	if exprok && expr.propagate {
 		expr.regb = reg
 	}
 }
 
+// spreadValue evaluates the array spread in an array literal and
+// returns it's register, the results of a call are collected in reg
+func (c *compiler) spreadValue(node *ast.VarArg, reg int) int {
+	if call, ok := node.Arg.(*ast.CallExpr); ok {
+		c.call(call, reg, 0)
+		return reg
+	}
+	arrData := exprdata{true, reg, reg}
+	node.Arg.Accept(c, &arrData)
+	if arrData.regb >= OpConstOffset {
+		c.emitABx(OpLoadconst, reg, arrData.regb-OpConstOffset, node.NodeInfo.Line)
+		return reg
+	}
+	return arrData.regb
+}
+
 func (c *compiler) VisitObjectField(node *ast.ObjectField, data interface{}) {
 	expr, exprok := data.(*exprdata)
-	assert(exprok, "ObjectField exprok")
+	c.assert(exprok, "ObjectField exprok")
 	objreg := expr.rega
-	key := OpConstOffset + c.addConst(String(node.Key))
+	key := c.addConst(String(node.Key))
 
 	valueData := exprdata{true, objreg + 1, objreg + 1}
 	node.Value.Accept(c, &valueData)
 	value := valueData.regb
 
-	c.emitABC(OpSetIndex, objreg, key, value, node.NodeInfo.Line)
+	c.emitABC(OpSetField, objreg, key, value, node.NodeInfo.Line)
 }
 
 func (c *compiler) VisitObject(node *ast.Object, data interface{}) {
@@ -681,18 +1375,83 @@ func (c *compiler) VisitObject(node *ast.Object, data interface{}) {
 	}
 }
 
+func (c *compiler) VisitComprehension(node *ast.Comprehension, data interface{}) {
+	var reg int
+	expr, exprok := data.(*exprdata)
+	if exprok {
+		reg = expr.rega
+	} else {
+		reg = c.genRegister()
+	}
+	if node.Key == nil {
+		c.emitAB(OpArray, reg, 0, node.NodeInfo.Line)
+	} else {
+		c.emitAB(OpObject, reg, 0, node.NodeInfo.Line)
+	}
+
+	// inside an expression the result may be above the
+	// registers of the block, the loop must not overwrite it
+	register := c.block.register
+	if reg >= register {
+		c.block.register = reg + 1
+	}
+	c.forIterator(node.Loop, func() {
+		tmp := c.block.register
+		if node.Key == nil {
+			// OpAppend takes the values after the array
+			c.emitAB(OpMove, tmp, reg, node.NodeInfo.Line)
+			valueData := exprdata{false, tmp + 1, tmp + 1}
+			node.Value.Accept(c, &valueData)
+			c.emitAB(OpAppend, tmp, 1, node.NodeInfo.Line)
+		} else {
+			keyData := exprdata{true, tmp, tmp}
+			node.Key.Accept(c, &keyData)
+			valueData := exprdata{true, tmp + 1, tmp + 1}
+			node.Value.Accept(c, &valueData)
+			c.emitABC(OpSetIndex, reg, keyData.regb, valueData.regb, node.NodeInfo.Line)
+		}
+	})
+	c.block.register = register
+
+	if exprok && expr.propagate {
+		expr.regb = reg
+	}
+}
+
 func (c *compiler) VisitFunction(node *ast.Function, data interface{}) {
 	var reg int
 	expr, exprok := data.(*exprdata)
+	hoistedReg, hoisted := c.hoisted[node]
 	if exprok {
 		reg = expr.rega
+	} else if hoisted {
+		reg = hoistedReg
+		delete(c.hoisted, node)
 	} else {
 		reg = c.genRegister()
 	}
 	parent := c.block.bytecode
-	bytecode := newBytecode(parent.Source)
+	bytecode := newBytecode(c.filename)
+	bytecode.Line = node.NodeInfo.Line
+	if name, ok := node.Name.(*ast.Id); ok {
+		bytecode.Name = name.Value
+
+		// the function can refer to itself
+		if !hoisted {
+			c.declareLocalVar(name.Value, reg)
+		}
+	}
 
+	for fn := range frameLocalFuncs(node.Body) {
+		c.frameLocal[fn] = true
+	}
 	block := newCompilerBlock(bytecode, kBlockContextFunc, c.block)
+	block.frameLocal = c.frameLocal[node]
+	if sel, ok := node.Name.(*ast.Selector); ok {
+		if obj, ok := sel.Left.(*ast.Id); ok {
+			block.method = obj.Value
+		}
+	}
 	c.block = block
 
 	index := int(parent.NumFuncs)
@@ -704,15 +1463,47 @@ func (c *compiler) VisitFunction(node *ast.Function, data interface{}) {
 
 	// insert arguments into scope
 	for _, n := range node.Args {
+		var name string
 		switch arg := n.(type) {
 		case *ast.Id:
+			name = arg.Value
+		case *ast.KwArg:
+			name = arg.Key
+		case *ast.VarArg:
+			// the last one, after the named parameters
 			reg := c.genRegister()
-			c.block.addNameInfo(arg.Value, &nameInfo{false, nil, reg, kScopeLocal, c.block})
+			c.block.addNameInfo(arg.Arg.(*ast.Id).Value, &nameInfo{false, nil, reg, kScopeLocal, c.block})
+			bytecode.Variadic = true
+			continue
+		default:
+			continue
 		}
+		reg := c.genRegister()
+		c.block.addNameInfo(name, &nameInfo{false, nil, reg, kScopeLocal, c.block})
+		bytecode.Params = append(bytecode.Params, name)
+	}
+	for i, n := range node.Args {
+		if arg, ok := n.(*ast.KwArg); ok {
+			c.defaultArg(arg, i+1)
+		}
+	}
+
+	if !c.strip {
+		block.contract = contractName(node.Name)
+		for _, cond := range node.Requires {
+			c.check(cond, "precondition"+block.contract+" failed")
+		}
+		block.ensures = node.Ensures
 	}
 
+	depth := c.depth
+	c.depth = 0
 	node.Body.Accept(c, nil)
 	c.functionReturnGuard()
+	c.depth = depth
+	bytecode.countRegisters()
+	bytecode.Shareable = c.shareable(bytecode)
+	block.endLocals()
 
 	c.block = c.block.parent
 	c.emitABx(OpFunc, reg, index, node.NodeInfo.Line)
@@ -720,7 +1511,7 @@ func (c *compiler) VisitFunction(node *ast.Function, data interface{}) {
 	if node.Name != nil {
 		switch name := node.Name.(type) {
 		case *ast.Id:
-			c.declareLocalVar(name.Value, reg)
+			c.prepareInline(node, name.Value, c.block.names[name.Value])
 		default:
 			c.assignmentHelper(name, reg+1, reg)
 		}
@@ -730,6 +1521,19 @@ func (c *compiler) VisitFunction(node *ast.Function, data interface{}) {
 	}
 }
 
+// defaultArg emits the assignment of the default value of arg to it's
+// register reg, when the argument is nil because it was not given
+func (c *compiler) defaultArg(arg *ast.KwArg, reg int) {
+	line := arg.NodeInfo.Line
+	testReg := c.block.register
+	c.emitABC(OpIsType, testReg, reg, int(ValueNil), line)
+	jmpInstr := c.emitAsBx(OpJmpfalse, testReg, 0, line)
+	label := c.newLabel()
+	valueData := exprdata{false, reg, reg}
+	arg.Value.Accept(c, &valueData)
+	c.modifyAsBx(jmpInstr, OpJmpfalse, testReg, c.labelOffset(label))
+}
+
 func (c *compiler) VisitSelector(node *ast.Selector, data interface{}) {
 	var reg int
 	expr, exprok := data.(*exprdata)
@@ -742,10 +1546,12 @@ func (c *compiler) VisitSelector(node *ast.Selector, data interface{}) {
 	node.Left.Accept(c, &objData)
 	objReg := objData.regb
 
-	key := OpConstOffset + c.addConst(String(node.Value))
-	c.emitABC(OpGetIndex, reg, objReg, key, node.NodeInfo.Line)
+	// the object fields are looked up without checking the kind
+	// of the key, the other values are indexed like with OpGetIndex
+	key := c.addConst(String(node.Value))
+	c.emitABC(OpGetField, reg, objReg, key, node.NodeInfo.Line)
 	if exprok && expr.propagate {
-		expr.regb = objReg
+		expr.regb = reg
 	}
 }
 
@@ -757,17 +1563,30 @@ func (c *compiler) VisitSubscript(node *ast.Subscript, data interface{}) {
 	} else {
 		reg = c.genRegister()
 	}
+	if slice, ok := node.Right.(*ast.Slice); ok {
+		// the value is sliced in place
+		arrData := exprdata{false, reg, reg}
+		node.Left.Accept(c, &arrData)
+		start := c.sliceBound(slice.Start, reg+1)
+		end := c.sliceBound(slice.End, reg+2)
+		c.emitABC(OpSlice, reg, start, end, node.NodeInfo.Line)
+		if exprok && expr.propagate {
+			expr.regb = reg
+		}
+		return
+	}
+
 	arrData := exprdata{true, reg + 1, reg + 1}
 	node.Left.Accept(c, &arrData)
 	arrReg := arrData.regb
-
-	_, ok := node.Right.(*ast.Slice)
-	if ok {
-		// TODO: generate code for slice
-		return
+	if arrReg >= OpConstOffset {
+		// indexing a constant string, which must be in a register
+		c.emitABx(OpLoadconst, reg+1, arrReg-OpConstOffset, node.NodeInfo.Line)
+		arrReg = reg + 1
 	}
 
-	indexData := exprdata{true, reg + 1, reg + 1}
+	// don't overwrite the value if it's in reg+1
+	indexData := exprdata{true, reg + 2, reg + 2}
 	node.Right.Accept(c, &indexData)
 	indexReg := indexData.regb
 	c.emitABC(OpGetIndex, reg, arrReg, indexReg, node.NodeInfo.Line)
@@ -778,65 +1597,281 @@ func (c *compiler) VisitSubscript(node *ast.Subscript, data interface{}) {
 }
 
 func (c *compiler) VisitSlice(node *ast.Slice, data interface{}) {
+	c.assert(false, "slice outside of a subscript")
+}
 
+// sliceBound returns the RK of a bound of a slice, which is
+// generated in reg if it's not a constant or a local
+func (c *compiler) sliceBound(node ast.Node, reg int) int {
+	if node == nil {
+		// the start or the end
+		return OpConstOffset + c.addConst(Nil{})
+	}
+	data := exprdata{true, reg, reg}
+	node.Accept(c, &data)
+	return data.regb
 }
 
-func (c *compiler) VisitKwArg(node *ast.KwArg, data interface{}) {
+func (c *compiler) VisitRange(node *ast.Range, data interface{}) {
+	var reg int
+	expr, exprok := data.(*exprdata)
+	if exprok {
+		reg = expr.rega
+	} else {
+		reg = c.genRegister()
+	}
+
+	// the start is replaced by the range, the step is 1 by default
+	startData := exprdata{false, reg, reg}
+	node.Start.Accept(c, &startData)
+	endData := exprdata{true, reg + 1, reg + 1}
+	node.End.Accept(c, &endData)
+	step := OpConstOffset + c.addConst(Number(1))
+	if node.Step != nil {
+		stepData := exprdata{true, reg + 2, reg + 2}
+		node.Step.Accept(c, &stepData)
+		step = stepData.regb
+	}
+	c.emitABC(OpRange, reg, endData.regb, step, node.NodeInfo.Line)
 
+	if exprok && expr.propagate {
+		expr.regb = reg
+	}
 }
 
+// VisitKwArg compiles the value of a keyword argument of a call,
+// the names are recorded by call
+func (c *compiler) VisitKwArg(node *ast.KwArg, data interface{}) {
+	node.Value.Accept(c, data)
+}
+
+// VisitVarArg unpacks the elements of an array into the registers
+// rega ... regb, as the last value of an assignment or a declaration
 func (c *compiler) VisitVarArg(node *ast.VarArg, data interface{}) {
+	expr, exprok := data.(*exprdata)
+	c.assert(exprok, "VarArg exprok")
+	arrData := exprdata{true, expr.rega, expr.rega}
+	node.Arg.Accept(c, &arrData)
+	arrReg := arrData.regb
+	if arrReg >= OpConstOffset {
+		c.emitABx(OpLoadconst, expr.rega, arrReg-OpConstOffset, node.NodeInfo.Line)
+		arrReg = expr.rega
+	}
+	count := expr.regb - expr.rega + 1
+	if count < 1 {
+		count = 1
+	}
+	c.emitABC(OpUnpack, expr.rega, count, arrReg, node.NodeInfo.Line)
+	if expr.propagate {
+		expr.regb = expr.rega
+	}
+}
 
+// VisitObjectUnpack gets the fields of an object into the registers
+// rega ... regb, as the value of '{a, b} := obj'
+func (c *compiler) VisitObjectUnpack(node *ast.ObjectUnpack, data interface{}) {
+	expr, exprok := data.(*exprdata)
+	c.assert(exprok, "ObjectUnpack exprok")
+	objData := exprdata{true, expr.rega, expr.rega}
+	node.Value.Accept(c, &objData)
+	objReg := objData.regb
+	if objReg >= OpConstOffset {
+		c.emitABx(OpLoadconst, expr.rega, objReg-OpConstOffset, node.NodeInfo.Line)
+		objReg = expr.rega
+	}
+	count := expr.regb - expr.rega + 1
+	if count > len(node.Keys) {
+		count = len(node.Keys)
+	}
+	// from the last one, the object may be in rega
+	for i := count - 1; i >= 0; i-- {
+		key := c.addConst(String(node.Keys[i]))
+		c.emitABC(OpGetField, expr.rega+i, objReg, key, node.NodeInfo.Line)
+	}
+	if expr.propagate {
+		expr.regb = expr.rega
+	}
 }
 
 func (c *compiler) VisitCallExpr(node *ast.CallExpr, data interface{}) {
-	var startReg, endReg, resultCount int
+	var startReg, resultCount int
 	expr, exprok := data.(*exprdata)
+	if !exprok || expr.regb <= expr.rega {
+		// the inlined expressions have only one result
+		if in := c.inlineCall(node); in != nil {
+			c.inline(in, data)
+			return
+		}
+	}
 	if exprok {
-		startReg, endReg = expr.rega, expr.regb
-		resultCount = endReg - startReg + 1
+		startReg, resultCount = expr.rega, expr.regb-expr.rega+1
+		if resultCount < 1 {
+			// inside another expression, only one result is needed
+			resultCount = 1
+		}
 	} else {
 		startReg = c.genRegister()
-		endReg = startReg
 		resultCount = 1
 	}
 
-	// check if it's a type conversion (string, number, bool)
-	v, ok := c.constFold(node)
-	if ok {
-		c.emitABx(OpLoadconst, startReg, c.addConst(v), node.NodeInfo.Line)
+	if c.isAssert(node) && (c.strip || len(node.Args) > 0) {
+		if !c.strip {
+			c.check(node.Args[0], "assertion failed", node.Args[1:]...)
+		}
+		if exprok {
+			c.emitLoadnil(startReg, startReg+resultCount-1, node.NodeInfo.Line)
+			if expr.propagate {
+				expr.regb = startReg
+			}
+		}
 		return
 	}
 
+	c.call(node, startReg, resultCount)
+	if exprok && expr.propagate {
+		expr.regb = startReg
+	}
+}
+
+// isAssert returns whether node calls the native assert, which is
+// compiled as a check (see check) or removed with
+// CompileOptions.StripAssertions
+func (c *compiler) isAssert(node *ast.CallExpr) bool {
+	id, ok := node.Left.(*ast.Id)
+	if !ok || id.Value != "assert" {
+		return false
+	}
+	_, declared := c.block.nameInfo(id.Value)
+	return !declared
+}
+
+// call emits the call of node with the function at reg and the
+// results stored from reg. With no results, the call stores an
+// array of all of them at reg.
+func (c *compiler) call(node *ast.CallExpr, startReg, resultCount int) {
+	endReg := startReg + resultCount - 1
+	if resultCount == 0 {
+		endReg = startReg
+	}
+
 	argCount := len(node.Args)
 	var op Opcode
-	switch node.Left.(type) {
+	switch left := node.Left.(type) {
 	case *ast.Selector:
 		op = OpCallmethod
-		callerData := exprdata{true, startReg, startReg}
-		node.Left.Accept(c, &callerData)
-		objReg := callerData.regb
+		// the object is both where the method comes from and the receiver
+		objData := exprdata{true, startReg + 1, startReg + 1}
+		left.Left.Accept(c, &objData)
+		objReg := objData.regb
+		key := c.addConst(String(left.Value))
+		c.emitABC(OpGetField, startReg, objReg, key, left.NodeInfo.Line)
 
-		// insert object as first argument
+		// insert object as first argument, the methods of
+		// the parent are called on 'this'
 		endReg += 1
 		argCount += 1
-		c.emitAB(OpMove, endReg, objReg, node.NodeInfo.Line)
+		if id, ok := left.Left.(*ast.Id); ok && id.Value == "super" && c.super(id) != id {
+			thisData := exprdata{false, endReg, endReg}
+			c.VisitId(&ast.Id{Value: "this", NodeInfo: id.NodeInfo}, &thisData)
+		} else {
+			c.emitAB(OpMove, endReg, objReg, node.NodeInfo.Line)
+		}
 	default:
 		op = OpCall
 		callerData := exprdata{false, startReg, startReg}
 		node.Left.Accept(c, &callerData)
 	}
 
+	// the keyword arguments come after the positional ones,
+	// their names are matched against the parameters by the VM
+	var keywords []string
 	for i, arg := range node.Args {
 		reg := endReg + i + 1
 		argData := exprdata{false, reg, reg}
 		arg.Accept(c, &argData)
+		if kw, ok := arg.(*ast.KwArg); ok {
+			keywords = append(keywords, kw.Key)
+		}
 	}
 
-	c.emitABC(op, startReg, resultCount, argCount, node.NodeInfo.Line)
+	instr := c.emitABC(op, startReg, resultCount, argCount, node.NodeInfo.Line)
+	if len(keywords) > 0 {
+		f := c.block.bytecode
+		f.Keywords = append(f.Keywords, KeywordInfo{Instr: uint32(instr), Names: keywords})
+	}
+}
+
+// templateCall returns the call to the tag of a tagged template,
+// tag(parts, values)
+func templateCall(node *ast.Template) *ast.CallExpr {
+	parts := &ast.Array{NodeInfo: node.NodeInfo}
+	for _, part := range node.Parts {
+		parts.Elements = append(parts.Elements, &ast.String{Value: part, NodeInfo: node.NodeInfo})
+	}
+	values := &ast.Array{Elements: node.Exprs, NodeInfo: node.NodeInfo}
+	return &ast.CallExpr{Left: node.Tag, Args: []ast.Node{parts, values}, NodeInfo: node.NodeInfo}
+}
+
+func (c *compiler) VisitTemplate(node *ast.Template, data interface{}) {
+	if node.Tag != nil {
+		c.VisitCallExpr(templateCall(node), data)
+		return
+	}
+	if value, ok := c.constFold(node); ok {
+		c.VisitString(&ast.String{Value: value.String(), NodeInfo: node.NodeInfo}, data)
+		return
+	}
+
+	var reg int
+	expr, exprok := data.(*exprdata)
+	if exprok {
+		reg = expr.rega
+	} else {
+		reg = c.genRegister()
+	}
+
+	// the text and the values go above reg, the constant
+	// expressions are folded into the text around them
+	line := node.NodeInfo.Line
+	n := 0
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			n++
+			c.emitABx(OpLoadconst, reg+n, c.addConst(String(text.String())), line)
+			text.Reset()
+		}
+	}
+	for i, part := range node.Parts {
+		text.WriteString(part)
+		if i == len(node.Exprs) {
+			break
+		}
+		if value, ok := c.constFold(node.Exprs[i]); ok {
+			text.WriteString(value.String())
+			continue
+		}
+		flush()
+		n++
+		exprdata := exprdata{false, reg + n, reg + n}
+		node.Exprs[i].Accept(c, &exprdata)
+	}
+	flush()
+	c.emitABC(OpConcat, reg, reg+1, reg+n, line)
+	if exprok && expr.propagate {
+		expr.regb = reg
+	}
 }
 
 func (c *compiler) VisitPostfixExpr(node *ast.PostfixExpr, data interface{}) {
+	c.incDec(node.Left, node.Op, true, node.NodeInfo.Line, data)
+}
+
+// incDec compiles x++ and x-- (postfix) or ++x and --x, as an expression
+// the value is the one before the change for postfix and after it for
+// prefix. Locals are changed in place, anything else is stored back
+// like in 'x += 1'.
+func (c *compiler) incDec(target ast.Node, tok ast.Token, postfix bool, line int, data interface{}) {
 	var reg int
 	expr, exprok := data.(*exprdata)
 	if exprok {
@@ -844,26 +1879,49 @@ func (c *compiler) VisitPostfixExpr(node *ast.PostfixExpr, data interface{}) {
 	} else {
 		reg = c.genRegister()
 	}
-	var op Opcode
-	switch node.Op {
-	case ast.TokenPlusplus:
-		op = OpAdd
-	case ast.TokenMinusminus:
+	op := OpAdd
+	if tok == ast.TokenMinusminus {
 		op = OpSub
 	}
-	leftdata := exprdata{true, reg, reg}
-	node.Left.Accept(c, &leftdata)
-	left := leftdata.regb
 	one := OpConstOffset + c.addConst(Number(1))
 
-	// don't bother moving if we're not in an expression
-	if exprok {
-		c.emitAB(OpMove, reg, left, node.NodeInfo.Line)
+	if id, ok := target.(*ast.Id); ok {
+		if info, ok := c.block.nameInfo(id.Value); ok && c.nameScope(info) == kScopeLocal {
+			// don't bother moving if we're not in an expression
+			if exprok && postfix {
+				c.emitAB(OpMove, reg, info.reg, line)
+			}
+			c.emitABC(op, info.reg, info.reg, one, line)
+			if exprok && !postfix {
+				c.emitAB(OpMove, reg, info.reg, line)
+			}
+			return
+		}
 	}
-	c.emitABC(op, left, left, one, node.NodeInfo.Line)
+
+	valueData := exprdata{false, reg, reg}
+	target.Accept(c, &valueData)
+	if !postfix {
+		c.emitABC(op, reg, reg, one, line)
+		c.assignmentHelper(target, reg+1, reg)
+		return
+	}
+
+	// the old value stays in reg
+	changed := reg + 1
+	if c.block.register > changed {
+		changed = c.block.register
+	}
+	c.emitABC(op, changed, reg, one, line)
+	c.assignmentHelper(target, changed+1, changed)
 }
 
 func (c *compiler) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
+	if ast.IsPostfixOp(node.Op) {
+		// prefix ++ and --
+		c.incDec(node.Right, node.Op, false, node.NodeInfo.Line, data)
+		return
+	}
 	var reg int
 	expr, exprok := data.(*exprdata)
 	if exprok {
@@ -878,20 +1936,6 @@ func (c *compiler) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
 			return
 		}
 		c.emitABx(OpLoadconst, reg, c.addConst(value), node.NodeInfo.Line)
-	} else if ast.IsPostfixOp(node.Op) {
-		op := OpAdd
-		if node.Op == ast.TokenMinusminus {
-			op = OpSub
-		}
-		exprdata := exprdata{true, reg, reg}
-		node.Right.Accept(c, &exprdata)
-		one := OpConstOffset + c.addConst(Number(1))
-		c.emitABC(op, exprdata.regb, exprdata.regb, one, node.NodeInfo.Line)
-
-		// don't bother moving if we're not in an expression
-		if exprok {
-			c.emitAB(OpMove, reg, exprdata.regb, node.NodeInfo.Line)
-		}
 	} else {
 		var op Opcode
 		switch node.Op {
@@ -901,6 +1945,8 @@ func (c *compiler) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
 			op = OpNot
 		case ast.TokenTilde:
 			op = OpCmpl
+		case ast.TokenHash:
+			op = OpLen
 		}
 		exprdata := exprdata{true, reg, reg}
 		node.Right.Accept(c, &exprdata)
@@ -911,7 +1957,27 @@ func (c *compiler) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
 	}
 }
 
+// whether both operands of node are known to be numbers
+func (c *compiler) isNumeric(node *ast.BinaryExpr) bool {
+	if c.numeric[node] {
+		return true
+	}
+	left, ok := c.constFold(node.Left)
+	if !ok || left.Type() != ValueNumber {
+		return false
+	}
+	right, ok := c.constFold(node.Right)
+	return ok && right.Type() == ValueNumber
+}
+
 func (c *compiler) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
+	if node.Op == ast.TokenAmpamp || node.Op == ast.TokenPipepipe {
+		if left, ok := c.constFold(node.Left); ok && !decidesLogic(node.Op, left) {
+			// the result is the right value
+			node.Right.Accept(c, data)
+			return
+		}
+	}
 	var reg int
 	expr, exprok := data.(*exprdata)
 	if exprok {
@@ -934,15 +2000,28 @@ func (c *compiler) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
 			} else {
 				op = OpJmptrue
 			}
-			exprdata := exprdata{expr.propagate, reg, reg}
-			node.Left.Accept(c, &exprdata)
-			left := exprdata.regb
+			// the result is the left value if it decides the
+			// result, the right one otherwise, both go to reg
+			leftData := exprdata{false, reg, reg}
+			node.Left.Accept(c, &leftData)
 
-			jmpInstr := c.emitAsBx(op, left, 0, node.NodeInfo.Line)
+			jmpInstr := c.emitAsBx(op, reg, 0, node.NodeInfo.Line)
 			rightLabel := c.newLabel()
 
-			node.Right.Accept(c, &exprdata)
-			c.modifyAsBx(jmpInstr, op, left, c.labelOffset(rightLabel))
+			rightData := exprdata{false, reg, reg}
+			node.Right.Accept(c, &rightData)
+			c.modifyAsBx(jmpInstr, op, reg, c.labelOffset(rightLabel))
+			if exprok && expr.propagate {
+				expr.regb = reg
+			}
+			return
+		}
+
+		if node.Op == ast.TokenIs {
+			c.isExpr(node, reg)
+			if exprok && expr.propagate {
+				expr.regb = reg
+			}
 			return
 		}
 
@@ -968,14 +2047,19 @@ func (c *compiler) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
 			op = OpOr
 		case ast.TokenTilde:
 			op = OpXor
-		case ast.TokenLt, ast.TokenGteq:
+		case ast.TokenLt, ast.TokenGt:
 			op = OpLt
-		case ast.TokenLteq, ast.TokenGt:
+		case ast.TokenLteq, ast.TokenGteq:
 			op = OpLe
-		case ast.TokenEq:
+		case ast.TokenEqeq:
 			op = OpEq
 		case ast.TokenBangeq:
 			op = OpNe
+		case ast.TokenIn:
+			op = OpIn
+		}
+		if nop, ok := numberOps[op]; ok && c.isNumeric(node) {
+			op = nop
 		}
 
 		exprdata := exprdata{true, reg, 0}
@@ -983,7 +2067,7 @@ func (c *compiler) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
 		left := exprdata.regb
 
 		// temp register for right expression
-		exprdata.rega += 1
+		exprdata.rega, exprdata.regb = reg+1, 0
 		node.Right.Accept(c, &exprdata)
 		right := exprdata.regb
 
@@ -999,7 +2083,35 @@ func (c *compiler) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
 	}
 }
 
+// 'is' tests the type of a value or it's parent chain
+func (c *compiler) isExpr(node *ast.BinaryExpr, reg int) {
+	exprdata := exprdata{true, reg, 0}
+	node.Left.Accept(c, &exprdata)
+	c.isTest(exprdata.regb, node.Right, reg, node.NodeInfo.Line)
+}
+
+// isTest emits R(reg) = RK(left) is right, where right is
+// a type name or a prototype
+func (c *compiler) isTest(left int, right ast.Node, reg int, line int) {
+	typ, isType := testedType(right)
+	switch {
+	case isType && typ == typeAny:
+		c.emitABx(OpLoadconst, reg, c.addConst(Bool(true)), line)
+	case isType:
+		c.emitABC(OpIsType, reg, left, int(typ), line)
+	default:
+		exprdata := exprdata{true, reg + 1, 0}
+		right.Accept(c, &exprdata)
+		c.emitABC(OpIsProto, reg, left, exprdata.regb, line)
+	}
+}
+
 func (c *compiler) VisitTernaryExpr(node *ast.TernaryExpr, data interface{}) {
+	if cond, ok := c.constFold(node.Cond); ok {
+		// only the branch taken is compiled
+		takenBranch(node, cond).Accept(c, data)
+		return
+	}
 	var reg int
 	expr, exprok := data.(*exprdata)
 	if exprok {
@@ -1007,7 +2119,13 @@ func (c *compiler) VisitTernaryExpr(node *ast.TernaryExpr, data interface{}) {
 	} else {
 		reg = c.genRegister()
 	}
-	c.branchConditionHelper(node.Cond, node.Then, node.Else, reg)
+	if sameExpr(node.Then, node.Else) {
+		c.warning(node.NodeInfo.Line, "both branches of the ternary are the same")
+	}
+	c.branchConditionHelper(node.Cond, node.Then, node.Else, reg, true)
+	if exprok && expr.propagate {
+		expr.regb = reg
+	}
 }
 
 func (c *compiler) VisitDeclaration(node *ast.Declaration, data interface{}) {
@@ -1016,20 +2134,20 @@ func (c *compiler) VisitDeclaration(node *ast.Declaration, data interface{}) {
 		for i, id := range node.Left {
 			_, ok := c.block.names[id.Value]
 			if ok {
-				c.error(node.NodeInfo.Line, fmt.Sprintf("cannot redeclare '%s'", id.Value))
+				c.error(node.NodeInfo.Line, ErrRedeclared, fmt.Sprintf("cannot redeclare '%s'", id.Value))
 			}
 			if i >= valueCount {
-				c.error(node.NodeInfo.Line, fmt.Sprintf("const '%s' without initializer", id.Value))
+				c.error(node.NodeInfo.Line, ErrConstInit, fmt.Sprintf("const '%s' without initializer", id.Value))
 			}
 			value, ok := c.constFold(node.Right[i])
 			if !ok {
-				c.error(node.NodeInfo.Line, fmt.Sprintf("const '%s' initializer is not a constant", id.Value))
+				c.error(node.NodeInfo.Line, ErrConstInit, fmt.Sprintf("const '%s' initializer is not a constant", id.Value))
 			}
 			c.block.addNameInfo(id.Value, &nameInfo{true, value, 0, kScopeLocal, c.block})
 		}
 		return
 	}
-	c.declare(node.Left, node.Right)
+	c.declare(node.Left, node.Right, c.following(node))
 }
 
 func (c *compiler) VisitAssignment(node *ast.Assignment, data interface{}) {
@@ -1039,7 +2157,7 @@ func (c *compiler) VisitAssignment(node *ast.Assignment, data interface{}) {
 		for _, id := range node.Left {
 			names = append(names, id.(*ast.Id))
 		}
-		c.declare(names, node.Right)
+		c.declare(names, node.Right, c.following(node))
 		return
 	} else if node.Op != ast.TokenEq {
 		// compound assignment
@@ -1054,22 +2172,24 @@ func (c *compiler) VisitAssignment(node *ast.Assignment, data interface{}) {
 	// then it has to be declared already
 	varCount, valueCount := len(node.Left), len(node.Right)
 	_, isCall := node.Right[valueCount-1].(*ast.CallExpr)
-	_, isUnpack := node.Right[valueCount-1].(*ast.VarArg)
+	isUnpack := unpacks(node.Right[valueCount-1])
 	start := c.block.register
 	current := start
 	end := start + varCount - 1
 
-	// evaluate all expressions first with temp registers
+	// evaluate all expressions first with temp registers,
+	// current is the first register above the values
 	for i, _ := range node.Left {
 		reg := start + i
 		exprdata := exprdata{false, reg, reg}
 		if i == valueCount-1 && (isCall || isUnpack) {
-			exprdata.regb, current = end, end
+			exprdata.regb, current = end, end+1
 			node.Right[i].Accept(c, &exprdata)
 			break
 		}
 		if i < valueCount {
 			node.Right[i].Accept(c, &exprdata)
+			c.nameFunc(node.Right[i], node.Left[i])
 			current = reg + 1
 		}
 	}
@@ -1078,23 +2198,25 @@ func (c *compiler) VisitAssignment(node *ast.Assignment, data interface{}) {
 		valueReg := start + i
 
 		// don't touch variables without a corresponding value
-		if valueReg > current {
+		if valueReg >= current {
 			break
 		}
-		c.assignmentHelper(variable, current+1, valueReg)
+		c.assignmentHelper(variable, current, valueReg)
 	}
 }
 
 func (c *compiler) VisitBranchStmt(node *ast.BranchStmt, data interface{}) {
-	if !c.insideLoop() {
-		c.error(node.NodeInfo.Line, fmt.Sprintf("%s outside loop", node.Type))
+	loop := c.enclosingLoop()
+	if loop == nil {
+		c.error(node.NodeInfo.Line, ErrOutsideLoop, fmt.Sprintf("%s outside loop", node.Type))
 	}
+	c.endWiths(kBlockContextLoop, node.NodeInfo.Line)
 	instr := c.emitAsBx(OpJmp, 0, 0, node.NodeInfo.Line)
 	switch node.Type {
 	case ast.TokenContinue:
-		c.block.loop.continues = append(c.block.loop.continues, uint32(instr))
+		loop.continues = append(loop.continues, uint32(instr))
 	case ast.TokenBreak:
-		c.block.loop.breaks = append(c.block.loop.breaks, uint32(instr))
+		loop.breaks = append(loop.breaks, uint32(instr))
 	}
 }
 
@@ -1105,40 +2227,76 @@ func (c *compiler) VisitReturnStmt(node *ast.ReturnStmt, data interface{}) {
 		data := exprdata{false, reg, reg}
 		v.Accept(c, &data)
 	}
+	if fn := c.block.funcBlock(); fn.ensures != nil {
+		c.ensures(fn, start, len(node.Values), node.NodeInfo.Line)
+	}
+	c.endWiths(kBlockContextFunc, node.NodeInfo.Line)
 	c.emitAB(OpReturn, start, len(node.Values), node.NodeInfo.Line)
 }
 
 func (c *compiler) VisitPanicStmt(node *ast.PanicStmt, data interface{}) {
-
+	reg := c.genRegister()
+	errData := exprdata{false, reg, reg}
+	node.Err.Accept(c, &errData)
+	c.emitAB(OpPanic, reg, 0, node.NodeInfo.Line)
 }
 
 func (c *compiler) VisitIfStmt(node *ast.IfStmt, data interface{}) {
-	_, ok := data.(*exprdata)
-	if !ok {
-		c.enterBlock(kBlockContextBranch)
-		defer c.leaveBlock()
+	c.enterBlock(kBlockContextBranch)
+	defer c.leaveBlock()
+
+	// used as an expression, the value goes to R(A)
+	expr, exprok := data.(*exprdata)
+	if exprok {
+		c.reserveRegister(expr.rega)
 	}
 	if node.Init != nil {
 		node.Init.Accept(c, nil)
 	}
-	c.branchConditionHelper(node.Cond, node.Body, node.Else, c.block.register)
+	c.checkConstCondition(node.Cond, "if condition")
+	if exprok {
+		c.branchConditionHelper(node.Cond, node.Body, node.Else, expr.rega, true)
+		if expr.propagate {
+			expr.regb = expr.rega
+		}
+	} else {
+		c.branchConditionHelper(node.Cond, node.Body, node.Else, c.block.register, false)
+	}
+}
+
+// reserveRegister keeps the registers allocated in the current block
+// from overwriting reg, the target of an expression
+func (c *compiler) reserveRegister(reg int) {
+	if c.block.register <= reg {
+		c.block.register = reg + 1
+	}
 }
 
 func (c *compiler) VisitForIteratorStmt(node *ast.ForIteratorStmt, data interface{}) {
+	c.forIterator(node, func() {
+		node.Body.Accept(c, nil)
+	})
+}
+
+// forIterator compiles the loop of node, with body emitting the
+// code of each iteration
+func (c *compiler) forIterator(node *ast.ForIteratorStmt, body func()) {
 	c.enterBlock(kBlockContextLoop)
 	defer c.leaveBlock()
 
+	// the array, keys or iterator, followed by the length and
+	// the index, see OpForbegin
 	arrReg := c.genRegister()
-	lenReg := c.genRegister()
+	c.genRegister()
+	c.genRegister()
 	keyReg := c.genRegister()
-	idxReg := c.genRegister()
 	valReg := c.genRegister()
+	doneReg := c.genRegister()
 	colReg := c.genRegister()
 
 	collectionData := exprdata{false, colReg, colReg}
 	node.Collection.Accept(c, &collectionData)
 	c.emitAB(OpForbegin, arrReg, colReg, node.NodeInfo.Line)
-	c.emitABx(OpLoadconst, idxReg, c.addConst(Number(0)), c.lastLine)
 
 	if node.Value == nil {
 		c.declareLocalVar(node.Key.Value, valReg)
@@ -1148,20 +2306,30 @@ func (c *compiler) VisitForIteratorStmt(node *ast.ForIteratorStmt, data interfac
 	}
 
 	testLabel := c.newLabel()
-	testReg := c.block.register
-	c.emitABC(OpLt, testReg, idxReg, lenReg, c.lastLine)
-	jmpInstr := c.emitAsBx(OpJmpfalse, testReg, 0, c.lastLine)
-
 	c.emitABC(OpForiter, keyReg, colReg, arrReg, node.NodeInfo.Line)
-	c.emitABC(OpGetIndex, valReg, colReg, keyReg, c.lastLine)
+	jmpInstr := c.emitAsBx(OpJmptrue, doneReg, 0, c.lastLine)
 
-	node.Body.Accept(c, nil)
+	if node.When == nil {
+		body()
+	} else {
+		testReg := c.block.register
+		whenData := exprdata{true, testReg, testReg}
+		node.When.Accept(c, &whenData)
+		whenReg := whenData.regb
+		whenInstr := c.emitAsBx(OpJmpfalse, whenReg, 0, c.lastLine)
+		body()
+		c.modifyAsBx(whenInstr, OpJmpfalse, whenReg, c.labelOffset(uint32(whenInstr)+1))
+	}
 	c.block.loop.continueTarget = c.newLabel()
+	if c.block.loop.closes {
+		// each iteration has it's own variables
+		c.emitAB(OpClose, keyReg, 0, c.lastLine)
+	}
 
 	c.emitAsBx(OpJmp, 0, -c.labelOffset(testLabel)-1, c.lastLine)
 	c.block.loop.breakTarget = c.newLabel()
 
-	c.modifyAsBx(jmpInstr, OpJmpfalse, testReg, c.labelOffset(uint32(jmpInstr)+1))
+	c.modifyAsBx(jmpInstr, OpJmptrue, doneReg, c.labelOffset(uint32(jmpInstr)+1))
 }
 
 func (c *compiler) VisitForStmt(node *ast.ForStmt, data interface{}) {
@@ -1169,6 +2337,7 @@ func (c *compiler) VisitForStmt(node *ast.ForStmt, data interface{}) {
 	defer c.leaveBlock()
 
 	hasCond := node.Cond != nil
+	initReg := c.block.register
 	if node.Init != nil {
 		node.Init.Accept(c, nil)
 	}
@@ -1178,6 +2347,7 @@ func (c *compiler) VisitForStmt(node *ast.ForStmt, data interface{}) {
 	var cond, jmpInstr int
 	var jmpLabel uint32
 	if hasCond {
+		c.checkConstCondition(node.Cond, "loop condition")
 		reg := c.block.register
 		condData := exprdata{true, reg, reg}
 		node.Cond.Accept(c, &condData)
@@ -1189,15 +2359,28 @@ func (c *compiler) VisitForStmt(node *ast.ForStmt, data interface{}) {
 
 	node.Body.Accept(c, nil)
 	c.block.loop.continueTarget = c.newLabel()
+	if c.block.loop.closes {
+		// each iteration has it's own variables, the ones in Init
+		// start the next iteration with the value they have now
+		c.emitAB(OpClose, initReg, 0, c.lastLine)
+	}
 
-	if node.Step != nil {
-		node.Step.Accept(c, nil)
-		c.block.register -= 1 // discard register consumed by Step
+	if counter, limit, ok := c.numericLoop(node); ok && hasCond && int(c.block.bytecode.NumCode+1-jmpLabel) <= kArgBCMask {
+		// the step and the condition in one instruction, the
+		// condition before the body is only checked on entry
+		c.emitABC(OpForloop, counter, limit, int(c.block.bytecode.NumCode+1-jmpLabel), c.lastLine)
 	} else {
-		c.block.loop.continueTarget = startLabel // saves one jump
-	}
+		if node.Step != nil {
+			node.Step.Accept(c, nil)
+			c.block.register -= 1 // discard register consumed by Step
+		} else if !c.block.loop.closes {
+			// saves one jump, but a continue can't skip the close
+			c.block.loop.continueTarget = startLabel
+		}
 
-	c.emitAsBx(OpJmp, 0, -c.labelOffset(startLabel)-1, c.lastLine)
+		// on the line of the loop, which an empty body doesn't set
+		c.emitAsBx(OpJmp, 0, -c.labelOffset(startLabel)-1, node.NodeInfo.Line)
+	}
 
 	if hasCond {
 		c.modifyAsBx(jmpInstr, OpJmpfalse, cond, c.labelOffset(jmpLabel))
@@ -1205,22 +2388,532 @@ func (c *compiler) VisitForStmt(node *ast.ForStmt, data interface{}) {
 	c.block.loop.breakTarget = c.newLabel()
 }
 
-func (c *compiler) VisitRecoverBlock(node *ast.RecoverBlock, data interface{}) {
+// numericLoop returns the register of the counter and the RK of the
+// limit of a loop like for i := 0; i < n; i++, where i is declared by
+// Init and n is a local or a constant
+func (c *compiler) numericLoop(node *ast.ForStmt) (counter, limit int, ok bool) {
+	cond, ok := node.Cond.(*ast.BinaryExpr)
+	if !ok || cond.Op != ast.TokenLt {
+		return 0, 0, false
+	}
+	step, ok := node.Step.(*ast.PostfixExpr)
+	if !ok || step.Op != ast.TokenPlusplus {
+		return 0, 0, false
+	}
+	i, ok := cond.Left.(*ast.Id)
+	if id, isId := step.Left.(*ast.Id); !ok || !isId || id.Value != i.Value {
+		return 0, 0, false
+	}
+	info, ok := c.block.nameInfo(i.Value)
+	if !ok || info.isConst || info.block != c.block || c.nameScope(info) != kScopeLocal {
+		return 0, 0, false
+	}
+
+	if value, ok := c.constFold(cond.Right); ok {
+		if value.Type() != ValueNumber {
+			return 0, 0, false
+		}
+		limit = OpConstOffset + c.addConst(value)
+	} else if n, isId := cond.Right.(*ast.Id); isId {
+		ninfo, ok := c.block.nameInfo(n.Value)
+		if !ok || c.nameScope(ninfo) != kScopeLocal || ninfo == info {
+			return 0, 0, false
+		}
+		limit = ninfo.reg
+	} else {
+		return 0, 0, false
+	}
+	if limit > kArgBCMask {
+		return 0, 0, false
+	}
+	return info.reg, limit, true
+}
+
+// patterns are compiled by VisitMatchStmt
+func (c *compiler) VisitArrayPattern(node *ast.ArrayPattern, data interface{}) {
+	c.assert(false, "pattern outside of a match")
+}
+
+func (c *compiler) VisitObjectPattern(node *ast.ObjectPattern, data interface{}) {
+	c.assert(false, "pattern outside of a match")
+}
+
+func (c *compiler) VisitMatchStmt(node *ast.MatchStmt, data interface{}) {
+	c.enterBlock(kBlockContextBranch)
+	defer c.leaveBlock()
+
+	// used as an expression, the value of the case
+	// taken goes to R(A), nil if there's none
+	expr, exprok := data.(*exprdata)
+	body := func(node ast.Node) {
+		if exprok {
+			node.Accept(c, &exprdata{false, expr.rega, expr.rega})
+		} else {
+			node.Accept(c, nil)
+		}
+	}
+	if exprok {
+		c.reserveRegister(expr.rega)
+		if expr.propagate {
+			expr.regb = expr.rega
+		}
+	}
+
+	c.checkMatchCases(node)
+
+	valueReg := c.genRegister()
+	valueData := exprdata{node.Name == nil, valueReg, valueReg}
+	node.Value.Accept(c, &valueData)
+	value := valueData.regb
+	if node.Name != nil {
+		// bound to the value in all the cases of a type switch
+		value = valueReg
+		c.declareLocalVar(node.Name.Value, valueReg)
+	}
+	testReg := c.genRegister()
+
+	// the else case runs only if no other case matches,
+	// regardless of it's position
+	var elseCase *ast.MatchCase
+	var exits []int
+	for _, mc := range node.Cases {
+		if len(mc.Values) == 0 {
+			elseCase = mc
+			continue
+		}
+		if isPattern(mc.Values[0]) {
+			exits = append(exits, c.patternCase(mc, value, testReg, body))
+			continue
+		}
+
+		var matches []int
+		for _, v := range mc.Values {
+			if node.IsType {
+				c.isTest(value, v, testReg, mc.NodeInfo.Line)
+			} else {
+				caseData := exprdata{true, testReg, testReg}
+				v.Accept(c, &caseData)
+				c.emitABC(OpEq, testReg, value, caseData.regb, mc.NodeInfo.Line)
+			}
+			matches = append(matches, c.emitAsBx(OpJmptrue, testReg, 0, mc.NodeInfo.Line))
+		}
+		nextInstr := c.emitAsBx(OpJmp, 0, 0, c.lastLine)
+
+		bodyLabel := c.newLabel()
+		for _, index := range matches {
+			c.modifyAsBx(index, OpJmptrue, testReg, int(bodyLabel)-index-1)
+		}
+		c.enterBlock(kBlockContextBranch)
+		body(mc.Body)
+		c.leaveBlock()
+		exits = append(exits, c.emitAsBx(OpJmp, 0, 0, c.lastLine))
+
+		c.modifyAsBx(nextInstr, OpJmp, 0, int(c.newLabel())-nextInstr-1)
+	}
+
+	if elseCase != nil {
+		c.enterBlock(kBlockContextBranch)
+		body(elseCase.Body)
+		c.leaveBlock()
+	} else if exprok {
+		c.emitAB(OpLoadnil, expr.rega, expr.rega, c.lastLine)
+	}
+
+	endLabel := c.newLabel()
+	for _, index := range exits {
+		c.modifyAsBx(index, OpJmp, 0, int(endLabel)-index-1)
+	}
+}
+
+func isPattern(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.ArrayPattern, *ast.ObjectPattern:
+		return true
+	}
+	return false
+}
+
+// patternCase compiles a case of a match whose value is a pattern,
+// the names it binds are locals of a block around the body. Returns
+// the index of the jump to the end of the match.
+func (c *compiler) patternCase(mc *ast.MatchCase, value, testReg int, body func(ast.Node)) int {
+	c.enterBlock(kBlockContextBranch)
+	pattern := mc.Values[0]
+	regs := make(map[string]int)
+	for _, id := range patternNames(pattern) {
+		if _, ok := regs[id.Value]; ok {
+			c.error(id.NodeInfo.Line, ErrRedeclared, fmt.Sprintf("cannot redeclare '%s'", id.Value))
+		}
+		regs[id.Value] = c.genRegister()
+		c.declareLocalVar(id.Value, regs[id.Value])
+	}
+
+	temps := c.block.register
+	if value >= OpConstOffset {
+		// the parts of the value are loaded from a register
+		reg := c.genRegister()
+		c.emitABx(OpLoadconst, reg, value-OpConstOffset, mc.NodeInfo.Line)
+		value = reg
+	}
+	var fails []int
+	c.matchPattern(pattern, value, testReg, regs, &fails)
+	c.block.register = temps
+
+	body(mc.Body)
+	c.leaveBlock()
+	exit := c.emitAsBx(OpJmp, 0, 0, c.lastLine)
+
+	nextLabel := c.newLabel()
+	for _, index := range fails {
+		c.modifyAsBx(index, OpJmpfalse, testReg, int(nextLabel)-index-1)
+	}
+	return exit
+}
+
+// matchPattern emits the tests of the pattern node against R(value)
+// and the loads of the names it binds to their registers in regs,
+// each failed test jumps to the next case from one of fails
+func (c *compiler) matchPattern(node ast.Node, value, testReg int, regs map[string]int, fails *[]int) {
+	line := ast.Line(node)
+	test := func() {
+		*fails = append(*fails, c.emitAsBx(OpJmpfalse, testReg, 0, line))
+	}
+	// the part of the value at key matches the pattern part
+	matchPart := func(key int, part ast.Node) {
+		if id, ok := part.(*ast.Id); ok {
+			if id.Value != "_" {
+				c.emitABC(OpGetIndex, regs[id.Value], value, key, line)
+			}
+			return
+		}
+		reg := c.genRegister()
+		c.emitABC(OpGetIndex, reg, value, key, line)
+		c.matchPattern(part, reg, testReg, regs, fails)
+	}
+
+	switch t := node.(type) {
+	case *ast.ArrayPattern:
+		c.emitABC(OpIsType, testReg, value, int(ValueArray), line)
+		test()
+		count := OpConstOffset + c.addConst(Number(len(t.Elements)))
+		c.emitABx(OpLen, testReg, value, line)
+		if t.Rest == nil {
+			c.emitABC(OpEq, testReg, testReg, count, line)
+		} else {
+			c.emitABC(OpLe, testReg, count, testReg, line)
+		}
+		test()
+		for i, el := range t.Elements {
+			matchPart(OpConstOffset+c.addConst(Number(i)), el)
+		}
+		if t.Rest != nil && t.Rest.Value != "_" {
+			rest := regs[t.Rest.Value]
+			c.emitAB(OpMove, rest, value, line)
+			c.emitABC(OpSlice, rest, count, OpConstOffset+c.addConst(Nil{}), line)
+		}
+	case *ast.ObjectPattern:
+		c.emitABC(OpIsType, testReg, value, int(ValueObject), line)
+		test()
+		for _, field := range t.Fields {
+			key := OpConstOffset + c.addConst(String(field.Key))
+			c.emitABC(OpIn, testReg, key, value, line)
+			test()
+			if field.Value == nil {
+				matchPart(key, &ast.Id{Value: field.Key})
+			} else {
+				matchPart(key, field.Value)
+			}
+		}
+	default:
+		// compared to the value
+		data := exprdata{true, testReg, testReg}
+		node.Accept(c, &data)
+		c.emitABC(OpEq, testReg, value, data.regb, line)
+		test()
+	}
+}
+
+// patternNames returns the names bound by a pattern, in order,
+// the ones of the shorthand object fields have their position
+func patternNames(node ast.Node) []*ast.Id {
+	var names []*ast.Id
+	add := func(id *ast.Id) {
+		if id.Value != "_" {
+			names = append(names, id)
+		}
+	}
+	switch t := node.(type) {
+	case *ast.Id:
+		add(t)
+	case *ast.ArrayPattern:
+		for _, el := range t.Elements {
+			names = append(names, patternNames(el)...)
+		}
+		if t.Rest != nil {
+			add(t.Rest)
+		}
+	case *ast.ObjectPattern:
+		for _, field := range t.Fields {
+			if field.Value == nil {
+				add(&ast.Id{Value: field.Key, NodeInfo: field.NodeInfo})
+			} else {
+				names = append(names, patternNames(field.Value)...)
+			}
+		}
+	}
+	return names
+}
+
+func (c *compiler) VisitWithStmt(node *ast.WithStmt, data interface{}) {
+	c.enterBlock(kBlockContextWith)
+	defer c.leaveBlock()
+
+	reg := c.genRegister()
+	valueData := exprdata{false, reg, reg}
+	node.Value.Accept(c, &valueData)
+	c.declareLocalVar(node.Name.Value, reg)
+	c.emitAB(OpWith, reg, 0, node.NodeInfo.Line)
 
+	node.Body.Accept(c, nil)
+	c.emitAB(OpEndWith, c.block.register, 0, c.lastLine)
 }
 
+// endWiths emits the closing of the resources of the with statements
+// left when jumping out to the nearest block of the given context, and
+// the popping of the handlers of the try blocks, followed by their
+// finally blocks
+func (c *compiler) endWiths(context blockContext, line int) {
+	for block := c.block; block != nil && block.context != context; block = block.parent {
+		switch block.context {
+		case kBlockContextWith:
+			c.emitAB(OpEndWith, c.block.register, 0, line)
+		case kBlockContextTry:
+			c.emitAB(OpPopHandler, 0, 0, line)
+			if block.finally != nil {
+				c.inlineFinally(block)
+			}
+		}
+	}
+}
+
+// inlineFinally compiles the finally block of the try block at the
+// current position, in the scope of the try statement and above the
+// registers in use
+func (c *compiler) inlineFinally(try *compilerBlock) {
+	inner, warn := c.block, c.warn
+	c.block = newCompilerBlock(inner.bytecode, kBlockContextBranch, try.parent)
+	c.block.register = inner.register
+	c.block.loop = try.parent.loop
+
+	// the warnings are reported when it's compiled after the try block
+	c.warn = nil
+	try.finally.Accept(c, nil)
+	c.leaveBlock()
+	c.block, c.warn = inner, warn
+}
+
+func (c *compiler) VisitProtoDecl(node *ast.ProtoDecl, data interface{}) {
+	line := node.NodeInfo.Line
+	reg := c.genRegister()
+	c.emitABx(OpProto, reg, c.addConst(String(node.Name.Value)), line)
+	if node.Parent != nil {
+		parent := c.genRegister()
+		parentData := exprdata{false, parent, parent}
+		node.Parent.Accept(c, &parentData)
+		c.emitABC(OpProtofield, reg, parent, 0, line)
+
+		// 'super' in the methods of the prototype
+		c.declareLocalVar(parentName(node.Name.Value), parent)
+	}
+
+	declared := make(map[string]bool)
+	for _, field := range node.Fields {
+		name := field.Name.Value
+		if declared[name] {
+			c.error(field.NodeInfo.Line, ErrRedeclared, fmt.Sprintf("field '%s' declared twice in %s", name, node.Name.Value))
+		}
+		declared[name] = true
+		key := OpConstOffset + c.addConst(String(name))
+
+		// the default is the value of the field in the prototype
+		if field.Value != nil {
+			valueData := exprdata{true, c.block.register, c.block.register}
+			field.Value.Accept(c, &valueData)
+			c.emitABC(OpSetIndex, reg, key, valueData.regb, field.NodeInfo.Line)
+		}
+		typ := "any"
+		if field.Type != nil {
+			typ = field.Type.Value
+		}
+		c.emitABC(OpProtofield, reg, key, OpConstOffset+c.addConst(String(typ)), field.NodeInfo.Line)
+	}
+	c.declareLocalVar(node.Name.Value, reg)
+}
+
+func (c *compiler) VisitRecoverBlock(node *ast.RecoverBlock, data interface{}) {
+	// compiled by VisitTryRecoverStmt
+}
+
+// VisitTryRecoverStmt compiles the try block between OpPushHandler and
+// OpPopHandler, an error raised in it jumps to the recover block with
+// the error in R(A) and true in R(A+1). The finally block runs after
+// both, and raises the error again if it was not recovered:
+//
+//   loadnil      R(A) R(A+1)
+//   pushhandler  R(A) -> recover
+//   <try>
+//   pophandler
+//   jmp          -> finally
+// recover:
+//   loadnil      R(A+1)
+//   pushhandler  R(A) -> finally
+//   <recover>
+//   pophandler
+// finally:
+//   <finally>
+//   jmpfalse     R(A+1) -> end
+//   panic        R(A)
+// end:
+//
+// The jumps out of the try and recover blocks (break, continue and
+// return) pop the handlers and run the finally block on their way,
+// see endWiths.
 func (c *compiler) VisitTryRecoverStmt(node *ast.TryRecoverStmt, data interface{}) {
+	c.enterBlock(kBlockContextBranch)
+	defer c.leaveBlock()
+
+	line := node.NodeInfo.Line
+	errReg := c.genRegister()
+	failedReg := c.genRegister()
+	c.emitLoadnil(errReg, failedReg, line)
+
+	handlerInstr := c.emitAsBx(OpPushHandler, errReg, 0, line)
+	c.enterBlock(kBlockContextTry)
+	c.block.finally = node.Finally
+	node.Try.Accept(c, nil)
+	c.leaveBlock()
+	c.emitAB(OpPopHandler, 0, 0, c.lastLine)
+
+	if node.Recover != nil {
+		jmpInstr := c.emitAsBx(OpJmp, 0, 0, c.lastLine)
+		c.modifyAsBx(handlerInstr, OpPushHandler, errReg, c.labelOffset(uint32(handlerInstr)+1))
+
+		rec := node.Recover
+		if node.Finally != nil {
+			// recovered, unless it raises another error
+			c.emitLoadnil(failedReg, failedReg, rec.NodeInfo.Line)
+			handlerInstr = c.emitAsBx(OpPushHandler, errReg, 0, rec.NodeInfo.Line)
+			c.enterBlock(kBlockContextTry)
+			c.block.finally = node.Finally
+		} else {
+			c.enterBlock(kBlockContextBranch)
+		}
+		if rec.Id != nil {
+			// in it's own register, to be captured by the closures
+			reg := c.genRegister()
+			c.emitAB(OpMove, reg, errReg, rec.NodeInfo.Line)
+			c.declareLocalVar(rec.Id.Value, reg)
+		}
+		rec.Block.Accept(c, nil)
+		c.leaveBlock()
+		if node.Finally != nil {
+			c.emitAB(OpPopHandler, 0, 0, c.lastLine)
+		}
+		c.modifyAsBx(jmpInstr, OpJmp, 0, c.labelOffset(uint32(jmpInstr)+1))
+	}
+	if node.Recover == nil || node.Finally != nil {
+		c.modifyAsBx(handlerInstr, OpPushHandler, errReg, c.labelOffset(uint32(handlerInstr)+1))
+	}
+
+	if node.Finally != nil {
+		c.enterBlock(kBlockContextBranch)
+		node.Finally.Accept(c, nil)
+		c.leaveBlock()
+		endInstr := c.emitAsBx(OpJmpfalse, failedReg, 0, c.lastLine)
+		c.emitAB(OpPanic, errReg, 0, c.lastLine)
+		c.modifyAsBx(endInstr, OpJmpfalse, failedReg, c.labelOffset(uint32(endInstr)+1))
+	}
+}
 
+// whether the statement always leaves the block
+func isTerminating(stmt ast.Node) bool {
+	switch stmt.(type) {
+	case *ast.ReturnStmt, *ast.BranchStmt, *ast.PanicStmt:
+		return true
+	}
+	return false
 }
 
 func (c *compiler) VisitBlock(node *ast.Block, data interface{}) {
+	f := c.block.bytecode
+	if uint32(c.depth) > f.MaxDepth {
+		f.MaxDepth = uint32(c.depth)
+	}
+	c.depth++
+	defer func() { c.depth-- }()
+
+	// the function declarations are visible in the whole
+	// block, so they can refer to each other
 	for _, stmt := range node.Nodes {
+		if fn, ok := stmt.(*ast.Function); ok {
+			if name, ok := fn.Name.(*ast.Id); ok {
+				if _, ok := c.block.names[name.Value]; ok {
+					c.error(name.NodeInfo.Line, ErrRedeclared, fmt.Sprintf("cannot redeclare '%s'", name.Value))
+				}
+				reg := c.genRegister()
+				c.block.addNameInfo(name.Value, &nameInfo{false, nil, reg, kScopeLocal, c.block})
+				c.hoisted[fn] = reg
+			}
+		}
+	}
+
+	// used as an expression, the value of the last
+	// expression goes to R(A), nil if it's a statement
+	expr, exprok := data.(*exprdata)
+	if exprok {
+		c.reserveRegister(expr.rega)
+		if expr.propagate {
+			expr.regb = expr.rega
+		}
+	}
+
+	f.NumStmts += uint32(len(node.Nodes))
+	for i, stmt := range node.Nodes {
+		if i > 0 && isTerminating(node.Nodes[i-1]) {
+			c.warning(ast.Line(stmt), "unreachable code")
+		}
+		c.stmt, c.rest = stmt, node.Nodes[i+1:]
+		if exprok && i == len(node.Nodes)-1 && hasValue(stmt) {
+			if c.block.register <= expr.rega+1 {
+				stmt.Accept(c, &exprdata{false, expr.rega, expr.rega})
+				return
+			}
+			// the expressions use the registers above R(A), which
+			// may hold locals of the block
+			reg := c.genRegister()
+			stmt.Accept(c, &exprdata{false, reg, reg})
+			c.emitAB(OpMove, expr.rega, reg, c.lastLine)
+			return
+		}
 		stmt.Accept(c, nil)
 
 		if !ast.IsStmt(stmt) {
 			c.block.register -= 1
 		}
 	}
+	if exprok {
+		c.emitAB(OpLoadnil, expr.rega, expr.rega, c.lastLine)
+	}
+}
+
+// hasValue tells if node has a value as the last node of a block,
+// either an expression or an if or match
+func hasValue(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.IfStmt, *ast.MatchStmt:
+		return true
+	}
+	return !ast.IsStmt(node)
 }
 
 // Compile receives the root node of the AST and generates code
@@ -1229,24 +2922,109 @@ func (c *compiler) VisitBlock(node *ast.Block, data interface{}) {
 // or a single expression.
 //
 func Compile(root ast.Node, filename string) (res *Bytecode, err error) {
+	return CompileWithOptions(root, filename, CompileOptions{})
+}
+
+// CompileWithOptions is like Compile, but allows to control
+// the compilation process (see CompileOptions).
+func CompileWithOptions(root ast.Node, filename string, opts CompileOptions) (*Bytecode, error) {
+	finished := compileStarted(opts, filename)
+	res, err := compileRoot(root, filename, opts)
+	finished(err, false)
+	return res, err
+}
+
+// compileRoot is CompileWithOptions without the events
+func compileRoot(root ast.Node, filename string, opts CompileOptions) (res *Bytecode, err error) {
+	var c *compiler
 	defer func() {
 		if r := recover(); r != nil {
-			if cerr, ok := r.(*CompileError); ok {
-				err = cerr
-			} else {
-				panic(r)
-			}
+			res, err = nil, recoverError(c, r)
 		}
 	}()
 
-	var c compiler
-	c.filename = filename
+	c = newCompiler(filename, opts, root)
+	c.compileFile(root, filename)
+	res = c.finish()
+	return
+}
+
+// FoldedConstants compiles root and returns the values of the expressions
+// the compiler folded into constants. On errors the expressions folded
+// until the error are returned with it.
+func FoldedConstants(root ast.Node, filename string) (folded map[ast.Node]Value, err error) {
+	var c *compiler
+	defer func() {
+		if r := recover(); r != nil {
+			err = recoverError(c, r)
+		}
+	}()
+
+	folded = make(map[ast.Node]Value)
+	c = newCompiler(filename, CompileOptions{}, root)
+	c.folded = folded
+	c.compileFile(root, filename)
+	return
+}
+
+// newCompiler returns a compiler for the main function of a program
+// made of the given roots
+func newCompiler(filename string, opts CompileOptions, roots ...ast.Node) *compiler {
+	c := &compiler{
+		filename:   filename,
+		warn:       opts.Warn,
+		optLevel:   opts.OptLevel,
+		dedup:      opts.Dedup,
+		strip:      opts.StripAssertions,
+		numeric:    make(map[ast.Node]bool),
+		frameLocal: make(map[*ast.Function]bool),
+		hoisted:    make(map[*ast.Function]int),
+	}
+	c.assigned = make(map[string]bool)
+	for _, root := range roots {
+		for name := range assignedNames(root) {
+			c.assigned[name] = true
+		}
+	}
+	if opts.OptLevel > 0 {
+		c.inlines = make(map[*nameInfo]*inlineFunc)
+		if opts.Profile != nil {
+			c.profile = opts.Profile
+			c.hotCalls = int64(hotCallShare*float64(opts.Profile.totalCalls())) + 1
+		}
+	}
 	c.mainFunc = newBytecode(filename)
 	c.block = newCompilerBlock(c.mainFunc, kBlockContextFunc, nil)
+	return c
+}
 
-	root.Accept(&c, nil)
-	c.functionReturnGuard()
+// compileFile analyzes root and generates it's code in the main function
+func (c *compiler) compileFile(root ast.Node, filename string) {
+	c.filename = filename
+	typecheck(root, filename, c.warn)
 
-	res = c.mainFunc
-	return
+	if c.warn != nil || c.optLevel > 0 {
+		warn := c.warn
+		if warn == nil {
+			warn = func(w *CompileWarning) {}
+		}
+		for node := range inferTypes(root, filename, warn) {
+			c.numeric[node] = true
+		}
+	}
+	for fn := range frameLocalFuncs(root) {
+		c.frameLocal[fn] = true
+	}
+
+	root.Accept(c, nil)
+}
+
+func (c *compiler) finish() *Bytecode {
+	c.functionReturnGuard()
+	c.block.endLocals()
+	c.mainFunc.countRegisters()
+	if c.dedup != nil {
+		return c.dedup.Add(c.mainFunc)
+	}
+	return c.mainFunc
 }
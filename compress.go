@@ -0,0 +1,347 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// The compress module compresses and decompresses strings (which are
+// just sequences of bytes) in the formats registered in compressFormats.
+// gzip and zlib are always available, zstd is available when built
+// with the "zstd" tag.
+//
+//   compress.gzip(data, level), compress.gunzip(data, max)
+//   compress.zlib(data, level), compress.unzlib(data, max)
+//   compress.compress(format, data, level), compress.decompress(format, data, max)
+//   compress.formats()                 the names of the formats, sorted
+//
+// The decompressed output is limited to max bytes, compressMaxOutput
+// (64 MiB) if not given, so a small input can't expand to fill the
+// memory of the host; going over it raises an error.
+//
+// For large payloads there are streams, which receive the data in chunks
+// and return the output produced so far on every call, the outputs of all
+// the calls put together are the result:
+//
+//   w := compress.writer("gzip")
+//   var out = ""
+//   for chunk in chunks {
+//     out = "${out}${w.write(chunk)}"
+//   }
+//   out = "${out}${w.close()}"
+//
+//   r := compress.reader("gzip", max)
+//   data := "${r.write(out)}${r.close()}"
+//
+// A reader decompresses in another goroutine, which waits for the input
+// until the reader is closed, or until it's garbage collected if the
+// script never closes it.
+
+type compressFormat struct {
+	newWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+const (
+	compressDefaultLevel = -1
+	compressMaxOutput    = 64 << 20
+)
+
+var compressFormats = map[string]*compressFormat{
+	"gzip": {
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zlib": {
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+	},
+	"deflate": {
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+}
+
+func compressModule() *Object {
+	return newModule(map[string]GoFunc{
+		"gzip":       compressWith("gzip"),
+		"gunzip":     decompressWith("gzip"),
+		"zlib":       compressWith("zlib"),
+		"unzlib":     decompressWith("zlib"),
+		"compress":   compressCompress,
+		"decompress": compressDecompress,
+		"formats":    compressListFormats,
+		"writer":     compressWriter,
+		"reader":     compressReader,
+	})
+}
+
+func lookupCompressFormat(name string) *compressFormat {
+	f, ok := compressFormats[name]
+	if !ok {
+		panic(fmt.Sprintf("compress: unknown format '%s'", name))
+	}
+	return f
+}
+
+func compressData(format *compressFormat, data string, level int) string {
+	var buf bytes.Buffer
+	w, err := format.newWriter(&buf, level)
+	if err != nil {
+		panic("compress: " + err.Error())
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		panic("compress: " + err.Error())
+	}
+	if err := w.Close(); err != nil {
+		panic("compress: " + err.Error())
+	}
+	return buf.String()
+}
+
+func decompressData(format *compressFormat, data string, max int64) string {
+	r, err := format.newReader(bytes.NewReader([]byte(data)))
+	if err != nil {
+		panic("compress: " + err.Error())
+	}
+	defer r.Close()
+
+	res, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		panic("compress: " + err.Error())
+	}
+	if int64(len(res)) > max {
+		panic("compress: " + outputTooLarge(max).Error())
+	}
+	return string(res)
+}
+
+func outputTooLarge(max int64) error {
+	return fmt.Errorf("output is larger than the maximum of %d bytes", max)
+}
+
+// the max argument of the decompressing functions
+func maxOutputArg(call *FuncCall, i uint) int64 {
+	return int64(call.optNumberArg(i, compressMaxOutput))
+}
+
+func compressWith(name string) GoFunc {
+	return func(call *FuncCall) {
+		level := int(call.optNumberArg(1, compressDefaultLevel))
+		call.PushReturnValue(String(compressData(lookupCompressFormat(name), call.stringArg(0), level)))
+	}
+}
+
+func decompressWith(name string) GoFunc {
+	return func(call *FuncCall) {
+		call.PushReturnValue(String(decompressData(lookupCompressFormat(name), call.stringArg(0), maxOutputArg(call, 1))))
+	}
+}
+
+func compressCompress(call *FuncCall) {
+	format := lookupCompressFormat(call.stringArg(0))
+	level := int(call.optNumberArg(2, compressDefaultLevel))
+	call.PushReturnValue(String(compressData(format, call.stringArg(1), level)))
+}
+
+func compressDecompress(call *FuncCall) {
+	format := lookupCompressFormat(call.stringArg(0))
+	call.PushReturnValue(String(decompressData(format, call.stringArg(1), maxOutputArg(call, 2))))
+}
+
+func compressListFormats(call *FuncCall) {
+	names := make(Array, 0, len(compressFormats))
+	for name := range compressFormats {
+		names = append(names, String(name))
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i].(String) < names[j].(String) })
+	call.PushReturnValue(&names)
+}
+
+//
+// streams
+//
+
+// compressStream buffers the output of a compressor, every call
+// to write/close takes whatever was produced so far
+type compressStream struct {
+	w      io.WriteCloser
+	out    bytes.Buffer
+	closed bool
+}
+
+// decompressStream feeds the chunks to a decompressor running in
+// another goroutine through a pipe, since the decompressors need
+// to pull their input. The goroutine only sees the state, so the
+// stream can be collected and close the pipe if it's never closed.
+type decompressStream struct {
+	*decompressState
+}
+
+type decompressState struct {
+	pw     *io.PipeWriter
+	mu     sync.Mutex
+	out    bytes.Buffer
+	left   int64 // the output allowed before failing
+	err    error
+	done   chan struct{}
+	closed bool
+}
+
+func newStreamObject(data interface{}, methods map[string]GoFunc) *GoObject {
+	return &GoObject{Object: *newModule(methods), Data: data}
+}
+
+func streamData(call *FuncCall) interface{} {
+	if obj, ok := call.This.(*GoObject); ok {
+		return obj.Data
+	}
+	panic("compress: stream method called without a stream")
+}
+
+func compressWriter(call *FuncCall) {
+	format := lookupCompressFormat(call.stringArg(0))
+	level := int(call.optNumberArg(1, compressDefaultLevel))
+
+	s := &compressStream{}
+	w, err := format.newWriter(&s.out, level)
+	if err != nil {
+		panic("compress: " + err.Error())
+	}
+	s.w = w
+
+	call.PushReturnValue(newStreamObject(s, map[string]GoFunc{
+		"write": compressStreamWrite,
+		"close": compressStreamClose,
+	}))
+}
+
+func (s *compressStream) take() String {
+	res := String(s.out.String())
+	s.out.Reset()
+	return res
+}
+
+func compressStreamWrite(call *FuncCall) {
+	s := streamData(call).(*compressStream)
+	if s.closed {
+		panic("compress: write on closed stream")
+	}
+	if _, err := io.WriteString(s.w, call.stringArg(0)); err != nil {
+		panic("compress: " + err.Error())
+	}
+	call.PushReturnValue(s.take())
+}
+
+func compressStreamClose(call *FuncCall) {
+	s := streamData(call).(*compressStream)
+	if !s.closed {
+		s.closed = true
+		if err := s.w.Close(); err != nil {
+			panic("compress: " + err.Error())
+		}
+	}
+	call.PushReturnValue(s.take())
+}
+
+func compressReader(call *FuncCall) {
+	format := lookupCompressFormat(call.stringArg(0))
+	max := maxOutputArg(call, 1)
+	pr, pw := io.Pipe()
+	s := &decompressState{pw: pw, left: max, done: make(chan struct{})}
+
+	go func() {
+		defer close(s.done)
+		r, err := format.newReader(pr)
+		if err == nil {
+			_, err = io.Copy(s, r)
+			r.Close()
+			if err == errOutputTooLarge {
+				err = outputTooLarge(max)
+			}
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		}
+		// unblock the writer if we stopped before the input ended
+		pr.CloseWithError(err)
+	}()
+
+	stream := &decompressStream{s}
+	runtime.SetFinalizer(stream, func(stream *decompressStream) {
+		stream.pw.Close()
+	})
+	call.PushReturnValue(newStreamObject(stream, map[string]GoFunc{
+		"write": decompressStreamWrite,
+		"close": decompressStreamClose,
+	}))
+}
+
+var errOutputTooLarge = errors.New("output too large")
+
+// io.Writer for the decompressor goroutine
+func (s *decompressState) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(len(p)) > s.left {
+		return 0, errOutputTooLarge
+	}
+	s.left -= int64(len(p))
+	return s.out.Write(p)
+}
+
+func (s *decompressState) take() String {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		panic("compress: " + s.err.Error())
+	}
+	res := String(s.out.String())
+	s.out.Reset()
+	return res
+}
+
+func decompressStreamWrite(call *FuncCall) {
+	s := streamData(call).(*decompressStream)
+	if s.closed {
+		panic("compress: write on closed stream")
+	}
+	// the error, if any, is reported by take
+	s.pw.Write([]byte(call.stringArg(0)))
+	call.PushReturnValue(s.take())
+}
+
+func decompressStreamClose(call *FuncCall) {
+	s := streamData(call).(*decompressStream)
+	if !s.closed {
+		s.closed = true
+		s.pw.Close()
+		<-s.done
+	}
+	call.PushReturnValue(s.take())
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompress(t *testing.T) {
+	vm := NewVM()
+	vm.Define("data", String(strings.Repeat("all work and no play ", 100)))
+	res := runString(t, vm, `
+		var gz = compress.gzip(data)
+		var results = [
+			compress.gunzip(gz) == data,
+			compress.unzlib(compress.zlib(data, 9)) == data,
+			compress.decompress("deflate", compress.compress("deflate", data, 1)) == data,
+			len(gz) < len(data),
+		]
+
+		// the example of the docs
+		var chunks = [data[:10], data[10:1000], data[1000:]]
+		w := compress.writer("gzip")
+		var out = ""
+		for chunk in chunks {
+			out = "${out}${w.write(chunk)}"
+		}
+		out = "${out}${w.close()}"
+
+		r := compress.reader("gzip")
+		var back = ""
+		for i := 0; i < len(out); i += 7 {
+			back = "${back}${r.write(out[i:i+7 > len(out) ? len(out) : i+7])}"
+		}
+		back = "${back}${r.close()}"
+		append(results, compress.gunzip(out) == data, back == data)
+		return results`)
+	if got := res[0].String(); got != "[true true true true true true]" {
+		t.Errorf("unexpected results %s", got)
+	}
+
+	for _, source := range []string{
+		`compress.gunzip("xx")`,
+		`compress.unzlib(compress.gzip("x"))`,
+		`compress.decompress("rar", "")`,
+		`compress.gzip("x", 42)`,
+		`var r = compress.reader("zlib"); r.write("not zlib"); r.close()`,
+		`var w = compress.writer("gzip"); w.close(); w.write("x")`,
+		`compress.gunzip(compress.gzip("0123456789"), 9)`,
+		`compress.decompress("deflate", compress.compress("deflate", "0123456789"), 5)`,
+		`var r = compress.reader("gzip", 9); r.write(compress.gzip("0123456789")); r.close()`,
+	} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewVM().run(code)
+		if rerr, ok := err.(*RuntimeError); !ok || !strings.HasPrefix(rerr.Message, "compress: ") {
+			t.Errorf("%s: expected a compress error, got %v", source, err)
+		}
+	}
+}
+
+func TestCompressLimits(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var gz = compress.gzip("0123456789")
+		var r = compress.reader("gzip", 10)
+		return compress.gunzip(gz, 10), "${r.write(gz)}${r.close()}", compress.formats()`)
+	if got := fmt.Sprint(res); got != "[0123456789 0123456789 [deflate gzip zlib]]" && got != "[0123456789 0123456789 [deflate gzip zlib zstd]]" {
+		t.Errorf("unexpected results %s", got)
+	}
+
+	vm := NewVM()
+	vm.Define("data", String(strings.Repeat("\x00", compressMaxOutput+1)))
+	code, err := CompileReader(strings.NewReader("compress.gunzip(compress.gzip(data))"), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vm.run(code)
+	want := fmt.Sprintf("compress: output is larger than the maximum of %d bytes", compressMaxOutput)
+	if rerr, ok := err.(*RuntimeError); !ok || rerr.Message != want {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+}
+
+func TestCompressReaderCollected(t *testing.T) {
+	before := runtime.NumGoroutine()
+	func() {
+		call := FuncCall{Args: []Value{String("gzip")}, NumArgs: 1}
+		compressReader(&call)
+	}()
+
+	// the goroutine of a reader that is never closed ends with it
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("expected %d goroutines, got %d", before, n)
+	}
+}
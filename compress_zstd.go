@@ -0,0 +1,33 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+//go:build zstd
+// +build zstd
+
+package yo
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstd support depends on an external package,
+// so it's only compiled with the "zstd" build tag
+
+func init() {
+	compressFormats["zstd"] = &compressFormat{
+		newWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == compressDefaultLevel {
+				return zstd.NewWriter(w)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"math"
+	"sync"
+)
+
+// Dedup stores the functions and the constants of the programs
+// compiled in a process once, for hosts compiling many similar scripts
+// (like the rules of the users of a service, see CompileOptions.Dedup).
+// A function with the same code as one compiled before is replaced by
+// it, and equal strings by the same string. The functions of other
+// files keep their own Bytecode, to report their errors with the name
+// of their file, but share the code, the constants and the debug
+// information, so their code is not quickened. It's safe for
+// concurrent use.
+//
+// The functions and strings stored are kept as long as the Dedup.
+type Dedup struct {
+	mu      sync.Mutex
+	funcs   map[dedupKey]*Bytecode // by file and contents
+	bodies  map[[sha256.Size]byte]*Bytecode
+	strings map[string]string
+}
+
+type dedupKey struct {
+	source string
+	sum    [sha256.Size]byte
+}
+
+// NewDedup returns an empty Dedup.
+func NewDedup() *Dedup {
+	return &Dedup{
+		funcs:   make(map[dedupKey]*Bytecode),
+		bodies:  make(map[[sha256.Size]byte]*Bytecode),
+		strings: make(map[string]string),
+	}
+}
+
+// Add stores the functions of b and returns the Bytecode to use in
+// place of it, which is b itself if no function like it was stored
+// before. The functions defined in b are replaced in place, so b must
+// not have run yet.
+func (d *Dedup) Add(b *Bytecode) *Bytecode {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res, _ := d.function(b)
+	// prepared once, the VMs running it only read it
+	res.prepare(make(map[string]Value))
+	return res
+}
+
+// function returns the stored function with the contents of b, and
+// the hash of the contents
+func (d *Dedup) function(b *Bytecode) (*Bytecode, [sha256.Size]byte) {
+	// the code may be shared with the programs of other VMs
+	b.frozen = true
+	h := sha256.New()
+	for i, f := range b.Funcs {
+		var sum [sha256.Size]byte
+		b.Funcs[i], sum = d.function(f)
+		h.Write(sum[:])
+	}
+	for i, c := range b.Consts {
+		if s, ok := c.(String); ok {
+			b.Consts[i] = String(d.intern(string(s)))
+		}
+	}
+	for i := range b.Locals {
+		b.Locals[i].Name = d.intern(b.Locals[i].Name)
+	}
+	for i := range b.Upvals {
+		b.Upvals[i].Name = d.intern(b.Upvals[i].Name)
+	}
+	for i := range b.Params {
+		b.Params[i] = d.intern(b.Params[i])
+	}
+	for _, k := range b.Keywords {
+		for i := range k.Names {
+			k.Names[i] = d.intern(k.Names[i])
+		}
+	}
+	b.Name = d.intern(b.Name)
+
+	hashContents(h, b)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	key := dedupKey{b.Source, sum}
+	if same, ok := d.funcs[key]; ok {
+		return same, sum
+	}
+	if other, ok := d.bodies[sum]; ok {
+		// the same function in another file
+		b.Consts, b.Code, b.Lines = other.Consts, other.Code, other.Lines
+		b.Upvals, b.Locals = other.Upvals, other.Locals
+		b.Params, b.Keywords = other.Params, other.Keywords
+	} else {
+		d.bodies[sum] = b
+	}
+	d.funcs[key] = b
+	return b, sum
+}
+
+func (d *Dedup) intern(s string) string {
+	if interned, ok := d.strings[s]; ok {
+		return interned
+	}
+	d.strings[s] = s
+	return s
+}
+
+// hashContents writes everything in b but the file name and the
+// functions defined in it to h, with the instructions specialized
+// for numbers as their generic version
+func hashContents(h hash.Hash, b *Bytecode) {
+	var buf [binary.MaxVarintLen64]byte
+	num := func(n uint64) {
+		h.Write(buf[:binary.PutUvarint(buf[:], n)])
+	}
+	str := func(s string) {
+		num(uint64(len(s)))
+		h.Write([]byte(s))
+	}
+
+	str(b.Name)
+	num(uint64(b.Line))
+	num(uint64(b.NumRegs))
+	num(uint64(b.NumStmts))
+	num(uint64(b.MaxDepth))
+	if b.Shareable {
+		num(1)
+	} else {
+		num(0)
+	}
+	num(uint64(len(b.Consts)))
+	for _, c := range b.Consts {
+		num(uint64(c.Type()))
+		switch c := c.(type) {
+		case Bool:
+			if c {
+				num(1)
+			} else {
+				num(0)
+			}
+		case Number:
+			num(math.Float64bits(float64(c)))
+		case String:
+			str(string(c))
+		}
+	}
+	num(uint64(len(b.Code)))
+	for _, instr := range b.Code {
+		num(uint64(OpGeneric(instr)))
+	}
+	num(uint64(len(b.Lines)))
+	for _, l := range b.Lines {
+		num(uint64(l.Instr))
+		num(uint64(l.Line))
+	}
+	num(uint64(len(b.Upvals)))
+	for _, u := range b.Upvals {
+		str(u.Name)
+		num(uint64(u.Kind))
+		num(uint64(u.Index))
+	}
+	num(uint64(len(b.Locals)))
+	for _, l := range b.Locals {
+		str(l.Name)
+		num(uint64(l.Reg))
+		num(uint64(l.StartPC))
+		num(uint64(l.EndPC))
+	}
+	num(uint64(len(b.Params)))
+	for _, name := range b.Params {
+		str(name)
+	}
+	if b.Variadic {
+		num(1)
+	} else {
+		num(0)
+	}
+	num(uint64(len(b.Keywords)))
+	for _, k := range b.Keywords {
+		num(uint64(k.Instr))
+		num(uint64(len(k.Names)))
+		for _, name := range k.Names {
+			str(name)
+		}
+	}
+	num(uint64(len(b.Funcs)))
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestDedup(t *testing.T) {
+	d := NewDedup()
+	compile := func(source, filename string) *Bytecode {
+		b, err := CompileSource([]byte(source), filename, CompileOptions{Dedup: d})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	lib := "func check(x) { if x > 10 { return \"big\" }; return nil() }\n"
+
+	a := compile(lib+"return check(20)", "a.yo")
+	b := compile(lib+"return check(30)", "a.yo")
+	if a == b || a.Funcs[0] != b.Funcs[0] {
+		t.Errorf("expected the same function in the programs of the same file")
+	}
+	if same := compile(lib+"return check(20)", "a.yo"); same != a {
+		t.Errorf("expected the same main function for the same program")
+	}
+
+	other := compile(lib+"return check(20)", "b.yo")
+	if other.Funcs[0] == a.Funcs[0] || &other.Funcs[0].Code[0] != &a.Funcs[0].Code[0] {
+		t.Errorf("expected the code of the function shared with it's own Bytecode in another file")
+	}
+	x, y := compile("return \"key\"", "x.yo"), compile("var n = 1\nreturn \"key\", n", "y.yo")
+	if unsafe.StringData(string(x.Consts[0].(String))) != unsafe.StringData(string(y.Consts[1].(String))) {
+		t.Errorf("expected the same string constants")
+	}
+
+	// the errors of the shared code are reported in the file that ran it
+	for _, test := range []struct {
+		b    *Bytecode
+		want string
+	}{
+		{a, "big"}, {b, "big"}, {other, "big"},
+		{compile(lib+"return check(1)", "c.yo"), "c.yo:1:"},
+	} {
+		res, err := NewVM().run(test.b)
+		if err != nil {
+			if !strings.HasPrefix(err.Error(), test.want) {
+				t.Errorf("%s: expected %s, got %v", test.b.Source, test.want, err)
+			}
+		} else if res[0].String() != test.want {
+			t.Errorf("%s: expected %s, got %v", test.b.Source, test.want, res[0])
+		}
+	}
+}
+
+func TestDedupConcurrent(t *testing.T) {
+	d := NewDedup()
+	var wg sync.WaitGroup
+	res := make([]*Bytecode, 8)
+	for i := range res {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b, err := CompileSource([]byte("func f(x) -> x * 2\nreturn f(1)"), "rule.yo", CompileOptions{Dedup: d})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res[i] = b
+		}(i)
+	}
+	wg.Wait()
+	for _, b := range res[1:] {
+		if b != res[0] {
+			t.Errorf("expected all the programs to be the same")
+		}
+	}
+
+	// the same code runs in many VMs, with numbers and not
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, source := range []string{"return f(1)", "return f(\"a\")"} {
+				b, err := CompileSource([]byte("func f(x) -> x + x\n"+source), "many.yo", CompileOptions{Dedup: d})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := NewVM().run(b); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b, _ := CompileSource([]byte("func f(x) -> x + x\nreturn f(1)"), "many.yo", CompileOptions{Dedup: d})
+	if ops := arithOps(b.Funcs[0]); len(ops) != 1 || ops[0] != OpAdd {
+		t.Errorf("expected the deduplicated code not to be quickened, got %v", ops)
+	}
+}
@@ -0,0 +1,419 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+//
+// Semantic differences between two versions of a script, for reviewing
+// the updates of scripts and triaging changes in the compiler output
+
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/glhrmfrts/yo"
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/pretty"
+)
+
+// Kind tells how a declaration changed.
+type Kind int
+
+const (
+	Added Kind = iota
+	Removed
+	Modified
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	}
+	return "modified"
+}
+
+// Change is a difference between two versions of a script.
+type Change struct {
+	Kind Kind
+	What string // "func", "method", "const", "var" or "proto"
+	Name string // Proto.name for methods, the path of nested functions in bytecode
+
+	// the line of the declaration in each version, 0 in the
+	// version where it's missing
+	OldLine, NewLine int
+
+	Detail string // what changed, like "body changed" or "1 -> 2"
+}
+
+// String returns the change as a line of a report, e.g.
+// "modified func scale (line 4): parameters changed".
+func (c Change) String() string {
+	line := c.NewLine
+	if c.Kind == Removed {
+		line = c.OldLine
+	}
+	s := fmt.Sprintf("%s %s %s", c.Kind, c.What, c.Name)
+	if line > 0 {
+		s += fmt.Sprintf(" (line %d)", line)
+	}
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+	return s
+}
+
+//
+// syntax trees
+//
+
+type decl struct {
+	what, name string
+	line       int
+	node       ast.Node // the function, the value of the variable or the proto
+}
+
+// Trees returns the changes of the top-level declarations of the file
+// old to the ones of new: the functions, methods, constants, variables
+// and protos added, removed or modified. Only their meaning is compared,
+// changes in the layout, the comments or the position of a declaration
+// are not reported. The statements outside of declarations are
+// compared as the function main.
+//
+// The removed and modified declarations come first, in the order of
+// old, followed by the added ones in the order of new.
+func Trees(old, new ast.Node) []Change {
+	oldDecls, oldMain := decls(old)
+	newDecls, newMain := decls(new)
+
+	var changes []Change
+	index := make(map[string]decl, len(newDecls))
+	for _, d := range newDecls {
+		index[d.what+" "+d.name] = d
+	}
+	seen := make(map[string]bool, len(oldDecls))
+	for _, o := range oldDecls {
+		key := o.what + " " + o.name
+		seen[key] = true
+		n, ok := index[key]
+		if !ok {
+			changes = append(changes, Change{Kind: Removed, What: o.what, Name: o.name, OldLine: o.line})
+			continue
+		}
+		if detail := compareDecls(o, n); detail != "" {
+			changes = append(changes, Change{Modified, o.what, o.name, o.line, n.line, detail})
+		}
+	}
+	if compact(oldMain...) != compact(newMain...) {
+		changes = append(changes, Change{Kind: Modified, What: "func", Name: "main", Detail: "top-level statements changed"})
+	}
+	for _, n := range newDecls {
+		if !seen[n.what+" "+n.name] {
+			changes = append(changes, Change{Kind: Added, What: n.what, Name: n.name, NewLine: n.line})
+		}
+	}
+	return changes
+}
+
+// decls returns the top-level declarations of root and the other
+// statements, in the order they appear
+func decls(root ast.Node) ([]decl, []ast.Node) {
+	block, ok := root.(*ast.Block)
+	if !ok {
+		return nil, []ast.Node{root}
+	}
+	var res []decl
+	var stmts []ast.Node
+	variables := func(names []ast.Node, values []ast.Node, what string) {
+		for i, name := range names {
+			id, ok := name.(*ast.Id)
+			if !ok {
+				continue
+			}
+			var value ast.Node
+			if i < len(values) {
+				value = values[i]
+			} else if len(values) > 0 {
+				// the rest of the results of a call, or of an unpacked array
+				value = values[len(values)-1]
+			}
+			kind := what
+			if _, ok := value.(*ast.Function); ok && what == "var" {
+				kind = "func"
+			}
+			res = append(res, decl{kind, id.Value, ast.Line(id), value})
+		}
+	}
+	for _, node := range block.Nodes {
+		switch n := node.(type) {
+		case *ast.Function:
+			switch name := n.Name.(type) {
+			case *ast.Id:
+				res = append(res, decl{"func", name.Value, ast.Line(n), n})
+				continue
+			case *ast.Selector:
+				if proto, ok := name.Left.(*ast.Id); ok {
+					res = append(res, decl{"method", proto.Value + "." + name.Value, ast.Line(n), n})
+					continue
+				}
+			}
+		case *ast.Declaration:
+			what := "var"
+			if n.IsConst {
+				what = "const"
+			}
+			names := make([]ast.Node, len(n.Left))
+			for i, id := range n.Left {
+				names[i] = id
+			}
+			variables(names, n.Right, what)
+			continue
+		case *ast.Assignment:
+			if n.Op == ast.TokenColoneq {
+				variables(n.Left, n.Right, "var")
+				continue
+			}
+		case *ast.ProtoDecl:
+			res = append(res, decl{"proto", n.Name.Value, ast.Line(n), n})
+			continue
+		}
+		stmts = append(stmts, node)
+	}
+	return res, stmts
+}
+
+// compareDecls describes how the declaration o changed to n,
+// or returns "" if it didn't
+func compareDecls(o, n decl) string {
+	oldFn, ok := o.node.(*ast.Function)
+	newFn, ok2 := n.node.(*ast.Function)
+	if ok && ok2 {
+		return compareFuncs(oldFn, newFn)
+	}
+	if compact(o.node) == compact(n.node) {
+		return ""
+	}
+	if o.what == "proto" {
+		return "fields changed"
+	}
+	oldValue, ok := literal(o.node)
+	newValue, ok2 := literal(n.node)
+	if ok && ok2 {
+		return oldValue + " -> " + newValue
+	}
+	return "value changed"
+}
+
+func compareFuncs(o, n *ast.Function) string {
+	var details []string
+	if signature(o) != signature(n) {
+		details = append(details, "parameters changed")
+	}
+	if compact(o.Requires...) != compact(n.Requires...) || compact(o.Ensures...) != compact(n.Ensures...) {
+		details = append(details, "contracts changed")
+	}
+	if compact(o.Body) != compact(n.Body) {
+		details = append(details, "body changed")
+	}
+	return strings.Join(details, ", ")
+}
+
+// the parameters of fn with their types, and the type of the results
+func signature(fn *ast.Function) string {
+	s := compact(fn.Args...)
+	for _, typ := range fn.ArgTypes {
+		if typ != nil {
+			s += " " + typ.Value
+		} else {
+			s += " any"
+		}
+	}
+	if fn.ReturnType != nil {
+		s += " : " + fn.ReturnType.Value
+	}
+	return s
+}
+
+// compact returns the syntax trees of nodes in a single line,
+// without their positions
+func compact(nodes ...ast.Node) string {
+	var buf bytes.Buffer
+	cfg := pretty.Printer{Compact: true}
+	for _, node := range nodes {
+		if node == nil {
+			buf.WriteString("()\n")
+			continue
+		}
+		cfg.Fprint(&buf, node)
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// literal returns the value of a literal as written in the source
+func literal(node ast.Node) (string, bool) {
+	switch n := node.(type) {
+	case nil, *ast.Nil:
+		return "nil", true
+	case *ast.Bool:
+		return strconv.FormatBool(n.Value), true
+	case *ast.Number:
+		return strconv.FormatFloat(n.Value, 'g', -1, 64), true
+	case *ast.String:
+		return strconv.Quote(n.Value), true
+	}
+	return "", false
+}
+
+//
+// bytecode
+//
+
+// Bytecode returns the changes of the functions compiled in old to the
+// ones of new. The functions are matched by their path, the names of
+// the functions they are nested in, like main.outer.inner, with the
+// anonymous ones numbered in the order they appear in their parent,
+// like main.<anonymous 1>. A function is modified if it's code (with
+// the constants written by value, see pretty.Listing, and the
+// instructions quickened by the VM as the generic ones) or it's free
+// variables change, and each constant added to or removed from it is
+// reported as a change of a const named by the value, with the path
+// of the function as the detail.
+func Bytecode(old, new *yo.Bytecode) []Change {
+	var changes []Change
+	diffFunc(&changes, old, new, "main")
+	return changes
+}
+
+// instructions returns the instructions of f as written by
+// pretty.Listing, with the ones the VM specialized for numbers while
+// running written as the generic ones, so running the code is not
+// a change
+func instructions(f *yo.Bytecode) []string {
+	generic := *f
+	generic.Code = make([]uint32, len(f.Code))
+	for pc, instr := range f.Code {
+		generic.Code[pc] = yo.OpGeneric(instr)
+	}
+	return pretty.Instructions(&generic)
+}
+
+type namedFunc struct {
+	path string
+	f    *yo.Bytecode
+}
+
+func diffFunc(changes *[]Change, old, new *yo.Bytecode, path string) {
+	var details []string
+	if detail := diffCode(instructions(old), instructions(new)); detail != "" {
+		details = append(details, detail)
+	}
+	if upvals(old) != upvals(new) {
+		details = append(details, "free variables changed")
+	}
+	if len(details) > 0 {
+		*changes = append(*changes, Change{Modified, "func", path, old.Line, new.Line, strings.Join(details, ", ")})
+	}
+
+	oldConsts, newConsts := constCounts(old), constCounts(new)
+	for _, c := range old.Consts {
+		value := pretty.Constant(c)
+		if newConsts[value] > 0 {
+			newConsts[value]--
+			continue
+		}
+		*changes = append(*changes, Change{Kind: Removed, What: "const", Name: value, OldLine: old.Line, Detail: "in " + path})
+	}
+	for _, c := range new.Consts {
+		value := pretty.Constant(c)
+		if oldConsts[value] > 0 {
+			oldConsts[value]--
+			continue
+		}
+		*changes = append(*changes, Change{Kind: Added, What: "const", Name: value, NewLine: new.Line, Detail: "in " + path})
+	}
+
+	newFuncs := children(new, path)
+	index := make(map[string]*yo.Bytecode, len(newFuncs))
+	for _, child := range newFuncs {
+		index[child.path] = child.f
+	}
+	matched := make(map[string]bool)
+	for _, child := range children(old, path) {
+		if f, ok := index[child.path]; ok {
+			matched[child.path] = true
+			diffFunc(changes, child.f, f, child.path)
+			continue
+		}
+		*changes = append(*changes, Change{Kind: Removed, What: "func", Name: child.path, OldLine: child.f.Line})
+	}
+	for _, child := range newFuncs {
+		if !matched[child.path] {
+			*changes = append(*changes, Change{Kind: Added, What: "func", Name: child.path, NewLine: child.f.Line})
+		}
+	}
+}
+
+// children returns the functions nested in f with their paths
+func children(f *yo.Bytecode, path string) []namedFunc {
+	var res []namedFunc
+	anonymous := 0
+	named := make(map[string]int)
+	for _, child := range f.Funcs {
+		var childPath string
+		if child.Name == "" {
+			anonymous++
+			childPath = fmt.Sprintf("%s.<anonymous %d>", path, anonymous)
+		} else {
+			// functions with the same name in different scopes
+			named[child.Name]++
+			childPath = path + "." + child.Name
+			if n := named[child.Name]; n > 1 {
+				childPath += fmt.Sprintf("#%d", n)
+			}
+		}
+		res = append(res, namedFunc{childPath, child})
+	}
+	return res
+}
+
+// diffCode describes the first difference between two listings
+// of instructions, or returns "" if they are the same
+func diffCode(old, new []string) string {
+	i := 0
+	for i < len(old) && i < len(new) && old[i] == new[i] {
+		i++
+	}
+	if i == len(old) && i == len(new) {
+		return ""
+	}
+	at := func(code []string) string {
+		if i < len(code) {
+			return strings.Join(strings.Fields(code[i]), " ")
+		}
+		return "(end)"
+	}
+	detail := fmt.Sprintf("code changed at instruction %d: %s -> %s", i, at(old), at(new))
+	if len(old) != len(new) {
+		detail += fmt.Sprintf(" (%d -> %d instructions)", len(old), len(new))
+	}
+	return detail
+}
+
+func upvals(f *yo.Bytecode) string {
+	names := make([]string, len(f.Upvals))
+	for i, u := range f.Upvals {
+		names[i] = u.Name
+	}
+	return strings.Join(names, " ")
+}
+
+func constCounts(f *yo.Bytecode) map[string]int {
+	counts := make(map[string]int, len(f.Consts))
+	for _, c := range f.Consts {
+		counts[pretty.Constant(c)]++
+	}
+	return counts
+}
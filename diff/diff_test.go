@@ -0,0 +1,131 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/glhrmfrts/yo"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+const oldSource = `const limit = 10
+var names = []
+
+proto Point { x = 0 }
+
+/// scales n
+func scale(n) -> n * 2
+
+func Point.len() -> this.x
+
+func unused() {}
+
+println(scale(limit))
+`
+
+// the layout and the comments of scale change, but not it's meaning
+const newSource = `const limit = 20
+var names = []
+
+proto Point { x = 0; y = 0 }
+
+func scale(n) {
+	return n * 2
+}
+
+func Point.len() -> this.x + this.y
+
+func added(a, b) -> a + b
+
+println(scale(limit))
+`
+
+func TestTrees(t *testing.T) {
+	old, err := parse.ParseFile([]byte(oldSource), "old.yo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	new, err := parse.ParseFile([]byte(newSource), "new.yo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"modified const limit (line 1): 10 -> 20",
+		"modified proto Point (line 4): fields changed",
+		"modified method Point.len (line 10): body changed",
+		"removed func unused (line 11)",
+		"added func added (line 12)",
+	}
+	changes := Trees(old, new)
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, got %v", len(want), changes)
+	}
+	for i, c := range changes {
+		if c.String() != want[i] {
+			t.Errorf("(%d) expected %q, got %q", i, want[i], c.String())
+		}
+	}
+
+	if changes := Trees(old, old); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+}
+
+func TestBytecode(t *testing.T) {
+	compile := func(source string) *yo.Bytecode {
+		code, err := yo.CompileReader(strings.NewReader(source), "test.yo", yo.CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	old := compile(`func greet(name) -> "hello " + name
+println(greet("world"))
+func() {}
+`)
+	new := compile(`func greet(name) -> "hi " + name
+println(greet("world"))
+func() {}
+func() {}
+`)
+
+	changes := Bytecode(old, new)
+	want := []struct {
+		kind       Kind
+		what, name string
+	}{
+		{Modified, "func", "main"},
+		{Modified, "func", "main.greet"},
+		{Removed, "const", `"hello "`},
+		{Added, "const", `"hi "`},
+		{Added, "func", "main.<anonymous 2>"},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d changes, got %v", len(want), changes)
+	}
+	for i, c := range changes {
+		if c.Kind != want[i].kind || c.What != want[i].what || c.Name != want[i].name {
+			t.Errorf("(%d) expected %s %s %s, got %v", i, want[i].kind, want[i].what, want[i].name, c)
+		}
+	}
+	if detail := `code changed at instruction 0: add r2 "hello " r1 -> add r2 "hi " r1`; changes[1].Detail != detail {
+		t.Errorf("expected %q, got %q", detail, changes[1].Detail)
+	}
+
+	if changes := Bytecode(old, old); len(changes) != 0 {
+		t.Errorf("expected no changes, got %v", changes)
+	}
+
+	// the code quickened by running it is the same code
+	const add = "func add(a, b) -> a + b\nreturn add(1, 2)"
+	ran := compile(add)
+	if err := yo.NewVM().RunBytecode(ran); err != nil {
+		t.Fatal(err)
+	}
+	if changes := Bytecode(compile(add), ran); len(changes) != 0 {
+		t.Errorf("expected no changes after running, got %v", changes)
+	}
+}
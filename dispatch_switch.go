@@ -0,0 +1,47 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+//go:build dispatch_switch && !dispatch_threaded
+// +build dispatch_switch,!dispatch_threaded
+
+package yo
+
+// Switch dispatch: the most frequent simple opcodes are executed
+// directly in a switch, saving the indirect call, the rest go
+// through the table.
+
+const dispatchStrategy = "switch"
+
+func dispatch(vm *VM, cf *callFrame, instr uint32) int {
+	switch Opcode(instr & kOpcodeMask) {
+	case OpMove:
+		cf.r[OpGetA(instr)] = cf.r[OpGetB(instr)]
+	case OpLoadconst:
+		cf.r[OpGetA(instr)] = cf.fn.Bytecode.consts[OpGetBx(instr)]
+	case OpJmp:
+		cf.pc += OpGetsBx(instr)
+	case OpJmpfalse:
+		if vm.profile != nil {
+			return opTable[OpJmpfalse](vm, cf, instr)
+		}
+		a := OpGetA(instr)
+		if a < OpConstOffset && !cf.r[a].truthy() {
+			cf.pc += OpGetsBx(instr)
+		} else if a >= OpConstOffset && !cf.fn.Bytecode.Consts[a-OpConstOffset].ToBool() {
+			cf.pc += OpGetsBx(instr)
+		}
+	case OpAddNN, OpSubNN, OpMulNN, OpDivNN:
+		return opArithNN(vm, cf, instr)
+	case OpLtNN, OpLeNN:
+		return opCmpNN(vm, cf, instr)
+	case OpForloop:
+		return opForloop(vm, cf, instr)
+	default:
+		return opTable[instr&kOpcodeMask](vm, cf, instr)
+	}
+	return 0
+}
+
+// replace the instruction being executed
+func setInstr(cf *callFrame, instr uint32) {
+	cf.fn.Bytecode.Code[cf.pc-1] = instr
+}
@@ -0,0 +1,22 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+//go:build !dispatch_switch && !dispatch_threaded
+// +build !dispatch_switch,!dispatch_threaded
+
+package yo
+
+// The default dispatch: the opcode indexes a table of handlers.
+//
+// The other strategies are selected with the build tags dispatch_switch
+// and dispatch_threaded, compare them with 'go test -bench .'
+
+const dispatchStrategy = "table"
+
+func dispatch(vm *VM, cf *callFrame, instr uint32) int {
+	return opTable[instr&kOpcodeMask](vm, cf, instr)
+}
+
+// replace the instruction being executed
+func setInstr(cf *callFrame, instr uint32) {
+	cf.fn.Bytecode.Code[cf.pc-1] = instr
+}
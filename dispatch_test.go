@@ -0,0 +1,67 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"testing"
+
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// Microbenchmarks of the interpreter loop, run them with each dispatch
+// strategy to compare:
+//
+//   go test -run NONE -bench .
+//   go test -run NONE -bench . -tags dispatch_switch
+//   go test -run NONE -bench . -tags dispatch_threaded
+
+var dispatchBenchmarks = []struct {
+	name   string
+	source string
+}{
+	{"Loop", `
+		var s = 0
+		for i := 0; i < 10000; i++ { s = s + i }
+	`},
+	{"Arith", `
+		var a, b, c = 1, 2, 3
+		for i := 0; i < 10000; i++ {
+			a = (b + c) * 2 - a / 3
+			b = a - c
+		}
+	`},
+	{"Calls", `
+		func add(a, b) { return a + b }
+		var s = 0
+		for i := 0; i < 2000; i++ { s = add(s, i) }
+	`},
+	{"Fib", `
+		func fib(f, n) {
+			if n < 2 { return n }
+			return f(f, n - 1) + f(f, n - 2)
+		}
+		fib(fib, 15)
+	`},
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	for _, bench := range dispatchBenchmarks {
+		root, err := parse.ParseFile([]byte(bench.source), bench.name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		code, err := Compile(root, bench.name)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(dispatchStrategy+"/"+bench.name, func(b *testing.B) {
+			vm := NewVM()
+			for i := 0; i < b.N; i++ {
+				if err := vm.RunBytecode(code); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
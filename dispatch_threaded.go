@@ -0,0 +1,40 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+//go:build dispatch_threaded
+// +build dispatch_threaded
+
+package yo
+
+// Threaded dispatch: the code of each function is predecoded on it's
+// first execution into a slice with the handler of each instruction,
+// so dispatching doesn't need to decode the opcode.
+
+const dispatchStrategy = "threaded"
+
+func dispatch(vm *VM, cf *callFrame, instr uint32) int {
+	b := cf.fn.Bytecode
+	if b.handlers == nil {
+		if b.frozen {
+			// predecoding would change it
+			return opTable[instr&kOpcodeMask](vm, cf, instr)
+		}
+		predecode(b)
+	}
+	return b.handlers[cf.pc-1](vm, cf, instr)
+}
+
+func predecode(b *Bytecode) {
+	b.handlers = make([]opHandler, len(b.Code))
+	for i, instr := range b.Code {
+		b.handlers[i] = opTable[instr&kOpcodeMask]
+	}
+}
+
+// replace the instruction being executed, and it's handler
+func setInstr(cf *callFrame, instr uint32) {
+	b := cf.fn.Bytecode
+	b.Code[cf.pc-1] = instr
+	if b.handlers != nil {
+		b.handlers[cf.pc-1] = opTable[instr&kOpcodeMask]
+	}
+}
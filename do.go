@@ -0,0 +1,79 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// DoString compiles and runs source in a new VM, returning the
+// values returned by the program (with a top-level return statement).
+func DoString(source string) ([]Value, error) {
+	return doSource([]byte(source), "<string>")
+}
+
+// DoFile is like DoString, but reads the source from a file.
+func DoFile(path string) ([]Value, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return doSource(source, path)
+}
+
+// EvalExpr evaluates a single expression in a new VM with the given
+// globals defined, along with the builtins. Useful for one-off
+// evaluations like conditions in configuration files.
+func EvalExpr(source string, globals map[string]Value) (Value, error) {
+	expr, err := parse.ParseExpr([]byte(source))
+	if err != nil {
+		return nil, err
+	}
+
+	root := &ast.ReturnStmt{Values: []ast.Node{expr}}
+	code, err := Compile(root, "<expr>")
+	if err != nil {
+		return nil, err
+	}
+
+	vm := NewVM()
+	for name, v := range globals {
+		vm.Define(name, v)
+	}
+	res, err := vm.run(code)
+	if err != nil {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+// CompileReader parses and compiles the source read from r, without
+// buffering more than opts.MaxSourceSize bytes of it.
+func CompileReader(r io.Reader, filename string, opts CompileOptions) (*Bytecode, error) {
+	finished := compileStarted(opts, filename)
+	root, err := parse.ParseReader(r, opts.MaxSourceSize, filename)
+	if err != nil {
+		finished(err, false)
+		return nil, err
+	}
+	b, err := compileRoot(root, filename, opts)
+	finished(err, false)
+	return b, err
+}
+
+func doSource(source []byte, filename string) ([]Value, error) {
+	root, err := parse.ParseFile(source, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := Compile(root, filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewVM().run(code)
+}
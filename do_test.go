@@ -0,0 +1,102 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDoString(t *testing.T) {
+	res, err := DoString(`
+		func double(x) -> x * 2
+		return double(21), "ok"
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0] != Number(42) || res[1] != String("ok") {
+		t.Errorf("unexpected results %v", res)
+	}
+
+	if _, err := DoString(`return missing()`); err == nil {
+		t.Errorf("expected a runtime error")
+	}
+}
+
+func TestEvalExpr(t *testing.T) {
+	globals := map[string]Value{"version": Number(3), "beta": Bool(true)}
+	v, err := EvalExpr("version >= 2 && beta", globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != Bool(true) {
+		t.Errorf("expected true, got %v", v)
+	}
+
+	if _, err := EvalExpr("1 +", nil); err == nil {
+		t.Errorf("expected a parse error")
+	}
+}
+
+func TestCompileReader(t *testing.T) {
+	source := "var x = 1\nreturn x + 1\n"
+	if _, err := CompileReader(strings.NewReader(source), "<reader>", CompileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := CompileOptions{MaxSourceSize: 10}
+	if _, err := CompileReader(strings.NewReader(source), "<reader>", opts); err == nil {
+		t.Errorf("expected an error for a source larger than %d bytes", opts.MaxSourceSize)
+	}
+}
+
+func TestEval(t *testing.T) {
+	vm := NewVM()
+	if _, ok := vm.Globals["eval"]; ok {
+		t.Fatalf("eval is defined without EnableEval")
+	}
+	vm.EnableEval()
+
+	res := runString(t, vm, `
+		var n = 10
+		func add(x) { return x + n }
+		var rule = "add(age) >= min"
+		var results = [eval(rule, {add: add, age: 20, min: 25}), eval(rule, {add: add, age: 20, min: 31})]
+		var nested = eval("eval(\"1 + x\", {x: x}) * 2", {x: 3})
+		return results, nested, eval("len(\"abc\")"), add(1)
+	`)
+	want := []string{"[true false]", "8", "3", "11"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+
+	for _, source := range []string{`eval("1 +")`, `eval("missing")`, `eval("x", 1)`} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vm.run(code); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+func TestCompileBuiltin(t *testing.T) {
+	vm := NewVM()
+	vm.EnableEval()
+
+	res := runString(t, vm, `
+		var rule = compile("age >= min", ["age", "min"])
+		var pi = compile("3")
+		return rule(20, 18), rule(16, 18), pi(), [rule(x, 2) for x in [1, 2, 3]]
+	`)
+	want := []string{"true", "false", "3", "[false true true]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+//
+// API documentation of script libraries, from the /// comments
+// of their top-level declarations
+
+package docgen
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/glhrmfrts/yo/ast"
+)
+
+// Entry is a documented declaration of a script.
+type Entry struct {
+	Kind string // "func", "method", "const", "var" or "proto"
+	Name string // the function name is Proto.name for methods
+	Line int
+
+	// the declaration as written in the source, without the body of
+	// functions and the values of variables, e.g. "func add(a, b = 1)"
+	Signature string
+
+	Doc string // the /// comment, without the slashes
+}
+
+// Extract returns the entries of the top-level declarations of root,
+// parsed from source, in the order they are declared. The names
+// starting with an underscore are private and left out, along with
+// declarations that aren't simple names, like 'func a[0]() {}'.
+func Extract(root ast.Node, source []byte) []Entry {
+	block, ok := root.(*ast.Block)
+	if !ok {
+		return nil
+	}
+	var entries []Entry
+	add := func(kind, name string, node ast.Node, sig, doc string) {
+		if !strings.HasPrefix(name, "_") {
+			entries = append(entries, Entry{kind, name, ast.Line(node), sig, doc})
+		}
+	}
+	for _, node := range block.Nodes {
+		switch n := node.(type) {
+		case *ast.Function:
+			kind, name := "func", ""
+			switch fn := n.Name.(type) {
+			case *ast.Id:
+				name = fn.Value
+			case *ast.Selector:
+				if proto, ok := fn.Left.(*ast.Id); ok {
+					kind, name = "method", proto.Value+"."+fn.Value
+				}
+			}
+			if name == "" {
+				continue
+			}
+			// the body starts with '{', '->' or '~'
+			sig := text(source, ast.Info(n).Start, ast.Info(n.Body).Start)
+			add(kind, name, n, strings.TrimSpace(sig), n.Doc)
+		case *ast.Declaration:
+			kind := "var"
+			end := ast.Info(n.Left[len(n.Left)-1]).End
+			if n.IsConst {
+				kind, end = "const", ast.Info(n).End
+			}
+			sig := text(source, ast.Info(n).Start, end)
+			for _, id := range n.Left {
+				add(kind, id.Value, n, sig, n.Doc)
+			}
+		case *ast.ProtoDecl:
+			add("proto", n.Name.Value, n, text(source, ast.Info(n).Start, ast.Info(n).End), n.Doc)
+		}
+	}
+	return entries
+}
+
+// text returns the source between the positions start and end
+func text(source []byte, start, end ast.Position) string {
+	return string(source[offset(source, start):offset(source, end)])
+}
+
+// offset returns the index in source of the position pos
+func offset(source []byte, pos ast.Position) int {
+	i := 0
+	for line := 1; line < pos.Line && i < len(source); i++ {
+		if source[i] == '\n' {
+			line++
+		}
+	}
+	for col := 1; col < pos.Column && i < len(source); col++ {
+		_, size := utf8.DecodeRune(source[i:])
+		i += size
+	}
+	return i
+}
+
+// Markdown writes the documentation of entries to w, under
+// a heading with title, returning the first error of w.
+func Markdown(w io.Writer, title string, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# %s\n", title)
+	for _, e := range entries {
+		fmt.Fprintf(bw, "\n## %s %s\n\n", e.Kind, e.Name)
+		fmt.Fprintf(bw, "```\n%s\n```\n", e.Signature)
+		if e.Doc != "" {
+			fmt.Fprintf(bw, "\n%s\n", e.Doc)
+		}
+	}
+	return bw.Flush()
+}
+
+// HTML writes the documentation of entries to w as a standalone
+// page, returning the first error of w. Paragraphs of the comments
+// are separated by blank lines.
+func HTML(w io.Writer, title string, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>%s</title></head>\n<body>\n", html.EscapeString(title))
+	fmt.Fprintf(bw, "<h1>%s</h1>\n", html.EscapeString(title))
+	for _, e := range entries {
+		id := strings.Replace(e.Name, ".", "-", -1)
+		fmt.Fprintf(bw, "<h2 id=\"%s\">%s %s</h2>\n", id, e.Kind, html.EscapeString(e.Name))
+		fmt.Fprintf(bw, "<pre>%s</pre>\n", html.EscapeString(e.Signature))
+		for _, par := range strings.Split(e.Doc, "\n\n") {
+			if par = strings.TrimSpace(par); par != "" {
+				fmt.Fprintf(bw, "<p>%s</p>\n", html.EscapeString(par))
+			}
+		}
+	}
+	fmt.Fprintf(bw, "</body>\n</html>\n")
+	return bw.Flush()
+}
@@ -0,0 +1,95 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package docgen
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/glhrmfrts/yo/parse"
+)
+
+const source = `/// Not attached, there's a blank line after it.
+
+/// The ratio of a circle's circumference to it's diameter.
+const pi = 3.14159
+
+/// Adds a and b.
+///
+/// b is 1 if it's not given.
+func add(a: number, b = 1): number {
+	return a + b
+}
+
+// a regular comment
+func sub(a, b) -> a - b
+
+/// A point in the plane.
+proto Point { x: number = 0, y: number = 0 }
+
+/// The distance from the origin.
+func Point.norm() -> this.x * this.x + this.y * this.y
+
+var count, total = 0, 0
+
+/// Private.
+func _helper() -> 1
+`
+
+func TestExtract(t *testing.T) {
+	root, err := parse.ParseFile([]byte(source), "lib.yo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := Extract(root, []byte(source))
+	want := []Entry{
+		{"const", "pi", 4, "const pi = 3.14159", "The ratio of a circle's circumference to it's diameter."},
+		{"func", "add", 9, "func add(a: number, b = 1): number", "Adds a and b.\n\nb is 1 if it's not given."},
+		{"func", "sub", 14, "func sub(a, b)", ""},
+		{"proto", "Point", 17, "proto Point { x: number = 0, y: number = 0 }", "A point in the plane."},
+		{"method", "Point.norm", 20, "func Point.norm()", "The distance from the origin."},
+		{"var", "count", 22, "var count, total", ""},
+		{"var", "total", 22, "var count, total", ""},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %d: %v", len(want), len(entries), entries)
+	}
+	for i, w := range want {
+		if entries[i] != w {
+			t.Errorf("(%d) expected %#v, got %#v", i, w, entries[i])
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	entries := []Entry{
+		{"func", "add", 2, "func add(a, b = 1)", "Adds a and b.\n\nb is <1> by default."},
+		{"method", "Point.norm", 5, "func Point.norm()", ""},
+	}
+
+	var buf bytes.Buffer
+	if err := Markdown(&buf, "lib", entries); err != nil {
+		t.Fatal(err)
+	}
+	want := "# lib\n\n## func add\n\n```\nfunc add(a, b = 1)\n```\n\nAdds a and b.\n\nb is <1> by default.\n" +
+		"\n## method Point.norm\n\n```\nfunc Point.norm()\n```\n"
+	if buf.String() != want {
+		t.Errorf("expected markdown:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	if err := HTML(&buf, "lib", entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"<h2 id=\"add\">func add</h2>",
+		"<pre>func add(a, b = 1)</pre>",
+		"<p>Adds a and b.</p>\n<p>b is &lt;1&gt; by default.</p>",
+		"<h2 id=\"Point-norm\">method Point.norm</h2>",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected %q in the page:\n%s", s, buf.String())
+		}
+	}
+}
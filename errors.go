@@ -0,0 +1,166 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/glhrmfrts/yo/parse"
+)
+
+var (
+	// ErrSyntax matches any parse.ParseError with errors.Is.
+	ErrSyntax = parse.ErrSyntax
+
+	// ErrSemantic matches any CompileError with errors.Is.
+	ErrSemantic = errors.New("semantic error")
+)
+
+// ErrorCode tells the kind of a CompileError.
+type ErrorCode int
+
+const (
+	ErrRedeclared       ErrorCode = iota + 1 // a name declared twice in the same scope
+	ErrConstInit                             // a const without a constant initializer
+	ErrOutsideLoop                           // break or continue outside of a loop
+	ErrMultipleElse                          // more than one else case in a match
+	ErrUnknownType                           // an annotation with an unknown type name
+	ErrTypeMismatch                          // a value of the wrong type for an annotation
+	ErrTooManyConstants                      // a function with more constants than fit an instruction
+	ErrArgCount                              // a call with more arguments than the function takes
+	ErrBadKeyword                            // a keyword argument the function doesn't have, or given twice
+	ErrUnknownField                          // a field not declared in the prototype of an instance
+	ErrRequireCycle                          // files that require each other (see Bundle)
+	ErrNoParent                              // 'super' in a method of a prototype without a parent
+	ErrInternal                              // a bug in the compiler
+)
+
+var errorCodeStrings = [...]string{
+	ErrRedeclared:       "redeclared",
+	ErrConstInit:        "invalid const initializer",
+	ErrOutsideLoop:      "outside loop",
+	ErrMultipleElse:     "multiple else cases",
+	ErrUnknownType:      "unknown type",
+	ErrTypeMismatch:     "type mismatch",
+	ErrTooManyConstants: "too many constants",
+	ErrArgCount:         "wrong argument count",
+	ErrBadKeyword:       "invalid keyword argument",
+	ErrUnknownField:     "unknown field",
+	ErrRequireCycle:     "require cycle",
+	ErrNoParent:         "no parent prototype",
+	ErrInternal:         "internal compiler error",
+}
+
+// Error returns a description of the code, so it can
+// be used as a target for errors.Is.
+func (code ErrorCode) Error() string {
+	if code > 0 && int(code) < len(errorCodeStrings) {
+		return errorCodeStrings[code]
+	}
+	return fmt.Sprintf("compile error %d", int(code))
+}
+
+func (err *CompileError) Is(target error) bool {
+	return target == ErrSemantic || (err.Code != 0 && target == error(err.Code))
+}
+
+// RuntimeError is an error that stopped a program, either raised by
+// the VM, by a native function or by a panic statement. Inside of a
+// try block it's caught by the recover block instead.
+type RuntimeError struct {
+	File    string
+	Line    int
+	Message string
+
+	// Value is the value given to panic, nil for the
+	// errors raised by the VM and native functions
+	Value Value
+
+	// Err is the error raised by a native function, like a
+	// *PermissionError, nil if it raised a message
+	Err error
+}
+
+func (err *RuntimeError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Message)
+}
+
+func (err *RuntimeError) Unwrap() error {
+	return err.Err
+}
+
+// ErrorList is a list of parse and compile errors. Errors.Is and
+// errors.As look into all the errors of the list.
+type ErrorList []error
+
+// Add appends err to the list, the errors of an ErrorList are
+// appended one by one.
+func (l *ErrorList) Add(err error) {
+	if list, ok := err.(ErrorList); ok {
+		*l = append(*l, list...)
+	} else if err != nil {
+		*l = append(*l, err)
+	}
+}
+
+func (l ErrorList) Len() int      { return len(l) }
+func (l ErrorList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+
+func (l ErrorList) Less(i, j int) bool {
+	fi, li := errorPosition(l[i])
+	fj, lj := errorPosition(l[j])
+	if fi != fj {
+		return fi < fj
+	}
+	return li < lj
+}
+
+// Sort sorts the list by file and line, errors without
+// a position come first.
+func (l ErrorList) Sort() {
+	sort.Stable(l)
+}
+
+// Limit returns the first n errors of the list.
+func (l ErrorList) Limit(n int) ErrorList {
+	if n >= 0 && n < len(l) {
+		return l[:n]
+	}
+	return l
+}
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
+func (l ErrorList) Unwrap() []error {
+	return l
+}
+
+// Err returns nil if the list is empty, the list otherwise.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func errorPosition(err error) (file string, line int) {
+	switch e := err.(type) {
+	case *parse.ParseError:
+		return e.File, e.Line
+	case *CompileError:
+		return e.File, e.Line
+	case *RuntimeError:
+		return e.File, e.Line
+	}
+	return "", 0
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		source string
+		kind   error
+		code   error
+	}{
+		{"var x = (1", ErrSyntax, parse.ErrUnexpectedToken},
+		{"var s = \"unterminated", ErrSyntax, parse.ErrIllegalToken},
+		{"1 = 2", ErrSyntax, parse.ErrIllegalAssignment},
+		{"var x = 1\nvar x = 2", ErrSemantic, ErrRedeclared},
+		{"break", ErrSemantic, ErrOutsideLoop},
+		{"const c", ErrSemantic, ErrConstInit},
+		{"func f(a) { return a }\nf(1, 2)", ErrSemantic, ErrArgCount},
+		{"func f(a) { return a }\nf(b = 1)", ErrSemantic, ErrBadKeyword},
+		{"func f(a) { return a }\nf(1, a = 2)", ErrSemantic, ErrBadKeyword},
+		{"proto P { x = 0 }\nvar p = P()\np.y = 1", ErrSemantic, ErrUnknownField},
+		{"proto P { x: number = 0 }\nvar p = P(\"s\")", ErrSemantic, ErrTypeMismatch},
+		{"proto P { x, x }", ErrSemantic, ErrRedeclared},
+		{"proto P { x = 0 }\nproto Q : P { z = 0 }\nvar q = Q()\nq.w = 1", ErrSemantic, ErrUnknownField},
+		{"proto P { x }\nfunc P.f() { return super.f() }", ErrSemantic, ErrNoParent},
+		{"var s = `a ${1}", ErrSyntax, parse.ErrIllegalToken},
+		{"var s = `a ${1 2}`", ErrSyntax, parse.ErrUnexpectedToken},
+		{"func tag(parts) { return parts }\ntag`a ${1}`", ErrSemantic, ErrArgCount},
+		{"match x := 1 {}", ErrSyntax, parse.ErrIllegalAssignment},
+		{"func f(v): number { match n := type(v) { string { return n } } }", ErrSemantic, ErrTypeMismatch},
+	}
+	for _, test := range tests {
+		_, err := DoString(test.source)
+		if !errors.Is(err, test.kind) || !errors.Is(err, test.code) {
+			t.Errorf("%q: expected %v (%v), got %v", test.source, test.kind, test.code, err)
+		}
+		if test.kind == ErrSyntax && errors.Is(err, ErrSemantic) {
+			t.Errorf("%q: syntax error matches ErrSemantic", test.source)
+		}
+	}
+}
+
+func TestArityChecks(t *testing.T) {
+	tests := []struct {
+		source string
+		warns  []string
+	}{
+		{"func f(a, b) { return a }\nf(1)", []string{"missing argument 'b' in call to f, it will be nil"}},
+		{"func f(a, b = 2) { return a }\nf(1)", nil},
+		{"func f(a, b) { return a }\nf(b = 1, a = 2)", nil},
+		{"func f(a, rest...) { return a }\nf(1, 2, 3)", nil},
+		{"func f(a, b) { return a }\nvar x = [1, 2]\nf(x...)", nil},
+
+		// the signature isn't known when the name is reassigned
+		{"func f(a) { return a }\nf = func(a, b) { return b }\nf(1, 2)", nil},
+	}
+	for _, test := range tests {
+		var warns []string
+		opts := CompileOptions{Warn: func(w *CompileWarning) {
+			warns = append(warns, w.Message)
+		}}
+		if _, err := CompileReader(strings.NewReader(test.source), "arity", opts); err != nil {
+			t.Errorf("%q: %v", test.source, err)
+		}
+		if !reflect.DeepEqual(warns, test.warns) {
+			t.Errorf("%q: expected warnings %q, got %q", test.source, test.warns, warns)
+		}
+	}
+}
+
+func TestErrorList(t *testing.T) {
+	var errs ErrorList
+	if errs.Err() != nil {
+		t.Errorf("empty list is not nil")
+	}
+	errs.Add(&CompileError{Code: ErrRedeclared, File: "b.yo", Line: 3})
+	errs.Add(ErrorList{
+		&parse.ParseError{Code: parse.ErrIllegalToken, File: "a.yo", Line: 9},
+		&CompileError{Code: ErrOutsideLoop, File: "b.yo", Line: 1},
+	})
+	errs.Sort()
+
+	want := []struct {
+		file string
+		line int
+	}{{"a.yo", 9}, {"b.yo", 1}, {"b.yo", 3}}
+	for i, w := range want {
+		if file, line := errorPosition(errs[i]); file != w.file || line != w.line {
+			t.Errorf("error %d: expected %s:%d, got %s:%d", i, w.file, w.line, file, line)
+		}
+	}
+
+	err := errs.Limit(2).Err()
+	if !errors.Is(err, ErrSyntax) || !errors.Is(err, ErrOutsideLoop) || errors.Is(err, ErrRedeclared) {
+		t.Errorf("unexpected matches for %v", err)
+	}
+	var cerr *CompileError
+	if !errors.As(err, &cerr) || cerr.Code != ErrOutsideLoop {
+		t.Errorf("expected to find the compile error in %v", err)
+	}
+}
+
+func TestInternalError(t *testing.T) {
+	roots := []ast.Node{
+		// an object field outside of an object
+		&ast.Block{Nodes: []ast.Node{&ast.ObjectField{Key: "x", Value: &ast.Number{Value: 1}}}},
+
+		// a binary expression without operands
+		&ast.Block{Nodes: []ast.Node{&ast.Declaration{
+			Left:  []*ast.Id{{Value: "x"}},
+			Right: []ast.Node{&ast.BinaryExpr{Op: ast.TokenPlus}},
+		}}},
+	}
+	for i, root := range roots {
+		_, err := Compile(root, "internal")
+		var cerr *CompileError
+		if !errors.As(err, &cerr) || !errors.Is(err, ErrInternal) || cerr.File != "internal" {
+			t.Errorf("(%d) expected an internal compile error, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"github.com/glhrmfrts/yo/ast"
+)
+
+// Escape analysis of closures.
+//
+// A closure reads the variables of the enclosing function through
+// upvalues, which are allocated when the closure is created and outlive
+// the call that declared the variables. If the closure can't be called
+// after that call returns, it can read the variables directly from the
+// stack instead (see UpvalueStack).
+//
+// This is known for sure when the closure is declared with a name
+// ('func f() {}' or 'var f = func() {}') and the name is only used to
+// call it, either by the enclosing function or by the closure itself.
+// In any other case (assigned, passed as argument, returned, captured
+// by another closure...) the closure escapes.
+
+// frameLocalFuncs returns the closures declared in body (not including
+// the ones declared inside other closures) that don't escape
+func frameLocalFuncs(body ast.Node) map[*ast.Function]bool {
+	candidates := make(map[string]*ast.Function)
+	decls := make(map[*ast.Id]bool)
+	escapes := make(map[string]bool)
+	add := func(id *ast.Id, fn *ast.Function) {
+		if _, dup := candidates[id.Value]; dup {
+			escapes[id.Value] = true
+		}
+		candidates[id.Value] = fn
+		decls[id] = true
+	}
+
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch t := node.(type) {
+		case *ast.Function:
+			if id, ok := t.Name.(*ast.Id); ok {
+				add(id, t)
+			}
+			return false
+		case *ast.Declaration:
+			if len(t.Left) == 1 && len(t.Right) == 1 {
+				if fn, ok := t.Right[0].(*ast.Function); ok && fn.Name == nil {
+					add(t.Left[0], fn)
+				}
+			}
+		}
+		return true
+	})
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// fn is the innermost closure containing node, nil if it's in body
+	var walk func(node ast.Node, fn *ast.Function)
+	walk = func(node ast.Node, fn *ast.Function) {
+		switch t := node.(type) {
+		case *ast.Id:
+			if !decls[t] {
+				escapes[t.Value] = true
+			}
+			return
+		case *ast.CallExpr:
+			if id, ok := t.Left.(*ast.Id); ok && (fn == nil || fn == candidates[id.Value]) {
+				for _, arg := range t.Args {
+					walk(arg, fn)
+				}
+				return
+			}
+		case *ast.Function:
+			fn = t
+		}
+		for _, child := range ast.Children(node) {
+			walk(child, fn)
+		}
+	}
+	walk(body, nil)
+
+	res := make(map[*ast.Function]bool)
+	for name, fn := range candidates {
+		if !escapes[name] {
+			res[fn] = true
+		}
+	}
+	return res
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// eval(src, env) compiles the expression src and returns it's results,
+// for scripts that receive expressions as data, like the conditions
+// of a rule engine:
+//
+//   eval("age >= min", {age: 20, min: 18})   true
+//
+// The fields of env (optional) are visible to the expression as
+// variables, along with the globals, but not the locals of the caller.
+//
+// compile(src, names) compiles the expression src without running it,
+// and returns a function taking the arguments in the array names
+// (optional) and returning the results of the expression, so it can
+// be called many times with different bindings:
+//
+//   var rule = compile("age >= min", ["age", "min"])
+//   rule(20, 18)                              true
+//
+// Parse, compile and runtime errors panic like in any other builtin.
+
+// EnableEval defines the eval and compile builtins, which NewVM leaves
+// out because they let scripts run code that doesn't come from the host.
+func (vm *VM) EnableEval() {
+	vm.Define("compile", GoFunc(builtinCompile))
+	vm.Define("eval", GoFunc(builtinEval))
+}
+
+func builtinEval(call *FuncCall) {
+	src := call.stringArg(0)
+
+	// the fields of env are the arguments of the compiled function
+	var names []string
+	var args []Value
+	if call.NumArgs > 1 && call.Args[1].Type() != ValueNil {
+		env, ok := toObject(call.Args[1])
+		if !ok {
+			argTypeError(1, "object", call.Args[1])
+		}
+		for _, key := range env.Keys() {
+			names = append(names, key)
+			args = append(args, env.Fields[key])
+		}
+	}
+
+	fn := compileExpr(call.VM, "eval", src, names)
+	res, err := call.VM.call(fn, args)
+	if err != nil {
+		panic("eval: " + err.Error())
+	}
+	for _, v := range res {
+		call.PushReturnValue(v)
+	}
+}
+
+func builtinCompile(call *FuncCall) {
+	src := call.stringArg(0)
+
+	var names []string
+	if call.NumArgs > 1 && call.Args[1].Type() != ValueNil {
+		arr, ok := toArray(call.Args[1])
+		if !ok {
+			argTypeError(1, "array", call.Args[1])
+		}
+		for _, v := range arr {
+			name, ok := v.assertString()
+			if !ok {
+				panic(fmt.Sprintf("compile: argument names must be strings, got %s", v.Type()))
+			}
+			names = append(names, name)
+		}
+	}
+	call.PushReturnValue(compileExpr(call.VM, "compile", src, names))
+}
+
+// compileExpr compiles the expression src as the body of a function
+// taking the arguments names, panicking with the errors prefixed by
+// the name of the builtin
+func compileExpr(vm *VM, builtin, src string, names []string) *Func {
+	expr, err := parse.ParseExpr([]byte(src))
+	if err != nil {
+		panic(builtin + ": " + err.Error())
+	}
+	params := make([]ast.Node, len(names))
+	for i, name := range names {
+		params[i] = &ast.Id{Value: name}
+	}
+	fn := &ast.Function{
+		Args: params,
+		Body: &ast.Block{Nodes: []ast.Node{&ast.ReturnStmt{Values: []ast.Node{expr}}}},
+	}
+	code, err := Compile(&ast.ReturnStmt{Values: []ast.Node{fn}}, "<"+builtin+">")
+	if err != nil {
+		panic(builtin + ": " + err.Error())
+	}
+
+	code.prepare(vm.strings)
+	res, err := vm.call(&Func{Bytecode: code}, nil)
+	if err != nil {
+		panic(builtin + ": " + err.Error())
+	}
+	return res[0].(*Func)
+}
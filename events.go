@@ -0,0 +1,139 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"time"
+)
+
+// Event is something that happened while compiling or running a
+// program, given to the functions subscribed to a VM with Subscribe or
+// to the compilation with CompileOptions.Events. The events are the
+// structs of this file, hosts can switch on their type to log them or
+// to collect their own metrics:
+//
+//	vm.Subscribe(func(e yo.Event) {
+//		switch e := e.(type) {
+//		case yo.ErrorRaised:
+//			log.Printf("script error (handled: %v): %v", e.Handled, e.Err)
+//		case yo.LimitExceeded:
+//			metrics.Inc("limits." + e.Limit)
+//		}
+//	})
+//
+// The functions are called on the goroutine running the VM, before the
+// VM goes on, so they must be quick; to read the events elsewhere send
+// them to a buffered channel. There's no event for garbage collection,
+// the values of the scripts are Go values collected by the Go runtime.
+type Event interface {
+	event()
+}
+
+// CompileStarted is sent when the compilation of File starts.
+type CompileStarted struct {
+	File string
+}
+
+// CompileFinished is sent when the compilation of File ends, Err is
+// the error that stopped it.
+type CompileFinished struct {
+	File     string
+	Duration time.Duration
+	Err      error
+	Cached   bool // the code was found in CompileOptions.Cache
+}
+
+// CallEntered is sent when a script function is called, Depth is the
+// number of calls running, 1 for the main function.
+type CallEntered struct {
+	Call  TracedCall
+	Depth int
+}
+
+// CallExited is sent when a script function returns, or is left by
+// an error, which is in Err.
+type CallExited struct {
+	Call  TracedCall
+	Depth int
+	Err   error
+}
+
+// ErrorRaised is sent when an error is raised in a script, Handled
+// tells if a try statement recovers it.
+type ErrorRaised struct {
+	Err     error
+	Handled bool
+}
+
+// LimitExceeded is sent when a program goes over a limit of the VM,
+// which is "stack" for the depth of the calls or the operation denied
+// by the capabilities ("read", "write", "net", "exec" or "env"). The
+// error it causes is raised after it.
+type LimitExceeded struct {
+	Limit string
+	Err   error
+}
+
+func (CompileStarted) event()  {}
+func (CompileFinished) event() {}
+func (CallEntered) event()     {}
+func (CallExited) event()      {}
+func (ErrorRaised) event()     {}
+func (LimitExceeded) event()   {}
+
+type subscriber struct {
+	fn func(Event)
+}
+
+// Subscribe calls fn with the events of the VM from now on, until the
+// returned function is called or the VM is Reset.
+func (vm *VM) Subscribe(fn func(Event)) (unsubscribe func()) {
+	s := &subscriber{fn}
+	vm.subscribers = append(vm.subscribers, s)
+	return func() {
+		for i, other := range vm.subscribers {
+			if other == s {
+				vm.subscribers = append(vm.subscribers[:i:i], vm.subscribers[i+1:]...)
+				break
+			}
+		}
+		if len(vm.subscribers) == 0 {
+			vm.subscribers = nil
+		}
+	}
+}
+
+// emit sends e to the subscribers of the VM
+func (vm *VM) emit(e Event) {
+	for _, s := range vm.subscribers {
+		s.fn(e)
+	}
+}
+
+// stackOverflow reports that the calls went over CallStackSize
+func (vm *VM) stackOverflow(err error) {
+	if vm.subscribers != nil {
+		vm.emit(LimitExceeded{Limit: "stack", Err: err})
+	}
+}
+
+// permissionDenied sends LimitExceeded if err was raised by the
+// capabilities of the VM
+func (vm *VM) permissionDenied(err *RuntimeError) {
+	if perr, ok := err.Err.(*PermissionError); ok {
+		vm.emit(LimitExceeded{Limit: perr.Op, Err: err})
+	}
+}
+
+// compileStarted sends CompileStarted for filename to opts.Events, and
+// returns the function that sends CompileFinished
+func compileStarted(opts CompileOptions, filename string) func(err error, cached bool) {
+	if opts.Events == nil {
+		return func(error, bool) {}
+	}
+	start := time.Now()
+	opts.Events(CompileStarted{File: filename})
+	return func(err error, cached bool) {
+		opts.Events(CompileFinished{File: filename, Duration: time.Since(start), Err: err, Cached: cached})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	var compiled []string
+	opts := CompileOptions{Cache: NewLRUCache(1 << 20), Events: func(e Event) {
+		switch e := e.(type) {
+		case CompileStarted:
+			compiled = append(compiled, "start "+e.File)
+		case CompileFinished:
+			compiled = append(compiled, fmt.Sprintf("finish %s %v %v", e.File, e.Err != nil, e.Cached))
+		}
+	}}
+	source := `func inner(fail) {
+		if fail { panic "boom" }
+	}
+	func outer() -> inner(false)
+	outer()
+	try { inner(true) } recover e {}
+	inner(true)`
+	code, err := CompileSource([]byte(source), "t.yo", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := []byte("func f(x) -> x * 2\nreturn f(1)")
+	CompileSource(cached, "c.yo", opts)
+	CompileSource(cached, "c.yo", opts)
+	CompileReader(strings.NewReader("return (1"), "bad.yo", opts)
+	want := []string{
+		"start t.yo", "finish t.yo false false",
+		"start c.yo", "finish c.yo false false",
+		"start c.yo", "finish c.yo false true",
+		"start bad.yo", "finish bad.yo true false",
+	}
+	if !reflect.DeepEqual(compiled, want) {
+		t.Errorf("expected compile events:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(compiled, "\n"))
+	}
+
+	vm := NewVM()
+	var events []string
+	vm.Subscribe(func(e Event) {
+		switch e := e.(type) {
+		case CallEntered:
+			events = append(events, fmt.Sprintf("enter %s %d", e.Call.Name, e.Depth))
+		case CallExited:
+			events = append(events, fmt.Sprintf("exit %s %d %v", e.Call.Name, e.Depth, e.Err != nil))
+		case ErrorRaised:
+			events = append(events, fmt.Sprintf("error %v", e.Handled))
+		}
+	})
+	if _, err := vm.run(code); err == nil {
+		t.Fatal("expected an error")
+	}
+	want = []string{
+		"enter main 1",
+		"enter outer 2", "enter inner 3", "exit inner 3 false", "exit outer 2 false",
+		"enter inner 2", "error true", "exit inner 2 true",
+		"enter inner 2", "error false",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("expected events:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(events, "\n"))
+	}
+
+	var limits []string
+	unsubscribe := vm.Subscribe(func(e Event) {
+		if e, ok := e.(LimitExceeded); ok {
+			limits = append(limits, e.Limit)
+		}
+	})
+	vm.SetCapabilities(&Capabilities{})
+	vm.Define("read", GoFunc(func(call *FuncCall) {
+		call.VM.CheckRead("secret.txt")
+	}))
+	limited, err := CompileReader(strings.NewReader("func f() -> f()\ntry { f() } recover e {}\nread()"), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.run(limited); err == nil {
+		t.Fatal("expected a permission error")
+	}
+	if want := []string{"stack", "read"}; !reflect.DeepEqual(limits, want) {
+		t.Errorf("expected limits %v, got %v", want, limits)
+	}
+
+	unsubscribe()
+	events, limits = nil, nil
+	vm.run(code)
+	if len(events) == 0 || len(limits) != 0 {
+		t.Errorf("expected only the events of the remaining subscriber")
+	}
+	vm.Reset()
+	events = nil
+	vm.run(code)
+	if len(events) != 0 {
+		t.Errorf("expected no events after Reset")
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Formatter writes values as text for people: the output of println,
+// the values of the cells of a Kernel and the messages of the errors
+// raised with panic (see VM.SetFormatter). The zero Formatter writes
+// them like their String methods, with no limits.
+//
+// With limits, dumping the values of scripts in the logs of a server is
+// safe, the large arrays and the deep objects are written partially and
+// the secrets are hidden:
+//
+//	vm.SetFormatter(&yo.Formatter{
+//		MaxDepth:    3,
+//		MaxElements: 20,
+//		MaxString:   200,
+//		Redact:      yo.RedactFields("password", "token"),
+//	})
+//
+// The arrays and objects that contain themselves are written once, their
+// values inside of them as <cycle>. A limit of 0 is no limit.
+type Formatter struct {
+	// MaxDepth is how many levels of nested arrays and objects are
+	// written, the deeper ones are written as [...] and map[...]
+	MaxDepth int
+
+	// MaxElements is how many elements of an array or fields of an
+	// object are written, followed by the count of the others
+	MaxElements int
+
+	// MaxString is the length in bytes of the longest string written
+	// inside of arrays and objects, the longer ones are cut
+	MaxString int
+
+	// Redact returns the text written in place of the value v of the
+	// field key of an object, and whether to replace it
+	Redact func(key string, v Value) (string, bool)
+}
+
+// RedactFields returns a Formatter.Redact hiding the fields with one
+// of names, ignoring the case, as <redacted>.
+func RedactFields(names ...string) func(key string, v Value) (string, bool) {
+	return func(key string, v Value) (string, bool) {
+		for _, name := range names {
+			if strings.EqualFold(key, name) {
+				return "<redacted>", true
+			}
+		}
+		return "", false
+	}
+}
+
+// Format returns v written by f.
+func (f *Formatter) Format(v Value) string {
+	var sb strings.Builder
+	f.write(&sb, v, 0, nil)
+	return sb.String()
+}
+
+// write writes v at depth, path has the arrays and objects it's in
+func (f *Formatter) write(sb *strings.Builder, v Value, depth int, path []interface{}) {
+	switch v := v.(type) {
+	case nil:
+		sb.WriteString(Nil{}.String())
+	case String:
+		if depth > 0 && f.MaxString > 0 && len(v) > f.MaxString {
+			sb.WriteString(cutString(string(v), f.MaxString))
+			sb.WriteString("...")
+			return
+		}
+		sb.WriteString(string(v))
+	case *Array:
+		f.writeArray(sb, *v, depth, path)
+	case Array:
+		f.writeArray(sb, v, depth, path)
+	case *Object:
+		f.writeObject(sb, v, depth, path)
+	default:
+		sb.WriteString(v.String())
+	}
+}
+
+func (f *Formatter) writeArray(sb *strings.Builder, arr Array, depth int, path []interface{}) {
+	if f.MaxDepth > 0 && depth >= f.MaxDepth {
+		sb.WriteString("[...]")
+		return
+	}
+	if len(arr) > 0 {
+		// the copies of an array share the elements
+		if inPath(path, &arr[0]) {
+			sb.WriteString("<cycle>")
+			return
+		}
+		path = append(path, &arr[0])
+	}
+
+	sb.WriteByte('[')
+	for i, el := range arr {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		if f.MaxElements > 0 && i == f.MaxElements {
+			sb.WriteString("... " + strconv.Itoa(len(arr)-i) + " more")
+			break
+		}
+		f.write(sb, el, depth+1, path)
+	}
+	sb.WriteByte(']')
+}
+
+func (f *Formatter) writeObject(sb *strings.Builder, obj *Object, depth int, path []interface{}) {
+	if f.MaxDepth > 0 && depth >= f.MaxDepth {
+		sb.WriteString("map[...]")
+		return
+	}
+	if inPath(path, obj) {
+		sb.WriteString("<cycle>")
+		return
+	}
+	path = append(path, obj)
+
+	keys := obj.Keys()
+	sb.WriteString("map[")
+	for i, key := range keys {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		if f.MaxElements > 0 && i == f.MaxElements {
+			sb.WriteString("... " + strconv.Itoa(len(keys)-i) + " more")
+			break
+		}
+		sb.WriteString(key)
+		sb.WriteByte(':')
+		if f.Redact != nil {
+			if text, ok := f.Redact(key, obj.Fields[key]); ok {
+				sb.WriteString(text)
+				continue
+			}
+		}
+		f.write(sb, obj.Fields[key], depth+1, path)
+	}
+	sb.WriteByte(']')
+}
+
+func inPath(path []interface{}, container interface{}) bool {
+	for _, p := range path {
+		if p == container {
+			return true
+		}
+	}
+	return false
+}
+
+// cutString returns the first n bytes of s, without
+// splitting the last character
+func cutString(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// SetFormatter makes the VM write the values with f in the output of
+// println, the values of the cells of a Kernel and the messages of the
+// errors raised with panic. A nil Formatter restores the zero one.
+func (vm *VM) SetFormatter(f *Formatter) {
+	vm.formatter = f
+}
+
+// Format returns v written by the Formatter of the VM (see SetFormatter).
+func (vm *VM) Format(v Value) string {
+	if vm == nil || vm.formatter == nil {
+		return (&Formatter{}).Format(v)
+	}
+	return vm.formatter.Format(v)
+}
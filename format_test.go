@@ -0,0 +1,60 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import "testing"
+
+func TestFormatter(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var nested = {name: "ana", tags: ["a", "b", "c", "d"], inner: {deep: {deeper: [1, [2]]}}}
+		var cycle = {name: "loop"}
+		cycle.self = cycle
+		var arr = [1]
+		append(arr, arr)
+		return nested, cycle, arr, {user: "ana", Password: "secret", token: nil}, ["abcdefgh", "ãé"]
+	`)
+	tests := []struct {
+		f    Formatter
+		v    Value
+		want string
+	}{
+		{Formatter{}, res[0], "map[inner:map[deep:map[deeper:[1 [2]]]] name:ana tags:[a b c d]]"},
+		{Formatter{MaxDepth: 2}, res[0], "map[inner:map[deep:map[...]] name:ana tags:[a b c d]]"},
+		{Formatter{MaxDepth: 1}, res[0], "map[inner:map[...] name:ana tags:[...]]"},
+		{Formatter{MaxElements: 2}, res[0], "map[inner:map[deep:map[deeper:[1 [2]]]] name:ana ... 1 more]"},
+		{Formatter{MaxElements: 1, MaxDepth: 2}, res[0].(*Object).Fields["tags"], "[a ... 3 more]"},
+		{Formatter{}, res[1], "map[name:loop self:<cycle>]"},
+		{Formatter{}, res[2], "[1 <cycle>]"},
+		{Formatter{Redact: RedactFields("password", "token")}, res[3], "map[Password:<redacted> token:<redacted> user:ana]"},
+		{Formatter{MaxString: 3}, res[4], "[abc... ã...]"},
+		{Formatter{MaxString: 3}, String("abcdefgh"), "abcdefgh"},
+	}
+	for i, test := range tests {
+		if got := test.f.Format(test.v); got != test.want {
+			t.Errorf("(%d) expected %q, got %q", i, test.want, got)
+		}
+	}
+
+	// the values are written like this by String
+	if got := res[0].String(); got != tests[0].want {
+		t.Errorf("expected %q, got %q", tests[0].want, got)
+	}
+}
+
+func TestVMFormatter(t *testing.T) {
+	vm := NewVM()
+	vm.SetFormatter(&Formatter{MaxElements: 2, Redact: RedactFields("password")})
+	k := NewKernel(vm)
+	res := k.Execute("var xs = [1, 2, 3]\nprintln({user: \"ana\", password: \"secret\"})\nxs")
+	if res.Output != "map[password:<redacted> user:ana]\n" {
+		t.Errorf("unexpected output %q", res.Output)
+	}
+	if len(res.Values) != 1 || res.Values[0].Text != "[1 2 ... 1 more]" {
+		t.Errorf("unexpected values %v", res.Values)
+	}
+
+	res = k.Execute(`panic {password: "secret"}`)
+	if res.Error == nil || res.Error.Message != "map[password:<redacted>]" {
+		t.Errorf("expected the password to be redacted, got %v", res.Error)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"strings"
+	"testing"
+)
+
+// sum recurses through its argument, so it needs no globals or closures
+const frameTestSource = `
+func sum(f, n) {
+  if n < 1 {
+    return 0
+  }
+  return n + f(f, n - 1)
+}
+result(sum(sum, 200))
+`
+
+func freeFrameCount(vm *VM) int {
+	n := 0
+	for cf := vm.freeFrames; cf != nil; cf = cf.parent {
+		n++
+	}
+	return n
+}
+
+func TestFrameReuse(t *testing.T) {
+	var results []Value
+	vm := NewVM()
+	vm.Define("result", GoFunc(func(call *FuncCall) {
+		results = append(results, call.Args...)
+	}))
+
+	run := func() {
+		results = nil
+		if err := vm.RunString([]byte(frameTestSource), "<test>"); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0] != Number(20100) {
+			t.Fatalf("unexpected results %v", results)
+		}
+		if vm.depth != 0 || vm.currentFrame != nil {
+			t.Fatalf("frames left active: depth %d", vm.depth)
+		}
+	}
+
+	// 200 recursive calls need more registers than the initial stack has
+	run()
+	frames := freeFrameCount(vm)
+	if frames != 202 {
+		t.Errorf("expected 202 free frames, got %d", frames)
+	}
+	if len(vm.stack) <= registerStackSize {
+		t.Errorf("expected the register stack to grow, it has %d registers", len(vm.stack))
+	}
+
+	run()
+	if n := freeFrameCount(vm); n != frames {
+		t.Errorf("expected the %d frames to be reused, got %d", frames, n)
+	}
+
+	// re-entering after an error starts from an empty call stack
+	err := vm.RunString([]byte("func loop(f) {\n  return f(f)\n}\nloop(loop)"), "<test>")
+	if err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Fatalf("expected a stack overflow, got %v", err)
+	}
+	run()
+}
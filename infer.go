@@ -0,0 +1,704 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"github.com/glhrmfrts/yo/ast"
+)
+
+// Type inference diagnostics.
+//
+// This pass follows the flow of the program inferring the kind of the
+// values of local variables from literals and operators, and warns
+// about operations which are guaranteed to fail at runtime, like
+// calling a number or indexing nil.
+//
+// It's conservative: a variable only has a known kind if every path to
+// the current point gives it the same kind, variables from enclosing
+// functions are never known (they may change between the definition
+// and the call of a closure) and neither are globals.
+
+type (
+	inferName struct {
+		kind     ValueType
+		depth    int  // function depth of the declaration
+		unstable bool // assigned by a nested function, can't be known
+	}
+
+	inferScope struct {
+		names  map[string]*inferName
+		parent *inferScope
+	}
+
+	// the kinds of all visible variables at some point
+	inferState map[*inferName]ValueType
+
+	inferencer struct {
+		filename string
+		warn     func(w *CompileWarning)
+		scope    *inferScope
+		depth    int
+		silent   int // don't warn while > 0
+		last     ValueType
+
+		// binary expressions known to operate on numbers, and
+		// calls with only numbers as arguments
+		numeric map[ast.Node]bool
+	}
+)
+
+func (c *inferencer) warning(line int, format string, args ...interface{}) {
+	if c.silent > 0 {
+		return
+	}
+	c.warn(&CompileWarning{Line: line, File: c.filename, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *inferencer) enterScope() {
+	c.scope = &inferScope{names: make(map[string]*inferName), parent: c.scope}
+}
+
+func (c *inferencer) leaveScope() {
+	c.scope = c.scope.parent
+}
+
+func (c *inferencer) declare(name string, kind ValueType) {
+	c.scope.names[name] = &inferName{kind: kind, depth: c.depth}
+}
+
+func (c *inferencer) lookup(name string) *inferName {
+	for scope := c.scope; scope != nil; scope = scope.parent {
+		if info, ok := scope.names[name]; ok {
+			return info
+		}
+	}
+	return nil
+}
+
+func (c *inferencer) kindOf(node ast.Node) ValueType {
+	c.last = typeAny
+	node.Accept(c, nil)
+	return c.last
+}
+
+func (c *inferencer) assign(left ast.Node, kind ValueType) {
+	id, ok := left.(*ast.Id)
+	if !ok {
+		c.kindOf(left)
+		return
+	}
+	info := c.lookup(id.Value)
+	if info == nil {
+		return
+	}
+	if info.depth < c.depth {
+		info.unstable = true
+	}
+	if info.unstable {
+		info.kind = typeAny
+	} else {
+		info.kind = kind
+	}
+}
+
+func (c *inferencer) snapshot() inferState {
+	state := make(inferState)
+	for scope := c.scope; scope != nil; scope = scope.parent {
+		for _, info := range scope.names {
+			state[info] = info.kind
+		}
+	}
+	return state
+}
+
+func (c *inferencer) restore(state inferState) {
+	for info, kind := range state {
+		info.kind = kind
+	}
+}
+
+// merge the states at the end of two paths
+func (c *inferencer) join(a, b inferState) {
+	for info, kind := range a {
+		if b[info] != kind || info.unstable {
+			info.kind = typeAny
+		} else {
+			info.kind = kind
+		}
+	}
+}
+
+func isKnownKind(kind ValueType) bool {
+	return kind != typeAny
+}
+
+func isCallable(kind ValueType) bool {
+	return kind == typeAny || kind == ValueFunc || kind == ValueGoFunc || kind == ValueObject
+}
+
+func isIndexable(kind ValueType) bool {
+	return kind == typeAny || kind == ValueArray || kind == ValueObject || kind == ValueString
+}
+
+//
+// visitor interface
+//
+
+func (c *inferencer) VisitNil(node *ast.Nil, data interface{}) {
+	c.last = ValueNil
+}
+
+func (c *inferencer) VisitBool(node *ast.Bool, data interface{}) {
+	c.last = ValueBool
+}
+
+func (c *inferencer) VisitNumber(node *ast.Number, data interface{}) {
+	c.last = ValueNumber
+}
+
+func (c *inferencer) VisitString(node *ast.String, data interface{}) {
+	c.last = ValueString
+}
+
+func (c *inferencer) VisitId(node *ast.Id, data interface{}) {
+	info := c.lookup(node.Value)
+	if info == nil || info.unstable || info.depth < c.depth {
+		c.last = typeAny
+	} else {
+		c.last = info.kind
+	}
+}
+
+func (c *inferencer) VisitArray(node *ast.Array, data interface{}) {
+	for _, el := range node.Elements {
+		spread, ok := el.(*ast.VarArg)
+		if !ok {
+			c.kindOf(el)
+			continue
+		}
+		// the results of a call are collected in an array
+		kind := c.kindOf(spread.Arg)
+		if _, isCall := spread.Arg.(*ast.CallExpr); !isCall && isKnownKind(kind) && kind != ValueArray {
+			c.warning(spread.NodeInfo.Line, "cannot spread a %s value", typeName(kind))
+		}
+	}
+	c.last = ValueArray
+}
+
+func (c *inferencer) VisitObjectField(node *ast.ObjectField, data interface{}) {
+	if node.Value != nil {
+		c.kindOf(node.Value)
+	}
+}
+
+func (c *inferencer) VisitObject(node *ast.Object, data interface{}) {
+	for _, field := range node.Fields {
+		field.Accept(c, nil)
+	}
+	c.last = ValueObject
+}
+
+func (c *inferencer) VisitComprehension(node *ast.Comprehension, data interface{}) {
+	c.forIterator(node.Loop, func() {
+		if node.Key != nil {
+			c.kindOf(node.Key)
+		}
+		c.kindOf(node.Value)
+	})
+	if node.Key == nil {
+		c.last = ValueArray
+	} else {
+		c.last = ValueObject
+	}
+}
+
+func (c *inferencer) VisitFunction(node *ast.Function, data interface{}) {
+	if name, ok := node.Name.(*ast.Id); ok {
+		c.declare(name.Value, ValueFunc)
+	} else if node.Name != nil {
+		c.kindOf(node.Name)
+	}
+
+	c.depth++
+	c.enterScope()
+	for _, arg := range node.Args {
+		switch arg := arg.(type) {
+		case *ast.Id:
+			c.declare(arg.Value, typeAny)
+		case *ast.KwArg:
+			c.kindOf(arg.Value)
+			c.declare(arg.Key, typeAny)
+		case *ast.VarArg:
+			c.declare(arg.Arg.(*ast.Id).Value, ValueArray)
+		}
+	}
+	node.Body.Accept(c, nil)
+	c.leaveScope()
+	c.depth--
+
+	c.last = ValueFunc
+}
+
+func (c *inferencer) VisitSelector(node *ast.Selector, data interface{}) {
+	if kind := c.kindOf(node.Left); !isIndexable(kind) {
+		c.warning(node.NodeInfo.Line, "accessing field '%s' of a %s value", node.Value, typeName(kind))
+	}
+	c.last = typeAny
+}
+
+func (c *inferencer) VisitSubscript(node *ast.Subscript, data interface{}) {
+	if kind := c.kindOf(node.Left); !isIndexable(kind) {
+		c.warning(node.NodeInfo.Line, "indexing a %s value", typeName(kind))
+	}
+	c.kindOf(node.Right)
+	c.last = typeAny
+}
+
+func (c *inferencer) VisitSlice(node *ast.Slice, data interface{}) {
+	if node.Start != nil {
+		c.kindOf(node.Start)
+	}
+	if node.End != nil {
+		c.kindOf(node.End)
+	}
+	c.last = typeAny
+}
+
+func (c *inferencer) VisitRange(node *ast.Range, data interface{}) {
+	for _, bound := range []ast.Node{node.Start, node.End, node.Step} {
+		if bound == nil {
+			continue
+		}
+		if kind := c.kindOf(bound); isKnownKind(kind) && kind != ValueNumber {
+			c.warning(node.NodeInfo.Line, "invalid operation: .. on %s value", typeName(kind))
+		}
+	}
+	c.last = ValueRange
+}
+
+func (c *inferencer) VisitKwArg(node *ast.KwArg, data interface{}) {
+	c.kindOf(node.Value)
+}
+
+func (c *inferencer) VisitVarArg(node *ast.VarArg, data interface{}) {
+	if kind := c.kindOf(node.Arg); isKnownKind(kind) && kind != ValueArray {
+		c.warning(node.NodeInfo.Line, "cannot unpack a %s value", typeName(kind))
+	}
+	// the kinds of the elements are unknown
+	c.last = typeAny
+}
+
+func (c *inferencer) VisitObjectUnpack(node *ast.ObjectUnpack, data interface{}) {
+	if kind := c.kindOf(node.Value); !isIndexable(kind) {
+		c.warning(node.NodeInfo.Line, "unpacking the fields of a %s value", typeName(kind))
+	}
+	c.last = typeAny
+}
+
+func (c *inferencer) VisitCallExpr(node *ast.CallExpr, data interface{}) {
+	if kind := c.kindOf(node.Left); !isCallable(kind) {
+		c.warning(node.NodeInfo.Line, "calling a %s value", typeName(kind))
+	}
+	numbers := len(node.Args) > 0
+	for _, arg := range node.Args {
+		if c.kindOf(arg) != ValueNumber {
+			numbers = false
+		}
+	}
+	if c.silent == 0 && numbers {
+		c.numeric[node] = true
+	}
+	c.last = typeAny
+}
+
+func (c *inferencer) VisitTemplate(node *ast.Template, data interface{}) {
+	if node.Tag != nil {
+		c.VisitCallExpr(templateCall(node), data)
+		return
+	}
+	for _, expr := range node.Exprs {
+		c.kindOf(expr)
+	}
+	c.last = ValueString
+}
+
+func (c *inferencer) VisitPostfixExpr(node *ast.PostfixExpr, data interface{}) {
+	if kind := c.kindOf(node.Left); isKnownKind(kind) && kind != ValueNumber {
+		c.warning(node.NodeInfo.Line, "invalid operation: %s on %s value", node.Op, typeName(kind))
+	}
+	c.last = ValueNumber
+}
+
+func (c *inferencer) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
+	kind := c.kindOf(node.Right)
+	switch node.Op {
+	case ast.TokenNot, ast.TokenBang:
+		c.last = ValueBool
+	case ast.TokenHash:
+		if isKnownKind(kind) && !hasLength(kind) {
+			c.warning(node.NodeInfo.Line, "invalid operation: %s on %s value", node.Op, typeName(kind))
+		}
+		c.last = ValueNumber
+	default:
+		if isKnownKind(kind) && kind != ValueNumber {
+			c.warning(node.NodeInfo.Line, "invalid operation: %s on %s value", node.Op, typeName(kind))
+		}
+		c.last = ValueNumber
+	}
+}
+
+func (c *inferencer) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
+	left := c.kindOf(node.Left)
+	right := c.kindOf(node.Right)
+	known := isKnownKind(left) && isKnownKind(right)
+	// the operators of objects may be overloaded (see meta.go)
+	overloaded := left == ValueObject || right == ValueObject
+	if c.silent == 0 && left == ValueNumber && right == ValueNumber {
+		c.numeric[node] = true
+	}
+	invalid := func() {
+		c.warning(node.NodeInfo.Line, "invalid operation: %s %s %s", typeName(left), node.Op, typeName(right))
+	}
+
+	switch node.Op {
+	case ast.TokenEqeq, ast.TokenBangeq:
+		c.last = ValueBool
+	case ast.TokenAmpamp, ast.TokenPipepipe:
+		if left == right {
+			c.last = left
+		} else {
+			c.last = typeAny
+		}
+	case ast.TokenLt, ast.TokenLteq, ast.TokenGt, ast.TokenGteq:
+		if known && !overloaded && (left != right || (left != ValueNumber && left != ValueString)) {
+			invalid()
+		}
+		c.last = ValueBool
+	case ast.TokenIs:
+		if _, isType := typeTest(node); !isType && isKnownKind(right) && right != ValueObject {
+			invalid()
+		}
+		c.last = ValueBool
+	case ast.TokenIn:
+		if isKnownKind(right) && right != ValueArray && right != ValueObject && right != ValueString {
+			invalid()
+		}
+		c.last = ValueBool
+	case ast.TokenPlus:
+		c.last = typeAny
+		if known && left == right && (left == ValueNumber || left == ValueString) {
+			c.last = left
+		} else if known && !overloaded {
+			invalid()
+		}
+	default:
+		// the rest only work with numbers
+		if overloaded {
+			c.last = typeAny
+			return
+		}
+		if (isKnownKind(left) && left != ValueNumber) || (isKnownKind(right) && right != ValueNumber) {
+			invalid()
+		}
+		c.last = ValueNumber
+	}
+}
+
+func (c *inferencer) VisitTernaryExpr(node *ast.TernaryExpr, data interface{}) {
+	c.kindOf(node.Cond)
+	then := c.kindOf(node.Then)
+	else_ := c.kindOf(node.Else)
+	if then == else_ {
+		c.last = then
+	} else {
+		c.last = typeAny
+	}
+}
+
+func (c *inferencer) VisitDeclaration(node *ast.Declaration, data interface{}) {
+	kinds := make([]ValueType, len(node.Left))
+	for i, v := range node.Right {
+		kind := c.kindOf(v)
+		if i < len(kinds) {
+			kinds[i] = kind
+		}
+	}
+	for i, id := range node.Left {
+		kind := kinds[i]
+		if i >= len(node.Right) {
+			// without initializer, unless the last value is a call with
+			// multiple results or an array or object unpacked
+			kind = ValueNil
+			if len(node.Right) > 0 {
+				switch node.Right[len(node.Right)-1].(type) {
+				case *ast.CallExpr, *ast.VarArg, *ast.ObjectUnpack:
+					kind = typeAny
+				}
+			}
+		}
+		c.declare(id.Value, kind)
+	}
+}
+
+func (c *inferencer) VisitAssignment(node *ast.Assignment, data interface{}) {
+	kinds := make([]ValueType, len(node.Left))
+	for i := range kinds {
+		kinds[i] = typeAny
+	}
+	if node.Op == ast.TokenEq || node.Op == ast.TokenColoneq {
+		for i, v := range node.Right {
+			kind := c.kindOf(v)
+			if i < len(kinds) && len(node.Left) == len(node.Right) {
+				kinds[i] = kind
+			}
+		}
+	} else {
+		// compound assignment, check it as the binary operation
+		bin := ast.BinaryExpr{Op: ast.CompoundOp(node.Op), Left: node.Left[0], Right: node.Right[0], NodeInfo: node.NodeInfo}
+		kinds[0] = c.kindOf(&bin)
+	}
+
+	for i, left := range node.Left {
+		if node.Op == ast.TokenColoneq {
+			c.declare(left.(*ast.Id).Value, kinds[i])
+		} else {
+			c.assign(left, kinds[i])
+		}
+	}
+}
+
+func (c *inferencer) VisitBranchStmt(node *ast.BranchStmt, data interface{}) {
+
+}
+
+func (c *inferencer) VisitReturnStmt(node *ast.ReturnStmt, data interface{}) {
+	for _, v := range node.Values {
+		c.kindOf(v)
+	}
+}
+
+func (c *inferencer) VisitPanicStmt(node *ast.PanicStmt, data interface{}) {
+	c.kindOf(node.Err)
+}
+
+func (c *inferencer) VisitIfStmt(node *ast.IfStmt, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	if node.Init != nil {
+		node.Init.Accept(c, nil)
+	}
+	c.kindOf(node.Cond)
+
+	before := c.snapshot()
+	node.Body.Accept(c, nil)
+	then := c.snapshot()
+
+	c.restore(before)
+	if node.Else != nil {
+		node.Else.Accept(c, nil)
+	}
+	c.join(then, c.snapshot())
+
+	// the value of an if expression isn't tracked
+	c.last = typeAny
+}
+
+// the body of a loop may run many times, so it's visited once without
+// warnings to find out what it changes, and again with the merged state
+func (c *inferencer) loopBody(visit func()) {
+	before := c.snapshot()
+	c.silent++
+	visit()
+	c.silent--
+	c.join(before, c.snapshot())
+
+	merged := c.snapshot()
+	visit()
+	c.join(merged, c.snapshot())
+}
+
+func (c *inferencer) VisitForIteratorStmt(node *ast.ForIteratorStmt, data interface{}) {
+	c.forIterator(node, func() {
+		node.Body.Accept(c, nil)
+	})
+}
+
+// forIterator infers the head of node and then body, as the
+// body of the loop
+func (c *inferencer) forIterator(node *ast.ForIteratorStmt, body func()) {
+	c.enterScope()
+	defer c.leaveScope()
+	kind := c.kindOf(node.Collection)
+	if isKnownKind(kind) && kind != ValueArray && kind != ValueObject && kind != ValueRange {
+		c.warning(node.NodeInfo.Line, "cannot iterate over a %s value", typeName(kind))
+	}
+	// the keys and values of a range are all numbers
+	elem := typeAny
+	if kind == ValueRange {
+		elem = ValueNumber
+	}
+	c.declare(node.Key.Value, elem)
+	if node.Value != nil {
+		c.declare(node.Value.Value, elem)
+	}
+	c.loopBody(func() {
+		if node.When != nil {
+			c.kindOf(node.When)
+		}
+		body()
+	})
+}
+
+func (c *inferencer) VisitForStmt(node *ast.ForStmt, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	if node.Init != nil {
+		node.Init.Accept(c, nil)
+	}
+	c.loopBody(func() {
+		if node.Cond != nil {
+			c.kindOf(node.Cond)
+		}
+		node.Body.Accept(c, nil)
+		if node.Step != nil {
+			c.kindOf(node.Step)
+		}
+	})
+}
+
+func (c *inferencer) VisitArrayPattern(node *ast.ArrayPattern, data interface{}) {
+	for _, el := range node.Elements {
+		c.pattern(el)
+	}
+	if node.Rest != nil {
+		c.declare(node.Rest.Value, ValueArray)
+	}
+	c.last = ValueArray
+}
+
+func (c *inferencer) VisitObjectPattern(node *ast.ObjectPattern, data interface{}) {
+	for _, field := range node.Fields {
+		if field.Value == nil {
+			c.declare(field.Key, typeAny)
+		} else {
+			c.pattern(field.Value)
+		}
+	}
+	c.last = ValueObject
+}
+
+// pattern declares the names bound by a pattern, whose
+// values are not known
+func (c *inferencer) pattern(node ast.Node) {
+	if id, ok := node.(*ast.Id); ok {
+		c.declare(id.Value, typeAny)
+	} else {
+		c.kindOf(node)
+	}
+}
+
+func (c *inferencer) VisitMatchStmt(node *ast.MatchStmt, data interface{}) {
+	c.kindOf(node.Value)
+
+	// every case starts from the same state, without an else case
+	// the state before the match is also a possible outcome
+	before := c.snapshot()
+	var outcomes []inferState
+	hasElse := false
+	for _, mc := range node.Cases {
+		c.restore(before)
+		c.enterScope()
+		for _, v := range mc.Values {
+			if _, isType := testedType(v); !node.IsType || !isType {
+				c.kindOf(v)
+			}
+		}
+		if node.Name != nil {
+			// narrowed to the type of the case
+			c.declare(node.Name.Value, narrowedType(mc))
+		}
+		hasElse = hasElse || len(mc.Values) == 0
+		mc.Body.Accept(c, nil)
+		c.leaveScope()
+		outcomes = append(outcomes, c.snapshot())
+	}
+	if !hasElse {
+		outcomes = append(outcomes, before)
+	}
+
+	c.restore(outcomes[0])
+	for _, state := range outcomes[1:] {
+		c.join(c.snapshot(), state)
+	}
+
+	// the value of a match expression isn't tracked
+	c.last = typeAny
+}
+
+func (c *inferencer) VisitWithStmt(node *ast.WithStmt, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	if kind := c.kindOf(node.Value); isKnownKind(kind) && kind != ValueObject && kind != ValueNil {
+		c.warning(node.NodeInfo.Line, "cannot use a %s value in 'with'", typeName(kind))
+	}
+	c.declare(node.Name.Value, typeAny)
+	node.Body.Accept(c, nil)
+}
+
+func (c *inferencer) VisitProtoDecl(node *ast.ProtoDecl, data interface{}) {
+	if node.Parent != nil {
+		c.kindOf(node.Parent)
+	}
+	for _, field := range node.Fields {
+		if field.Value != nil {
+			c.kindOf(field.Value)
+		}
+	}
+	// an object, but one that can be called
+	c.declare(node.Name.Value, typeAny)
+}
+
+func (c *inferencer) VisitRecoverBlock(node *ast.RecoverBlock, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	if node.Id != nil {
+		c.declare(node.Id.Value, typeAny)
+	}
+	node.Block.Accept(c, nil)
+}
+
+func (c *inferencer) VisitTryRecoverStmt(node *ast.TryRecoverStmt, data interface{}) {
+	// any statement of the try block may be the last one executed
+	before := c.snapshot()
+	c.silent++
+	node.Try.Accept(c, nil)
+	c.silent--
+	c.join(before, c.snapshot())
+	node.Try.Accept(c, nil)
+	c.join(before, c.snapshot())
+
+	if node.Recover != nil {
+		node.Recover.Accept(c, nil)
+	}
+	if node.Finally != nil {
+		node.Finally.Accept(c, nil)
+	}
+}
+
+func (c *inferencer) VisitBlock(node *ast.Block, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	for _, stmt := range node.Nodes {
+		c.kindOf(stmt)
+	}
+}
+
+// inferTypes reports guaranteed runtime type errors through warn,
+// and returns the binary expressions whose operands are always numbers
+func inferTypes(root ast.Node, filename string, warn func(w *CompileWarning)) map[ast.Node]bool {
+	c := inferencer{filename: filename, warn: warn, numeric: make(map[ast.Node]bool)}
+	c.enterScope()
+	root.Accept(&c, nil)
+	return c.numeric
+}
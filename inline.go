@@ -0,0 +1,362 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"github.com/glhrmfrts/yo/ast"
+)
+
+// Inlining of small functions.
+//
+// With CompileOptions.OptLevel > 0, calls to small named functions are
+// replaced by their body, with the parameters replaced by the arguments.
+// A function can be inlined if:
+//
+//   - it's body is a single returned expression (like 'func f(a) -> a * 2')
+//     of at most inlineBudget nodes
+//   - it's arguments are plain names, and it doesn't use 'this'
+//   - it's not recursive and it's name is never assigned to
+//   - it has no requires or ensures clauses, unless they are stripped
+//
+// The arguments that are literals or local variables never assigned to
+// replace the parameters in the body, the others are evaluated once, in
+// order, into temporary registers the body refers to, so the inlined
+// call has the same effects as the call (see inlineArgs). The other
+// names in the body must refer to the same variables at the call site as
+// they do in the function. Mutually recursive functions are expanded once
+// in each other's body.
+//
+// With a CompileOptions.Profile, the functions up to hotInlineBudgetBy
+// times the budget are also inlined, only in the hot call sites.
+//
+// The native functions abs, min and max are inlined as comparisons when
+// their arguments are known to be numbers (see inferTypes).
+
+type inlineFunc struct {
+	params []string
+	body   ast.Node
+	size   int // inlined only in the hot calls if it's over the budget
+
+	// the variables referenced by the body, nil for globals
+	refs map[string]*nameInfo
+
+	// whether the body is being compiled in place of a call
+	expanding bool
+}
+
+// inlineExpansion is the expression compiled in place of a call, with
+// it's params bound to the args of the call
+type inlineExpansion struct {
+	body   ast.Node
+	params []string
+	args   []ast.Node
+	fn     *inlineFunc // nil for intrinsics
+}
+
+// size budget (in nodes) of inlined bodies for each optimization level
+func inlineBudget(level int) int {
+	switch {
+	case level <= 0:
+		return 0
+	case level == 1:
+		return 12
+	default:
+		return 40
+	}
+}
+
+func exprSize(node ast.Node) int {
+	switch t := node.(type) {
+	case *ast.UnaryExpr:
+		return 1 + exprSize(t.Right)
+	case *ast.BinaryExpr:
+		return 1 + exprSize(t.Left) + exprSize(t.Right)
+	case *ast.TernaryExpr:
+		return 1 + exprSize(t.Cond) + exprSize(t.Then) + exprSize(t.Else)
+	case *ast.Selector:
+		return 1 + exprSize(t.Left)
+	case *ast.Subscript:
+		return 1 + exprSize(t.Left) + exprSize(t.Right)
+	case *ast.CallExpr:
+		n := 1 + exprSize(t.Left)
+		for _, arg := range t.Args {
+			n += exprSize(arg)
+		}
+		return n
+	}
+	return 1
+}
+
+// substitutable returns whether the argument node can replace a
+// parameter in an inlined body, which may use it more than once or not
+// at all: evaluating it has no effects and always gives the same value
+func (c *compiler) substitutable(node ast.Node) bool {
+	switch t := node.(type) {
+	case *ast.Nil, *ast.Bool, *ast.Number, *ast.String:
+		return true
+	case *ast.Id:
+		info, ok := c.block.nameInfo(t.Value)
+		return ok && c.nameScope(info) == kScopeLocal && !c.assigned[t.Value]
+	}
+	return false
+}
+
+// collect the names used in an inlinable expression, returns false
+// if node contains something that can't be inlined
+func inlineNames(node ast.Node, names map[string]bool) bool {
+	switch t := node.(type) {
+	case *ast.Nil, *ast.Bool, *ast.Number, *ast.String:
+		return true
+	case *ast.Id:
+		names[t.Value] = true
+		return t.Value != "this"
+	case *ast.UnaryExpr:
+		return inlineNames(t.Right, names)
+	case *ast.BinaryExpr:
+		return inlineNames(t.Left, names) && inlineNames(t.Right, names)
+	case *ast.TernaryExpr:
+		return inlineNames(t.Cond, names) && inlineNames(t.Then, names) && inlineNames(t.Else, names)
+	case *ast.Selector:
+		return inlineNames(t.Left, names)
+	case *ast.Subscript:
+		return inlineNames(t.Left, names) && inlineNames(t.Right, names)
+	case *ast.CallExpr:
+		for _, arg := range t.Args {
+			if !inlineNames(arg, names) {
+				return false
+			}
+		}
+		return inlineNames(t.Left, names)
+	}
+	return false
+}
+
+// replace the names in node with the expressions in args
+func substitute(node ast.Node, args map[string]ast.Node) ast.Node {
+	switch t := node.(type) {
+	case *ast.Id:
+		if arg, ok := args[t.Value]; ok {
+			return arg
+		}
+		return t
+	case *ast.UnaryExpr:
+		return &ast.UnaryExpr{Op: t.Op, Right: substitute(t.Right, args), NodeInfo: t.NodeInfo}
+	case *ast.BinaryExpr:
+		return &ast.BinaryExpr{Op: t.Op, Left: substitute(t.Left, args), Right: substitute(t.Right, args), NodeInfo: t.NodeInfo}
+	case *ast.TernaryExpr:
+		return &ast.TernaryExpr{
+			Cond:     substitute(t.Cond, args),
+			Then:     substitute(t.Then, args),
+			Else:     substitute(t.Else, args),
+			NodeInfo: t.NodeInfo,
+		}
+	case *ast.Selector:
+		return &ast.Selector{Left: substitute(t.Left, args), Value: t.Value, NodeInfo: t.NodeInfo}
+	case *ast.Subscript:
+		return &ast.Subscript{Left: substitute(t.Left, args), Right: substitute(t.Right, args), NodeInfo: t.NodeInfo}
+	case *ast.CallExpr:
+		call := &ast.CallExpr{Left: substitute(t.Left, args), NodeInfo: t.NodeInfo}
+		for _, arg := range t.Args {
+			call.Args = append(call.Args, substitute(arg, args))
+		}
+		return call
+	}
+	return node
+}
+
+// assignedNames returns the names that are assigned to anywhere in the
+// program, the variables with these names can't be inlined and the
+// closures that capture them can't be shared
+func assignedNames(root ast.Node) map[string]bool {
+	names := make(map[string]bool)
+	ast.Inspect(root, func(node ast.Node) bool {
+		switch t := node.(type) {
+		case *ast.Assignment:
+			if t.Op != ast.TokenColoneq {
+				for _, left := range t.Left {
+					if id, ok := left.(*ast.Id); ok {
+						names[id.Value] = true
+					}
+				}
+			}
+		case *ast.PostfixExpr:
+			if id, ok := t.Left.(*ast.Id); ok {
+				names[id.Value] = true
+			}
+		case *ast.UnaryExpr:
+			// prefix ++ and --
+			if id, ok := t.Right.(*ast.Id); ok && ast.IsPostfixOp(t.Op) {
+				names[id.Value] = true
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// prepareInline checks if the function declared as info can be inlined
+func (c *compiler) prepareInline(node *ast.Function, name string, info *nameInfo) {
+	if c.inlines == nil || c.assigned[name] {
+		return
+	}
+	body, ok := node.Body.(*ast.Block)
+	if !ok || len(body.Nodes) != 1 {
+		return
+	}
+	if !c.strip && (node.Requires != nil || node.Ensures != nil) {
+		// the contracts are checked by the calls
+		return
+	}
+	budget := inlineBudget(c.optLevel)
+	if c.profile != nil {
+		budget *= hotInlineBudgetBy
+	}
+	ret, ok := body.Nodes[0].(*ast.ReturnStmt)
+	if !ok || len(ret.Values) != 1 || exprSize(ret.Values[0]) > budget {
+		return
+	}
+
+	fn := &inlineFunc{body: ret.Values[0], size: exprSize(ret.Values[0]), refs: make(map[string]*nameInfo)}
+	isParam := make(map[string]bool)
+	for _, arg := range node.Args {
+		id, ok := arg.(*ast.Id)
+		if !ok {
+			return
+		}
+		fn.params = append(fn.params, id.Value)
+		isParam[id.Value] = true
+	}
+
+	names := make(map[string]bool)
+	if !inlineNames(fn.body, names) || names[name] {
+		return
+	}
+	for ref := range names {
+		if !isParam[ref] {
+			// resolved from the scope where the function is declared
+			fn.refs[ref], _ = c.block.nameInfo(ref)
+		}
+	}
+	c.inlines[info] = fn
+}
+
+// inlineCall returns the expression to be compiled in place of the
+// call, or nil if it can't be inlined
+func (c *compiler) inlineCall(node *ast.CallExpr) *inlineExpansion {
+	id, ok := node.Left.(*ast.Id)
+	if !ok || c.inlines == nil {
+		return nil
+	}
+	for _, arg := range node.Args {
+		if _, ok := arg.(*ast.KwArg); ok {
+			return nil
+		}
+		if _, ok := arg.(*ast.VarArg); ok {
+			return nil
+		}
+	}
+
+	info, ok := c.block.nameInfo(id.Value)
+	if !ok {
+		return c.inlineIntrinsic(id.Value, node)
+	}
+	fn, ok := c.inlines[info]
+	if !ok || fn.expanding || len(node.Args) != len(fn.params) {
+		return nil
+	}
+	if fn.size > inlineBudget(c.optLevel) && !c.hotCall(node.NodeInfo.Line) {
+		return nil
+	}
+	for ref, refInfo := range fn.refs {
+		if info, _ := c.block.nameInfo(ref); info != refInfo {
+			// shadowed at the call site
+			return nil
+		}
+	}
+	return &inlineExpansion{body: fn.body, params: fn.params, args: node.Args, fn: fn}
+}
+
+// inline compiles the expansion of a call as the expression data
+func (c *compiler) inline(in *inlineExpansion, data interface{}) {
+	if in.fn != nil {
+		// mutually recursive functions can't be expanded forever
+		in.fn.expanding = true
+		defer func() { in.fn.expanding = false }()
+	}
+	expr, exprok := data.(*exprdata)
+	var reg int
+	if exprok {
+		reg = expr.rega
+	} else {
+		reg = c.genRegister()
+	}
+
+	c.enterBlock(kBlockContextBranch)
+	defer c.leaveBlock()
+	args, temp := c.inlineArgs(in, reg+1)
+	body := substitute(in.body, args)
+	if temp == reg+1 {
+		body.Accept(c, data)
+		return
+	}
+
+	// the body goes above the temporary registers, which the
+	// registers it uses for the intermediate values would overwrite
+	bodyData := exprdata{false, temp, temp}
+	body.Accept(c, &bodyData)
+	c.emitAB(OpMove, reg, temp, c.lastLine)
+	if exprok && expr.propagate {
+		expr.regb = reg
+	}
+}
+
+// inlineArgs returns the expressions replacing the params of in, and
+// the register after the temporary ones, from reg, where the arguments
+// that are not substitutable are evaluated, in the order of the call
+func (c *compiler) inlineArgs(in *inlineExpansion, reg int) (map[string]ast.Node, int) {
+	args := make(map[string]ast.Node, len(in.params))
+	for i, param := range in.params {
+		arg := in.args[i]
+		if c.substitutable(arg) {
+			args[param] = arg
+			continue
+		}
+		argData := exprdata{false, reg, reg}
+		arg.Accept(c, &argData)
+
+		// a name that can't be written in the source
+		name := "(" + param + ")"
+		c.block.names[name] = &nameInfo{false, nil, reg, kScopeLocal, c.block}
+		args[param] = &ast.Id{Value: name, NodeInfo: ast.Info(arg)}
+		reg++
+	}
+	return args, reg
+}
+
+func (c *compiler) inlineIntrinsic(name string, node *ast.CallExpr) *inlineExpansion {
+	// the comparisons would call the metamethods of objects (see
+	// meta.go), the native functions only take numbers
+	if c.assigned[name] || !c.numeric[node] {
+		return nil
+	}
+	line := node.NodeInfo
+	a, b := &ast.Id{Value: "a", NodeInfo: line}, &ast.Id{Value: "b", NodeInfo: line}
+	ternary := func(op ast.Token) *inlineExpansion {
+		cond := &ast.BinaryExpr{Op: op, Left: a, Right: b, NodeInfo: line}
+		body := &ast.TernaryExpr{Cond: cond, Then: a, Else: b, NodeInfo: line}
+		return &inlineExpansion{body: body, params: []string{"a", "b"}, args: node.Args}
+	}
+
+	switch {
+	case name == "abs" && len(node.Args) == 1:
+		cond := &ast.BinaryExpr{Op: ast.TokenLt, Left: a, Right: &ast.Number{Value: 0, NodeInfo: line}, NodeInfo: line}
+		neg := &ast.UnaryExpr{Op: ast.TokenMinus, Right: a, NodeInfo: line}
+		body := &ast.TernaryExpr{Cond: cond, Then: neg, Else: a, NodeInfo: line}
+		return &inlineExpansion{body: body, params: []string{"a"}, args: node.Args}
+	case name == "min" && len(node.Args) == 2:
+		return ternary(ast.TokenLteq)
+	case name == "max" && len(node.Args) == 2:
+		return ternary(ast.TokenGteq)
+	}
+	return nil
+}
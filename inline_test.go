@@ -0,0 +1,152 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func countCalls(code *Bytecode) int {
+	count := 0
+	for _, instr := range code.Code {
+		if op := OpGetOpcode(instr); op == OpCall || op == OpCallmethod {
+			count++
+		}
+	}
+	return count
+}
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		source string
+		level  int
+		calls  int
+		want   string
+	}{
+		{"func double(x) -> x * 2\nvar y = 3\nreturn double(y)", 1, 0, "[6]"},
+		{"func double(x) -> x * 2\nvar y = 3\nreturn double(y)", 0, 1, "[6]"},
+		{"const k = 10\nfunc add(x, y) -> x + y + k\nvar a, b = 1, 2\nreturn add(a, b), add(b, 5)", 1, 0, "[13 17]"},
+		{"var a = -2\nreturn abs(a), max(a, 1), min(a, 1)", 1, 0, "[2 1 -2]"},
+
+		// an argument with effects is evaluated once, before the body
+		{"func double(x) -> x * 2\nvar s = \"abcd\"\nreturn double(len(s))", 1, 1, "[8]"},
+
+		// recursive, assigned to and a body too big
+		{"func f(x) -> x < 1 ? 0 : f(x - 1)\nreturn f(3)", 1, 1, "[0]"},
+		{"func f(x) -> x\nf = func(x) -> x + 1\nreturn f(1)", 1, 1, "[2]"},
+		{"func f(x) -> x + x + x + x + x + x + x + x\nvar y = 1\nreturn f(y)", 1, 1, "[8]"},
+		{"func f(x) -> x + x + x + x + x + x + x + x\nvar y = 1\nreturn f(y)", 2, 0, "[8]"},
+	}
+	for _, test := range tests {
+		code, err := CompileReader(strings.NewReader(test.source), "<test>", CompileOptions{OptLevel: test.level})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls := countCalls(code); calls != test.calls {
+			t.Errorf("%q at level %d: expected %d calls, got %d", test.source, test.level, test.calls, calls)
+		}
+		res, err := NewVM().run(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(res); got != test.want {
+			t.Errorf("%q: expected %s, got %s", test.source, test.want, got)
+		}
+	}
+}
+
+// the inlined calls have the same effects as the calls, at every level
+func TestInlineArgs(t *testing.T) {
+	const lib = `
+		proto V { x = 0 }
+		var adds = 0
+		func V.__add(a, b) { adds++; return V(a.x + b.x) }
+		var log = []
+		var o = {__index: func(key) { append(log, key); return 1 }}
+		var arr = [1]
+		func first(a, b) -> a
+		func second(a, b) -> b
+		func twice(a) -> a.x + a.x
+	`
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"return first(1, arr[5])", "index 5 out of range"},
+		{"return first(1, o.missing), log", "[1 [missing]]"},
+		{"var p, q = V(1), V(2)\nreturn twice(p + q), adds", "[6 1]"},
+		{"return second(o.a, o.b), log", "[1 [a b]]"},
+		{"var y = 2\ny = 3\nreturn first(y, 0), abs(adds - 1), max(arr[0], 0)", "[3 1 1]"},
+	}
+	for _, test := range tests {
+		calls := 0
+		for level := 0; level <= 2; level++ {
+			code, err := CompileReader(strings.NewReader(lib+test.source), "<test>", CompileOptions{OptLevel: level})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level == 0 {
+				calls = countCalls(code)
+			} else if countCalls(code) >= calls {
+				t.Errorf("%q at level %d: expected the calls to be inlined", test.source, level)
+			}
+			var got string
+			if res, err := NewVM().run(code); err != nil {
+				got = err.Error()
+			} else {
+				got = fmt.Sprint(res)
+			}
+			if !strings.Contains(got, test.want) {
+				t.Errorf("%q at level %d: expected %s, got %s", test.source, level, test.want, got)
+			}
+		}
+	}
+}
+
+// the operators and fields of objects run the same metamethods
+// whether the calls are inlined or not
+func TestInlineMetamethods(t *testing.T) {
+	const lib = `
+		var calls = 0
+		proto V { x = 0 }
+		func V.__add(a, b) { calls++; return V(a.x + b.x) }
+		func V.__lt(a, b) { calls++; return a.x < b.x }
+		func V.__le(a, b) { calls++; return a.x <= b.x }
+		var o = {__index: func(key) { calls++; return V(1) }}
+		func double(a) -> a + a
+		func least(a, b) -> a < b ? a : b
+		func pick(a, b) -> a
+		var p, q = V(1), V(2)
+	`
+	tests := []string{
+		"return double(p).x, calls",
+		"return least(q, p).x, calls",
+		"return pick(p, o.missing).x, calls",
+		"return double(o.a + o.b).x, calls",
+		"return min(p, q), calls",
+		"return abs(p), calls",
+		"return max(p.x, q.x), calls",
+	}
+	for _, source := range tests {
+		var first string
+		for level := 0; level <= 2; level++ {
+			code, err := CompileReader(strings.NewReader(lib+source), "<test>", CompileOptions{OptLevel: level})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if res, err := NewVM().run(code); err != nil {
+				got = err.Error()
+			} else {
+				got = fmt.Sprint(res)
+			}
+			if level == 0 {
+				first = got
+			} else if got != first {
+				t.Errorf("%q: expected %s at level %d as at level 0, got %s", source, first, level, got)
+			}
+		}
+	}
+}
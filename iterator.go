@@ -0,0 +1,70 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// Iterators over host collections.
+//
+// A for-in loop iterates over any object with a next method returning
+// the next value and whether the iteration is done, so the host can give
+// scripts the values of a Go iterator one at a time, without collecting
+// them in an Array first:
+//
+//	rows := db.Query(...)
+//	vm.Define("rows", yo.Iterator(func() (yo.Value, bool) {
+//		if !rows.Next() {
+//			return nil, false
+//		}
+//		return rowValue(rows), true
+//	}))
+//
+//	for i, row in rows { ... }
+//
+// The iterators can only be iterated once, like the ones returned by
+// next methods in scripts, and the keys of the loop count the values.
+
+// Iterator returns an object that for-in loops iterate over by calling
+// next, until it returns false.
+func Iterator(next func() (Value, bool)) *Object {
+	done := false
+	return NewObject(nil, map[string]Value{
+		"next": GoFunc(func(call *FuncCall) {
+			var v Value
+			if !done {
+				var ok bool
+				v, ok = next()
+				done = !ok
+			}
+			if done {
+				// next is not called again after it's done
+				v = nil
+			}
+			call.PushReturnValue(v)
+			call.PushReturnValue(Bool(done))
+		}),
+	})
+}
+
+// IteratorOf returns an object that for-in loops iterate over by calling
+// next, with the values converted by value, until next returns false.
+func IteratorOf[T any](next func() (T, bool), value func(T) Value) *Object {
+	return Iterator(func() (Value, bool) {
+		v, ok := next()
+		if !ok {
+			return nil, false
+		}
+		return value(v), true
+	})
+}
+
+// ChanIterator returns an object that for-in loops iterate over by
+// receiving from ch, with the values converted by value, until ch is
+// closed. A loop blocks the VM while it waits for the next value.
+func ChanIterator[T any](ch <-chan T, value func(T) Value) *Object {
+	return Iterator(func() (Value, bool) {
+		v, ok := <-ch
+		if !ok {
+			return nil, false
+		}
+		return value(v), true
+	})
+}
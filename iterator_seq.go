@@ -0,0 +1,44 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+//go:build go1.23
+// +build go1.23
+
+package yo
+
+import (
+	"iter"
+)
+
+// SeqIterator returns an object that for-in loops iterate over by
+// pulling the values of seq, converted by value. The sequence runs until
+// it ends or the object is closed by it's close method, so a loop that
+// may stop early should close it with 'with':
+//
+//	with it := users {
+//		for u in it { if u.admin { break } }
+//	}
+func SeqIterator[T any](seq iter.Seq[T], value func(T) Value) *Object {
+	next, stop := iter.Pull(seq)
+	it := IteratorOf(next, value)
+	it.Fields["close"] = GoFunc(func(call *FuncCall) {
+		stop()
+	})
+	return it
+}
+
+// Seq2Iterator is like SeqIterator for sequences of pairs, the
+// values are the ones converted by value from each pair.
+func Seq2Iterator[K, V any](seq iter.Seq2[K, V], value func(K, V) Value) *Object {
+	next, stop := iter.Pull2(seq)
+	it := Iterator(func() (Value, bool) {
+		k, v, ok := next()
+		if !ok {
+			return nil, false
+		}
+		return value(k, v), true
+	})
+	it.Fields["close"] = GoFunc(func(call *FuncCall) {
+		stop()
+	})
+	return it
+}
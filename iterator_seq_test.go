@@ -0,0 +1,52 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+//go:build go1.23
+// +build go1.23
+
+package yo
+
+import (
+	"testing"
+)
+
+func TestSeqIterator(t *testing.T) {
+	stopped := false
+	seq := func(yield func(int) bool) {
+		defer func() { stopped = true }()
+		for i := 0; ; i++ {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+	pairs := func(yield func(string, int) bool) {
+		_ = yield("a", 1) && yield("b", 2)
+	}
+
+	vm := NewVM()
+	vm.Define("naturals", SeqIterator(seq, func(n int) Value { return Number(n) }))
+	vm.Define("pairs", Seq2Iterator(pairs, func(k string, v int) Value {
+		return String(k + "=" + Number(v).String())
+	}))
+	res := runString(t, vm, `
+		var found = nil
+		with it := naturals {
+			for n in it {
+				if n * n > 50 {
+					found = n
+					break
+				}
+			}
+		}
+		return found, [p for p in pairs]
+	`)
+	if res[0].String() != "8" {
+		t.Errorf("expected 8, got %s", res[0])
+	}
+	if res[1].String() != "[a=1 b=2]" {
+		t.Errorf("expected the pairs, got %s", res[1])
+	}
+	if !stopped {
+		t.Errorf("expected the sequence to be stopped by close")
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"testing"
+)
+
+func TestHostIterators(t *testing.T) {
+	vm := NewVM()
+	i, calls := 0, 0
+	vm.Define("numbers", IteratorOf(func() (int, bool) {
+		calls++
+		i++
+		return i, i <= 1000
+	}, func(n int) Value { return Number(n) }))
+
+	ch := make(chan string, 3)
+	ch <- "a"
+	ch <- "b"
+	ch <- "c"
+	close(ch)
+	vm.Define("letters", ChanIterator(ch, func(s string) Value { return String(s) }))
+
+	res := runString(t, vm, `
+		var sum = 0
+		for n in numbers {
+			if n > 3 {
+				break
+			}
+			sum += n
+		}
+		var rest = [[k, v] for k, v in letters]
+		return sum, rest
+	`)
+	if res[0].String() != "6" {
+		t.Errorf("expected 6, got %s", res[0])
+	}
+	if res[1].String() != "[[0 a] [1 b] [2 c]]" {
+		t.Errorf("expected the letters with their keys, got %s", res[1])
+	}
+	if calls != 4 {
+		t.Errorf("expected the values to be pulled lazily, got %d calls", calls)
+	}
+}
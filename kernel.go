@@ -0,0 +1,226 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// Kernel runs the cells of a notebook one after the other in the same
+// VM, for exploratory scripting. The variables and functions declared
+// at the top-level of a cell are globals, so the next cells see them
+// (the constants and the prototypes are only visible in their cell),
+// and a cell ending with an expression returns it's values:
+//
+//	k := yo.NewKernel(yo.NewVM())
+//	k.Execute("var xs = [1, 2, 3]")
+//	k.Execute("len(xs)")            // Values: [{number 3}]
+//
+// The output of println is returned with the results of the cell
+// instead of going to the standard output.
+type Kernel struct {
+	VM *VM
+
+	count  int // the cells executed
+	output strings.Builder
+	stack  []StackFrame // of the last error raised and not recovered
+}
+
+// CellResult is the result of executing a cell.
+type CellResult struct {
+	Cell   int         `json:"cell"` // the number of the cell, from 1
+	Values []CellValue `json:"values,omitempty"`
+	Output string      `json:"output,omitempty"`
+	Error  *CellError  `json:"error,omitempty"`
+}
+
+// CellValue is a value returned by a cell, printed.
+type CellValue struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// CellError is the parse, compile or runtime error that stopped a cell.
+type CellError struct {
+	Message     string          `json:"message"`
+	File        string          `json:"file,omitempty"`
+	Line        int             `json:"line,omitempty"`
+	Traceback   []TracebackLine `json:"traceback,omitempty"` // from the innermost call
+	Interrupted bool            `json:"interrupted,omitempty"`
+}
+
+// TracebackLine is a call running when the error of a cell was raised.
+type TracebackLine struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// NewKernel returns a kernel running the cells in vm, it replaces the
+// println of vm to collect the output of the cells.
+func NewKernel(vm *VM) *Kernel {
+	k := &Kernel{VM: vm}
+	vm.Define("println", GoFunc(func(call *FuncCall) {
+		for _, arg := range call.Args[:call.NumArgs] {
+			k.output.WriteString(vm.Format(arg))
+		}
+		k.output.WriteByte('\n')
+	}))
+	vm.Subscribe(func(e Event) {
+		if e, ok := e.(ErrorRaised); ok && !e.Handled {
+			k.stack = vm.Stack()
+		}
+	})
+	return k
+}
+
+// Execute runs the source of a cell.
+func (k *Kernel) Execute(source string) CellResult {
+	k.count++
+	res := CellResult{Cell: k.count}
+	filename := fmt.Sprintf("cell[%d]", k.count)
+	defer k.output.Reset()
+
+	code, err := k.compile(source, filename)
+	if err == nil {
+		var values []Value
+		k.stack = nil
+		if values, err = k.VM.run(code); err == nil {
+			for _, v := range values {
+				res.Values = append(res.Values, CellValue{Type: v.Type().String(), Text: k.VM.Format(v)})
+			}
+		}
+	}
+	res.Output = k.output.String()
+	if err != nil {
+		res.Error = k.cellError(err)
+	}
+	return res
+}
+
+// Interrupt stops the cell being executed, from another goroutine.
+func (k *Kernel) Interrupt() {
+	k.VM.Interrupt()
+}
+
+// compile compiles the source of a cell with it's top-level
+// declarations as globals and it's last expressions returned
+func (k *Kernel) compile(source, filename string) (*Bytecode, error) {
+	root, err := parse.ParseCell([]byte(source), filename)
+	if err != nil {
+		return nil, err
+	}
+	block := hoistTopLevel(root, func(id *ast.Id) {}).(*ast.Block)
+	if n := len(block.Nodes); n > 0 && isCellExpr(block.Nodes[n-1]) {
+		last := block.Nodes[n-1]
+		block.Nodes[n-1] = &ast.ReturnStmt{Values: []ast.Node{last}, NodeInfo: ast.Info(last)}
+	}
+	return CompileWithOptions(block, filename, CompileOptions{})
+}
+
+// isCellExpr tells if the node at the top-level of a cell is an
+// expression, which gives the result of the cell
+func isCellExpr(node ast.Node) bool {
+	switch t := node.(type) {
+	case *ast.Declaration, *ast.Assignment, *ast.BranchStmt, *ast.ReturnStmt,
+		*ast.PanicStmt, *ast.IfStmt, *ast.ForIteratorStmt, *ast.ForStmt,
+		*ast.MatchStmt, *ast.WithStmt, *ast.ProtoDecl, *ast.TryRecoverStmt,
+		*ast.Block, *ast.PostfixExpr:
+		return false
+	case *ast.Function:
+		return t.Name == nil
+	}
+	return true
+}
+
+func (k *Kernel) cellError(err error) *CellError {
+	cerr := &CellError{Message: err.Error()}
+	switch err := err.(type) {
+	case *RuntimeError:
+		cerr.Message, cerr.File, cerr.Line = err.Message, err.File, err.Line
+		cerr.Interrupted = err.Err == ErrInterrupted
+		for _, frame := range k.stack {
+			cerr.Traceback = append(cerr.Traceback, TracebackLine(frame))
+		}
+	case *parse.ParseError:
+		cerr.Message, cerr.File, cerr.Line = err.Message, err.File, err.Line
+	case *CompileError:
+		cerr.Message, cerr.File, cerr.Line = err.Message, err.File, err.Line
+	}
+	return cerr
+}
+
+// The protocol of Serve is made of JSON objects, one per line. The
+// requests are:
+//
+//	{"id": "1", "op": "execute", "code": "var x = 1\nx + 1"}
+//	{"op": "interrupt"}
+//
+// Each execute request is answered in order by it's CellResult with
+// the id of the request:
+//
+//	{"id": "1", "cell": 1, "values": [{"type": "number", "text": "2"}]}
+//
+// An interrupt request stops the cell being executed, whose result has
+// an error with "interrupted": true, and has no answer. Errors in the
+// requests are answered with an error and no cell.
+
+type kernelRequest struct {
+	ID   string `json:"id"`
+	Op   string `json:"op"`
+	Code string `json:"code"`
+}
+
+type kernelResponse struct {
+	ID string `json:"id,omitempty"`
+	CellResult
+}
+
+// Serve reads requests from r and writes the answers to w until r
+// ends, running the cells in the order they come.
+func (k *Kernel) Serve(r io.Reader, w io.Writer) error {
+	requests := make(chan kernelRequest, 16)
+	readErr := make(chan error, 1)
+	enc := json.NewEncoder(w)
+
+	go func() {
+		defer close(requests)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<24)
+		for scanner.Scan() {
+			var req kernelRequest
+			if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+				req = kernelRequest{Op: "invalid", Code: err.Error()}
+			}
+			if req.Op == "interrupt" {
+				k.Interrupt()
+				continue
+			}
+			requests <- req
+		}
+		readErr <- scanner.Err()
+	}()
+
+	for req := range requests {
+		var res kernelResponse
+		switch req.Op {
+		case "execute":
+			res = kernelResponse{req.ID, k.Execute(req.Code)}
+		case "invalid":
+			res = kernelResponse{CellResult: CellResult{Error: &CellError{Message: "invalid request: " + req.Code}}}
+		default:
+			res = kernelResponse{req.ID, CellResult{Error: &CellError{Message: fmt.Sprintf("unknown op %q", req.Op)}}}
+		}
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	}
+	return <-readErr
+}
@@ -0,0 +1,94 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKernel(t *testing.T) {
+	k := NewKernel(NewVM())
+	cells := []struct {
+		source string
+		want   string
+	}{
+		{"var xs = [1, 2]\nfunc total(a) { var n = 0; for x in a { n += x }; return n }", "null"},
+		{"println(\"hi\", 1)\ntotal(xs), len(xs)", `[{"type":"number","text":"3"},{"type":"number","text":"2"}]`},
+		{"xs = append(xs, 4)\ntotal(xs)", `[{"type":"number","text":"7"}]`},
+	}
+	for i, cell := range cells {
+		res := k.Execute(cell.source)
+		if res.Error != nil {
+			t.Fatalf("(%d) %s", i, res.Error.Message)
+		}
+		values, _ := json.Marshal(res.Values)
+		if string(values) != cell.want {
+			t.Errorf("(%d) expected %s, got %s", i, cell.want, values)
+		}
+		if res.Cell != i+1 {
+			t.Errorf("(%d) expected cell %d, got %d", i, i+1, res.Cell)
+		}
+	}
+	if res := k.Execute("println(\"hi\", 1)"); res.Output != "hi1\n" {
+		t.Errorf("expected the output of the cell, got %q", res.Output)
+	}
+
+	res := k.Execute("func inner() {\n  panic \"boom\"\n}\nfunc outer() -> inner()\nouter()")
+	want := []TracebackLine{{"inner", "cell[5]", 2}, {"outer", "cell[5]", 4}, {"main", "cell[5]", 5}}
+	if res.Error == nil || res.Error.Message != "boom" || len(res.Error.Traceback) != len(want) {
+		t.Fatalf("expected an error with a traceback, got %+v", res.Error)
+	}
+	for i, line := range res.Error.Traceback {
+		if line != want[i] {
+			t.Errorf("expected %v, got %v", want[i], line)
+		}
+	}
+	if res := k.Execute("var = 1"); res.Error == nil || res.Error.Line != 1 {
+		t.Errorf("expected a parse error, got %+v", res.Error)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		k.Interrupt()
+	}()
+	res = k.Execute("try { for { } } recover e {}")
+	if res.Error == nil || !res.Error.Interrupted {
+		t.Errorf("expected the cell to be interrupted, got %+v", res.Error)
+	}
+	if res := k.Execute("total(xs)"); res.Error != nil {
+		t.Errorf("expected the next cell to run, got %s", res.Error.Message)
+	}
+}
+
+func TestKernelServe(t *testing.T) {
+	r, w := io.Pipe()
+	var out strings.Builder
+	done := make(chan error)
+	go func() {
+		done <- NewKernel(NewVM()).Serve(r, &out)
+	}()
+	io.WriteString(w, `{"id": "a", "op": "execute", "code": "var x = 20"}`+"\n")
+	io.WriteString(w, `{"id": "b", "op": "execute", "code": "for { }"}`+"\n")
+	time.Sleep(10 * time.Millisecond)
+	io.WriteString(w, `{"op": "interrupt"}`+"\n")
+	io.WriteString(w, `{"id": "c", "op": "execute", "code": "x + 1"}`+"\n")
+	io.WriteString(w, "nope\n")
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`{"id":"a","cell":1}`,
+		`{"id":"b","cell":2,"error":{"message":"interrupted","file":"cell[2]","line":1,"traceback":[{"name":"main","file":"cell[2]","line":1}],"interrupted":true}}`,
+		`{"id":"c","cell":3,"values":[{"type":"number","text":"21"}]}`,
+		`{"cell":0,"error":{"message":"invalid request: invalid character 'o' in literal null (expecting 'u')"}}`,
+	}
+	if got := strings.TrimSpace(out.String()); got != strings.Join(want, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(want, "\n"), got)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// Operator overloading with metamethods:
+//
+//   proto Vec { x = 0, y = 0 }
+//   func Vec.__add(a, b) -> Vec(a.x + b.x, a.y + b.y)
+//   func Vec.__eq(a, b) -> a.x == b.x && a.y == b.y
+//   Vec(1, 2) + Vec(3, 4) == Vec(4, 6) // true
+//
+// When an operand of an arithmetic operator or a comparison is an
+// object, the method of the operator is looked up in the left operand
+// and then in the right one, and called with both operands in order,
+// with the object that has it as 'this'. The result of the method is
+// the result of the operator, != is the negation of __eq and > and >=
+// are __lt and __le with the operands swapped, as the compiler emits
+// them. Without a method the operator works as before.
+//
+// __index(key) is called when a key is not found in an object or in
+// it's parent chain, and it's result is the value of the key.
+//
+// The other methods the VM calls are __len (see OpLen) and __iter
+// (see OpForbegin).
+
+// metaNames are the methods of the operators, by opcode
+var metaNames = map[Opcode]string{
+	OpAdd: "__add",
+	OpSub: "__sub",
+	OpMul: "__mul",
+	OpDiv: "__div",
+	OpPow: "__pow",
+	OpLt:  "__lt",
+	OpLe:  "__le",
+	OpEq:  "__eq",
+	OpNe:  "__eq",
+}
+
+// binaryMeta calls the method of the operator op of the operands b
+// and c, if either is an object with it, and stores the result in R(a).
+// Returns false if there's no method to call.
+func (vm *VM) binaryMeta(cf *callFrame, op Opcode, a uint, b, c Value) (status int, ok bool) {
+	if op >= OpAddNN && op <= OpLeNN {
+		op = genericOps[op-OpAddNN]
+	}
+	name, ok := metaNames[op]
+	if !ok {
+		return 0, false
+	}
+	this := b
+	fn, ok := method(b, name)
+	if !ok {
+		this = c
+		if fn, ok = method(c, name); !ok {
+			return 0, false
+		}
+	}
+	res, status := vm.callMeta(fn, this, b, c)
+	if status != 0 {
+		return status, true
+	}
+	switch op {
+	case OpLt, OpLe, OpEq:
+		cf.r[a].setBool(res.ToBool())
+	case OpNe:
+		cf.r[a].setBool(!res.ToBool())
+	default:
+		cf.r[a].set(res)
+	}
+	return 0, true
+}
+
+// getKey returns the value of key in obj, or the result of it's
+// __index method if the key is not found
+func (vm *VM) getKey(obj *Object, key string) (Value, int) {
+	for o := obj; o != nil; o = o.Parent {
+		if val, ok := o.Fields[key]; ok {
+			return val, 0
+		}
+	}
+	fn, ok := method(obj, "__index")
+	if !ok {
+		return Nil{}, 0
+	}
+	return vm.callMeta(fn, obj, String(key))
+}
+
+// callMeta calls the metamethod fn with this and args, returning
+// it's first result
+func (vm *VM) callMeta(fn, this Value, args ...Value) (Value, int) {
+	var res []Value
+	switch fn := fn.(type) {
+	case GoFunc:
+		call := FuncCall{VM: vm, Args: args, This: this, ExpectResults: 1, NumArgs: uint(len(args))}
+		fn(&call)
+		vm.usage.NativeCalls++
+		res = call.results
+	case *Func:
+		var err error
+		if res, err = vm.invoke(fn, this, args); err != nil {
+			vm.error = err
+			return nil, 1
+		}
+	}
+	if len(res) == 0 {
+		return Nil{}, 0
+	}
+	return res[0], 0
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"time"
+)
+
+// FuncMetrics describes the size and complexity of a compiled function,
+// applications embedding user scripts can use it to enforce limits.
+type FuncMetrics struct {
+	Name  string // empty for main and anonymous functions
+	Line  int    // 0 for main
+	Depth int    // how deep the function is nested inside other functions
+
+	// Complexity is the cyclomatic complexity of the function, the
+	// number of conditional branches (including && and ||) plus one.
+	Complexity int
+
+	Statements int // statements in the body, not counting nested functions
+	MaxDepth   int // deepest nesting of blocks in the body
+	Registers  int // how many registers the function needs at the same time
+}
+
+// Metrics returns the metrics of the given function and all the
+// functions defined inside it, in the order they appear in the source.
+func Metrics(b *Bytecode) []FuncMetrics {
+	var res []FuncMetrics
+	collectMetrics(b, 0, &res)
+	return res
+}
+
+func collectMetrics(b *Bytecode, depth int, res *[]FuncMetrics) {
+	m := FuncMetrics{
+		Name:       b.Name,
+		Line:       b.Line,
+		Depth:      depth,
+		Complexity: 1,
+		Statements: int(b.NumStmts),
+		MaxDepth:   int(b.MaxDepth),
+		Registers:  int(b.NumRegs),
+	}
+	for _, instr := range b.Code {
+		switch OpGetOpcode(instr) {
+		case OpJmptrue, OpJmpfalse:
+			m.Complexity++
+		}
+	}
+
+	*res = append(*res, m)
+	for _, f := range b.Funcs {
+		collectMetrics(f, depth+1, res)
+	}
+}
+
+// Usage counts the work done by the programs run by a VM, so hosts
+// running scripts of different users can bill or limit them. The
+// counters add up over all the runs, until they are reset.
+type Usage struct {
+	Instructions uint64 // executed
+	NativeCalls  uint64 // calls to Go functions made by the scripts
+
+	// arrays, objects, closures and strings created by the
+	// scripts, without counting the ones made by Go functions
+	Allocations uint64
+
+	PeakRegisters int           // the most registers in use at the same time
+	NativeTime    time.Duration // spent in calls to Go functions
+}
+
+// Usage returns the resources used by the VM since it was
+// created or since the last call to ResetUsage.
+func (vm *VM) Usage() Usage {
+	return vm.usage
+}
+
+// ResetUsage clears the counters of the VM and returns them,
+// hosts can call it after each run to get the usage of the run.
+func (vm *VM) ResetUsage() Usage {
+	u := vm.usage
+	vm.usage = Usage{}
+	return u
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUsage(t *testing.T) {
+	source := `
+		proto Point { x = 0, y = 0 }
+		func f(n) -> [n, {n: n}, Point(n)]
+		var s = ""
+		for i := 0; i < 3; i++ {
+			f(i)
+			s = "${s}${len(str(i))}"
+		}
+		return s[1:]
+	`
+	vm := NewVM()
+	runString(t, vm, source)
+	first := vm.ResetUsage()
+	if first.Instructions == 0 || first.PeakRegisters == 0 {
+		t.Errorf("expected instructions and registers to be counted, got %+v", first)
+	}
+	// 3 calls to len and str
+	if first.NativeCalls != 6 {
+		t.Errorf("expected 6 native calls, got %d", first.NativeCalls)
+	}
+	// f, 3 * (array, object, Point, string) and the slice
+	if first.Allocations != 14 {
+		t.Errorf("expected 14 allocations, got %d", first.Allocations)
+	}
+	if vm.Usage() != (Usage{}) {
+		t.Errorf("expected the usage to be reset, got %+v", vm.Usage())
+	}
+
+	runString(t, vm, source)
+	second := vm.Usage()
+	second.NativeTime = first.NativeTime
+	if second != first {
+		t.Errorf("expected the same usage in the same run, got %+v and %+v", first, second)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	source := `var total = 0
+func classify(n) {
+	if n < 0 && n > -10 {
+		return "small negative"
+	} else if n == 0 {
+		return "zero"
+	}
+	for i := 0; i < n; i++ {
+		total += i
+	}
+	return n > 100 ? "big" : "positive"
+}
+var f = func(x) -> x * 2
+classify(f(3))`
+	code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := Metrics(code)
+	for i := range metrics {
+		if metrics[i].Registers == 0 {
+			t.Errorf("(%d) expected the registers to be counted", i)
+		}
+		metrics[i].Registers = 0
+	}
+
+	// the branches of classify are &&, the two ifs, the loop and the ternary
+	want := []FuncMetrics{
+		{Name: "", Line: 0, Depth: 0, Complexity: 1, Statements: 4, MaxDepth: 0},
+		{Name: "classify", Line: 2, Depth: 1, Complexity: 6, Statements: 6, MaxDepth: 1},
+		{Name: "f", Line: 13, Depth: 1, Complexity: 1, Statements: 1, MaxDepth: 0},
+	}
+	if !reflect.DeepEqual(metrics, want) {
+		t.Errorf("expected metrics:\n%+v\ngot:\n%+v", want, metrics)
+	}
+}
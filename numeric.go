@@ -0,0 +1,170 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"math"
+)
+
+// The numbers of the scripts are float64, there's no separate integer
+// type: the integers are the numbers without a fraction, and the ones
+// in the range of int64 are the integers of the host. By default the
+// result of + - * and ** on integers that falls out of the range is
+// kept as a float, which can't hold all the integers that big exactly
+// (like promoting them to a bigger type that loses precision). A VM
+// can be set to treat it as an overflow instead, with
+// VM.SetIntOverflow:
+//
+//	vm.SetIntOverflow(yo.OverflowError) // for money, never lose a cent
+//	vm.SetIntOverflow(yo.OverflowWrap)  // like Go, for hashes and games
+//
+// The conversion int(v) applies the same mode to the values out of
+// the range, and takes an optional rounding mode:
+//
+//	int(2.5)            2, "trunc" rounds towards zero
+//	int(2.5, "floor")   2
+//	int(2.5, "ceil")    3
+//	int(2.5, "round")   3, half away from zero
+//	int(2.5, "even")    2, half to even (banker's rounding)
+//
+// The compiler doesn't fold the constant expressions that overflow,
+// so they follow the mode of the VM that runs them.
+//
+// There's no mode that promotes the result to a big integer: the
+// scripts have no big integer type, and adding one to all the
+// operators, conversions and serialized formats is left out. The
+// hosts that need exact big results should use OverflowError and
+// do that arithmetic in native functions, with math/big.
+
+// IntOverflow is what a VM does when an integer operation overflows.
+type IntOverflow int
+
+const (
+	OverflowFloat    IntOverflow = iota // keep the result as a float, the default
+	OverflowWrap                        // wrap around, as int64 arithmetic in Go
+	OverflowSaturate                    // clamp to the nearest of math.MinInt64 and math.MaxInt64
+	OverflowError                       // raise an error
+)
+
+// SetIntOverflow sets what the VM does when an integer operation
+// overflows.
+func (vm *VM) SetIntOverflow(mode IntOverflow) {
+	vm.intOverflow = mode
+}
+
+// roundings are the modes of int(v, mode)
+var roundings = map[string]func(float64) float64{
+	"trunc": math.Trunc,
+	"floor": math.Floor,
+	"ceil":  math.Ceil,
+	"round": math.Round,
+	"even":  math.RoundToEven,
+}
+
+// isInt64 tells if f is an integer in the range of int64
+func isInt64(f float64) bool {
+	return f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+}
+
+// intArith is the result of the operator op with the integers a and
+// b, wrapped around on overflow. ok is false if op is not + - * or **
+// with a positive exponent, or a and b are not in the range of int64.
+func intArith(op Opcode, a, b float64) (res int64, overflow, ok bool) {
+	if !isInt64(a) || !isInt64(b) {
+		return 0, false, false
+	}
+	x, y := int64(a), int64(b)
+	switch op {
+	case OpAdd:
+		res = x + y
+		overflow = (x > 0 && y > 0 && res < 0) || (x < 0 && y < 0 && res >= 0)
+	case OpSub:
+		res = x - y
+		overflow = (x >= 0 && y < 0 && res < 0) || (x < 0 && y > 0 && res >= 0)
+	case OpMul:
+		res = x * y
+		overflow = mulOverflows(x, y, res)
+	case OpPow:
+		if y < 0 {
+			return 0, false, false
+		}
+		// by squaring, the base is only squared when it's used again
+		res = 1
+		for base := x; y > 0; y >>= 1 {
+			if y&1 == 1 {
+				next := res * base
+				overflow = overflow || mulOverflows(res, base, next)
+				res = next
+			}
+			if y > 1 {
+				next := base * base
+				overflow = overflow || mulOverflows(base, base, next)
+				base = next
+			}
+		}
+	default:
+		return 0, false, false
+	}
+	return res, overflow, true
+}
+
+// checkOverflow applies the overflow mode of the VM to res, the
+// result of the operator op with a and b. Returns false if it raised
+// an error.
+func (vm *VM) checkOverflow(op Opcode, a, b, res float64) (float64, bool) {
+	wrapped, overflow, ok := intArith(op, a, b)
+	if !ok || !overflow {
+		return res, true
+	}
+	switch vm.intOverflow {
+	case OverflowWrap:
+		return float64(wrapped), true
+	case OverflowSaturate:
+		return saturate(res), true
+	case OverflowError:
+		vm.setError("integer overflow: %s", formatIntOp(op, a, b))
+		return 0, false
+	}
+	return res, true
+}
+
+// intRange applies the overflow mode of the VM to f, the result of
+// a conversion to int
+func (vm *VM) intRange(f float64) (float64, error) {
+	if f >= math.MinInt64 && f < math.MaxInt64 {
+		return f, nil
+	}
+	switch vm.intOverflow {
+	case OverflowWrap:
+		f = math.Mod(f, 1<<64)
+		if f >= math.MaxInt64 {
+			f -= 1 << 64
+		} else if f < math.MinInt64 {
+			f += 1 << 64
+		}
+	case OverflowSaturate:
+		f = saturate(f)
+	case OverflowError:
+		return 0, fmt.Errorf("%v overflows int", Number(f))
+	}
+	return f, nil
+}
+
+func saturate(f float64) float64 {
+	if f > 0 {
+		return math.MaxInt64
+	}
+	return math.MinInt64
+}
+
+// mulOverflows tells if res, the product x * y, wrapped around
+func mulOverflows(x, y, res int64) bool {
+	return x != 0 && (res/x != y || (x == -1 && y == math.MinInt64))
+}
+
+var intOpSymbols = map[Opcode]string{OpAdd: "+", OpSub: "-", OpMul: "*", OpPow: "**"}
+
+func formatIntOp(op Opcode, a, b float64) string {
+	return fmt.Sprintf("%v %s %v", Number(a), intOpSymbols[op], Number(b))
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIntOverflow(t *testing.T) {
+	source := `var max = 9223372036854775807 - 1024
+	var big = 3037000500
+	return max + 2048, max - max - 2048, big * big, 2 ** 64, 3 ** 2, 2.5 * 3, int(1e30)`
+	for _, test := range []struct {
+		mode IntOverflow
+		want string
+	}{
+		{OverflowFloat, "9.223372036854776e+18 -2048 9.22337203700025e+18 1.8446744073709552e+19 9 7.5 1e+30"},
+		{OverflowWrap, "-9.223372036854775e+18 -2048 -9.223372036709301e+18 0 9 7.5 5.076964154930102e+18"},
+		{OverflowSaturate, "9.223372036854776e+18 -2048 9.223372036854776e+18 9.223372036854776e+18 9 7.5 9.223372036854776e+18"},
+	} {
+		vm := NewVM()
+		vm.SetIntOverflow(test.mode)
+		var got []string
+		for _, v := range runString(t, vm, source) {
+			got = append(got, v.String())
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("(%d) expected %s, got %s", test.mode, test.want, strings.Join(got, " "))
+		}
+	}
+
+	vm := NewVM()
+	vm.SetIntOverflow(OverflowError)
+	for _, source := range []string{
+		"var x = 9223372036854775807 - 1024\nreturn x * 2",
+		"return 9223372036854775807 - 1024 + 2048",
+	} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vm.run(code); err == nil || !strings.Contains(err.Error(), "overflow") {
+			t.Errorf("%q: expected an overflow error, got %v", source, err)
+		}
+	}
+	res := runString(t, vm, "try { int(1e30) } recover e { return e.message }")
+	if res[0].String() != "int: 1e+30 overflows int" {
+		t.Errorf("expected the error of int, got %v", res[0])
+	}
+}
+
+func TestIntRounding(t *testing.T) {
+	res := runString(t, NewVM(), `return int(2.5), int(-2.5), int(2.5, "floor"), int(-2.5, "floor"),
+		int(2.5, "ceil"), int(2.5, "round"), int(-2.5, "round"), int(2.5, "even"), int(3.5, "even")`)
+	want := []string{"2", "-2", "2", "-3", "3", "3", "-3", "2", "4"}
+	for i, v := range res {
+		if v.String() != want[i] {
+			t.Errorf("(%d) expected %s, got %v", i, want[i], v)
+		}
+	}
+}
@@ -23,9 +23,9 @@ const (
 	OpLoadnil    Opcode = iota //  R(A) ... R(B) = nil
 	OpLoadconst                //  R(A) = K(Bx)
 	OpLoadglobal               //  R(A) = globals[K(Bx)]
-	OpSetglobal                //  TODO: remove this opcode
-	OpLoadFree                 //  R(A) = refs[K(Bx)]
-	OpSetFree                  //  refs[K(Bx)] = R(A)
+	OpSetglobal                //  globals[K(Bx)] = R(A)
+	OpLoadFree                 //  R(A) = U(Bx)
+	OpSetFree                  //  U(Bx) = R(A)
 
 	OpUnm  //  R(A) = -RK(Bx)
 	OpNot  //  R(A) = NOT RK(Bx)
@@ -45,13 +45,18 @@ const (
 	OpLe  //  R(A) = RK(B) <= RK(C)
 	OpEq  //  R(A) = RK(B) == RK(C)
 	OpNe  //  R(A) = RK(B) != RK(C)
+	OpIn  //  R(A) = RK(B) in RK(C)
+
+	OpIsType  //  R(A) = RK(B) is a value of the type C (a ValueType)
+	OpIsProto //  R(A) = RK(C) is in the parent chain of RK(B)
 
 	OpMove     //  R(A) = R(B)
 	OpGetIndex //  R(A) = R(B)[RK(C)]
+	OpSlice    //  R(A) = R(A)[RK(B):RK(C)]
 	OpSetIndex //  R(A)[RK(B)] = RK(C)
 	OpAppend   //  R(A) = append(R(A), R(A+1) ... R(A+B))
 
-	OpCall       //  R(A) ... R(A+B-1) = R(A)(R(A+B) ... R(A+B+C-1))
+	OpCall       //  R(A) ... R(A+B-1) = R(A)(R(A+B) ... R(A+B+C-1)), if B == 0 then R(A) = [results...] and the args start at R(A+1)
 	OpCallmethod //  same as OpCall, but first argument is the receiver
 	OpArray      //  R(A) = []
 	OpObject     //  R(A) = {}
@@ -61,13 +66,65 @@ const (
 	OpJmptrue  //  pc = pc + sBx if RK(A) is not false or nil
 	OpJmpfalse //  pc = pc + sBx if RK(A) is false or nil
 	OpReturn   //  return R(A) ... R(A+B-1)
-	OpForbegin //  R(A), R(A+1) = objkeys(R(B)), len(objkeys(R(B))) if R(B) is an object
-	//  R(A), R(A+1) = R(B), len(R(B)) if R(B) is an array
-	//  error if not array
-
-	OpForiter //  R(A) = R(A+1)++ if R(B) is an array
-	//  R(A) = R(C)[R(A+1)++] if R(B) is an object (R(C) should be an array of keys of the object)
-	kOpCount int = int(OpForiter) + 1
+	OpForbegin //  R(A), R(A+1), R(A+2) = R(B), len(R(B)), 0 if R(B) is an array or a range
+	//  R(A), R(A+1), R(A+2) = R(B).__iter(), -1, 0 if R(B) has an __iter method
+	//  R(A), R(A+1), R(A+2) = R(B), -1, 0 if R(B) has a next method (it's an iterator)
+	//  R(A), R(A+1), R(A+2) = objkeys(R(B)), len(objkeys(R(B))), 0 if R(B) is an object (sorted, see Object.Keys)
+	//  error otherwise
+
+	OpForiter //  R(A+2) = R(C+2) >= R(C+1), the loop is done
+	//  R(A), R(A+1) = R(C+2), R(B)[R(C+2)] if R(B) is an array
+	//  R(A), R(A+1) = R(C+2), the R(C+2)th number of R(B) if R(B) is a range
+	//  R(A), R(A+1) = R(C)[R(C+2)], R(B)[R(C)[R(C+2)]] if R(B) is an object (R(C) should be an array of keys of the object)
+	//  R(A), R(A+1), R(A+2) = R(C+2), R(C).next() if R(C) is an iterator (R(C+1) is -1)
+	//  R(C+2)++
+
+	OpClose //  close the upvalues of R(A) and above
+
+	OpWith    //  push R(A) to the resources, closed by OpEndWith or when stopped by an error
+	OpEndWith //  R(A) = pop the last resource and call it's close method
+
+	OpProto      //  R(A) = new prototype named K(Bx)
+	OpProtofield //  declare the field RK(B) with the type named RK(C) in the prototype R(A), or inherit from R(B)
+
+	OpConcat //  R(A) = str(R(B)) + ... + str(R(C)), "" if B > C
+	OpLen    //  R(A) = len(RK(Bx)), or RK(Bx).__len() if it has that method
+
+	// specialized versions of the opcodes above for number operands,
+	// emitted by the compiler when it knows the operands are numbers
+	// and by the VM after it sees the generic version with numbers
+	// (if the operands turn out not to be numbers, they go back
+	// to the generic version)
+	OpAddNN //  R(A) = RK(B) + RK(C)
+	OpSubNN //  R(A) = RK(B) - RK(C)
+	OpMulNN //  R(A) = RK(B) * RK(C)
+	OpDivNN //  R(A) = RK(B) / RK(C)
+	OpLtNN  //  R(A) = RK(B) < RK(C)
+	OpLeNN  //  R(A) = RK(B) <= RK(C)
+
+	// the step and the condition of a loop like
+	// for i := 0; i < n; i++, see VisitForStmt
+	OpForloop //  R(A) += 1; if R(A) < RK(B) then pc -= C
+
+	// the try blocks, see VisitTryRecoverStmt
+	OpPushHandler //  push a handler: on an error, R(A) = the error, R(A+1) = true and pc += sBx
+	OpPopHandler  //  pop the last handler
+	OpPanic       //  raise R(A) as an error
+
+	// the indexing of objects with a constant string key,
+	// like a selector, see VisitSelector
+	OpGetField //  R(A) = R(B)[K(C)]
+	OpSetField //  R(A)[K(B)] = RK(C)
+
+	OpRange //  R(A) = R(A)..RK(B) by RK(C)
+
+	// a, b = arr... and [a, b] = arr, see VisitVarArg
+	OpUnpack //  R(A) ... R(A+B-1) = R(C)[0] ... R(C)[B-1], nil after the end of R(C)
+
+	// [a, rest..., b], see VisitArray
+	OpAppendArray //  R(A) = append(R(A), R(B)...)
+
+	kOpCount int = int(OpAppendArray) + 1
 )
 
 // instruction parameters
@@ -90,56 +147,37 @@ const (
 const OpConstOffset = 250
 
 var (
-	opStrings = map[Opcode]string{
-		OpLoadnil:    "loadnil",
-		OpLoadconst:  "loadconst",
-		OpLoadglobal: "loadglobal",
-		OpSetglobal:  "setglobal",
-		OpLoadFree:   "loadfree",
-		OpSetFree:    "setfree",
-
-		OpUnm:  "neg",
-		OpNot:  "not",
-		OpCmpl: "cmpl",
-
-		OpAdd: "add",
-		OpSub: "sub",
-		OpMul: "mul",
-		OpDiv: "div",
-		OpPow: "pow",
-		OpShl: "shl",
-		OpShr: "shr",
-		OpAnd: "and",
-		OpOr:  "or",
-		OpXor: "xor",
-		OpLt:  "lt",
-		OpLe:  "le",
-		OpEq:  "eq",
-		OpNe:  "ne",
-
-		OpMove:     "move",
-		OpGetIndex: "getindex",
-		OpSetIndex: "setindex",
-		OpAppend:   "append",
-
-		OpCall:       "call",
-		OpCallmethod: "callmethod",
-		OpArray:      "array",
-		OpObject:     "object",
-		OpFunc:       "func",
-
-		OpJmp:      "jmp",
-		OpJmptrue:  "jmptrue",
-		OpJmpfalse: "jmpfalse",
-		OpReturn:   "return",
-		OpForbegin: "forbegin",
-		OpForiter:  "foriter",
+	// generic opcode -> specialized for numbers
+	numberOps = map[Opcode]Opcode{
+		OpAdd: OpAddNN,
+		OpSub: OpSubNN,
+		OpMul: OpMulNN,
+		OpDiv: OpDivNN,
+		OpLt:  OpLtNN,
+		OpLe:  OpLeNN,
 	}
+
+	// specialized -> generic, indexed by op-OpAddNN
+	genericOps = [...]Opcode{OpAdd, OpSub, OpMul, OpDiv, OpLt, OpLe}
 )
 
 // Stringer interface
 func (op Opcode) String() string {
-	return opStrings[op]
+	return op.Info().Name
+}
+
+// replace the opcode of the instruction
+func opSetOpcode(instr uint32, op Opcode) uint32 {
+	return instr&^kOpcodeMask | uint32(op)
+}
+
+// OpGeneric returns instr with the generic opcode if the VM specialized
+// it for numbers while running (OpAddNN to OpLeNN), or instr as it is.
+func OpGeneric(instr uint32) uint32 {
+	if op := OpGetOpcode(instr); op >= OpAddNN && op <= OpLeNN {
+		return opSetOpcode(instr, genericOps[op-OpAddNN])
+	}
+	return instr
 }
 
 // Instruction constructors.
@@ -191,3 +229,69 @@ func OpGetBx(instr uint32) uint {
 func OpGetsBx(instr uint32) int {
 	return int(OpGetBx(instr)) - kArgsBxMask
 }
+
+// highestRegister returns the highest register used by the
+// instruction, or -1 if it doesn't use any
+func highestRegister(instr uint32) int {
+	a, b, c := int(OpGetA(instr)), int(OpGetB(instr)), int(OpGetC(instr))
+	bx := int(OpGetBx(instr))
+	reg := func(regs ...int) int {
+		max := -1
+		for _, r := range regs {
+			if r < OpConstOffset && r > max {
+				max = r
+			}
+		}
+		return max
+	}
+
+	switch OpGetOpcode(instr) {
+	case OpLoadnil, OpMove:
+		return reg(a, b)
+	case OpLoadconst, OpLoadglobal, OpSetglobal, OpLoadFree, OpSetFree, OpArray, OpObject, OpFunc:
+		return a
+	case OpUnm, OpNot, OpCmpl, OpLen:
+		return reg(a, bx)
+	case OpAppend:
+		return a + b
+	case OpCall, OpCallmethod:
+		if b == 0 {
+			// the results are collected in R(A)
+			b = 1
+		}
+		return reg(a, a+b+c-1)
+	case OpJmp, OpClose, OpPopHandler:
+		return -1
+	case OpPushHandler:
+		return a + 1
+	case OpPanic:
+		return a
+	case OpWith, OpEndWith, OpProto:
+		return a
+	case OpProtofield:
+		return reg(a, b, c)
+	case OpConcat:
+		return reg(a, c)
+	case OpForloop:
+		return reg(a, b)
+	case OpJmptrue, OpJmpfalse:
+		return reg(a)
+	case OpReturn:
+		return a + b - 1
+	case OpForbegin:
+		return reg(a+2, b)
+	case OpForiter:
+		return reg(a+2, b, c+2)
+	case OpIsType, OpGetField:
+		return reg(a, b)
+	case OpSetField:
+		return reg(a, c)
+	case OpUnpack:
+		return reg(a+b-1, c)
+	case OpAppendArray:
+		return reg(a, b)
+	default:
+		// arithmetic, comparison and indexing
+		return reg(a, b, c)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// Opcode metadata, for tools that need to understand the instructions
+// (disassemblers, verifiers, etc) without hard-coding them.
+
+// OpFormat is how the operands of an instruction are encoded.
+type OpFormat uint8
+
+const (
+	FormatAB   OpFormat = iota // A and B
+	FormatABC                  // A, B and C
+	FormatABx                  // A and the unsigned Bx
+	FormatAsBx                 // A and the signed sBx
+	FormatABnC                 // A, B and C, which is negated (a jump backwards)
+)
+
+// OperandKind tells what an operand of an instruction refers to.
+type OperandKind uint8
+
+const (
+	OperandUnused  OperandKind = iota
+	OperandReg                 // a register
+	OperandRK                  // a register, or a constant if >= OpConstOffset
+	OperandConst               // index in the constants of the function
+	OperandFunc                // index in the functions defined in the function
+	OperandUpvalue             // index in the upvalues of the function
+	OperandJump                // offset relative to the next instruction
+	OperandCount               // a number of values (results, arguments, etc)
+	OperandType                // a ValueType
+)
+
+// OpcodeInfo describes an opcode.
+type OpcodeInfo struct {
+	Name   string
+	Format OpFormat
+
+	// the kind of each operand, B is Bx or sBx in the
+	// formats ABx and AsBx and C is unused in them
+	A, B, C OperandKind
+}
+
+// Opcodes describes all the opcodes, indexed by Opcode.
+var Opcodes = [kOpCount]OpcodeInfo{
+	OpLoadnil:    {"loadnil", FormatAB, OperandReg, OperandReg, OperandUnused},
+	OpLoadconst:  {"loadconst", FormatABx, OperandReg, OperandConst, OperandUnused},
+	OpLoadglobal: {"loadglobal", FormatABx, OperandReg, OperandConst, OperandUnused},
+	OpSetglobal:  {"setglobal", FormatABx, OperandReg, OperandConst, OperandUnused},
+	OpLoadFree:   {"loadfree", FormatABx, OperandReg, OperandUpvalue, OperandUnused},
+	OpSetFree:    {"setfree", FormatABx, OperandReg, OperandUpvalue, OperandUnused},
+
+	OpUnm:  {"neg", FormatABx, OperandReg, OperandRK, OperandUnused},
+	OpNot:  {"not", FormatABx, OperandReg, OperandRK, OperandUnused},
+	OpCmpl: {"cmpl", FormatABx, OperandReg, OperandRK, OperandUnused},
+
+	OpAdd: {"add", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpSub: {"sub", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpMul: {"mul", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpDiv: {"div", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpPow: {"pow", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpShl: {"shl", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpShr: {"shr", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpAnd: {"and", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpOr:  {"or", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpXor: {"xor", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpLt:  {"lt", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpLe:  {"le", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpEq:  {"eq", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpNe:  {"ne", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpIn:  {"in", FormatABC, OperandReg, OperandRK, OperandRK},
+
+	OpIsType:  {"istype", FormatABC, OperandReg, OperandRK, OperandType},
+	OpIsProto: {"isproto", FormatABC, OperandReg, OperandRK, OperandRK},
+
+	OpMove:     {"move", FormatAB, OperandReg, OperandReg, OperandUnused},
+	OpGetIndex: {"getindex", FormatABC, OperandReg, OperandReg, OperandRK},
+	OpSlice:    {"slice", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpSetIndex: {"setindex", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpAppend:   {"append", FormatAB, OperandReg, OperandCount, OperandUnused},
+
+	OpCall:       {"call", FormatABC, OperandReg, OperandCount, OperandCount},
+	OpCallmethod: {"callmethod", FormatABC, OperandReg, OperandCount, OperandCount},
+	OpArray:      {"array", FormatAB, OperandReg, OperandUnused, OperandUnused},
+	OpObject:     {"object", FormatAB, OperandReg, OperandUnused, OperandUnused},
+	OpFunc:       {"func", FormatABx, OperandReg, OperandFunc, OperandUnused},
+
+	OpJmp:      {"jmp", FormatAsBx, OperandUnused, OperandJump, OperandUnused},
+	OpJmptrue:  {"jmptrue", FormatAsBx, OperandRK, OperandJump, OperandUnused},
+	OpJmpfalse: {"jmpfalse", FormatAsBx, OperandRK, OperandJump, OperandUnused},
+	OpReturn:   {"return", FormatAB, OperandReg, OperandCount, OperandUnused},
+	OpForbegin: {"forbegin", FormatAB, OperandReg, OperandReg, OperandUnused},
+	OpForiter:  {"foriter", FormatABC, OperandReg, OperandReg, OperandReg},
+	OpClose:    {"close", FormatAB, OperandReg, OperandUnused, OperandUnused},
+
+	OpWith:    {"with", FormatAB, OperandReg, OperandUnused, OperandUnused},
+	OpEndWith: {"endwith", FormatAB, OperandReg, OperandUnused, OperandUnused},
+
+	OpProto:      {"proto", FormatABx, OperandReg, OperandConst, OperandUnused},
+	OpProtofield: {"protofield", FormatABC, OperandReg, OperandRK, OperandRK},
+
+	OpConcat: {"concat", FormatABC, OperandReg, OperandReg, OperandReg},
+	OpLen:    {"len", FormatABx, OperandReg, OperandRK, OperandUnused},
+
+	OpAddNN: {"addnn", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpSubNN: {"subnn", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpMulNN: {"mulnn", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpDivNN: {"divnn", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpLtNN:  {"ltnn", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpLeNN:  {"lenn", FormatABC, OperandReg, OperandRK, OperandRK},
+
+	OpForloop: {"forloop", FormatABnC, OperandReg, OperandRK, OperandJump},
+
+	OpPushHandler: {"pushhandler", FormatAsBx, OperandReg, OperandJump, OperandUnused},
+	OpPopHandler:  {"pophandler", FormatAB, OperandUnused, OperandUnused, OperandUnused},
+	OpPanic:       {"panic", FormatAB, OperandReg, OperandUnused, OperandUnused},
+
+	OpGetField: {"getfield", FormatABC, OperandReg, OperandReg, OperandConst},
+	OpSetField: {"setfield", FormatABC, OperandReg, OperandConst, OperandRK},
+
+	OpRange:       {"range", FormatABC, OperandReg, OperandRK, OperandRK},
+	OpUnpack:      {"unpack", FormatABC, OperandReg, OperandCount, OperandReg},
+	OpAppendArray: {"appendarray", FormatAB, OperandReg, OperandReg, OperandUnused},
+}
+
+// Info returns the description of the opcode, the zero
+// OpcodeInfo if it's not a valid opcode.
+func (op Opcode) Info() OpcodeInfo {
+	if int(op) >= kOpCount {
+		return OpcodeInfo{}
+	}
+	return Opcodes[op]
+}
+
+// OpDecode splits an instruction in it's opcode and operands
+// according to the opcode's format. For the formats ABx and AsBx
+// b is Bx or sBx and c is always 0, for ABnC c is -C.
+func OpDecode(instr uint32) (op Opcode, a, b, c int) {
+	op = OpGetOpcode(instr)
+	a = int(OpGetA(instr))
+	switch op.Info().Format {
+	case FormatAB:
+		b = int(OpGetB(instr))
+	case FormatABC:
+		b, c = int(OpGetB(instr)), int(OpGetC(instr))
+	case FormatABx:
+		b = int(OpGetBx(instr))
+	case FormatAsBx:
+		b = OpGetsBx(instr)
+	case FormatABnC:
+		b, c = int(OpGetB(instr)), -int(OpGetC(instr))
+	}
+	return
+}
@@ -0,0 +1,21 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"testing"
+)
+
+func TestOpcodes(t *testing.T) {
+	for op := Opcode(0); int(op) < kOpCount; op++ {
+		if op.Info().Name == "" {
+			t.Errorf("opcode %d has no metadata", op)
+		}
+	}
+
+	instr := OpNewAsBx(OpJmpfalse, 3, -5)
+	op, a, b, c := OpDecode(instr)
+	if op != OpJmpfalse || a != 3 || b != -5 || c != 0 {
+		t.Errorf("OpDecode: got %v %d %d %d", op, a, b, c)
+	}
+}
@@ -3,68 +3,232 @@
 package parse
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/glhrmfrts/yo/ast"
+	"io"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 type parser struct {
 	tok            ast.Token
 	literal        string
 	ignoreNewlines bool
+	noIn           bool // 'in' is not an operator in the head of a for statement
+	cell           bool // the source can end with a list of expressions, see ParseCell
 	tokenizer      tokenizer
+
+	// source offsets of the current token and
+	// the end of the token before it
+	start, end, prevEnd int
 }
 
+// ParseError is a syntax error in the source. Every ParseError matches
+// ErrSyntax and it's Code with errors.Is.
 type ParseError struct {
-	Guilty  ast.Token
+	Code    ErrorCode
+	Guilty  ast.Token // the token where the error was found, if any
 	Line    int
+	Column  int // in characters, starting at 1
 	File    string
 	Message string
+	Err     error // the error reading the source, if Code is ErrRead
+
+	Found      string // description of the guilty token
+	Expected   string // what was expected instead, if known
+	SourceLine string // the line of the source where the error was found
+}
+
+// ErrSyntax matches any ParseError with errors.Is.
+var ErrSyntax = errors.New("syntax error")
+
+// ErrorCode tells the kind of a ParseError.
+type ErrorCode int
+
+const (
+	ErrUnexpectedToken   ErrorCode = iota + 1 // a token not allowed where it was found
+	ErrIllegalToken                           // malformed characters, numbers or strings
+	ErrIllegalArgument                        // misplaced argument in a call or function
+	ErrIllegalAssignment                      // non-assignable or non-identifier at the left side
+	ErrIllegalExpression                      // an expression that can't be a statement
+	ErrSourceTooLarge                         // the source is larger than the limit
+	ErrRead                                   // the source couldn't be read
+)
+
+var errorCodeStrings = [...]string{
+	ErrUnexpectedToken:   "unexpected token",
+	ErrIllegalToken:      "illegal token",
+	ErrIllegalArgument:   "illegal argument",
+	ErrIllegalAssignment: "illegal assignment",
+	ErrIllegalExpression: "illegal expression",
+	ErrSourceTooLarge:    "source too large",
+	ErrRead:              "read error",
+}
+
+// Error returns a description of the code, so it can
+// be used as a target for errors.Is.
+func (code ErrorCode) Error() string {
+	if code > 0 && int(code) < len(errorCodeStrings) {
+		return errorCodeStrings[code]
+	}
+	return fmt.Sprintf("parse error %d", int(code))
 }
 
 func (err *ParseError) Error() string {
 	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Message)
 }
 
+// Detail returns the error followed by the line of the source
+// where it was found, with a caret under the guilty column:
+//
+//	main.yo:3: unexpected ')', expected identifier
+//	    var x = foo(a, )
+//	                   ^
+func (err *ParseError) Detail() string {
+	var buf bytes.Buffer
+	buf.WriteString(err.Error())
+	if err.SourceLine != "" || err.Column > 0 {
+		buf.WriteString("\n    ")
+		buf.WriteString(err.SourceLine)
+		buf.WriteString("\n    ")
+		// keep the tabs so the caret lines up
+		col := 1
+		for _, r := range err.SourceLine {
+			if col >= err.Column {
+				break
+			}
+			if r == '\t' {
+				buf.WriteByte('\t')
+			} else {
+				buf.WriteByte(' ')
+			}
+			col++
+		}
+		for ; col < err.Column; col++ {
+			buf.WriteByte(' ')
+		}
+		buf.WriteByte('^')
+	}
+	return buf.String()
+}
+
+// MarshalJSON renders the error for tools, with the code as a string.
+func (err *ParseError) MarshalJSON() ([]byte, error) {
+	var code string
+	if err.Code != 0 {
+		code = err.Code.Error()
+	}
+	return json.Marshal(struct {
+		File       string `json:"file"`
+		Line       int    `json:"line"`
+		Column     int    `json:"column,omitempty"`
+		Code       string `json:"code,omitempty"`
+		Message    string `json:"message"`
+		Found      string `json:"found,omitempty"`
+		Expected   string `json:"expected,omitempty"`
+		SourceLine string `json:"sourceLine,omitempty"`
+	}{err.File, err.Line, err.Column, code, err.Message, err.Found, err.Expected, err.SourceLine})
+}
+
+func (err *ParseError) Is(target error) bool {
+	return target == ErrSyntax || (err.Code != 0 && target == error(err.Code))
+}
+
+func (err *ParseError) Unwrap() error {
+	return err.Err
+}
+
 //
 // common productions
 //
 
-func parseNumber(typ ast.Token, str string) float64 {
+func parseNumber(typ ast.Token, str string) (float64, error) {
 	if typ == ast.TokenFloat {
-		f, err := strconv.ParseFloat(str, 64)
-		if err != nil {
-			panic(err)
-		}
-		return f
-	} else {
-		i, err := strconv.Atoi(str)
-		if err != nil {
-			panic(err)
-		}
-		return float64(i)
+		return strconv.ParseFloat(str, 64)
 	}
+	// base 0 reads the prefixes 0x, 0o, 0b and 0 (octal),
+	// and the underscores between the digits
+	i, err := strconv.ParseUint(str, 0, 64)
+	return float64(i), err
 }
 
-func (p *parser) error(msg string) {
-	t := p.tokenizer
-	panic(&ParseError{Guilty: p.tok, Line: t.lineno, File: t.filename, Message: msg})
+func (p *parser) error(code ErrorCode, msg string) {
+	panic(p.newError(code, msg))
+}
+
+// newError creates a ParseError at the current token
+func (p *parser) newError(code ErrorCode, msg string) *ParseError {
+	t := &p.tokenizer
+	err := t.errorAt(code, msg, t.tokOffset, t.tokLine)
+	err.Guilty = p.tok
+	err.Found = p.tok.String()
+	switch p.tok {
+	case ast.TokenId, ast.TokenInt, ast.TokenFloat:
+		err.Found += " " + p.literal
+	case ast.TokenString, ast.TokenRawString:
+		err.Found += " " + strconv.Quote(p.literal)
+	case ast.TokenRune:
+		err.Found += " " + strconv.QuoteRune(p.runeValue())
+	}
+	return err
+}
+
+// runeValue returns the value of the current rune literal
+func (p *parser) runeValue() rune {
+	r, _ := utf8.DecodeRuneInString(p.literal)
+	return r
 }
 
 func (p *parser) errorExpected(expected string) {
-	p.error(fmt.Sprintf("unexpected %s, expected %s", p.tok, expected))
+	err := p.newError(ErrUnexpectedToken, fmt.Sprintf("unexpected %s, expected %s", p.tok, expected))
+	err.Expected = expected
+	panic(err)
 }
 
 func (p *parser) line() int {
 	return p.tokenizer.lineno
 }
 
+// pos returns the position of the current token
+func (p *parser) pos() ast.Position {
+	return p.tokenizer.position(p.start)
+}
+
+// nodeInfo returns the NodeInfo of a node reported at line, which
+// starts at start and ends with the last token consumed
+func (p *parser) nodeInfo(line int, start ast.Position) ast.NodeInfo {
+	return ast.NodeInfo{Line: line, Start: start, End: p.tokenizer.position(p.prevEnd)}
+}
+
+// tokenInfo returns the NodeInfo of a node made of the current token
+func (p *parser) tokenInfo() ast.NodeInfo {
+	return ast.NodeInfo{Line: p.line(), Start: p.pos(), End: p.tokenizer.position(p.end)}
+}
+
 func (p *parser) next() {
+	p.prevEnd = p.end
 	p.tok, p.literal = p.tokenizer.nextToken()
 
 	for p.ignoreNewlines && p.tok == ast.TokenNewline {
 		p.tok, p.literal = p.tokenizer.nextToken()
 	}
+	p.start, p.end = p.tokenizer.tokOffset, p.tokenizer.offset
+}
+
+// doc returns the /// comment on the lines right before the
+// current token, which starts a declaration
+func (p *parser) doc() string {
+	t := &p.tokenizer
+	if len(t.doc) == 0 || t.docEnd != p.pos().Line-1 {
+		return ""
+	}
+	doc := strings.Join(t.doc, "\n")
+	t.doc = nil
+	return doc
 }
 
 func (p *parser) accept(toktype ast.Token) bool {
@@ -76,7 +240,7 @@ func (p *parser) accept(toktype ast.Token) bool {
 }
 
 func (p *parser) makeId() *ast.Id {
-	return &ast.Id{Value: p.literal}
+	return &ast.Id{Value: p.literal, NodeInfo: p.tokenInfo()}
 }
 
 func (p *parser) makeSelector(left ast.Node) *ast.Selector {
@@ -86,8 +250,11 @@ func (p *parser) makeSelector(left ast.Node) *ast.Selector {
 func (p *parser) idList() []*ast.Id {
 	var list []*ast.Id
 
-	for p.tok == ast.TokenId {
-		list = append(list, &ast.Id{Value: p.literal})
+	for {
+		if p.tok != ast.TokenId {
+			p.errorExpected("identifier")
+		}
+		list = append(list, p.makeId())
 
 		p.next()
 		if !p.accept(ast.TokenComma) {
@@ -138,7 +305,12 @@ func (p *parser) exprList(inArray bool) []ast.Node {
 			break
 		}
 
+		line, start := p.line(), p.pos()
 		expr := p.expr()
+		if inArray && p.accept(ast.TokenDotdotdot) {
+			// the elements of an array, or all the results of a call
+			expr = &ast.VarArg{Arg: expr, NodeInfo: p.nodeInfo(line, start)}
+		}
 		list = append(list, expr)
 		if !p.accept(ast.TokenComma) {
 			break
@@ -148,25 +320,46 @@ func (p *parser) exprList(inArray bool) []ast.Node {
 	return list
 }
 
+// typeList parses the values of a case of a type switch, type names
+// (func is a keyword, as at the right of 'is') or prototypes
+func (p *parser) typeList() []ast.Node {
+	var list []ast.Node
+	for {
+		if p.tok == ast.TokenFunc {
+			list = append(list, p.makeId())
+			p.next()
+		} else {
+			list = append(list, p.expr())
+		}
+		if !p.accept(ast.TokenComma) {
+			break
+		}
+	}
+	return list
+}
+
 //
 // grammar rules
 //
 
 func (p *parser) array() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	p.next() // '['
 
 	if p.accept(ast.TokenRbrack) {
 		// no elements
-		return &ast.Array{}
+		return &ast.Array{NodeInfo: p.nodeInfo(line, start)}
 	}
 
 	list := p.exprList(true)
+	if _, ok := list[0].(*ast.VarArg); !ok && len(list) == 1 && p.tok == ast.TokenFor {
+		return p.comprehension(line, start, nil, list[0])
+	}
 	if !p.accept(ast.TokenRbrack) {
 		p.errorExpected("closing ']'")
 	}
 
-	return &ast.Array{Elements: list, NodeInfo: ast.NodeInfo{line}}
+	return &ast.Array{Elements: list, NodeInfo: p.nodeInfo(line, start)}
 }
 
 func (p *parser) objectFieldList() []*ast.ObjectField {
@@ -178,7 +371,8 @@ func (p *parser) objectFieldList() []*ast.ObjectField {
 		}
 
 		var key string
-		if p.tok == ast.TokenId || p.tok == ast.TokenString {
+		start := p.pos()
+		if p.tok == ast.TokenId || p.tok == ast.TokenString || p.tok == ast.TokenRawString {
 			key = p.literal
 			p.next()
 		} else {
@@ -187,10 +381,10 @@ func (p *parser) objectFieldList() []*ast.ObjectField {
 
 		line := p.line()
 		if !p.accept(ast.TokenColon) {
-			list = append(list, &ast.ObjectField{Key: key, NodeInfo: ast.NodeInfo{line}})
+			list = append(list, &ast.ObjectField{Key: key, NodeInfo: p.nodeInfo(line, start)})
 		} else {
 			value := p.expr()
-			list = append(list, &ast.ObjectField{Key: key, Value: value, NodeInfo: ast.NodeInfo{line}})
+			list = append(list, &ast.ObjectField{Key: key, Value: value, NodeInfo: p.nodeInfo(line, start)})
 		}
 
 		if !p.accept(ast.TokenComma) {
@@ -202,58 +396,128 @@ func (p *parser) objectFieldList() []*ast.ObjectField {
 }
 
 func (p *parser) object() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	p.next() // '{'
 
 	if p.accept(ast.TokenRbrace) {
 		// no elements
-		return &ast.Object{}
+		return &ast.Object{NodeInfo: p.nodeInfo(line, start)}
+	}
+
+	// the key of a comprehension can be any expression,
+	// so the first key is parsed as one
+	keyLine, keyStart := p.line(), p.pos()
+	key := p.expr()
+	var value ast.Node
+	if p.accept(ast.TokenColon) {
+		value = p.expr()
+		if p.tok == ast.TokenFor {
+			return p.comprehension(line, start, key, value)
+		}
 	}
 
-	fields := p.objectFieldList()
+	var fieldKey string
+	switch t := key.(type) {
+	case *ast.Id:
+		fieldKey = t.Value
+	case *ast.String:
+		fieldKey = t.Value
+	default:
+		p.error(ErrUnexpectedToken, "object key must be an identifier or string")
+	}
+
+	fields := []*ast.ObjectField{{Key: fieldKey, Value: value, NodeInfo: p.nodeInfo(keyLine, keyStart)}}
+	if p.accept(ast.TokenComma) {
+		fields = append(fields, p.objectFieldList()...)
+	}
 	if !p.accept(ast.TokenRbrace) {
 		p.errorExpected("closing '}'")
 	}
 
-	return &ast.Object{Fields: fields, NodeInfo: ast.NodeInfo{line}}
+	return &ast.Object{Fields: fields, NodeInfo: p.nodeInfo(line, start)}
+}
+
+// comprehension parses the rest of an array comprehension after its
+// element, or of an object comprehension if key is not nil
+func (p *parser) comprehension(line int, start ast.Position, key, value ast.Node) ast.Node {
+	loopLine, loopStart := p.line(), p.pos()
+	p.next() // 'for'
+
+	noIn := p.noIn
+	p.noIn = true
+	ids := p.exprList(false)
+	p.noIn = noIn
+	if p.tok != ast.TokenIn {
+		p.errorExpected("'in'")
+	}
+
+	loop := p.forIterator(ids, ast.TokenIf)
+	loop.NodeInfo = p.nodeInfo(loopLine, loopStart)
+
+	closing, expected := ast.TokenRbrack, "closing ']'"
+	if key != nil {
+		closing, expected = ast.TokenRbrace, "closing '}'"
+	}
+	if !p.accept(closing) {
+		p.errorExpected(expected)
+	}
+
+	return &ast.Comprehension{Key: key, Value: value, Loop: loop, NodeInfo: p.nodeInfo(line, start)}
 }
 
-func (p *parser) functionArgs() []ast.Node {
+// optional type annotation after ':'
+func (p *parser) typeAnnotation() *ast.Id {
+	if !p.accept(ast.TokenColon) {
+		return nil
+	}
+	if p.tok != ast.TokenId && p.tok != ast.TokenNil && p.tok != ast.TokenFunc {
+		p.errorExpected("type name")
+	}
+	typ := p.makeId()
+	p.next()
+	return typ
+}
+
+func (p *parser) functionArgs() ([]ast.Node, []*ast.Id) {
 	if !p.accept(ast.TokenLparen) {
 		p.errorExpected("'('")
 	}
 
 	var list []ast.Node
+	var types []*ast.Id
 	if p.accept(ast.TokenRparen) {
 		// no arguments
-		return list
+		return list, types
 	}
 
 	var vararg, kwarg bool
 	for p.tok == ast.TokenId {
 		if vararg {
-			p.error("argument after variadic argument")
+			p.error(ErrIllegalArgument, "argument after variadic argument")
 		}
 
 		var arg ast.Node
-		line := p.line()
+		line, start := p.line(), p.pos()
 		id := p.makeId()
 		p.next()
 
+		// ':'
+		types = append(types, p.typeAnnotation())
+
 		// '='
 		if p.accept(ast.TokenEq) {
 			value := p.expr()
-			arg = &ast.KwArg{Key: id.Value, Value: value, NodeInfo: ast.NodeInfo{line}}
+			arg = &ast.KwArg{Key: id.Value, Value: value, NodeInfo: p.nodeInfo(line, start)}
 			kwarg = true
 		} else if p.accept(ast.TokenDotdotdot) {
-			arg = &ast.VarArg{Arg: id, NodeInfo: ast.NodeInfo{line}}
+			arg = &ast.VarArg{Arg: id, NodeInfo: p.nodeInfo(line, start)}
 			vararg = true
 		} else {
 			if vararg {
-				p.error("positional argument after variadic argument")
+				p.error(ErrIllegalArgument, "positional argument after variadic argument")
 			}
 			if kwarg {
-				p.error("positional argument after keyword argument")
+				p.error(ErrIllegalArgument, "positional argument after keyword argument")
 			}
 			arg = id
 		}
@@ -267,28 +531,29 @@ func (p *parser) functionArgs() []ast.Node {
 	if !p.accept(ast.TokenRparen) {
 		p.errorExpected("closing ')'")
 	}
-	return list
+	return list, types
 }
 
 func (p *parser) functionBody() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	if p.accept(ast.TokenTilde) {
 		// '^' curried function
-		args := p.functionArgs()
+		args, types := p.functionArgs()
+		ret := p.typeAnnotation()
 		body := p.functionBody()
-		fn := &ast.Function{Args: args, Body: body, NodeInfo: ast.NodeInfo{line}}
+		fn := &ast.Function{Args: args, ArgTypes: types, ReturnType: ret, Body: body, NodeInfo: p.nodeInfo(line, start)}
 
 		return &ast.Block{
-			Nodes:    []ast.Node{&ast.ReturnStmt{Values: []ast.Node{fn}, NodeInfo: ast.NodeInfo{line}}},
-			NodeInfo: ast.NodeInfo{line},
+			Nodes:    []ast.Node{&ast.ReturnStmt{Values: []ast.Node{fn}, NodeInfo: p.nodeInfo(line, start)}},
+			NodeInfo: p.nodeInfo(line, start),
 		}
 	} else if p.accept(ast.TokenMinusgt) {
 		// '->' short function
 		list := p.exprList(false)
 
 		return &ast.Block{
-			Nodes:    []ast.Node{&ast.ReturnStmt{Values: list, NodeInfo: ast.NodeInfo{line}}},
-			NodeInfo: ast.NodeInfo{line},
+			Nodes:    []ast.Node{&ast.ReturnStmt{Values: list, NodeInfo: p.nodeInfo(line, start)}},
+			NodeInfo: p.nodeInfo(line, start),
 		}
 	} else if p.tok == ast.TokenLbrace {
 		// '{' regular function body
@@ -299,25 +564,49 @@ func (p *parser) functionBody() ast.Node {
 	return nil
 }
 
+// contracts parses the conditions of a function before it's body,
+// 'requires' and 'ensures' are names anywhere else:
+//
+//	func div(a, b) requires b != 0 ensures result * b == a -> a / b
+func (p *parser) contracts() (requires, ensures []ast.Node) {
+	for p.tok == ast.TokenId && (p.literal == "requires" || p.literal == "ensures") {
+		clause := p.literal
+		p.next()
+		if clause == "requires" {
+			requires = append(requires, p.expr())
+		} else {
+			ensures = append(ensures, p.expr())
+		}
+	}
+	return requires, ensures
+}
+
 func (p *parser) function() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
+	doc := p.doc()
 	p.next() // 'func'
 
 	var name ast.Node
 	if p.tok != ast.TokenLparen {
 		name = p.selectorOrSubscriptExpr(nil)
 		if !p.checkLhs(name) {
-			p.error("function name must be assignable")
+			p.error(ErrIllegalAssignment, "function name must be assignable")
 		}
 	}
 
-	args := p.functionArgs()
+	args, types := p.functionArgs()
+	ret := p.typeAnnotation()
+	requires, ensures := p.contracts()
 	body := p.functionBody()
-	return &ast.Function{Name: name, Args: args, Body: body, NodeInfo: ast.NodeInfo{line}}
+	fn := &ast.Function{Name: name, Args: args, ArgTypes: types, ReturnType: ret, Body: body, NodeInfo: p.nodeInfo(line, start)}
+	fn.Requires, fn.Ensures = requires, ensures
+	if name != nil {
+		fn.Doc = doc
+	}
+	return fn
 }
 
 func (p *parser) primaryExpr() ast.Node {
-	line := p.line()
 	// these first productions before the second 'switch'
 	// handle the ending token themselves, so 'defer p.next()'
 	// needs to be after them
@@ -328,9 +617,18 @@ func (p *parser) primaryExpr() ast.Node {
 		return p.array()
 	case ast.TokenLbrace:
 		return p.object()
+	case ast.TokenString, ast.TokenRawString, ast.TokenTemplate:
+		return p.stringLit()
+	case ast.TokenIf:
+		return p.ifStmt()
+	case ast.TokenMatch:
+		return p.matchStmt()
 	case ast.TokenLparen:
 		p.next()
+		old := p.noIn
+		p.noIn = false
 		expr := p.expr()
+		p.noIn = old
 		if !p.accept(ast.TokenRparen) {
 			p.errorExpected("closing ')'")
 		}
@@ -340,24 +638,33 @@ func (p *parser) primaryExpr() ast.Node {
 		defer p.next()
 		switch p.tok {
 		case ast.TokenInt, ast.TokenFloat:
-			return &ast.Number{Value: parseNumber(p.tok, p.literal), NodeInfo: ast.NodeInfo{line}}
+			value, err := parseNumber(p.tok, p.literal)
+			if err != nil {
+				if errors.Is(err, strconv.ErrRange) {
+					p.error(ErrIllegalToken, fmt.Sprintf("number %s out of range", p.literal))
+				}
+				p.error(ErrIllegalToken, fmt.Sprintf("illegal number %s", p.literal))
+			}
+			return &ast.Number{Value: value, NodeInfo: p.tokenInfo()}
 		case ast.TokenId:
-			return &ast.Id{Value: p.literal, NodeInfo: ast.NodeInfo{line}}
-		case ast.TokenString:
-			return &ast.String{Value: p.literal, NodeInfo: ast.NodeInfo{line}}
+			return p.makeId()
+		case ast.TokenRune:
+			// a rune is its code point, there's no integer type yet
+			return &ast.Number{Value: float64(p.runeValue()), NodeInfo: p.tokenInfo()}
 		case ast.TokenTrue, ast.TokenFalse:
-			return &ast.Bool{Value: p.tok == ast.TokenTrue, NodeInfo: ast.NodeInfo{line}}
+			return &ast.Bool{Value: p.tok == ast.TokenTrue, NodeInfo: p.tokenInfo()}
 		case ast.TokenNil:
-			return &ast.Nil{NodeInfo: ast.NodeInfo{line}}
+			return &ast.Nil{NodeInfo: p.tokenInfo()}
 		}
 	}
 
-	p.error(fmt.Sprintf("unexpected %s", p.tok))
+	p.error(ErrUnexpectedToken, fmt.Sprintf("unexpected %s", p.tok))
 	return nil
 }
 
 func (p *parser) selectorExpr(left ast.Node) ast.Node {
-	if !(p.tok == ast.TokenId) {
+	// keywords are valid field names
+	if !(p.tok == ast.TokenId || ast.IsKeyword(p.tok)) {
 		p.errorExpected("identifier")
 	}
 
@@ -366,12 +673,22 @@ func (p *parser) selectorExpr(left ast.Node) ast.Node {
 }
 
 func (p *parser) subscriptExpr(left ast.Node) ast.Node {
-	line := p.line()
-	expr := p.expr()
+	line, start := p.line(), p.pos()
+
+	// the bounds of a slice are optional
+	var expr ast.Node
+	if p.tok != ast.TokenColon {
+		expr = p.expr()
+	}
 	sub := &ast.Subscript{Left: left, Right: expr}
 	if p.accept(ast.TokenColon) {
-		expr2 := p.expr()
-		sub.Right = &ast.Slice{Start: expr, End: expr2, NodeInfo: ast.NodeInfo{line}}
+		var expr2 ast.Node
+		if p.tok != ast.TokenRbrack {
+			expr2 = p.expr()
+		}
+		sub.Right = &ast.Slice{Start: expr, End: expr2, NodeInfo: p.nodeInfo(line, start)}
+	} else if expr == nil {
+		p.errorExpected("index")
 	}
 
 	if !p.accept(ast.TokenRbrack) {
@@ -388,21 +705,21 @@ func (p *parser) selectorOrSubscriptExpr(left ast.Node) ast.Node {
 
 	for {
 		if dot, lBrack := p.tok == ast.TokenDot, p.tok == ast.TokenLbrack; dot || lBrack {
-			line := p.line()
+			line, start := p.line(), ast.Info(left).Start
 			old := p.ignoreNewlines
 			p.ignoreNewlines = false
 			p.next()
 			if p.tok == ast.TokenNewline || p.tok == ast.TokenEos {
-				p.error("expression not terminated")
+				p.error(ErrUnexpectedToken, "expression not terminated")
 			}
 			p.ignoreNewlines = old
 
 			if dot {
 				left = p.selectorExpr(left)
-				left.(*ast.Selector).NodeInfo.Line = line
+				left.(*ast.Selector).NodeInfo = p.nodeInfo(line, start)
 			} else {
 				left = p.subscriptExpr(left)
-				left.(*ast.Subscript).NodeInfo.Line = line
+				left.(*ast.Subscript).NodeInfo = p.nodeInfo(line, start)
 			}
 		} else {
 			break
@@ -419,8 +736,9 @@ func (p *parser) callArgs() []ast.Node {
 		return list
 	}
 
+	kwarg := false
 	for {
-		line := p.line()
+		line, start := p.line(), p.pos()
 		arg := p.expr()
 
 		// '='
@@ -428,12 +746,16 @@ func (p *parser) callArgs() []ast.Node {
 			value := p.expr()
 
 			if id, isId := arg.(*ast.Id); isId {
-				arg = &ast.KwArg{Key: id.Value, Value: value, NodeInfo: ast.NodeInfo{line}}
+				arg = &ast.KwArg{Key: id.Value, Value: value, NodeInfo: p.nodeInfo(line, start)}
+				kwarg = true
 			} else {
-				p.error("non-identifier in left side of keyword argument")
+				p.error(ErrIllegalArgument, "non-identifier in left side of keyword argument")
 			}
+		} else if kwarg {
+			// the keyword arguments are passed after the positional ones
+			p.error(ErrIllegalArgument, "positional argument after keyword argument")
 		} else if p.accept(ast.TokenDotdotdot) {
-			arg = &ast.VarArg{Arg: arg, NodeInfo: ast.NodeInfo{line}}
+			arg = &ast.VarArg{Arg: arg, NodeInfo: p.nodeInfo(line, start)}
 		}
 
 		list = append(list, arg)
@@ -446,36 +768,90 @@ func (p *parser) callArgs() []ast.Node {
 }
 
 func (p *parser) callExpr() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	left := p.selectorOrSubscriptExpr(nil)
 
-	var args []ast.Node
-	for p.accept(ast.TokenLparen) {
-		args = p.callArgs()
-		if !p.accept(ast.TokenRparen) {
-			p.errorExpected("closing ')'")
+	for {
+		if p.accept(ast.TokenLparen) {
+			args := p.callArgs()
+			if !p.accept(ast.TokenRparen) {
+				p.errorExpected("closing ')'")
+			}
+			left = &ast.CallExpr{Left: left, Args: args, NodeInfo: p.nodeInfo(line, start)}
+		} else if p.tok == ast.TokenTemplate && p.tokenizer.src[p.start] == '`' {
+			// tagged template, tag`...`
+			left = p.template(left, line, start)
+		} else {
+			break
 		}
-		left = &ast.CallExpr{Left: left, Args: args, NodeInfo: ast.NodeInfo{line}}
+
+		// the result may be selected and called again, as in a.f().g()
+		left = p.selectorOrSubscriptExpr(left)
 	}
 
-	return p.selectorOrSubscriptExpr(left)
+	return left
+}
+
+// stringLit parses adjacent string and template literals as one,
+// "a" "b" is "ab" and "a" `b${c}` is `ab${c}`. A string with
+// interpolations, "a${b}", is a template, a raw string is a string.
+func (p *parser) stringLit() ast.Node {
+	line, start := p.line(), p.pos()
+	parts := []string{""}
+	var exprs []ast.Node
+	for p.tok == ast.TokenString || p.tok == ast.TokenRawString || p.tok == ast.TokenTemplate {
+		if p.tok != ast.TokenTemplate {
+			parts[len(parts)-1] += p.literal
+			p.next()
+			continue
+		}
+		t := p.template(nil, line, start)
+		parts[len(parts)-1] += t.Parts[0]
+		parts = append(parts, t.Parts[1:]...)
+		exprs = append(exprs, t.Exprs...)
+	}
+
+	info := p.nodeInfo(line, start)
+	if len(exprs) == 0 {
+		return &ast.String{Value: parts[0], NodeInfo: info}
+	}
+	return &ast.Template{Parts: parts, Exprs: exprs, NodeInfo: info}
+}
+
+// template parses a template literal, the current token is it's text
+// up to the first interpolation
+func (p *parser) template(tag ast.Node, line int, start ast.Position) *ast.Template {
+	node := &ast.Template{Tag: tag, Parts: []string{p.literal}}
+	for p.tokenizer.interpolate {
+		p.next()
+		node.Exprs = append(node.Exprs, p.expr())
+		if p.tok != ast.TokenRbrace {
+			p.errorExpected("closing '}'")
+		}
+		p.tok, p.literal = p.tokenizer.resumeTemplate()
+		p.start, p.end = p.tokenizer.tokOffset, p.tokenizer.offset
+		node.Parts = append(node.Parts, p.literal)
+	}
+	p.next()
+	node.NodeInfo = p.nodeInfo(line, start)
+	return node
 }
 
 func (p *parser) postfixExpr() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	left := p.callExpr()
 
 	if ast.IsPostfixOp(p.tok) {
 		op := p.tok
 		p.next()
-		return &ast.PostfixExpr{Op: op, Left: left, NodeInfo: ast.NodeInfo{line}}
+		return &ast.PostfixExpr{Op: op, Left: left, NodeInfo: p.nodeInfo(line, start)}
 	}
 
 	return left
 }
 
 func (p *parser) unaryExpr() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	if ast.IsUnaryOp(p.tok) {
 		op := p.tok
 		p.next()
@@ -486,16 +862,20 @@ func (p *parser) unaryExpr() ast.Node {
 		} else {
 			right = p.postfixExpr()
 		}
-		return &ast.UnaryExpr{Op: op, Right: right, NodeInfo: ast.NodeInfo{line}}
+		return &ast.UnaryExpr{Op: op, Right: right, NodeInfo: p.nodeInfo(line, start)}
 	}
 
 	return p.postfixExpr()
 }
 
+func (p *parser) isBinaryOp(tok ast.Token) bool {
+	return ast.IsBinaryOp(tok) && !(p.noIn && tok == ast.TokenIn)
+}
+
 // parse a binary expression using the legendary wikipedia's algorithm :)
 func (p *parser) binaryExpr(left ast.Node, minPrecedence int) ast.Node {
 	line := p.line()
-	for ast.IsBinaryOp(p.tok) && ast.Precedence(p.tok) >= minPrecedence {
+	for p.isBinaryOp(p.tok) && ast.Precedence(p.tok) >= minPrecedence {
 		op := p.tok
 		opPrecedence := ast.Precedence(op)
 
@@ -504,23 +884,30 @@ func (p *parser) binaryExpr(left ast.Node, minPrecedence int) ast.Node {
 		p.ignoreNewlines = false
 		p.next()
 		if p.tok == ast.TokenNewline || p.tok == ast.TokenEos {
-			p.error("expression not terminated")
+			p.error(ErrUnexpectedToken, "expression not terminated")
 		}
 		p.ignoreNewlines = old
 
-		right := p.unaryExpr()
-		for (ast.IsBinaryOp(p.tok) && ast.Precedence(p.tok) > opPrecedence) ||
+		var right ast.Node
+		if op == ast.TokenIs && (p.tok == ast.TokenNil || p.tok == ast.TokenFunc) {
+			// type names that are keywords
+			right = p.makeId()
+			p.next()
+		} else {
+			right = p.unaryExpr()
+		}
+		for (p.isBinaryOp(p.tok) && ast.Precedence(p.tok) > opPrecedence) ||
 			(ast.RightAssociative(p.tok) && ast.Precedence(p.tok) >= opPrecedence) {
 			right = p.binaryExpr(right, ast.Precedence(p.tok))
 		}
-		left = &ast.BinaryExpr{Op: op, Left: left, Right: right, NodeInfo: ast.NodeInfo{line}}
+		left = &ast.BinaryExpr{Op: op, Left: left, Right: right, NodeInfo: p.nodeInfo(line, ast.Info(left).Start)}
 	}
 
 	return left
 }
 
 func (p *parser) ternaryExpr(left ast.Node) ast.Node {
-	line := p.line()
+	line, start := p.line(), ast.Info(left).Start
 	p.next() // '?'
 
 	whenTrue := p.expr()
@@ -529,11 +916,38 @@ func (p *parser) ternaryExpr(left ast.Node) ast.Node {
 	}
 
 	whenFalse := p.expr()
-	return &ast.TernaryExpr{Cond: left, Then: whenTrue, Else: whenFalse, NodeInfo: ast.NodeInfo{line}}
+	return &ast.TernaryExpr{Cond: left, Then: whenTrue, Else: whenFalse, NodeInfo: p.nodeInfo(line, start)}
+}
+
+// rangeExpr parses the rest of a range from the '..', the range binds
+// looser than the binary operators, so 0..n-1 is 0..(n-1). 'by' is a
+// name anywhere else.
+func (p *parser) rangeExpr(start ast.Node) ast.Node {
+	line := p.line()
+
+	// consume '..'
+	old := p.ignoreNewlines
+	p.ignoreNewlines = false
+	p.next()
+	if p.tok == ast.TokenNewline || p.tok == ast.TokenEos {
+		p.error(ErrUnexpectedToken, "expression not terminated")
+	}
+	p.ignoreNewlines = old
+
+	end := p.binaryExpr(p.unaryExpr(), 0)
+	var step ast.Node
+	if p.tok == ast.TokenId && p.literal == "by" {
+		p.next()
+		step = p.binaryExpr(p.unaryExpr(), 0)
+	}
+	return &ast.Range{Start: start, End: end, Step: step, NodeInfo: p.nodeInfo(line, ast.Info(start).Start)}
 }
 
 func (p *parser) expr() ast.Node {
 	left := p.binaryExpr(p.unaryExpr(), 0)
+	if p.tok == ast.TokenDotdot {
+		left = p.rangeExpr(left)
+	}
 
 	// avoid unecessary calls to ternaryExpr
 	if p.tok == ast.TokenQuestion {
@@ -544,7 +958,8 @@ func (p *parser) expr() ast.Node {
 }
 
 func (p *parser) declaration() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
+	doc := p.doc()
 	isConst := p.tok == ast.TokenConst
 	p.next()
 
@@ -553,11 +968,11 @@ func (p *parser) declaration() ast.Node {
 	// '='
 	if !p.accept(ast.TokenEq) {
 		// a declaration without any values
-		return &ast.Declaration{IsConst: isConst, Left: left, NodeInfo: ast.NodeInfo{line}}
+		return &ast.Declaration{IsConst: isConst, Left: left, Doc: doc, NodeInfo: p.nodeInfo(line, start)}
 	}
 
-	right := p.exprList(false)
-	return &ast.Declaration{IsConst: isConst, Left: left, Right: right, NodeInfo: ast.NodeInfo{line}}
+	right := p.valueList()
+	return &ast.Declaration{IsConst: isConst, Left: left, Right: right, Doc: doc, NodeInfo: p.nodeInfo(line, start)}
 }
 
 func (p *parser) assignment(left []ast.Node) ast.Node {
@@ -566,64 +981,134 @@ func (p *parser) assignment(left []ast.Node) ast.Node {
 	if left == nil {
 		left = p.exprList(false)
 	}
+	start := ast.Info(left[0]).Start
 
 	if !ast.IsAssignOp(p.tok) {
 		if len(left) > 1 {
-			p.error("illegal expression")
+			if p.cell {
+				// the results of a cell, when it's the last statement
+				p.accept(ast.TokenSemicolon)
+				if p.tok == ast.TokenEos {
+					return &ast.ReturnStmt{Values: left, NodeInfo: p.nodeInfo(line, start)}
+				}
+			}
+			p.error(ErrIllegalExpression, "illegal expression")
 		}
 		return left[0]
 	}
 
+	// '[a, b] := arr' is the same as 'a, b := arr...', and
+	// '{a, b: c} := obj' assigns the fields a and b of obj to a and c
+	var pattern ast.Node
+	var keys []string
+	if len(left) == 1 && (p.tok == ast.TokenColoneq || p.tok == ast.TokenEq) {
+		switch t := left[0].(type) {
+		case *ast.Array:
+			if len(t.Elements) == 0 {
+				p.error(ErrIllegalAssignment, "nothing to unpack at left side of assignment")
+			}
+			pattern, left = t, t.Elements
+		case *ast.Object:
+			if len(t.Fields) == 0 {
+				p.error(ErrIllegalAssignment, "nothing to unpack at left side of assignment")
+			}
+			pattern, left = t, nil
+			for _, field := range t.Fields {
+				target := field.Value
+				if target == nil {
+					target = &ast.Id{Value: field.Key, NodeInfo: field.NodeInfo}
+				}
+				keys = append(keys, field.Key)
+				left = append(left, target)
+			}
+		}
+	}
+
 	// ':='
 	if p.tok == ast.TokenColoneq {
 		// a short variable declaration
 		if isIdList := p.checkIdList(left); !isIdList {
-			p.error("non-identifier at left side of ':='")
+			p.error(ErrIllegalAssignment, "non-identifier at left side of ':='")
 		}
 	} else {
 		// validate left side of assignment
 		if isLhsList := p.checkLhsList(left); !isLhsList {
-			p.error("non-assignable at left side of '='")
+			p.error(ErrIllegalAssignment, "non-assignable at left side of '='")
 		}
 	}
 
 	op := p.tok
 	p.next()
 
-	right := p.exprList(false)
-	return &ast.Assignment{Op: op, Left: left, Right: right, NodeInfo: ast.NodeInfo{line}}
+	right := p.valueList()
+	switch pattern.(type) {
+	case *ast.Array:
+		if len(right) != 1 {
+			p.error(ErrIllegalAssignment, "expected one array to unpack at right side of assignment")
+		}
+		if _, ok := right[0].(*ast.VarArg); !ok {
+			info := ast.Info(right[0])
+			right[0] = &ast.VarArg{Arg: right[0], NodeInfo: info}
+		}
+	case *ast.Object:
+		if _, ok := right[0].(*ast.VarArg); ok || len(right) != 1 {
+			p.error(ErrIllegalAssignment, "expected one object to unpack at right side of assignment")
+		}
+		info := ast.Info(right[0])
+		right[0] = &ast.ObjectUnpack{Keys: keys, Value: right[0], NodeInfo: info}
+	}
+	return &ast.Assignment{Op: op, Left: left, Right: right, NodeInfo: p.nodeInfo(line, start)}
+}
+
+// valueList parses the values of an assignment or a declaration, the
+// last one is unpacked into the remaining names if followed by '...'
+func (p *parser) valueList() []ast.Node {
+	list := p.exprList(false)
+	if p.tok == ast.TokenDotdotdot {
+		p.next()
+		last := len(list) - 1
+		info := ast.Info(list[last])
+		list[last] = &ast.VarArg{Arg: list[last], NodeInfo: p.nodeInfo(info.Line, info.Start)}
+	}
+	return list
 }
 
 func (p *parser) stmt() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	defer p.accept(ast.TokenSemicolon)
 	switch tok := p.tok; tok {
 	case ast.TokenConst, ast.TokenVar:
 		return p.declaration()
 	case ast.TokenBreak, ast.TokenContinue, ast.TokenFallthrough:
 		p.next()
-		return &ast.BranchStmt{Type: tok, NodeInfo: ast.NodeInfo{line}}
+		return &ast.BranchStmt{Type: tok, NodeInfo: p.nodeInfo(line, start)}
 	case ast.TokenReturn:
 		p.next()
 		values := p.exprList(false)
-		return &ast.ReturnStmt{Values: values, NodeInfo: ast.NodeInfo{line}}
+		return &ast.ReturnStmt{Values: values, NodeInfo: p.nodeInfo(line, start)}
 	case ast.TokenPanic:
 		p.next()
 		err := p.expr()
-		return &ast.PanicStmt{Err: err, NodeInfo: ast.NodeInfo{line}}
+		return &ast.PanicStmt{Err: err, NodeInfo: p.nodeInfo(line, start)}
 	case ast.TokenIf:
 		return p.ifStmt()
 	case ast.TokenFor:
 		return p.forStmt()
+	case ast.TokenMatch:
+		return p.matchStmt()
 	case ast.TokenTry:
 		return p.tryRecoverStmt()
+	case ast.TokenWith:
+		return p.withStmt()
+	case ast.TokenProto:
+		return p.protoDecl()
 	default:
 		return p.assignment(nil)
 	}
 }
 
 func (p *parser) ifStmt() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	p.next() // 'if'
 
 	var init *ast.Assignment
@@ -648,23 +1133,31 @@ func (p *parser) ifStmt() ast.Node {
 		}
 	}
 
-	return &ast.IfStmt{Init: init, Cond: cond, Body: body, Else: else_, NodeInfo: ast.NodeInfo{line}}
+	return &ast.IfStmt{Init: init, Cond: cond, Body: body, Else: else_, NodeInfo: p.nodeInfo(line, start)}
 }
 
-func (p *parser) forIteratorStmt(ids []ast.Node) ast.Node {
+func (p *parser) forIteratorStmt(start ast.Position, ids []ast.Node) ast.Node {
 	line := p.line()
+	stmt := p.forIterator(ids, ast.TokenWhen)
+	stmt.Body = p.block()
+	stmt.NodeInfo = p.nodeInfo(line, start)
+	return stmt
+}
 
+// forIterator parses the head of a for iterator from the 'in', the
+// condition is introduced by filter ('when' in statements)
+func (p *parser) forIterator(ids []ast.Node, filter ast.Token) *ast.ForIteratorStmt {
 	var key *ast.Id
 	var value *ast.Id
 
 	length := len(ids)
 	if length > 2 {
-		p.error("too many identifiers in for iterator statement")
+		p.error(ErrIllegalAssignment, "too many identifiers in for iterator statement")
 	}
 
 	ok := p.checkIdList(ids)
 	if !ok {
-		p.error("non-identifier at left-side of 'in' in for iterator statement")
+		p.error(ErrIllegalAssignment, "non-identifier at left-side of 'in' in for iterator statement")
 	} else {
 		key = ids[0].(*ast.Id)
 		if length > 1 {
@@ -676,37 +1169,37 @@ func (p *parser) forIteratorStmt(ids []ast.Node) ast.Node {
 	coll := p.expr()
 
 	var when ast.Node
-	if p.accept(ast.TokenWhen) {
+	if p.accept(filter) {
 		when = p.expr()
 	}
 
-	body := p.block()
 	return &ast.ForIteratorStmt{
 		Key:        key,
 		Value:      value,
 		Collection: coll,
 		When:       when,
-		Body:       body,
-		NodeInfo:   ast.NodeInfo{line},
 	}
 }
 
 func (p *parser) forStmt() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	p.next() // 'for'
 
 	var init *ast.Assignment
 	var left []ast.Node
 	var cond ast.Node
 	var step ast.Node
-	var ok bool
+	var ok, noIn bool
 	if p.tok == ast.TokenLbrace {
 		goto parseBody
 	}
 
+	noIn = p.noIn
+	p.noIn = true
 	left = p.exprList(false)
+	p.noIn = noIn
 	if p.tok == ast.TokenIn {
-		return p.forIteratorStmt(left)
+		return p.forIteratorStmt(start, left)
 	}
 
 	cond = p.assignment(left)
@@ -728,16 +1221,210 @@ func (p *parser) forStmt() ast.Node {
 
 parseBody:
 	body := p.block()
-	return &ast.ForStmt{Init: init, Cond: cond, Step: step, Body: body, NodeInfo: ast.NodeInfo{line}}
+	return &ast.ForStmt{Init: init, Cond: cond, Step: step, Body: body, NodeInfo: p.nodeInfo(line, start)}
+}
+
+func (p *parser) matchStmt() ast.Node {
+	line, start := p.line(), p.pos()
+	p.next() // 'match'
+
+	// a type switch, match type(v) or match name := type(v)
+	var name *ast.Id
+	var isType bool
+	value := p.assignment(nil)
+	if assign, ok := value.(*ast.Assignment); ok {
+		if assign.Op != ast.TokenColoneq || len(assign.Left) != 1 || len(assign.Right) != 1 {
+			p.error(ErrIllegalAssignment, "expected name := type(value) in a type switch")
+		}
+		name = assign.Left[0].(*ast.Id)
+		value = assign.Right[0]
+	}
+	if call, ok := value.(*ast.CallExpr); ok && len(call.Args) == 1 {
+		if id, ok := call.Left.(*ast.Id); ok && id.Value == "type" && !isSpecialArg(call.Args[0]) {
+			value, isType = call.Args[0], true
+		}
+	}
+	if name != nil && !isType {
+		p.error(ErrIllegalAssignment, "':=' in a match is only allowed in a type switch, name := type(value)")
+	}
+
+	if !p.accept(ast.TokenLbrace) {
+		p.errorExpected("'{'")
+	}
+
+	var cases []*ast.MatchCase
+	for !(p.tok == ast.TokenRbrace || p.tok == ast.TokenEos) {
+		line, start := p.line(), p.pos()
+
+		var values []ast.Node
+		if p.tok == ast.TokenLbrack || p.tok == ast.TokenLbrace {
+			if isType {
+				p.error(ErrIllegalExpression, "a type switch can't have patterns")
+			}
+			values = []ast.Node{p.pattern()}
+			if p.tok == ast.TokenComma {
+				p.error(ErrIllegalExpression, "a pattern must be the only value of it's case")
+			}
+		} else if isType && p.tok != ast.TokenElse {
+			values = p.typeList()
+		} else if !p.accept(ast.TokenElse) {
+			values = p.exprList(false)
+		}
+
+		body := p.block()
+		cases = append(cases, &ast.MatchCase{Values: values, Body: body, NodeInfo: p.nodeInfo(line, start)})
+	}
+
+	if !p.accept(ast.TokenRbrace) {
+		p.errorExpected("closing '}'")
+	}
+	return &ast.MatchStmt{Name: name, Value: value, Cases: cases, IsType: isType, NodeInfo: p.nodeInfo(line, start)}
+}
+
+// pattern parses a value of a match case, where arrays and objects
+// are patterns whose names bind the parts of the value matched
+func (p *parser) pattern() ast.Node {
+	line, start := p.line(), p.pos()
+	switch p.tok {
+	case ast.TokenLbrack:
+		p.next()
+		var elements []ast.Node
+		var rest *ast.Id
+		for p.tok != ast.TokenRbrack {
+			if p.accept(ast.TokenDotdotdot) {
+				// the rest of the elements, always the last
+				if p.tok != ast.TokenId {
+					p.errorExpected("identifier")
+				}
+				rest = p.makeId()
+				p.next()
+				p.accept(ast.TokenComma)
+				break
+			}
+			elements = append(elements, p.pattern())
+			if !p.accept(ast.TokenComma) {
+				break
+			}
+		}
+		if !p.accept(ast.TokenRbrack) {
+			p.errorExpected("closing ']'")
+		}
+		return &ast.ArrayPattern{Elements: elements, Rest: rest, NodeInfo: p.nodeInfo(line, start)}
+	case ast.TokenLbrace:
+		p.next()
+		var fields []*ast.ObjectField
+		for p.tok != ast.TokenRbrace {
+			line, start := p.line(), p.pos()
+			tok, key := p.tok, p.literal
+			if tok != ast.TokenId && tok != ast.TokenString && tok != ast.TokenRawString {
+				p.errorExpected("identifier or string")
+			}
+			p.next()
+			var value ast.Node
+			if p.accept(ast.TokenColon) {
+				value = p.pattern()
+			} else if tok != ast.TokenId {
+				p.errorExpected("':'")
+			}
+			fields = append(fields, &ast.ObjectField{Key: key, Value: value, NodeInfo: p.nodeInfo(line, start)})
+			if !p.accept(ast.TokenComma) {
+				break
+			}
+		}
+		if !p.accept(ast.TokenRbrace) {
+			p.errorExpected("closing '}'")
+		}
+		return &ast.ObjectPattern{Fields: fields, NodeInfo: p.nodeInfo(line, start)}
+	}
+	return p.expr()
+}
+
+// isSpecialArg tells if node is a keyword argument or an expansion
+func isSpecialArg(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.KwArg, *ast.VarArg:
+		return true
+	}
+	return false
+}
+
+func (p *parser) withStmt() ast.Node {
+	line, start := p.line(), p.pos()
+	p.next() // 'with'
+
+	if p.tok != ast.TokenId {
+		p.errorExpected("identifier")
+	}
+	name := p.makeId()
+	p.next()
+	if !p.accept(ast.TokenColoneq) {
+		p.errorExpected("':='")
+	}
+
+	value := p.expr()
+	body := p.block()
+	return &ast.WithStmt{Name: name, Value: value, Body: body, NodeInfo: p.nodeInfo(line, start)}
+}
+
+func (p *parser) protoDecl() ast.Node {
+	line, start := p.line(), p.pos()
+	doc := p.doc()
+	p.next() // 'proto'
+
+	if p.tok != ast.TokenId {
+		p.errorExpected("identifier")
+	}
+	name := p.makeId()
+	p.next()
+
+	// ':' parent
+	var parent ast.Node
+	if p.accept(ast.TokenColon) {
+		parent = p.selectorOrSubscriptExpr(nil)
+	}
+	if !p.accept(ast.TokenLbrace) {
+		p.errorExpected("'{'")
+	}
+
+	var fields []*ast.ProtoField
+	for p.tok != ast.TokenRbrace {
+		if p.tok != ast.TokenId {
+			p.errorExpected("field name")
+		}
+		fieldLine, fieldStart := p.line(), p.pos()
+		field := &ast.ProtoField{Name: p.makeId()}
+		p.next()
+
+		// ':'
+		field.Type = p.typeAnnotation()
+
+		// '='
+		if p.accept(ast.TokenEq) {
+			field.Value = p.expr()
+		}
+		field.NodeInfo = p.nodeInfo(fieldLine, fieldStart)
+		fields = append(fields, field)
+
+		// one field per line is fine too
+		if !p.accept(ast.TokenComma) && !p.accept(ast.TokenSemicolon) {
+			break
+		}
+	}
+	if !p.accept(ast.TokenRbrace) {
+		p.errorExpected("closing '}'")
+	}
+
+	return &ast.ProtoDecl{Name: name, Parent: parent, Fields: fields, Doc: doc, NodeInfo: p.nodeInfo(line, start)}
 }
 
 func (p *parser) tryRecoverStmt() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	p.next() // 'try'
 
 	tryBlock := p.block().(*ast.Block)
 
 	var recoverBlock *ast.RecoverBlock
+	recoverStart := p.pos()
 	if p.accept(ast.TokenRecover) {
 		line := p.line()
 
@@ -748,7 +1435,7 @@ func (p *parser) tryRecoverStmt() ast.Node {
 		}
 
 		block := p.block().(*ast.Block)
-		recoverBlock = &ast.RecoverBlock{Id: id, Block: block, NodeInfo: ast.NodeInfo{line}}
+		recoverBlock = &ast.RecoverBlock{Id: id, Block: block, NodeInfo: p.nodeInfo(line, recoverStart)}
 	}
 
 	var finallyBlock *ast.Block
@@ -760,12 +1447,12 @@ func (p *parser) tryRecoverStmt() ast.Node {
 		Try:      tryBlock,
 		Recover:  recoverBlock,
 		Finally:  finallyBlock,
-		NodeInfo: ast.NodeInfo{line},
+		NodeInfo: p.nodeInfo(line, start),
 	}
 }
 
 func (p *parser) block() ast.Node {
-	line := p.line()
+	line, start := p.line(), p.pos()
 	if !p.accept(ast.TokenLbrace) {
 		p.errorExpected("'{'")
 	}
@@ -779,7 +1466,7 @@ func (p *parser) block() ast.Node {
 	if !p.accept(ast.TokenRbrace) {
 		p.errorExpected("closing '}'")
 	}
-	return &ast.Block{Nodes: nodes, NodeInfo: ast.NodeInfo{line}}
+	return &ast.Block{Nodes: nodes, NodeInfo: p.nodeInfo(line, start)}
 }
 
 func (p *parser) program() ast.Node {
@@ -789,7 +1476,7 @@ func (p *parser) program() ast.Node {
 		nodes = append(nodes, stmt)
 	}
 
-	return &ast.Block{Nodes: nodes}
+	return &ast.Block{Nodes: nodes, FrontMatter: p.tokenizer.frontMatter}
 }
 
 // initialization of parser
@@ -802,6 +1489,12 @@ func (p *parser) init(source []byte, filename string) {
 	p.next()
 }
 
+func (p *parser) initReader(r io.Reader, maxSize int, filename string) {
+	p.ignoreNewlines = true
+	p.tokenizer.initReader(r, maxSize, filename)
+	p.next()
+}
+
 func ParseExpr(source []byte) (expr ast.Node, err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -835,3 +1528,44 @@ func ParseFile(source []byte, filename string) (root ast.Node, err error) {
 	root = p.program()
 	return
 }
+
+// ParseCell is like ParseFile, but the source can end with a list of
+// expressions like 'a, b', which is parsed as a ReturnStmt of them. It's
+// used for the cells of notebooks, where the values are the results.
+func ParseCell(source []byte, filename string) (root ast.Node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if perr, ok := r.(*ParseError); ok {
+				err = perr
+			} else {
+				panic(r)
+			}
+		}
+	}()
+
+	var p parser
+	p.cell = true
+	p.init(source, filename)
+	root = p.program()
+	return
+}
+
+// ParseReader is like ParseFile, but reads the source from r as it's
+// tokenized. If maxSize > 0, sources larger than maxSize bytes are
+// rejected with an error without reading the rest of r.
+func ParseReader(r io.Reader, maxSize int, filename string) (root ast.Node, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if perr, ok := r.(*ParseError); ok {
+				err = perr
+			} else {
+				panic(r)
+			}
+		}
+	}()
+
+	var p parser
+	p.initReader(r, maxSize, filename)
+	root = p.program()
+	return
+}
@@ -5,9 +5,17 @@ package parse
 // TODO: add invalid tests expecting errors
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+
+	"github.com/glhrmfrts/yo/ast"
 )
 
 func TestExpr(t *testing.T) {
@@ -25,7 +33,15 @@ func TestExpr(t *testing.T) {
 		".5",
 		"\"Hello world!\"",
 		"\"Hello world\nI am a string!\"",
-		"'Hello world\nI am a longer string with single quotes'",
+		"'a'",
+		"'\\n'",
+		"'\\u{1F600}'",
+		"\"\\t\\x41\\u{e7}\\101\"",
+		"`text ${a + b} more ${f(`nested ${c}`)}`",
+		"sql`select * where id = ${id}`",
+		"\"adjacent \" \"strings \" `and ${templates}`",
+		"obj.tag`\\${not interpolated}`(1)",
+		"\"string ${a + b} with ${\"nested ${c}\"}\"",
 		"identifier",
 		"__identifier",
 		"identIfier",
@@ -37,15 +53,18 @@ func TestExpr(t *testing.T) {
 		"callingClosure()()",
 		"calling().field",
 		"object.field.calling()",
+		"object.calling().chained()[0].calling()",
 		"2 + 30 + 405",
 		"2.1654 * 0.123 / 180e+1",
 		"a*b-3/(5/2)",
 		"(((((((5/2)))))))",
-		"[1,2,3,4,5,'hello',6.45]",
-		"[1,2,3,4,5,'hello',trailing,]",
+		"[1,2,3,4,5,\"hello\",6.45]",
+		"[1,2,3,4,5,\"hello\",trailing,]",
 		"{field: value,field2: func() {}}",
-		"{2 + 2: value,\n\nfield: 'value\nvalue'}",
-		"{field: 'value', trailing: true,}",
+		"{\"2 + 2\": value,\n\nfield: \"value\nvalue\"}",
+		"{field: \"value\", trailing: true,}",
+		"[x * 2 for x in xs if x > 0]",
+		"{k: f(v) for k, v in obj}",
 		"func() {}",
 		"func(arg) { return arg }",
 		"func(arg) { return 2 }",
@@ -55,20 +74,33 @@ func TestExpr(t *testing.T) {
 		"func(a) ^(b) ^(c) -> a + b + c",
 		"func(a) ^(b) { return a * b * 3 }",
 		"func(a, b, c) ^(d, e, f, g) -> a + b + c + d + e + f + g",
+		"func(a: number, b: string): bool { return true }",
+		"func(a: number, b = 2, c: array...): number -> a",
+		"func(a: func) ^(b: nil): any -> a(b)",
 		"-2 + 5",
 		"-(2 + 5)",
 		"!false && true",
 		"!(false && true)",
 		"not false && true",
 		"(not false) && true",
+		"#items + 1",
+		"#\"str\" == #[1, 2]",
 		"reallyLongNameWithALotOfNonsenseWordsOnIt",
 		"5 < 2",
 		"5 > 2",
 		"a <= b * 2 / 3 * (4 ** 4)",
 		"5 ** 5",
-		"true ? 'is true' : 'is false'",
-		"true ? 'is true' : true ? 'is still true' : 'is false'",
-		"(98 < 100 ? 1 : 0) ? 'lt' : 'gt'",
+		"true ? \"is true\" : \"is false\"",
+		"true ? \"is true\" : true ? \"is still true\" : \"is false\"",
+		"(98 < 100 ? 1 : 0) ? \"lt\" : \"gt\"",
+		"if a { b } else if c { d } else { e }",
+		"1 + match x { 1 { a } else { b } }",
+		"1..10",
+		"0..#items - 1 by 2",
+		"[1, rest..., f()..., 5]",
+		"n..0 by -1",
+		"f(a, b = 2, c = g(x = 1))",
+		"match p { [] { a } [x, [1, _], ...rest] { b } {x, \"y\": {z}, kind: \"point\"} { c } }",
 	}
 
 	fmt.Println("TestExpr:")
@@ -90,8 +122,10 @@ func TestFiles(t *testing.T) {
 	fmt.Println("TestFiles:")
 	for i, file := range valid {
 		source, err := ioutil.ReadFile("./../../tests/" + file)
-		if err != nil {
-			panic(err)
+		if os.IsNotExist(err) {
+			t.Skipf("the fixture %s is not in this tree", file)
+		} else if err != nil {
+			t.Fatal(err)
 		}
 
 		_, err = ParseFile(source, file)
@@ -102,3 +136,362 @@ func TestFiles(t *testing.T) {
 		}
 	}
 }
+
+func TestContinuation(t *testing.T) {
+	source := `
+		var r = items
+			.filter(f)  // the comments are skipped
+			// even in their own line
+
+			.map(g)
+		x
+		y .5
+	`
+	for _, reader := range []bool{false, true} {
+		var root ast.Node
+		var err error
+		if reader {
+			root, err = ParseReader(iotest.OneByteReader(strings.NewReader(source)), 0, "continuation")
+		} else {
+			root, err = ParseFile([]byte(source), "continuation")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the newline before '.' doesn't end the statement, the others do
+		nodes := root.(*ast.Block).Nodes
+		if len(nodes) != 4 {
+			t.Fatalf("expected 4 statements, got %d", len(nodes))
+		}
+		call := nodes[0].(*ast.Declaration).Right[0].(*ast.CallExpr)
+		if sel := call.Left.(*ast.Selector); sel.Value != "map" {
+			t.Errorf("expected the chain to end with map, got %s", sel.Value)
+		}
+		if _, ok := nodes[1].(*ast.Id); !ok {
+			t.Errorf("expected x to be a statement, got %T", nodes[1])
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	valid := []struct {
+		source string
+		value  float64
+	}{
+		{"255", 255},
+		{"0xFF", 255},
+		{"0XfF", 255},
+		{"0o755", 493},
+		{"0755", 493},
+		{"0b1010", 10},
+		{"0B1_0", 2},
+		{"1_000_000", 1000000},
+		{"0x_FF_FF", 65535},
+		{"1_000.5", 1000.5},
+		{"1_0e1_0", 1e11},
+	}
+	for _, test := range valid {
+		root, err := ParseExpr([]byte(test.source))
+		if err != nil {
+			t.Errorf("%q: %v", test.source, err)
+			continue
+		}
+		if n, ok := root.(*ast.Number); !ok || n.Value != test.value {
+			t.Errorf("%q: expected %v, got %#v", test.source, test.value, root)
+		}
+	}
+
+	invalid := []string{
+		"0x", "0o", "0b", "0b102", "0o8", "0xFG", "089",
+		"1__0", "1_", "0x_", "1_.5", "0b1010_",
+		"0x1_0000_0000_0000_0000",
+	}
+	for _, source := range invalid {
+		if _, err := ParseExpr([]byte(source)); !errors.Is(err, ErrIllegalToken) {
+			t.Errorf("%q: expected an illegal token error, got %v", source, err)
+		}
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	strs := []struct {
+		source, value string
+	}{
+		{`"a\tb\n"`, "a\tb\n"},
+		{`"\"\\"`, "\"\\"},
+		{`"\x41\101"`, "AA"},
+		{`"\xc3\xa7"`, "ç"},
+		{`"\xff"`, "\xff"},
+		{`"\u00e7\u{e7}\U0001F600\u{1F600}"`, "çç😀😀"},
+	}
+	for _, test := range strs {
+		root, err := ParseExpr([]byte(test.source))
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if s, ok := root.(*ast.String); !ok || s.Value != test.value {
+			t.Errorf("%s: expected %q, got %#v", test.source, test.value, root)
+		}
+	}
+
+	runes := []struct {
+		source string
+		value  rune
+	}{
+		{`'a'`, 'a'},
+		{`'ç'`, 'ç'},
+		{`'\n'`, '\n'},
+		{`'\''`, '\''},
+		{`'\x7f'`, 0x7f},
+		{`'\u{1F600}'`, 0x1F600},
+	}
+	for _, test := range runes {
+		root, err := ParseExpr([]byte(test.source))
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if n, ok := root.(*ast.Number); !ok || n.Value != float64(test.value) {
+			t.Errorf("%s: expected %d, got %#v", test.source, test.value, root)
+		}
+	}
+
+	invalid := []string{
+		`"\q"`, `"\x4"`, `"\xzz"`, `"\'"`, `"\u{}"`, `"\u{110000}"`,
+		`"\u{D800}"`, `"\u{1234567}"`, `"\u{41"`, `"abc`,
+		`''`, `'ab'`, `'a`, "'\n'", `'\"'`,
+	}
+	for _, source := range invalid {
+		if _, err := ParseExpr([]byte(source)); !errors.Is(err, ErrIllegalToken) {
+			t.Errorf("%s: expected an illegal token error, got %v", source, err)
+		}
+	}
+}
+
+func TestRawStrings(t *testing.T) {
+	strs := []struct {
+		source, value string
+	}{
+		{`r"a\tb\n"`, `a\tb\n`},
+		{`r"C:\dir\${x}"`, `C:\dir\${x}`},
+		{"r\"multiple\r\n  lines\n\"", "multiple\n  lines\n"},
+		{`r"\d+" "\t"`, "\\d+\t"},
+		{`r""`, ""},
+	}
+	for _, test := range strs {
+		root, err := ParseExpr([]byte(test.source))
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+			continue
+		}
+		if s, ok := root.(*ast.String); !ok || s.Value != test.value {
+			t.Errorf("%s: expected %q, got %#v", test.source, test.value, root)
+		}
+	}
+
+	// r is still a name
+	if root, err := ParseExpr([]byte("r + r")); err != nil {
+		t.Error(err)
+	} else if _, ok := root.(*ast.BinaryExpr); !ok {
+		t.Errorf("expected a binary expression, got %#v", root)
+	}
+	if _, err := ParseExpr([]byte(`r"abc`)); !errors.Is(err, ErrIllegalToken) {
+		t.Errorf("expected an illegal token error, got %v", err)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	source := "#!/usr/bin/env yo\n---\nname: greeter\n\nversion:  1.2 \r\n---\nprintln(name)\n"
+	for _, reader := range []bool{false, true} {
+		var root ast.Node
+		var err error
+		if reader {
+			root, err = ParseReader(iotest.OneByteReader(strings.NewReader(source)), 0, "header")
+		} else {
+			root, err = ParseFile([]byte(source), "header")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := root.(*ast.Block)
+		want := map[string]string{"name": "greeter", "version": "1.2"}
+		if !reflect.DeepEqual(block.FrontMatter, want) {
+			t.Errorf("expected front matter %v, got %v", want, block.FrontMatter)
+		}
+		if len(block.Nodes) != 1 || ast.Line(block.Nodes[0]) != 7 {
+			t.Errorf("expected a statement at line 7, got %v", block.Nodes)
+		}
+	}
+
+	root, err := ParseFile([]byte("#!/bin/yo\nprintln(1)"), "shebang")
+	if err != nil || root.(*ast.Block).FrontMatter != nil {
+		t.Errorf("unexpected front matter or error %v", err)
+	}
+
+	invalid := []string{
+		"---\nname: greeter\n",
+		"---\nname\n---\n",
+		"---\nname: a\nname: b\n---\n",
+	}
+	for _, source := range invalid {
+		if _, err := ParseFile([]byte(source), "header"); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	source := `
+		// reading one byte at a time splits the multi-byte characters
+		var s = "áéí → ok"
+		func f(a, b) -> a >= b ? a : b
+	`
+	expected, err := ParseFile([]byte(source), "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := ParseReader(iotest.OneByteReader(strings.NewReader(source)), 0, "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(root, expected) {
+		t.Errorf("ParseReader and ParseFile results differ")
+	}
+
+	_, err = ParseReader(strings.NewReader(source), 16, "reader")
+	if err == nil {
+		t.Errorf("expected an error for a source larger than 16 bytes")
+	}
+}
+
+func TestCell(t *testing.T) {
+	for _, source := range []string{"x := 1\nx, f(x)", "x := 1\nx, f(x)\n"} {
+		root, err := ParseCell([]byte(source), "cell")
+		if err != nil {
+			t.Fatalf("%q: %s", source, err)
+		}
+		nodes := root.(*ast.Block).Nodes
+		if ret, ok := nodes[len(nodes)-1].(*ast.ReturnStmt); !ok || len(ret.Values) != 2 {
+			t.Errorf("%q: expected the last expressions to be returned, got %#v", source, nodes[len(nodes)-1])
+		}
+	}
+
+	// only at the end, and only in cells
+	if _, err := ParseCell([]byte("a, b\nc"), "cell"); !errors.Is(err, ErrIllegalExpression) {
+		t.Errorf("expected an illegal expression, got %v", err)
+	}
+	if _, err := ParseFile([]byte("a, b"), "file"); !errors.Is(err, ErrIllegalExpression) {
+		t.Errorf("expected an illegal expression, got %v", err)
+	}
+}
+
+func TestErrorDetail(t *testing.T) {
+	source := "var a = 1\n\tvar x = f(a, )\n"
+	_, err := ParseFile([]byte(source), "detail.yo")
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected a ParseError, got %v", err)
+	}
+	if perr.Line != 2 || perr.Column != 15 || perr.Found != ")" || perr.SourceLine != "\tvar x = f(a, )" {
+		t.Errorf("unexpected position %d:%d, found %q in %q", perr.Line, perr.Column, perr.Found, perr.SourceLine)
+	}
+	expected := "detail.yo:2: unexpected )\n" +
+		"    \tvar x = f(a, )\n" +
+		"    \t             ^"
+	if detail := perr.Detail(); detail != expected {
+		t.Errorf("unexpected detail:\n%s", detail)
+	}
+
+	_, err = ParseFile([]byte("func f(a, b {}"), "detail.yo")
+	perr = err.(*ParseError)
+	if perr.Expected != "closing ')'" || perr.Found != "{" {
+		t.Errorf("unexpected found %q and expected %q", perr.Found, perr.Expected)
+	}
+
+	for _, source := range []string{"var = 1", "const a, = 1"} {
+		_, err = ParseFile([]byte(source), "detail.yo")
+		if perr, ok := err.(*ParseError); !ok || perr.Expected != "identifier" {
+			t.Errorf("%q: expected a missing identifier, got %v", source, err)
+		}
+	}
+
+	b, err := json.Marshal(perr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["code"] != "unexpected token" || decoded["line"] != float64(1) || decoded["column"] != float64(13) {
+		t.Errorf("unexpected JSON %s", b)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	source := "var s = \"ação\" + x\nfoo.bar[1](\n\t2)\n"
+	root, err := ParseFile([]byte(source), "positions.yo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := root.(*ast.Block).Nodes
+	decl := nodes[0].(*ast.Declaration)
+	call := nodes[1].(*ast.CallExpr)
+	sub := call.Left.(*ast.Subscript)
+	tests := []struct {
+		node       ast.Node
+		start, end string
+	}{
+		{decl, "1:1", "1:19"},
+		{decl.Left[0], "1:5", "1:6"},
+		{decl.Right[0], "1:9", "1:19"},
+		{decl.Right[0].(*ast.BinaryExpr).Left, "1:9", "1:15"},
+		{call, "2:1", "3:4"},
+		{sub, "2:1", "2:11"},
+		{sub.Left, "2:1", "2:8"},
+		{call.Args[0], "3:2", "3:3"},
+	}
+	for i, test := range tests {
+		info := ast.Info(test.node)
+		if info.Start.String() != test.start || info.End.String() != test.end {
+			t.Errorf("(%d) expected %s-%s, got %s-%s", i, test.start, test.end, info.Start, info.End)
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	root, err := ParseFile([]byte("match p { [x, [1, _], ...rest] { a } {x, \"y\": {z}} { b } }"), "patterns.yo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := root.(*ast.Block).Nodes[0].(*ast.MatchStmt)
+	arr, ok := match.Cases[0].Values[0].(*ast.ArrayPattern)
+	if !ok || len(arr.Elements) != 2 || arr.Rest == nil || arr.Rest.Value != "rest" {
+		t.Fatalf("unexpected array pattern %#v", match.Cases[0].Values[0])
+	}
+	if nested, ok := arr.Elements[1].(*ast.ArrayPattern); !ok || len(nested.Elements) != 2 {
+		t.Errorf("unexpected nested pattern %#v", arr.Elements[1])
+	}
+	obj, ok := match.Cases[1].Values[0].(*ast.ObjectPattern)
+	if !ok || len(obj.Fields) != 2 || obj.Fields[0].Value != nil || obj.Fields[1].Key != "y" {
+		t.Fatalf("unexpected object pattern %#v", match.Cases[1].Values[0])
+	}
+	if _, ok := obj.Fields[1].Value.(*ast.ObjectPattern); !ok {
+		t.Errorf("unexpected nested pattern %#v", obj.Fields[1].Value)
+	}
+
+	failing := []string{
+		"match p { [a], [b] { c } }",
+		"match p { [...rest, a] { c } }",
+		"match p { {\"a\"} { c } }",
+		"match type(p) { [a] { c } }",
+	}
+	for _, source := range failing {
+		if _, err := ParseFile([]byte(source), "patterns.yo"); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
@@ -37,9 +37,12 @@
 package parse
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/glhrmfrts/yo/ast"
-	"os"
+	"io"
+	"sort"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -53,11 +56,34 @@ type tokenizer struct {
 	lineno     int
 	insertSemi bool
 	last       ast.Token
+
+	frontMatter map[string]string // nil if the source has none
+	interpolate bool              // the last template text ended with "${"
+	quotes      []rune            // of the literals being interpolated, from the outermost
+
+	// the text of the last run of /// comments on consecutive lines,
+	// and the line of the last one, see parser.doc
+	doc    []string
+	docEnd int
+
+	// position of the last token scanned
+	tokOffset int
+	tokLine   int
+
+	lineStarts []int // offset of the first character of each line
+
+	// when reading from an io.Reader, src is filled as the
+	// tokenizer advances (see fill)
+	reader  io.Reader
+	maxSize int // 0 means no limit
 }
 
 const bom = 0xFEFF
 const eof = -1
 
+// how much is read from the reader at a time
+const readChunkSize = 4096
+
 func isLetter(ch rune) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_' || ch >= 0x80 && unicode.IsLetter(ch)
 }
@@ -67,11 +93,91 @@ func isDigit(ch rune) bool {
 }
 
 func (t *tokenizer) error(msg string) {
-	fmt.Printf("%s:%d -> syntax error: %s\n", t.filename, t.lineno, msg)
-	os.Exit(1)
+	panic(t.errorAt(ErrIllegalToken, msg, t.offset, t.lineno))
+}
+
+// errorAt creates a ParseError at the character at offset,
+// line is the line count when the character was read
+func (t *tokenizer) errorAt(code ErrorCode, msg string, offset, line int) *ParseError {
+	if offset > len(t.src) {
+		offset = len(t.src)
+	}
+	if offset < len(t.src) && t.src[offset] == '\n' {
+		// the line is counted when the newline is read,
+		// but the newline ends the line before it
+		line--
+	}
+	start, end := offset, offset
+	for start > 0 && t.src[start-1] != '\n' {
+		start--
+	}
+	for end < len(t.src) && t.src[end] != '\n' {
+		end++
+	}
+	if end > start && t.src[end-1] == '\r' {
+		end--
+	}
+	return &ParseError{
+		Code:       code,
+		Line:       line,
+		Column:     utf8.RuneCount(t.src[start:offset]) + 1,
+		File:       t.filename,
+		Message:    msg,
+		SourceLine: string(t.src[start:end]),
+	}
+}
+
+// position returns the line and column of the character at offset,
+// which must have been read already
+func (t *tokenizer) position(offset int) ast.Position {
+	line := sort.Search(len(t.lineStarts), func(i int) bool {
+		return t.lineStarts[i] > offset
+	})
+	start := t.lineStarts[line-1]
+	if offset > len(t.src) {
+		offset = len(t.src)
+	}
+	return ast.Position{Line: line, Column: utf8.RuneCount(t.src[start:offset]) + 1}
+}
+
+// fill reads more source from the reader, at least enough
+// to decode the next character
+func (t *tokenizer) fill() {
+	t.fillTo(t.readOffset + utf8.UTFMax)
+}
+
+// fillTo reads from the reader until the source has n bytes
+// or the reader ends
+func (t *tokenizer) fillTo(n int) {
+	var chunk [readChunkSize]byte
+	for t.reader != nil && len(t.src) < n {
+		n, err := t.reader.Read(chunk[:])
+		t.src = append(t.src, chunk[:n]...)
+		if t.maxSize > 0 && len(t.src) > t.maxSize {
+			msg := fmt.Sprintf("source is larger than the maximum of %d bytes", t.maxSize)
+			panic(&ParseError{Code: ErrSourceTooLarge, Line: t.lineno, File: t.filename, Message: msg})
+		}
+		if err == io.EOF {
+			t.reader = nil
+		} else if err != nil {
+			panic(&ParseError{Code: ErrRead, Line: t.lineno, File: t.filename, Message: err.Error(), Err: err})
+		}
+	}
+}
+
+// peek returns the byte after the current character, 0 at the end
+// of the source
+func (t *tokenizer) peek() byte {
+	if t.readOffset < len(t.src) {
+		return t.src[t.readOffset]
+	}
+	return 0
 }
 
 func (t *tokenizer) nextChar() bool {
+	if t.reader != nil && len(t.src)-t.readOffset < utf8.UTFMax {
+		t.fill()
+	}
 	if t.readOffset < len(t.src) {
 		t.offset = t.readOffset
 		ch := t.src[t.readOffset]
@@ -92,6 +198,7 @@ func (t *tokenizer) nextChar() bool {
 
 		if ch == '\n' {
 			t.lineno++
+			t.lineStarts = append(t.lineStarts, t.offset+1)
 		}
 
 		t.r = r
@@ -107,9 +214,13 @@ func (t *tokenizer) nextChar() bool {
 func (t *tokenizer) scanComment() bool {
 	// initial '/' already consumed
 	if t.r == '/' {
+		offs, line, lineStart := t.offset-1, t.lineno, t.lineStarts[len(t.lineStarts)-1]
 		for t.r != eof && t.r != '\n' {
 			t.nextChar()
 		}
+		if len(bytes.TrimSpace(t.src[lineStart:offs])) == 0 {
+			t.docComment(line, string(t.src[offs:t.offset]))
+		}
 
 		return true
 	}
@@ -117,6 +228,20 @@ func (t *tokenizer) scanComment() bool {
 	return false
 }
 
+// docComment keeps the text of comment, alone in the given line,
+// if it's a /// comment
+func (t *tokenizer) docComment(line int, comment string) {
+	if !strings.HasPrefix(comment, "///") || strings.HasPrefix(comment, "////") {
+		return
+	}
+	text := strings.TrimPrefix(strings.TrimRight(comment[3:], "\r"), " ")
+	if t.docEnd != line-1 {
+		t.doc = nil
+	}
+	t.doc = append(t.doc, text)
+	t.docEnd = line
+}
+
 func (t *tokenizer) scanIdentifier() string {
 	offs := t.offset
 	for isLetter(t.r) || isDigit(t.r) {
@@ -125,6 +250,10 @@ func (t *tokenizer) scanIdentifier() string {
 	return string(t.src[offs:t.offset])
 }
 
+func lower(ch rune) rune {
+	return ('a' - 'A') | ch
+}
+
 func digitVal(ch rune) int {
 	switch {
 	case '0' <= ch && ch <= '9':
@@ -137,8 +266,10 @@ func digitVal(ch rune) int {
 	return 16
 }
 
+// scanMantissa scans the digits of base and the underscores separating
+// them, the placement of the underscores is checked by the parser
 func (t *tokenizer) scanMantissa(base int) {
-	for digitVal(t.r) < base {
+	for digitVal(t.r) < base || t.r == '_' {
 		t.nextChar()
 	}
 }
@@ -159,13 +290,19 @@ func (t *tokenizer) scanNumber(seenDecimalPoint bool) (ast.Token, string) {
 		// int or float
 		offs := t.offset
 		t.nextChar()
-		if t.r == 'x' || t.r == 'X' {
-			// hexadecimal int
+		if prefix := lower(t.r); prefix == 'x' || prefix == 'o' || prefix == 'b' {
+			// hexadecimal, octal or binary int
+			base, name := 16, "hexadecimal"
+			if prefix == 'o' {
+				base, name = 8, "octal"
+			} else if prefix == 'b' {
+				base, name = 2, "binary"
+			}
 			t.nextChar()
-			t.scanMantissa(16)
-			if t.offset-offs <= 2 {
-				// only scanned "0x" or "0X"
-				t.error("illegal hexadecimal number")
+			t.scanMantissa(base)
+			if t.offset-offs <= 2 || isLetter(t.r) || isDigit(t.r) {
+				// only scanned the prefix, or a digit not in base
+				t.error("illegal " + name + " number")
 			}
 		} else {
 			// octal int or float
@@ -191,7 +328,8 @@ func (t *tokenizer) scanNumber(seenDecimalPoint bool) (ast.Token, string) {
 	t.scanMantissa(10)
 
 fraction:
-	if t.r == '.' {
+	// 1..5 is a range, not 1. followed by .5
+	if t.r == '.' && t.peek() != '.' {
 		typ = ast.TokenFloat
 		t.nextChar()
 		t.scanMantissa(10)
@@ -211,12 +349,12 @@ exit:
 	return typ, string(t.src[offs:t.offset])
 }
 
-// scans a valid escape sequence and returns the evaluated value
-func (t *tokenizer) scanEscape(quote rune) rune {
+// scans a valid escape sequence and returns the evaluated value,
+// isByte tells if it's a single byte (\xNN and \NNN) instead of a rune
+func (t *tokenizer) scanEscape(quote rune) (r rune, isByte bool) {
 
 	var n int
 	var base, max uint32
-	var r rune
 
 	switch t.r {
 	case 'a':
@@ -239,11 +377,17 @@ func (t *tokenizer) scanEscape(quote rune) rune {
 		r = quote
 	case '0', '1', '2', '3', '4', '5', '6', '7':
 		n, base, max = 3, 8, 255
+		isByte = true
 	case 'x':
 		t.nextChar()
 		n, base, max = 2, 16, 255
+		isByte = true
 	case 'u':
 		t.nextChar()
+		if t.r == '{' {
+			t.nextChar()
+			return t.scanBracedEscape(), false
+		}
 		n, base, max = 4, 16, unicode.MaxRune
 	case 'U':
 		t.nextChar()
@@ -257,7 +401,8 @@ func (t *tokenizer) scanEscape(quote rune) rune {
 	}
 
 	if r > 0 {
-		return r
+		t.nextChar()
+		return r, false
 	}
 
 	var x uint32
@@ -273,43 +418,141 @@ func (t *tokenizer) scanEscape(quote rune) rune {
 		x = x*base + d
 		t.nextChar()
 		n--
-		if n == 0 && base == 16 && max == 255 && t.r == '\\' {
-			rd := t.readOffset
-			t.nextChar()
-			if t.r == 'x' {
-				n = 2
-				max = unicode.MaxRune
-				t.nextChar()
-			} else {
-				t.readOffset = rd
+	}
+
+	if x > max || !isByte && 0xD800 <= x && x < 0xE000 {
+		t.error("escape sequence is invalid Unicode code point")
+	}
+
+	return rune(x), isByte
+}
+
+// scans the hex digits of a \u{...} escape, after the '{'
+func (t *tokenizer) scanBracedEscape() rune {
+	var x uint32
+	n := 0
+	for t.r != '}' {
+		d := uint32(digitVal(t.r))
+		if d >= 16 {
+			msg := fmt.Sprintf("illegal character %#U in escape sequence", t.r)
+			if t.r < 0 {
+				msg = "escape sequence not terminated"
 			}
+			t.error(msg)
 		}
+		if n++; n > 6 {
+			t.error("escape sequence has more than 6 hex digits")
+		}
+		x = x*16 + d
+		t.nextChar()
 	}
+	t.nextChar()
 
-	if x > max || 0xD800 <= x && x < 0xE000 {
+	if n == 0 {
+		t.error("escape sequence has no hex digits")
+	}
+	if x > unicode.MaxRune || 0xD800 <= x && x < 0xE000 {
 		t.error("escape sequence is invalid Unicode code point")
 	}
-
 	return rune(x)
 }
 
+// scanString scans the text of a string or template literal up to the
+// closing quote, or up to the "${" of an interpolation, in which case
+// interpolate is set and the parser resumes the literal after the
+// closing '}' (see resumeTemplate)
 func (t *tokenizer) scanString(quote rune) string {
-	var result string
+	var result strings.Builder
+	t.interpolate = false
 	for {
 		ch := t.r
 		if ch < 0 {
-			t.error("string literal not terminated")
+			// reported where the literal or the interpolation starts
+			msg := "string literal not terminated"
+			if quote == '`' {
+				msg = "template literal not terminated"
+			}
+			panic(t.errorAt(ErrIllegalToken, msg, t.tokOffset, t.tokLine))
+		}
+		t.nextChar()
+		switch {
+		case ch == quote:
+			return result.String()
+		case ch == '$' && t.r == '{':
+			t.nextChar()
+			t.interpolate = true
+			t.quotes = append(t.quotes, quote)
+			return result.String()
+		case ch == '\\' && t.r == '$':
+			// \${ is not an interpolation
+			ch = '$'
+			t.nextChar()
+		case ch == '\\':
+			r, isByte := t.scanEscape(quote)
+			if isByte {
+				// \xNN and \NNN are bytes, so "\xc3\xa7" is "ç"
+				result.WriteByte(byte(r))
+				continue
+			}
+			ch = r
+		}
+		result.WriteRune(ch)
+	}
+}
+
+// scanRawString scans the text of a raw string literal, r"...", up to
+// the closing quote. The text is taken as it is, without escapes and
+// interpolations, except for carriage returns which are left out, so
+// the literal is the same in files with Windows line endings.
+func (t *tokenizer) scanRawString() string {
+	offs := t.offset
+	for t.r != '"' {
+		if t.r < 0 {
+			// reported where the string starts
+			panic(t.errorAt(ErrIllegalToken, "raw string literal not terminated", t.tokOffset, t.tokLine))
 		}
 		t.nextChar()
-		if ch == quote {
+	}
+	lit := t.src[offs:t.offset]
+	t.nextChar()
+	return strings.Replace(string(lit), "\r", "", -1)
+}
+
+// resumeTemplate scans the text of a string or template literal
+// after the '}' of an interpolation
+func (t *tokenizer) resumeTemplate() (ast.Token, string) {
+	t.tokOffset, t.tokLine = t.offset, t.lineno
+	quote := t.quotes[len(t.quotes)-1]
+	t.quotes = t.quotes[:len(t.quotes)-1]
+	lit := t.scanString(quote)
+	t.last = ast.TokenTemplate
+	return ast.TokenTemplate, lit
+}
+
+// scanRune scans a rune literal, after the opening quote
+func (t *tokenizer) scanRune() rune {
+	var r rune
+	n := 0
+	for {
+		ch := t.r
+		if ch < 0 || ch == '\n' {
+			// reported where the literal starts
+			panic(t.errorAt(ErrIllegalToken, "rune literal not terminated", t.tokOffset, t.tokLine))
+		}
+		t.nextChar()
+		if ch == '\'' {
 			break
 		}
 		if ch == '\\' {
-			ch = t.scanEscape(quote)
+			ch, _ = t.scanEscape('\'')
 		}
-		result += string(ch)
+		r = ch
+		n++
 	}
-	return result
+	if n != 1 {
+		panic(t.errorAt(ErrIllegalToken, "illegal rune literal", t.tokOffset, t.tokLine))
+	}
+	return r
 }
 
 func (t *tokenizer) skipWhitespace() {
@@ -319,10 +562,48 @@ func (t *tokenizer) skipWhitespace() {
 }
 
 func (t *tokenizer) needSemi(tok ast.Token) bool {
-	return (tok == ast.TokenId || tok == ast.TokenFloat || tok == ast.TokenInt || tok == ast.TokenString ||
+	return (tok == ast.TokenId || tok == ast.TokenFloat || tok == ast.TokenInt || tok == ast.TokenString || tok == ast.TokenRawString || tok == ast.TokenRune ||
+		(tok == ast.TokenTemplate && !t.interpolate) ||
 		tok == ast.TokenBreak || tok == ast.TokenContinue || tok == ast.TokenReturn || tok == ast.TokenPanic)
 }
 
+// continues tells if the next line that isn't blank or a comment
+// starts by continuing the expression of the previous one, so the
+// newline doesn't end the statement. That's the case of a leading
+// '.', for method chains written one call per line:
+//
+//	items.filter(f)
+//	     .map(g)
+//
+// It only looks at the source, nothing is consumed.
+func (t *tokenizer) continues() bool {
+	// the byte at i+1 is needed to tell '.' apart from '..' and numbers
+	at := func(i int) byte {
+		t.fillTo(i + 1)
+		if i < len(t.src) {
+			return t.src[i]
+		}
+		return 0
+	}
+	for i := t.offset; ; i++ {
+		switch at(i) {
+		case ' ', '\t', '\r', '\n':
+		case '/':
+			if at(i+1) != '/' {
+				return false
+			}
+			for at(i) != '\n' && at(i) != 0 {
+				i++
+			}
+		case '.':
+			next := at(i + 1)
+			return next != '.' && !('0' <= next && next <= '9')
+		default:
+			return false
+		}
+	}
+}
+
 // functions that look 1 or 2 characters ahead,
 // and return the given token types based on that
 
@@ -375,10 +656,15 @@ func (t *tokenizer) maybe3(a ast.Token, c1 rune, t1 ast.Token, c2 rune, t2 ast.T
 // and a literal string representing it
 func (t *tokenizer) scan() (ast.Token, string) {
 	t.skipWhitespace()
+	t.tokOffset, t.tokLine = t.offset, t.lineno
 
 	switch ch := t.r; {
 	case isLetter(t.r):
 		lit := t.scanIdentifier()
+		if lit == "r" && t.r == '"' {
+			t.nextChar()
+			return ast.TokenRawString, t.scanRawString()
+		}
 		kwtype, ok := ast.Keyword(lit)
 		if ok {
 			return kwtype, lit
@@ -386,9 +672,20 @@ func (t *tokenizer) scan() (ast.Token, string) {
 		return ast.TokenId, lit
 	case isDigit(t.r):
 		return t.scanNumber(false)
-	case t.r == '\'' || t.r == '"':
+	case t.r == '"':
+		t.nextChar()
+		lit := t.scanString(ch)
+		if t.interpolate {
+			// "a ${b}" is the same as `a ${b}`
+			return ast.TokenTemplate, lit
+		}
+		return ast.TokenString, lit
+	case t.r == '\'':
 		t.nextChar()
-		return ast.TokenString, t.scanString(ch)
+		return ast.TokenRune, string(t.scanRune())
+	case t.r == '`':
+		t.nextChar()
+		return ast.TokenTemplate, t.scanString(ch)
 	default:
 		if t.r == '/' {
 			t.nextChar()
@@ -439,6 +736,8 @@ func (t *tokenizer) scan() (ast.Token, string) {
 			tok = t.maybe1(ast.TokenBang, '=', ast.TokenBangeq)
 		case '?':
 			tok = ast.TokenQuestion
+		case '#':
+			tok = ast.TokenHash
 		case '(':
 			tok = ast.TokenLparen
 		case ')':
@@ -461,6 +760,7 @@ func (t *tokenizer) scan() (ast.Token, string) {
 					t.nextChar()
 					return ast.TokenDotdotdot, "..."
 				}
+				return ast.TokenDotdot, ".."
 			} else {
 				return ast.TokenDot, "."
 			}
@@ -487,7 +787,7 @@ func (t *tokenizer) nextToken() (ast.Token, string) {
 		return ast.TokenSemicolon, ";"
 	}
 	tok, literal := t.scan()
-	if tok == ast.TokenNewline && t.needSemi(t.last) {
+	if tok == ast.TokenNewline && t.needSemi(t.last) && !t.continues() {
 		t.insertSemi = true
 	}
 	t.last = tok
@@ -498,7 +798,80 @@ func (t *tokenizer) init(source []byte, filename string) {
 	t.src = source
 	t.filename = filename
 	t.lineno = 1
+	t.lineStarts = []int{0}
 
 	// fetch the first char
 	t.nextChar()
+	t.scanHeader()
+}
+
+// scanHeader skips the shebang line of executable scripts and reads
+// the front matter, "key: value" lines between two "---" lines at the
+// start of the source:
+//
+//	#!/usr/bin/env yo
+//	---
+//	name: greeter
+//	version: 1.2
+//	---
+//	println("hello")
+func (t *tokenizer) scanHeader() {
+	if t.r == '#' && t.startsWith("#!") {
+		t.scanLine()
+		t.nextChar()
+	}
+	if !t.startsWith("---\n") && !t.startsWith("---\r\n") {
+		return
+	}
+	t.scanLine()
+	t.nextChar()
+
+	t.frontMatter = make(map[string]string)
+	for {
+		if t.r == eof {
+			t.error("front matter not closed by '---'")
+		}
+		line := strings.TrimSpace(t.scanLine())
+		if line == "---" {
+			t.nextChar()
+			return
+		}
+		if line != "" {
+			colon := strings.IndexByte(line, ':')
+			if colon <= 0 {
+				t.error("expected 'key: value' in the front matter")
+			}
+			key := strings.TrimSpace(line[:colon])
+			if _, ok := t.frontMatter[key]; ok {
+				t.error(fmt.Sprintf("duplicate key '%s' in the front matter", key))
+			}
+			t.frontMatter[key] = strings.TrimSpace(line[colon+1:])
+		}
+		t.nextChar()
+	}
+}
+
+// startsWith tells if the source has prefix at the current character
+func (t *tokenizer) startsWith(prefix string) bool {
+	t.fillTo(t.offset + len(prefix))
+	return bytes.HasPrefix(t.src[t.offset:], []byte(prefix))
+}
+
+// scanLine returns the rest of the line, stopping at the newline
+func (t *tokenizer) scanLine() string {
+	offs := t.offset
+	for t.r != eof && t.r != '\n' {
+		t.nextChar()
+	}
+	return strings.TrimRight(string(t.src[offs:t.offset]), "\r")
+}
+
+func (t *tokenizer) initReader(r io.Reader, maxSize int, filename string) {
+	if maxSize > 0 {
+		// never read more than one byte past the limit
+		r = io.LimitReader(r, int64(maxSize)+1)
+	}
+	t.reader = r
+	t.maxSize = maxSize
+	t.init(nil, filename)
 }
@@ -0,0 +1,78 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"sync"
+)
+
+// Checkpoint saves the globals of the VM to be restored by Reset,
+// usually after the host defines it's modules.
+func (vm *VM) Checkpoint() {
+	vm.baseline = make(map[string]Value, len(vm.Globals))
+	for name, v := range vm.Globals {
+		vm.baseline[name] = v
+	}
+	vm.changed = make(map[string]struct{})
+}
+
+// Reset brings the VM back to the last checkpoint, so it can run
+// another program as if it was new: the globals defined after it are
+// restored or removed, and the user data, the tracer, the subscribers
+// and the usage are cleared.
+// Only the globals changed with Define or assigned by the scripts are
+// tracked, in time proportional to their number, the values are not
+// copied, so the changes made to the objects and arrays in the
+// globals are not undone. The capabilities, the profile and the
+// overflow mode are kept.
+func (vm *VM) Reset() {
+	for name := range vm.changed {
+		if v, ok := vm.baseline[name]; ok {
+			vm.Globals[name] = v
+		} else {
+			delete(vm.Globals, name)
+		}
+		delete(vm.changed, name)
+	}
+	vm.currentFrame = nil
+	vm.depth = 0
+	vm.openUpvalues = nil
+	vm.error = nil
+	vm.resources = nil
+	vm.handlers = nil
+	vm.results = nil
+	vm.userData = nil
+	vm.tracer, vm.traceCtx = nil, nil
+	vm.subscribers = nil
+	vm.usage = Usage{}
+}
+
+// VMPool keeps VMs ready to run programs, so a server running a
+// script for each request doesn't create and set up a VM each time.
+// It's safe for concurrent use, the VMs themselves are not.
+type VMPool struct {
+	// New creates the VMs of the pool, the globals it defines are
+	// the checkpoint of the VMs. NewVM is used if it's nil.
+	New func() *VM
+
+	pool sync.Pool
+}
+
+// Get returns a VM from the pool, or a new one if it's empty.
+func (p *VMPool) Get() *VM {
+	if vm, ok := p.pool.Get().(*VM); ok {
+		return vm
+	}
+	if p.New == nil {
+		return NewVM()
+	}
+	vm := p.New()
+	vm.Checkpoint()
+	return vm
+}
+
+// Put resets vm and returns it to the pool.
+func (p *VMPool) Put(vm *VM) {
+	vm.Reset()
+	p.pool.Put(vm)
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestReset(t *testing.T) {
+	vm := NewVM()
+	vm.Define("config", String("base"))
+	vm.Checkpoint()
+
+	vm.Define("config", String("request"))
+	vm.Define("request", Number(1))
+	vm.Define("println", Nil{})
+	vm.SetUserData("key", "value")
+	if res := runString(t, vm, "return config, request"); res[0].String() != "request" || res[1].String() != "1" {
+		t.Errorf("unexpected results %v", res)
+	}
+
+	vm.Reset()
+	if v := vm.Globals["config"]; v == nil || v.String() != "base" {
+		t.Errorf("expected config to be restored, got %v", v)
+	}
+	if _, ok := vm.Globals["request"]; ok {
+		t.Errorf("expected request to be removed")
+	}
+	if _, ok := vm.Globals["println"].(GoFunc); !ok {
+		t.Errorf("expected println to be restored")
+	}
+	if vm.UserData("key") != nil || vm.Usage() != (Usage{}) {
+		t.Errorf("expected the user data and the usage to be cleared")
+	}
+	if res := runString(t, vm, "return config"); res[0].String() != "base" {
+		t.Errorf("unexpected result %v", res[0])
+	}
+}
+
+func TestVMPool(t *testing.T) {
+	created := 0
+	pool := VMPool{New: func() *VM {
+		created++
+		vm := NewVM()
+		vm.Define("version", Number(2))
+		return vm
+	}}
+
+	for i := 0; i < 3; i++ {
+		vm := pool.Get()
+		if _, ok := vm.Globals["input"]; ok {
+			t.Errorf("(%d) expected a VM without the input of the last use", i)
+		}
+		vm.Define("input", Number(i))
+		if res := runString(t, vm, "return version * 10 + input"); res[0].String() != strconv.Itoa(20+i) {
+			t.Errorf("(%d) unexpected result %v", i, res[0])
+		}
+		pool.Put(vm)
+	}
+	if created == 0 {
+		t.Errorf("expected the pool to create a VM")
+	}
+}
@@ -1,29 +1,173 @@
 // Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
 //
-// Pretty-print the AST to a buffer
+// Pretty-print the AST as s-expressions
 
 package pretty
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/glhrmfrts/yo"
 	"github.com/glhrmfrts/yo/ast"
 )
 
+// Printer writes syntax trees as s-expressions, the zero value writes
+// everything in one level of indentation with no colors.
+type Printer struct {
+	IndentSize int  // spaces for each level of nesting
+	Color      bool // highlight the node kinds and values with ANSI escapes
+	Compact    bool // write the whole tree in a single line
+	MaxDepth   int  // nodes nested deeper than this are written as "...", 0 for no limit
+
+	// Dump annotates each node with it's range in the source and each
+	// expression the compiler folds with it's constant value, e.g.:
+	//
+	//   (binary + @main.yo:1:9-1:14 => 6
+	Dump bool
+	File string // the file name written in the ranges
+}
+
+// ANSI escapes used when Printer.Color is set
+const (
+	colorReset  = "\x1b[0m"
+	colorKind   = "\x1b[1;34m"
+	colorId     = "\x1b[33m"
+	colorLit    = "\x1b[36m"
+	colorString = "\x1b[32m"
+	colorDump   = "\x1b[2m"
+)
+
+// Fprint writes the tree of root to w, returning the first
+// error of the writer.
+func (cfg *Printer) Fprint(w io.Writer, root ast.Node) error {
+	bw := bufio.NewWriter(w)
+	p := prettyprinter{Printer: cfg, w: bw}
+	if cfg.Dump {
+		// a tree that doesn't compile still has it's ranges
+		p.folded, _ = yo.FoldedConstants(root, cfg.File)
+	}
+	p.node(root)
+	if p.err != nil {
+		return p.err
+	}
+	return bw.Flush()
+}
+
+// SyntaxTree returns the tree of root indented by indentSize spaces.
+func SyntaxTree(root ast.Node, indentSize int) string {
+	var buf bytes.Buffer
+	cfg := Printer{IndentSize: indentSize}
+	cfg.Fprint(&buf, root)
+	return buf.String()
+}
+
 type prettyprinter struct {
-	indent     int
-	indentSize int
-	buf        bytes.Buffer
+	*Printer
+	w      *bufio.Writer
+	err    error
+	indent int
+	depth  int
+
+	folded  map[ast.Node]yo.Value // only in dump mode
+	pending ast.Node              // node whose annotation is still to be written
 }
 
-func (p *prettyprinter) doIndent() {
-	for i := 0; i < p.indent*p.indentSize; i++ {
-		p.buf.WriteString(" ")
+func (p *prettyprinter) write(s string) {
+	if p.err == nil {
+		_, p.err = p.w.WriteString(s)
+	}
+}
+
+func (p *prettyprinter) colored(color, s string) {
+	if p.Color {
+		p.write(color + s + colorReset)
+	} else {
+		p.write(s)
+	}
+}
+
+// node writes n, or an ellipsis when it's too deep
+func (p *prettyprinter) node(n ast.Node) {
+	if p.MaxDepth > 0 && p.depth >= p.MaxDepth {
+		p.write("...")
+		return
+	}
+	p.depth++
+	p.pending = n
+	n.Accept(p, nil)
+	p.depth--
+}
+
+// open starts a node of the given kind and nests the following lines
+func (p *prettyprinter) open(kind string) {
+	p.write("(")
+	p.colored(colorKind, kind)
+	p.annotate()
+	p.indent++
+}
+
+func (p *prettyprinter) close() {
+	p.indent--
+	p.write(")")
+}
+
+// newline starts a line at the current indentation,
+// or just separates with a space in compact mode
+func (p *prettyprinter) newline() {
+	if p.Compact {
+		p.write(" ")
+		return
+	}
+	p.write("\n")
+	for i := 0; i < p.indent*p.IndentSize; i++ {
+		p.write(" ")
+	}
+}
+
+// leaf writes a node without children
+func (p *prettyprinter) leaf(kind, color, value string) {
+	p.write("(")
+	p.colored(colorKind, kind)
+	if value != "" {
+		p.write(" ")
+		p.colored(color, value)
+	}
+	p.annotate()
+	p.write(")")
+}
+
+// annotate writes the range and folded value of the node
+// being written, in dump mode
+func (p *prettyprinter) annotate() {
+	n := p.pending
+	p.pending = nil
+	if !p.Dump || n == nil {
+		return
+	}
+	if info := ast.Info(n); info.Start.IsValid() {
+		pos := info.Start.String()
+		if p.File != "" {
+			pos = p.File + ":" + pos
+		}
+		p.write(" ")
+		p.colored(colorDump, "@"+pos+"-"+info.End.String())
+	}
+	if v, ok := p.folded[n]; ok {
+		lit := v.String()
+		if v.Type() == yo.ValueString {
+			lit = strconv.Quote(lit)
+		}
+		p.write(" ")
+		p.colored(colorDump, "=> "+lit)
 	}
 }
 
 func (p *prettyprinter) VisitNil(node *ast.Nil, data interface{}) {
-	p.buf.WriteString("(nil)")
+	p.leaf("nil", "", "")
 }
 
 func (p *prettyprinter) VisitBool(node *ast.Bool, data interface{}) {
@@ -33,241 +177,240 @@ func (p *prettyprinter) VisitBool(node *ast.Bool, data interface{}) {
 	} else {
 		val = "false"
 	}
-	p.buf.WriteString("(" + val + ")")
+	p.leaf(val, "", "")
 }
 
 func (p *prettyprinter) VisitNumber(node *ast.Number, data interface{}) {
-	p.buf.WriteString(fmt.Sprintf("(number %f)", node.Value))
+	p.leaf("number", colorLit, fmt.Sprintf("%f", node.Value))
 }
 
 func (p *prettyprinter) VisitId(node *ast.Id, data interface{}) {
-	p.buf.WriteString("(id " + node.Value + ")")
+	p.leaf("id", colorId, node.Value)
 }
 
 func (p *prettyprinter) VisitString(node *ast.String, data interface{}) {
-	p.buf.WriteString("(string \"" + node.Value + "\")")
+	p.leaf("string", colorString, "\""+node.Value+"\"")
 }
 
 func (p *prettyprinter) VisitArray(node *ast.Array, data interface{}) {
-	p.buf.WriteString("(array")
-	p.indent++
-
+	p.open("array")
 	for _, n := range node.Elements {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		n.Accept(p, nil)
+		p.newline()
+		p.node(n)
 	}
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.close()
 }
 
 func (p *prettyprinter) VisitObjectField(node *ast.ObjectField, data interface{}) {
-	p.buf.WriteString("(field\n")
-	p.indent++
-	p.doIndent()
-
-	p.buf.WriteString("'" + node.Key + "'")
-	p.buf.WriteString("\n")
-	p.doIndent()
-
+	p.open("field")
+	p.newline()
+	p.colored(colorString, "'"+node.Key+"'")
+	p.newline()
 	if node.Value != nil {
-		node.Value.Accept(p, nil)
+		p.node(node.Value)
 	}
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.close()
 }
 
 func (p *prettyprinter) VisitObject(node *ast.Object, data interface{}) {
-	p.buf.WriteString("(object")
-	p.indent++
-
+	p.open("object")
 	for _, f := range node.Fields {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		f.Accept(p, nil)
+		p.newline()
+		p.node(f)
 	}
+	p.close()
+}
 
-	p.indent--
-	p.buf.WriteString(")")
+func (p *prettyprinter) VisitComprehension(node *ast.Comprehension, data interface{}) {
+	if node.Key == nil {
+		p.open("array comprehension")
+	} else {
+		p.open("object comprehension")
+		p.newline()
+		p.write("key: ")
+		p.node(node.Key)
+	}
+	p.newline()
+	p.write("value: ")
+	p.node(node.Value)
+	p.newline()
+	p.node(node.Loop)
+	p.close()
 }
 
 func (p *prettyprinter) VisitFunction(node *ast.Function, data interface{}) {
-	p.buf.WriteString("(func ")
+	p.open("func")
 	if node.Name != nil {
-		node.Name.Accept(p, nil)
+		p.write(" ")
+		p.node(node.Name)
 	}
-	p.buf.WriteString("\n")
-	p.indent++
 
-	for _, a := range node.Args {
-		p.doIndent()
-		a.Accept(p, nil)
-		p.buf.WriteString("\n")
+	for i, a := range node.Args {
+		p.newline()
+		p.node(a)
+		if i < len(node.ArgTypes) && node.ArgTypes[i] != nil {
+			p.write(" : " + node.ArgTypes[i].Value)
+		}
 	}
 
-	p.doIndent()
-	p.buf.WriteString("->\n")
-
-	p.doIndent()
-	node.Body.Accept(p, nil)
+	p.newline()
+	p.write("->")
+	if node.ReturnType != nil {
+		p.write(" " + node.ReturnType.Value)
+	}
+	for _, cond := range node.Requires {
+		p.newline()
+		p.open("requires")
+		p.newline()
+		p.node(cond)
+		p.close()
+	}
+	for _, cond := range node.Ensures {
+		p.newline()
+		p.open("ensures")
+		p.newline()
+		p.node(cond)
+		p.close()
+	}
 
-	p.indent--
-	p.buf.WriteString(")")
+	p.newline()
+	p.node(node.Body)
+	p.close()
 }
 
 func (p *prettyprinter) VisitSelector(node *ast.Selector, data interface{}) {
-	p.buf.WriteString("(selector\n")
-
-	p.indent++
-	p.doIndent()
-
-	node.Left.Accept(p, nil)
-
-	p.buf.WriteString("\n")
-	p.doIndent()
-
-	p.indent--
-	p.buf.WriteString("'" + node.Value + "')")
+	p.open("selector")
+	p.newline()
+	p.node(node.Left)
+	p.newline()
+	p.colored(colorString, "'"+node.Value+"'")
+	p.close()
 }
 
 func (p *prettyprinter) VisitSubscript(node *ast.Subscript, data interface{}) {
-	p.buf.WriteString("(subscript\n")
-
-	p.indent++
-	p.doIndent()
-
-	node.Left.Accept(p, nil)
-
-	p.buf.WriteString("\n")
-	p.doIndent()
-
-	node.Right.Accept(p, nil)
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.open("subscript")
+	p.newline()
+	p.node(node.Left)
+	p.newline()
+	p.node(node.Right)
+	p.close()
 }
 
 func (p *prettyprinter) VisitSlice(node *ast.Slice, data interface{}) {
-	p.buf.WriteString("(slice\n")
-
-	p.indent++
-	p.doIndent()
-
-	node.Start.Accept(p, nil)
-
-	p.buf.WriteString("\n")
-	p.doIndent()
-
-	node.End.Accept(p, nil)
+	p.open("slice")
+	for _, bound := range []ast.Node{node.Start, node.End} {
+		p.newline()
+		if bound != nil {
+			p.node(bound)
+		} else {
+			p.write("_")
+		}
+	}
+	p.close()
+}
 
-	p.indent--
-	p.buf.WriteString(")")
+func (p *prettyprinter) VisitRange(node *ast.Range, data interface{}) {
+	p.open("range")
+	for _, part := range []ast.Node{node.Start, node.End, node.Step} {
+		if part != nil {
+			p.newline()
+			p.node(part)
+		}
+	}
+	p.close()
 }
 
 func (p *prettyprinter) VisitKwArg(node *ast.KwArg, data interface{}) {
-	p.buf.WriteString("(kwarg\n")
-
-	p.indent++
-	p.doIndent()
-
-	p.buf.WriteString("'" + node.Key + "'\n")
-
-	p.doIndent()
-	node.Value.Accept(p, nil)
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.open("kwarg")
+	p.newline()
+	p.colored(colorString, "'"+node.Key+"'")
+	p.newline()
+	p.node(node.Value)
+	p.close()
 }
 
 func (p *prettyprinter) VisitVarArg(node *ast.VarArg, data interface{}) {
-	p.buf.WriteString("(vararg ")
-	node.Arg.Accept(p, nil)
-	p.buf.WriteString(")")
+	p.open("vararg")
+	p.write(" ")
+	p.node(node.Arg)
+	p.close()
 }
 
-func (p *prettyprinter) VisitCallExpr(node *ast.CallExpr, data interface{}) {
-	p.buf.WriteString("(call\n")
-	p.indent++
-	p.doIndent()
-
-	node.Left.Accept(p, nil)
+func (p *prettyprinter) VisitObjectUnpack(node *ast.ObjectUnpack, data interface{}) {
+	p.open("objectunpack")
+	for _, key := range node.Keys {
+		p.write(" ")
+		p.colored(colorString, "'"+key+"'")
+	}
+	p.newline()
+	p.node(node.Value)
+	p.close()
+}
 
+func (p *prettyprinter) VisitCallExpr(node *ast.CallExpr, data interface{}) {
+	p.open("call")
+	p.newline()
+	p.node(node.Left)
 	for _, arg := range node.Args {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		arg.Accept(p, nil)
+		p.newline()
+		p.node(arg)
 	}
+	p.close()
+}
 
-	p.indent--
-	p.buf.WriteString(")")
+func (p *prettyprinter) VisitTemplate(node *ast.Template, data interface{}) {
+	p.open("template")
+	if node.Tag != nil {
+		p.newline()
+		p.node(node.Tag)
+	}
+	for i, part := range node.Parts {
+		p.newline()
+		p.leaf("string", colorString, "\""+part+"\"")
+		if i < len(node.Exprs) {
+			p.newline()
+			p.node(node.Exprs[i])
+		}
+	}
+	p.close()
 }
 
 func (p *prettyprinter) VisitPostfixExpr(node *ast.PostfixExpr, data interface{}) {
-	p.buf.WriteString(fmt.Sprintf("(postfix %s\n", node.Op))
-
-	p.indent++
-	p.doIndent()
-
-	node.Left.Accept(p, nil)
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.open("postfix " + node.Op.String())
+	p.newline()
+	p.node(node.Left)
+	p.close()
 }
 
 func (p *prettyprinter) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
-	p.buf.WriteString(fmt.Sprintf("(unary %s\n", node.Op))
-
-	p.indent++
-	p.doIndent()
-
-	node.Right.Accept(p, nil)
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.open("unary " + node.Op.String())
+	p.newline()
+	p.node(node.Right)
+	p.close()
 }
 
 func (p *prettyprinter) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
-	p.buf.WriteString(fmt.Sprintf("(binary %s\n", node.Op))
-
-	p.indent++
-	p.doIndent()
-
-	node.Left.Accept(p, nil)
-
-	p.buf.WriteString("\n")
-	p.doIndent()
-
-	node.Right.Accept(p, nil)
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.open("binary " + node.Op.String())
+	p.newline()
+	p.node(node.Left)
+	p.newline()
+	p.node(node.Right)
+	p.close()
 }
 
 func (p *prettyprinter) VisitTernaryExpr(node *ast.TernaryExpr, data interface{}) {
-	p.buf.WriteString("(ternary\n")
-	p.indent++
-	p.doIndent()
-
-	node.Cond.Accept(p, nil)
-
-	p.buf.WriteString("\n")
-	p.doIndent()
-	p.buf.WriteString("?\n")
-	p.doIndent()
-
-	node.Then.Accept(p, nil)
-
-	p.buf.WriteString("\n")
-	p.doIndent()
-	p.buf.WriteString(":\n")
-	p.doIndent()
-
-	node.Else.Accept(p, nil)
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.open("ternary")
+	p.newline()
+	p.node(node.Cond)
+	p.newline()
+	p.write("?")
+	p.newline()
+	p.node(node.Then)
+	p.newline()
+	p.write(":")
+	p.newline()
+	p.node(node.Else)
+	p.close()
 }
 
 func (p *prettyprinter) VisitDeclaration(node *ast.Declaration, data interface{}) {
@@ -276,222 +419,257 @@ func (p *prettyprinter) VisitDeclaration(node *ast.Declaration, data interface{}
 		keyword = "const"
 	}
 
-	p.buf.WriteString(fmt.Sprintf("(%s", keyword))
-	p.indent++
-
+	p.open(keyword)
 	for _, id := range node.Left {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		id.Accept(p, nil)
+		p.newline()
+		p.node(id)
 	}
 
-	p.buf.WriteString("\n")
-	p.doIndent()
-	p.buf.WriteString("=")
-
+	p.newline()
+	p.write("=")
 	for _, node := range node.Right {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		node.Accept(p, nil)
+		p.newline()
+		p.node(node)
 	}
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.close()
 }
 
 func (p *prettyprinter) VisitAssignment(node *ast.Assignment, data interface{}) {
-	p.buf.WriteString("(assignment")
-	p.indent++
-
+	p.open("assignment")
 	for _, node := range node.Left {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		node.Accept(p, nil)
+		p.newline()
+		p.node(node)
 	}
 
-	p.buf.WriteString("\n")
-	p.doIndent()
-	p.buf.WriteString(node.Op.String())
-
+	p.newline()
+	p.write(node.Op.String())
 	for _, node := range node.Right {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		node.Accept(p, nil)
+		p.newline()
+		p.node(node)
 	}
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.close()
 }
 
 func (p *prettyprinter) VisitBranchStmt(node *ast.BranchStmt, data interface{}) {
-	p.buf.WriteString(fmt.Sprintf("(%s)", node.Type))
+	p.leaf(node.Type.String(), "", "")
 }
 
 func (p *prettyprinter) VisitReturnStmt(node *ast.ReturnStmt, data interface{}) {
-	p.buf.WriteString("(return")
-	p.indent++
-
+	p.open("return")
 	for _, v := range node.Values {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		v.Accept(p, nil)
+		p.newline()
+		p.node(v)
 	}
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.close()
 }
 
 func (p *prettyprinter) VisitPanicStmt(node *ast.PanicStmt, data interface{}) {
-	p.buf.WriteString("(panic\n")
-	p.indent++
-	p.doIndent()
-	node.Err.Accept(p, nil)
-	p.indent--
-	p.buf.WriteString(")")
+	p.open("panic")
+	p.newline()
+	p.node(node.Err)
+	p.close()
 }
 
 func (p *prettyprinter) VisitIfStmt(node *ast.IfStmt, data interface{}) {
-	p.buf.WriteString("(if\n")
-	p.indent++
-
+	p.open("if")
 	if node.Init != nil {
-		p.doIndent()
-		node.Init.Accept(p, nil)
-		p.buf.WriteString("\n")
+		p.newline()
+		p.node(node.Init)
 	}
 
-	p.doIndent()
-	node.Cond.Accept(p, nil)
-	p.buf.WriteString("\n")
-
-	p.doIndent()
-	node.Body.Accept(p, nil)
-	p.buf.WriteString("\n")
-	p.doIndent()
+	p.newline()
+	p.node(node.Cond)
+	p.newline()
+	p.node(node.Body)
 
 	if node.Else != nil {
-		node.Else.Accept(p, nil)
+		p.newline()
+		p.node(node.Else)
 	}
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.close()
 }
 
 func (p *prettyprinter) VisitForIteratorStmt(node *ast.ForIteratorStmt, data interface{}) {
-	p.buf.WriteString("(for iterator\n")
-	p.indent++
-	p.doIndent()
-	p.buf.WriteString("key: ")
-	node.Key.Accept(p, nil)
+	p.open("for iterator")
+	p.newline()
+	p.write("key: ")
+	p.node(node.Key)
 
 	if node.Value != nil {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		p.buf.WriteString("value: ")
-		node.Value.Accept(p, nil)
+		p.newline()
+		p.write("value: ")
+		p.node(node.Value)
 	}
 
-	p.buf.WriteString("\n")
-	p.doIndent()
-	p.buf.WriteString("collection: ")
-	node.Collection.Accept(p, nil)
+	p.newline()
+	p.write("collection: ")
+	p.node(node.Collection)
 
 	if node.When != nil {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		p.buf.WriteString("when: ")
-		node.When.Accept(p, nil)
+		p.newline()
+		p.write("when: ")
+		p.node(node.When)
 	}
 
-	p.buf.WriteString("\n")
-	p.doIndent()
-	node.Body.Accept(p, nil)
-
-	p.indent--
-	p.buf.WriteString("\n")
+	if node.Body != nil {
+		p.newline()
+		p.node(node.Body)
+	}
+	p.close()
 }
 
 func (p *prettyprinter) VisitForStmt(node *ast.ForStmt, data interface{}) {
-	p.buf.WriteString("(for\n")
-	p.indent++
-
+	p.open("for")
 	if node.Init != nil {
-		p.doIndent()
-		p.buf.WriteString("init: ")
-		node.Init.Accept(p, nil)
-		p.buf.WriteString("\n")
+		p.newline()
+		p.write("init: ")
+		p.node(node.Init)
 	}
 
 	if node.Cond != nil {
-		p.doIndent()
-		p.buf.WriteString("cond: ")
-		node.Cond.Accept(p, nil)
-		p.buf.WriteString("\n")
+		p.newline()
+		p.write("cond: ")
+		p.node(node.Cond)
 	}
 
-	p.doIndent()
 	if node.Step != nil {
-		p.buf.WriteString("step: ")
-		node.Step.Accept(p, nil)
-		p.buf.WriteString("\n")
-		p.doIndent()
+		p.newline()
+		p.write("step: ")
+		p.node(node.Step)
 	}
 
-	node.Body.Accept(p, nil)
-	p.indent--
-	p.buf.WriteString(")")
+	p.newline()
+	p.node(node.Body)
+	p.close()
+}
+
+func (p *prettyprinter) VisitArrayPattern(node *ast.ArrayPattern, data interface{}) {
+	p.open("array pattern")
+	for _, n := range node.Elements {
+		p.newline()
+		p.node(n)
+	}
+	if node.Rest != nil {
+		p.newline()
+		p.write("rest: ")
+		p.node(node.Rest)
+	}
+	p.close()
+}
+
+func (p *prettyprinter) VisitObjectPattern(node *ast.ObjectPattern, data interface{}) {
+	p.open("object pattern")
+	for _, f := range node.Fields {
+		p.newline()
+		p.node(f)
+	}
+	p.close()
+}
+
+func (p *prettyprinter) VisitMatchStmt(node *ast.MatchStmt, data interface{}) {
+	p.open("match")
+	if node.IsType {
+		p.write(" type")
+	}
+	if node.Name != nil {
+		p.write(" ")
+		p.node(node.Name)
+	}
+	p.write(" ")
+	p.node(node.Value)
+
+	for _, c := range node.Cases {
+		p.newline()
+		if len(c.Values) == 0 {
+			p.open("else")
+		} else {
+			p.open("case")
+			for _, v := range c.Values {
+				p.write(" ")
+				p.node(v)
+			}
+		}
+		p.write(" ")
+		p.node(c.Body)
+		p.close()
+	}
+	p.close()
+}
+
+func (p *prettyprinter) VisitWithStmt(node *ast.WithStmt, data interface{}) {
+	p.open("with")
+	p.newline()
+	p.write("name: ")
+	p.node(node.Name)
+	p.newline()
+	p.write("value: ")
+	p.node(node.Value)
+	p.newline()
+	p.node(node.Body)
+	p.close()
+}
+
+func (p *prettyprinter) VisitProtoDecl(node *ast.ProtoDecl, data interface{}) {
+	p.open("proto")
+	p.write(" ")
+	p.node(node.Name)
+	if node.Parent != nil {
+		p.write(" : ")
+		p.node(node.Parent)
+	}
+	for _, f := range node.Fields {
+		p.newline()
+		p.open("field")
+		p.write(" ")
+		p.node(f.Name)
+		if f.Type != nil {
+			p.write(" : " + f.Type.Value)
+		}
+		if f.Value != nil {
+			p.write(" = ")
+			p.node(f.Value)
+		}
+		p.close()
+	}
+	p.close()
 }
 
 func (p *prettyprinter) VisitRecoverBlock(node *ast.RecoverBlock, data interface{}) {
-	p.buf.WriteString(fmt.Sprintf("(recover %s ", node.Id.Value))
-	node.Block.Accept(p, nil)
-	p.buf.WriteString(")")
+	p.open("recover")
+	p.write(" ")
+	p.colored(colorId, node.Id.Value)
+	p.write(" ")
+	p.node(node.Block)
+	p.close()
 }
 
 func (p *prettyprinter) VisitTryRecoverStmt(node *ast.TryRecoverStmt, data interface{}) {
-	p.buf.WriteString("(try\n")
-	p.indent++
-
+	p.open("try")
 	if node.Try != nil {
-		p.doIndent()
-		p.buf.WriteString("try: ")
-		node.Try.Accept(p, nil)
-		p.buf.WriteString("\n")
+		p.newline()
+		p.write("try: ")
+		p.node(node.Try)
 	}
 
 	if node.Recover != nil {
-		p.doIndent()
-		p.buf.WriteString("recover: ")
-		node.Recover.Accept(p, nil)
-		p.buf.WriteString("\n")
+		p.newline()
+		p.write("recover: ")
+		p.node(node.Recover)
 	}
 
-	p.doIndent()
 	if node.Finally != nil {
-		p.buf.WriteString("finally: ")
-		node.Finally.Accept(p, nil)
+		p.newline()
+		p.write("finally: ")
+		p.node(node.Finally)
 	}
-
-	p.indent--
-	p.buf.WriteString(")")
+	p.close()
 }
 
 func (p *prettyprinter) VisitBlock(node *ast.Block, data interface{}) {
-	p.buf.WriteString("(block")
-	p.indent++
-
+	p.open("block")
 	for _, n := range node.Nodes {
-		p.buf.WriteString("\n")
-		p.doIndent()
-		n.Accept(p, nil)
+		p.newline()
+		p.node(n)
 	}
-
-	p.indent--
-	p.buf.WriteString(")")
-}
-
-func SyntaxTree(root ast.Node, indentSize int) string {
-	v := prettyprinter{indentSize: indentSize}
-	root.Accept(&v, nil)
-	return v.buf.String()
+	p.close()
 }
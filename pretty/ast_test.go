@@ -0,0 +1,90 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package pretty
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/glhrmfrts/yo/parse"
+)
+
+func TestPrinter(t *testing.T) {
+	root, err := parse.ParseFile([]byte("var x = f(1, y)"), "printer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		printer Printer
+		want    string
+	}{
+		{
+			Printer{IndentSize: 2},
+			"(block\n  (var\n    (id x)\n    =\n    (call\n      (id f)\n      (number 1.000000)\n      (id y))))",
+		},
+		{
+			Printer{Compact: true},
+			"(block (var (id x) = (call (id f) (number 1.000000) (id y))))",
+		},
+		{
+			Printer{Compact: true, MaxDepth: 3},
+			"(block (var (id x) = (call ... ... ...)))",
+		},
+		{
+			Printer{Compact: true, MaxDepth: 2, Color: true},
+			"(\x1b[1;34mblock\x1b[0m (\x1b[1;34mvar\x1b[0m ... = ...))",
+		},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		if err := test.printer.Fprint(&buf, root); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != test.want {
+			t.Errorf("(%d) expected:\n%s\ngot:\n%s", i, test.want, got)
+		}
+	}
+
+	if got := SyntaxTree(root, 2); got != tests[0].want {
+		t.Errorf("SyntaxTree: expected:\n%s\ngot:\n%s", tests[0].want, got)
+	}
+}
+
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write(b []byte) (int, error) { return 0, errWrite }
+
+func TestPrinterWriteError(t *testing.T) {
+	root, err := parse.ParseFile([]byte(strings.Repeat("f(1)\n", 2000)), "printer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := Printer{IndentSize: 2}
+	if err := p.Fprint(failingWriter{}, root); err != errWrite {
+		t.Errorf("expected the error of the writer, got %v", err)
+	}
+}
+
+func TestPrinterDump(t *testing.T) {
+	root, err := parse.ParseFile([]byte("const k = 2\nf(k * 3, \"a\")"), "dump.yo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	p := Printer{Compact: true, Dump: true, File: "dump.yo"}
+	if err := p.Fprint(&buf, root); err != nil {
+		t.Fatal(err)
+	}
+	want := "(block (const @dump.yo:1:1-1:12 (id k @dump.yo:1:7-1:8) = (number 2.000000 @dump.yo:1:11-1:12)) " +
+		"(call @dump.yo:2:1-2:14 (id f @dump.yo:2:1-2:2) " +
+		"(binary * @dump.yo:2:3-2:8 => 6 (id k @dump.yo:2:3-2:4 => 2) (number 3.000000 @dump.yo:2:7-2:8)) " +
+		"(string \"a\" @dump.yo:2:10-2:13)))"
+	if got := buf.String(); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -30,6 +30,21 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 	}
 	buf.WriteString("\n\n")
 
+	doIndent(buf, indent)
+	buf.WriteString(fmt.Sprintf("upvalues: %d\n", len(f.Upvals)))
+	doIndent(buf, indent)
+	for _, u := range f.Upvals {
+		kind := "reg"
+		switch u.Kind {
+		case yo.UpvalueStack:
+			kind = "stack"
+		case yo.UpvalueParent:
+			kind = "up"
+		}
+		buf.WriteString(fmt.Sprintf("\t%s(%s %d)", u.Name, kind, u.Index))
+	}
+	buf.WriteString("\n\n")
+
 	doIndent(buf, indent)
 	buf.WriteString(fmt.Sprintf("funcs: %d\n", f.NumFuncs))
 	for _, f := range f.Funcs {
@@ -79,11 +94,21 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 			bstr := getRegOrConst(bx)
 			buf.WriteString(fmt.Sprintf("\t!%d %s", yo.OpGetA(instr), bstr))
 		case yo.OpAdd, yo.OpSub, yo.OpMul, yo.OpDiv, yo.OpPow, yo.OpShl, yo.OpShr,
-			yo.OpAnd, yo.OpOr, yo.OpXor, yo.OpLe, yo.OpLt, yo.OpEq, yo.OpNe,
-			yo.OpGetIndex, yo.OpSetIndex:
+			yo.OpAnd, yo.OpOr, yo.OpXor, yo.OpLe, yo.OpLt, yo.OpEq, yo.OpNe, yo.OpIn, yo.OpIsProto,
+			yo.OpAddNN, yo.OpSubNN, yo.OpMulNN, yo.OpDivNN, yo.OpLtNN, yo.OpLeNN,
+			yo.OpGetIndex, yo.OpSlice, yo.OpSetIndex, yo.OpRange:
 			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
 			bstr, cstr := getRegOrConst(b), getRegOrConst(c)
 			buf.WriteString(fmt.Sprintf("\t!%d %s %s", a, bstr, cstr))
+		case yo.OpGetField:
+			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
+			buf.WriteString(fmt.Sprintf("\t!%d !%d %s", a, b, f.Consts[c]))
+		case yo.OpSetField:
+			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
+			buf.WriteString(fmt.Sprintf("\t!%d %s %s", a, f.Consts[b], getRegOrConst(c)))
+		case yo.OpIsType:
+			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
+			buf.WriteString(fmt.Sprintf("\t!%d %s %s", a, getRegOrConst(b), yo.ValueType(c)))
 		case yo.OpAppend, yo.OpReturn:
 			a, b := yo.OpGetA(instr), yo.OpGetB(instr)
 			buf.WriteString(fmt.Sprintf("\t!%d #%d", a, b))
@@ -95,7 +120,7 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 			buf.WriteString(fmt.Sprintf("!%d %s", a, f.Consts[bx]))
 		case yo.OpLoadFree, yo.OpSetFree:
 			a, bx := yo.OpGetA(instr), yo.OpGetBx(instr)
-			buf.WriteString(fmt.Sprintf("\t!%d %s", a, f.Consts[bx]))
+			buf.WriteString(fmt.Sprintf("\t!%d %s", a, f.Upvals[bx].Name))
 		case yo.OpCall, yo.OpCallmethod:
 			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
 			if opcode == yo.OpCall {
@@ -114,12 +139,32 @@ func disasmImpl(f *yo.Bytecode, buf *bytes.Buffer, indent int) {
 			a, sbx := yo.OpGetA(instr), yo.OpGetsBx(instr)
 			astr := getRegOrConst(a)
 			buf.WriteString(fmt.Sprintf("%s ->%d", astr, pc+sbx))
+		case yo.OpClose:
+			buf.WriteString(fmt.Sprintf("\t!%d", yo.OpGetA(instr)))
 		case yo.OpForbegin:
 			a, b := yo.OpGetA(instr), yo.OpGetB(instr)
 			buf.WriteString(fmt.Sprintf("!%d !%d", a, b))
 		case yo.OpForiter:
 			a, b, c := yo.OpGetA(instr), yo.OpGetB(instr), yo.OpGetC(instr)
 			buf.WriteString(fmt.Sprintf("\t!%d !%d !%d", a, b, c))
+		default:
+			// described by the opcode metadata
+			info := opcode.Info()
+			_, a, b, c := yo.OpDecode(instr)
+			for i, operand := range []int{a, b, c} {
+				kind := [...]yo.OperandKind{info.A, info.B, info.C}[i]
+				switch kind {
+				case yo.OperandReg:
+					buf.WriteString(fmt.Sprintf("\t!%d", operand))
+				case yo.OperandRK:
+					buf.WriteString("\t" + getRegOrConst(uint(operand)))
+				case yo.OperandJump:
+					buf.WriteString(fmt.Sprintf("\t->%d", pc+operand))
+				case yo.OperandUnused:
+				default:
+					buf.WriteString(fmt.Sprintf("\t#%d", operand))
+				}
+			}
 		}
 
 		buf.WriteString("\n")
@@ -0,0 +1,164 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+//
+// Canonical listing of a function prototype, for comparing
+// the output of the compiler against golden files
+
+package pretty
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/glhrmfrts/yo"
+)
+
+// Listing returns a textual dump of f and it's nested functions which
+// only changes when the code itself changes: constants are written by
+// value instead of by index (the constant table is listed sorted),
+// jump targets are symbolic labels and no addresses are written.
+func Listing(f *yo.Bytecode) string {
+	var buf bytes.Buffer
+	listFunc(&buf, f, "main")
+	return buf.String()
+}
+
+// Instructions returns the instructions of f as written by Listing,
+// without the ones of it's nested functions.
+func Instructions(f *yo.Bytecode) []string {
+	labels := jumpLabels(f.Code)
+	instrs := make([]string, len(f.Code))
+	for pc, instr := range f.Code {
+		instrs[pc] = listInstr(f, pc, instr, labels)
+	}
+	return instrs
+}
+
+// Constant returns v as written in the constant tables of Listing.
+func Constant(v yo.Value) string {
+	return listConst(v)
+}
+
+func listFunc(buf *bytes.Buffer, f *yo.Bytecode, path string) {
+	name := f.Name
+	if name == "" {
+		name = "<anonymous>"
+		if path == "main" {
+			name = "<main>"
+		}
+	}
+	fmt.Fprintf(buf, "func %s %s line %d regs %d\n", path, name, f.Line, f.NumRegs)
+
+	consts := make([]string, len(f.Consts))
+	for i, c := range f.Consts {
+		consts[i] = listConst(c)
+	}
+	sort.Strings(consts)
+	for _, c := range consts {
+		fmt.Fprintf(buf, "  const %s\n", c)
+	}
+
+	for _, u := range f.Upvals {
+		kind := "reg"
+		switch u.Kind {
+		case yo.UpvalueStack:
+			kind = "stack"
+		case yo.UpvalueParent:
+			kind = "up"
+		}
+		fmt.Fprintf(buf, "  upval %s %s %d\n", u.Name, kind, u.Index)
+	}
+
+	labels := jumpLabels(f.Code)
+	for pc, instr := range f.Code {
+		if label, ok := labels[pc]; ok {
+			fmt.Fprintf(buf, "%s:\n", label)
+		}
+		buf.WriteString("  " + listInstr(f, pc, instr, labels) + "\n")
+	}
+	if label, ok := labels[len(f.Code)]; ok {
+		fmt.Fprintf(buf, "%s:\n", label)
+	}
+
+	for i, child := range f.Funcs {
+		buf.WriteString("\n")
+		listFunc(buf, child, fmt.Sprintf("%s.%d", path, i))
+	}
+}
+
+// the jump targets of code, labeled in the order they appear
+func jumpLabels(code []uint32) map[int]string {
+	var targets []int
+	seen := make(map[int]bool)
+	for pc, instr := range code {
+		op, _, b, c := yo.OpDecode(instr)
+		info := op.Info()
+		for _, jump := range [...]struct {
+			kind yo.OperandKind
+			x    int
+		}{{info.B, b}, {info.C, c}} {
+			if jump.kind == yo.OperandJump && !seen[pc+1+jump.x] {
+				seen[pc+1+jump.x] = true
+				targets = append(targets, pc+1+jump.x)
+			}
+		}
+	}
+	sort.Ints(targets)
+
+	labels := make(map[int]string, len(targets))
+	for i, target := range targets {
+		labels[target] = fmt.Sprintf("L%d", i+1)
+	}
+	return labels
+}
+
+func listInstr(f *yo.Bytecode, pc int, instr uint32, labels map[int]string) string {
+	op, a, b, c := yo.OpDecode(instr)
+	info := op.Info()
+	parts := []string{fmt.Sprintf("%-10s", info.Name)}
+	operands := [...]struct {
+		kind yo.OperandKind
+		x    int
+	}{{info.A, a}, {info.B, b}, {info.C, c}}
+	for _, operand := range operands {
+		x := operand.x
+		switch operand.kind {
+		case yo.OperandReg:
+			parts = append(parts, fmt.Sprintf("r%d", x))
+		case yo.OperandRK:
+			if x >= yo.OpConstOffset {
+				parts = append(parts, listConst(f.Consts[x-yo.OpConstOffset]))
+			} else {
+				parts = append(parts, fmt.Sprintf("r%d", x))
+			}
+		case yo.OperandConst:
+			parts = append(parts, listConst(f.Consts[x]))
+		case yo.OperandFunc:
+			parts = append(parts, fmt.Sprintf("func.%d", x))
+		case yo.OperandUpvalue:
+			parts = append(parts, "^"+f.Upvals[x].Name)
+		case yo.OperandJump:
+			parts = append(parts, labels[pc+1+x])
+		case yo.OperandCount:
+			parts = append(parts, fmt.Sprintf("#%d", x))
+		case yo.OperandType:
+			parts = append(parts, yo.ValueType(x).String())
+		}
+	}
+	if names := f.KeywordsAt(pc); len(names) > 0 {
+		parts = append(parts, "kw("+strings.Join(names, " ")+")")
+	}
+	return strings.TrimRight(strings.Join(parts, " "), " ")
+}
+
+// constants are written with their type, strings quoted
+func listConst(v yo.Value) string {
+	switch v.Type() {
+	case yo.ValueString:
+		return fmt.Sprintf("%q", v.String())
+	case yo.ValueNumber:
+		return v.String()
+	}
+	return fmt.Sprintf("%s(%s)", v.Type(), v)
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package pretty
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/glhrmfrts/yo"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the current output")
+
+// checkGolden compares got with the contents of the golden file at
+// path, or rewrites the file with got when the tests run with -update
+func checkGolden(t *testing.T, path string, got string) {
+	t.Helper()
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run the tests with -update to create it)", err)
+	}
+	if got == string(want) {
+		return
+	}
+	gotLines, wantLines := strings.Split(got, "\n"), strings.Split(string(want), "\n")
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w {
+			t.Errorf("%s:%d: got %q, want %q", path, i+1, g, w)
+			return
+		}
+	}
+}
+
+func TestListing(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.yo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		source, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := parse.ParseFile(source, filepath.Base(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := yo.Compile(root, filepath.Base(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listing := Listing(code)
+		if again := Listing(code); again != listing {
+			t.Errorf("%s: listing is not deterministic", file)
+		}
+		checkGolden(t, strings.TrimSuffix(file, ".yo")+".golden", listing)
+	}
+}
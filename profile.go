@@ -0,0 +1,195 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Profile counts how many times the calls and the conditions of the
+// programs run by a VM ran (see VM.SetProfile). Given back to the
+// compiler with CompileOptions.Profile, it guides the optimizations
+// for the workloads of the host: the hot calls get more room for
+// inlining, and the branches of an if taken most of the time are laid
+// out first.
+//
+// The sites are identified by their file and line, so the counts
+// stay valid as long as the lines of the source don't move, and the
+// calls or the conditions on the same line are counted together.
+//
+// Many VMs can count in the same Profile at once, the maps should
+// only be read directly once they are done.
+type Profile struct {
+	Calls      map[ProfileSite]int64 // calls to script functions
+	Conditions map[ProfileSite]*ConditionCount
+
+	mu sync.Mutex // guards the maps while the VMs count
+}
+
+// ProfileSite is the position of a call or a condition in the source.
+type ProfileSite struct {
+	File string
+	Line int
+}
+
+// ConditionCount counts the times a condition was true and false.
+type ConditionCount struct {
+	True, False int64
+}
+
+// the share of all the calls of a profile a call site must have to be
+// hot, and how much larger than the budget of the optimization level
+// the functions inlined in hot call sites can be
+const (
+	hotCallShare      = 0.01
+	hotInlineBudgetBy = 4
+)
+
+// NewProfile returns an empty profile.
+func NewProfile() *Profile {
+	return &Profile{
+		Calls:      make(map[ProfileSite]int64),
+		Conditions: make(map[ProfileSite]*ConditionCount),
+	}
+}
+
+// SetProfile makes the VM count the calls and the conditions of the
+// programs it runs in p, nil stops counting.
+func (vm *VM) SetProfile(p *Profile) {
+	vm.profile = p
+}
+
+func (p *Profile) countCall(cf *callFrame) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Calls[ProfileSite{cf.fn.Bytecode.Source, cf.line}]++
+}
+
+func (p *Profile) countCondition(cf *callFrame, val bool) {
+	site := ProfileSite{cf.fn.Bytecode.Source, cf.line}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := p.Conditions[site]
+	if count == nil {
+		count = &ConditionCount{}
+		p.Conditions[site] = count
+	}
+	if val {
+		count.True++
+	} else {
+		count.False++
+	}
+}
+
+// totalCalls returns the number of calls counted in all the sites
+func (p *Profile) totalCalls() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var total int64
+	for _, n := range p.Calls {
+		total += n
+	}
+	return total
+}
+
+// hotCall returns whether the calls at line of the file being
+// compiled are a large share of all the calls of the profile
+func (c *compiler) hotCall(line int) bool {
+	if c.profile == nil {
+		return false
+	}
+	c.profile.mu.Lock()
+	defer c.profile.mu.Unlock()
+	return c.profile.Calls[ProfileSite{c.filename, line}] >= c.hotCalls
+}
+
+// likelyFalse returns whether the conditions at line of the file
+// being compiled were false more often than true
+func (c *compiler) likelyFalse(line int) bool {
+	if c.profile == nil {
+		return false
+	}
+	c.profile.mu.Lock()
+	defer c.profile.mu.Unlock()
+	count := c.profile.Conditions[ProfileSite{c.filename, line}]
+	return count != nil && count.False > count.True
+}
+
+// Write saves the profile as text to w, one site per line, to be
+// read back by ReadProfile.
+func (p *Profile) Write(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	var calls, conds []ProfileSite
+	for site := range p.Calls {
+		calls = append(calls, site)
+	}
+	for site := range p.Conditions {
+		conds = append(conds, site)
+	}
+	sortSites(calls)
+	sortSites(conds)
+
+	for _, site := range calls {
+		fmt.Fprintf(bw, "call\t%s\t%d\t%d\n", site.File, site.Line, p.Calls[site])
+	}
+	for _, site := range conds {
+		count := p.Conditions[site]
+		fmt.Fprintf(bw, "cond\t%s\t%d\t%d\t%d\n", site.File, site.Line, count.True, count.False)
+	}
+	return bw.Flush()
+}
+
+func sortSites(sites []ProfileSite) {
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].File != sites[j].File {
+			return sites[i].File < sites[j].File
+		}
+		return sites[i].Line < sites[j].Line
+	})
+}
+
+// ReadProfile reads a profile saved by Profile.Write. The counts of
+// the same site are added, so profiles can be merged by
+// concatenating them.
+func ReadProfile(r io.Reader) (*Profile, error) {
+	p := NewProfile()
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		nums := make([]int64, 0, 3)
+		for i := 2; i < len(fields); i++ {
+			num, err := strconv.ParseInt(fields[i], 10, 64)
+			if err != nil || num < 0 {
+				return nil, fmt.Errorf("profile:%d: invalid number '%s'", n, fields[i])
+			}
+			nums = append(nums, num)
+		}
+		switch {
+		case fields[0] == "call" && len(nums) == 2:
+			p.Calls[ProfileSite{fields[1], int(nums[0])}] += nums[1]
+		case fields[0] == "cond" && len(nums) == 3:
+			site := ProfileSite{fields[1], int(nums[0])}
+			count := p.Conditions[site]
+			if count == nil {
+				count = &ConditionCount{}
+				p.Conditions[site] = count
+			}
+			count.True += nums[1]
+			count.False += nums[2]
+		default:
+			return nil, fmt.Errorf("profile:%d: invalid line", n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const profiledSource = `func big(x) -> x * 2 + x * 3 + x * 4 + x * 5 + 1
+var s = 0
+for i := 0; i < 200; i++ {
+	s += big(i)
+	if i == 1000 {
+		s += 1
+	} else {
+		s += 2
+	}
+}
+s += big(1)
+return s`
+
+func TestProfile(t *testing.T) {
+	run := func(opts CompileOptions, p *Profile) (*Bytecode, string) {
+		b, err := CompileSource([]byte(profiledSource), "test.yo", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm := NewVM()
+		vm.SetProfile(p)
+		res, err := vm.run(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, res[0].String()
+	}
+	count := func(b *Bytecode, op Opcode) int {
+		n := 0
+		for _, instr := range b.Code {
+			if OpGetOpcode(instr) == op {
+				n++
+			}
+		}
+		return n
+	}
+
+	p := NewProfile()
+	_, want := run(CompileOptions{}, p)
+	if n := p.Calls[ProfileSite{"test.yo", 4}]; n != 200 {
+		t.Errorf("expected 200 calls at line 4, got %d", n)
+	}
+	if c := p.Conditions[ProfileSite{"test.yo", 5}]; c == nil || *c != (ConditionCount{0, 200}) {
+		t.Errorf("expected the condition at line 5 to be false 200 times, got %v", c)
+	}
+
+	// big is over the budget of the level, inlined only in the hot call
+	b, got := run(CompileOptions{OptLevel: 1}, nil)
+	if got != want || count(b, OpCall) != 2 || count(b, OpJmptrue) != 0 {
+		t.Errorf("without a profile: expected %s with 2 calls, got %s with %d", want, got, count(b, OpCall))
+	}
+	b, got = run(CompileOptions{OptLevel: 1, Profile: p}, nil)
+	if got != want || count(b, OpCall) != 1 || count(b, OpJmptrue) != 1 {
+		t.Errorf("with a profile: expected %s with 1 call and the else first, got %s with %d calls and %d jmptrue",
+			want, got, count(b, OpCall), count(b, OpJmptrue))
+	}
+}
+
+func TestProfileShared(t *testing.T) {
+	p := NewProfile()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		b, err := CompileSource([]byte(profiledSource), "test.yo", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vm := NewVM()
+			vm.SetProfile(p)
+			if _, err := vm.run(b); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := p.Calls[ProfileSite{"test.yo", 4}]; n != 800 {
+		t.Errorf("expected 800 calls at line 4, got %d", n)
+	}
+	if c := p.Conditions[ProfileSite{"test.yo", 5}]; c == nil || *c != (ConditionCount{0, 800}) {
+		t.Errorf("expected the condition at line 5 to be false 800 times, got %v", c)
+	}
+}
+
+func TestProfileReadWrite(t *testing.T) {
+	p := NewProfile()
+	p.Calls[ProfileSite{"a.yo", 3}] = 10
+	p.Calls[ProfileSite{"b c.yo", 1}] = 2
+	p.Conditions[ProfileSite{"a.yo", 7}] = &ConditionCount{5, 1}
+
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "call\ta.yo\t3\t10\ncall\tb c.yo\t1\t2\ncond\ta.yo\t7\t5\t1\n"
+	if buf.String() != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	// the counts of the same site add up
+	read, err := ReadProfile(strings.NewReader(want + want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Calls[ProfileSite{"a.yo", 3}] = 20
+	p.Calls[ProfileSite{"b c.yo", 1}] = 4
+	p.Conditions[ProfileSite{"a.yo", 7}] = &ConditionCount{10, 2}
+	if !reflect.DeepEqual(read, p) {
+		t.Errorf("expected %v, got %v", p, read)
+	}
+
+	for _, bad := range []string{"call\ta.yo\t1\n", "cond\ta.yo\t1\t2\tx\n", "jump\ta.yo\t1\t2\n", "\n"} {
+		if _, err := ReadProfile(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
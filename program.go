@@ -0,0 +1,192 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// Program is a program compiled from multiple source files (see Builder).
+type Program struct {
+	Main  *Bytecode // runs the files in the order they were added
+	Files []ProgramFile
+}
+
+// ProgramFile locates the code of one of the files of a Program
+// in it's main function. The functions defined in the file have
+// the file as their Source.
+type ProgramFile struct {
+	Name  string
+	Start uint32     // index of the file's first instruction in Main.Code
+	End   uint32     // index after the file's last instruction
+	Lines []LineInfo // the line table of the file's instructions
+}
+
+// Builder compiles multiple source files into a single Program.
+// The top-level variables and functions of all the files are visible
+// to each other, regardless of the order the files are added.
+type Builder struct {
+	opts  CompileOptions
+	files []builderFile
+}
+
+type builderFile struct {
+	name string
+	root ast.Node
+}
+
+func NewBuilder(opts CompileOptions) *Builder {
+	return &Builder{opts: opts}
+}
+
+// AddFile parses source and adds it to the program.
+func (b *Builder) AddFile(filename string, source []byte) error {
+	root, err := parse.ParseFile(source, filename)
+	if err != nil {
+		return err
+	}
+	b.files = append(b.files, builderFile{filename, root})
+	return nil
+}
+
+// Build compiles all the files added so far. All the names declared
+// by more than one file are reported together in an ErrorList.
+func (b *Builder) Build() (p *Program, err error) {
+	var c *compiler
+	defer func() {
+		if r := recover(); r != nil {
+			p, err = nil, recoverError(c, r)
+		}
+	}()
+	if len(b.files) == 0 {
+		return nil, fmt.Errorf("no files to build")
+	}
+
+	// the top-level names of all the files are declared
+	// at the start of the main function
+	declaredIn := make(map[string]string)
+	var names []*ast.Id
+	var errs ErrorList
+	roots := make([]ast.Node, len(b.files))
+	for i, f := range b.files {
+		roots[i] = hoistTopLevel(f.root, func(id *ast.Id) {
+			if other, ok := declaredIn[id.Value]; ok {
+				msg := fmt.Sprintf("'%s' is already declared in %s", id.Value, other)
+				errs.Add(&CompileError{Code: ErrRedeclared, Line: id.NodeInfo.Line, File: f.name, Message: msg})
+				return
+			}
+			declaredIn[id.Value] = f.name
+			names = append(names, id)
+		})
+	}
+	if len(errs) > 0 {
+		errs.Sort()
+		return nil, errs.Err()
+	}
+
+	c = newCompiler(b.files[0].name, b.opts, roots...)
+	if len(names) > 0 {
+		c.declare(names, nil, nil)
+	}
+
+	p = &Program{}
+	for i, f := range b.files {
+		start := c.mainFunc.NumCode
+		c.compileFile(roots[i], f.name)
+		p.Files = append(p.Files, ProgramFile{Name: f.name, Start: start, End: c.mainFunc.NumCode})
+	}
+	p.Main = c.finish()
+
+	for i := range p.Files {
+		p.Files[i].Lines = fileLines(p.Main.Lines, p.Files[i].Start, p.Files[i].End)
+	}
+	return p, nil
+}
+
+// Position returns the file and line of the instruction of Main at index instr.
+func (p *Program) Position(instr uint32) (file string, line int) {
+	for _, f := range p.Files {
+		if instr < f.Start || instr >= f.End {
+			continue
+		}
+		for _, l := range f.Lines {
+			if l.Instr > instr {
+				break
+			}
+			line = int(l.Line)
+		}
+		return f.Name, line
+	}
+	return "", 0
+}
+
+// the entries of lines that cover the instructions from start to end
+func fileLines(lines []LineInfo, start, end uint32) []LineInfo {
+	var res []LineInfo
+	for i, l := range lines {
+		if l.Instr >= end {
+			break
+		}
+		if l.Instr < start {
+			// the line may continue into the file
+			if i+1 < len(lines) && lines[i+1].Instr <= start {
+				continue
+			}
+			l.Instr = start
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// hoistTopLevel replaces the declarations at the top-level of root with
+// assignments, calling declare for each declared name. Constants
+// are not replaced, they are visible only to the files after them.
+func hoistTopLevel(root ast.Node, declare func(id *ast.Id)) ast.Node {
+	block, ok := root.(*ast.Block)
+	if !ok {
+		return root
+	}
+
+	nodes := make([]ast.Node, len(block.Nodes))
+	for i, node := range block.Nodes {
+		switch t := node.(type) {
+		case *ast.Declaration:
+			if t.IsConst {
+				break
+			}
+			var left []ast.Node
+			for _, id := range t.Left {
+				declare(id)
+				left = append(left, id)
+			}
+			right := t.Right
+			if len(right) == 0 {
+				right = []ast.Node{&ast.Nil{NodeInfo: t.NodeInfo}}
+			}
+			node = &ast.Assignment{Op: ast.TokenEq, Left: left, Right: right, NodeInfo: t.NodeInfo}
+		case *ast.Assignment:
+			if t.Op != ast.TokenColoneq {
+				break
+			}
+			for _, left := range t.Left {
+				declare(left.(*ast.Id))
+			}
+			node = &ast.Assignment{Op: ast.TokenEq, Left: t.Left, Right: t.Right, NodeInfo: t.NodeInfo}
+		case *ast.Function:
+			id, ok := t.Name.(*ast.Id)
+			if !ok {
+				break
+			}
+			declare(id)
+			fn := *t
+			fn.Name = nil
+			node = &ast.Assignment{Op: ast.TokenEq, Left: []ast.Node{id}, Right: []ast.Node{&fn}, NodeInfo: t.NodeInfo}
+		}
+		nodes[i] = node
+	}
+	return &ast.Block{Nodes: nodes, NodeInfo: block.NodeInfo}
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder(CompileOptions{})
+	files := []struct{ name, source string }{
+		{"a.yo", "var base = 40\nfunc answer() -> base + two()\n"},
+		{"b.yo", "func two() -> 2\n\nreturn answer()\n"},
+	}
+	for _, f := range files {
+		if err := b.AddFile(f.name, []byte(f.source)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := NewVM().run(p.Main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != Number(42) {
+		t.Errorf("unexpected results %v", res)
+	}
+
+	last := p.Files[1]
+	if file, line := p.Position(last.End - 1); file != "b.yo" || line != 3 {
+		t.Errorf("expected b.yo:3, got %s:%d", file, line)
+	}
+
+	b = NewBuilder(CompileOptions{})
+	b.AddFile("a.yo", []byte("var x = 1"))
+	b.AddFile("b.yo", []byte("func x() {}"))
+	if _, err := b.Build(); err == nil {
+		t.Errorf("expected an error for 'x' declared in both files")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// Prototypes declared with a schema:
+//
+//   proto Point { x: number = 0, y: number = 0, label }
+//   var p = Point(1)  // {x: 1, y: 0, label: nil}, with Point as parent
+//
+// Calling the prototype creates an instance with all of the declared
+// fields as it's own, in the order of the declaration. The arguments
+// initialize the fields by position and the rest get the value of the
+// prototype, it's default. A field with a type annotation only accepts
+// values of that type, so a typed field without a default is required.
+// Methods are added to the prototype like to any other object.
+//
+// A prototype can inherit from another one:
+//
+//   proto Point3 : Point { z: number = 0 }
+//   func Point3.len() { return super.len() + this.z }
+//   var p = Point3(1, 2, 3) // {x: 1, y: 2, z: 3, label: nil}
+//
+// It's instances have the fields of the parent first, then it's own,
+// and a field declared again takes the new type and default in the
+// same position. The parent is the parent of the prototype, so the
+// fields and methods not found in the prototype are looked up in the
+// parent. Inside the methods declared for the prototype, 'super' is
+// the parent, and the calls of it's methods pass 'this' along.
+
+// protoSchema lists the fields declared for a prototype
+type protoSchema struct {
+	name   string
+	fields []string
+	types  []ValueType // typeAny if the field has no annotation
+}
+
+func newPrototype(name string) *Object {
+	obj := NewObject(nil, make(map[string]Value))
+	obj.schema = &protoSchema{name: name}
+	return obj
+}
+
+// inherit makes parent the parent of proto, with it's fields
+func (proto *Object) inherit(parent *Object) {
+	proto.Parent = parent
+	if s := parent.schema; s != nil {
+		proto.schema.fields = append(proto.schema.fields, s.fields...)
+		proto.schema.types = append(proto.schema.types, s.types...)
+	}
+}
+
+// declareField adds a field to the schema of proto, it's current
+// value is the default
+func (proto *Object) declareField(name string, typ ValueType) {
+	s := proto.schema
+	for i, field := range s.fields {
+		if field == name {
+			// inherited
+			s.types[i] = typ
+			return
+		}
+	}
+	s.fields = append(s.fields, name)
+	s.types = append(s.types, typ)
+	if !proto.Has(name) {
+		proto.Fields[name] = Nil{}
+	}
+}
+
+// construct creates an instance of proto with the arguments at R(args)
+// ... R(args+nargs-1), the keyword arguments among them naming the
+// fields, the instance is stored at R(a) like the results of a call
+// expecting b results
+func (vm *VM) construct(cf *callFrame, proto *Object, a, b, args, nargs uint) int {
+	s := proto.schema
+	names := callKeywords(cf, nargs)
+	positional := nargs - uint(len(names))
+	if int(positional) > len(s.fields) {
+		vm.setError("too many arguments in call to %s: expected %d, got %d", s.name, len(s.fields), positional)
+		return 1
+	}
+	if len(names) > 0 && !vm.checkKeywords(s.name, s.fields, names, int(positional)) {
+		return 1
+	}
+
+	obj := NewObject(proto, make(map[string]Value, len(s.fields)))
+	vm.usage.Allocations++
+	for i, name := range s.fields {
+		val := proto.Get(name)
+		if i < int(positional) {
+			val = cf.r[args+uint(i)].get()
+		} else if j := paramIndex(names, name); j >= 0 {
+			// given as a keyword argument
+			val = cf.r[args+positional+uint(j)].get()
+		}
+		if typ := val.Type(); !typeCompatible(s.types[i], typ) {
+			vm.setError("cannot use a %s value as field '%s' of %s, expected %s", typ, name, s.name, s.types[i])
+			return 1
+		}
+		obj.Fields[name] = val
+	}
+
+	if b == 0 {
+		arr := Array{obj}
+		cf.r[a].set(&arr)
+		return 0
+	}
+	cf.r[a].set(obj)
+	for i := uint(1); i < b; i++ {
+		cf.r[a+i] = nilRegister
+	}
+	return 0
+}
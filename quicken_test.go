@@ -0,0 +1,74 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// the opcodes of code that are specialized for numbers or have one
+func arithOps(code *Bytecode) []Opcode {
+	var ops []Opcode
+	for _, instr := range code.Code {
+		op := OpGetOpcode(instr)
+		if _, ok := numberOps[op]; ok || (op >= OpAddNN && op <= OpLeNN) {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+func TestQuicken(t *testing.T) {
+	const lib = `
+		proto Vec { x = 0 }
+		func Vec.__add(a, b) -> Vec(a.x + b.x)
+		func add(a, b) -> a + b
+		func less(a, b) -> a < b
+	`
+	tests := []struct {
+		calls  string
+		before []Opcode // the ops of add and less before running
+		after  []Opcode
+		want   string
+	}{
+		// not executed, so nothing is quickened
+		{"return 0", []Opcode{OpAdd, OpLt}, []Opcode{OpAdd, OpLt}, "[0]"},
+
+		{"return add(1, 2), less(1, 2)", []Opcode{OpAdd, OpLt}, []Opcode{OpAddNN, OpLtNN}, "[3 true]"},
+		{"var a = 0\nfor i = 0; i < 3; i++ { a = add(a, i) }\nreturn a", []Opcode{OpAdd, OpLt}, []Opcode{OpAddNN, OpLt}, "[3]"},
+
+		// a non-number puts back the generic instruction and still
+		// gives the result of it
+		{"return add(1, 2), add(Vec(1), Vec(2)).x", []Opcode{OpAdd, OpLt}, []Opcode{OpAdd, OpLt}, "[3 3]"},
+		{"return less(1, 2), less(\"b\", \"a\")", []Opcode{OpAdd, OpLt}, []Opcode{OpAdd, OpLt}, "[true false]"},
+
+		// and numbers quicken it again
+		{"return add(Vec(1), Vec(2)).x, add(1, 2), less(\"a\", \"b\"), less(2, 1)", []Opcode{OpAdd, OpLt}, []Opcode{OpAddNN, OpLtNN}, "[3 3 true false]"},
+	}
+	for _, test := range tests {
+		source := lib + test.calls
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		funcs := code.Funcs[len(code.Funcs)-2:]
+		ops := func() []Opcode {
+			return append(arithOps(funcs[0]), arithOps(funcs[1])...)
+		}
+		if got := ops(); fmt.Sprint(got) != fmt.Sprint(test.before) {
+			t.Errorf("%q: expected %v before running, got %v", test.calls, test.before, got)
+		}
+		res, err := NewVM().run(code)
+		if err != nil {
+			t.Fatalf("%q: %v", test.calls, err)
+		}
+		if got := fmt.Sprint(res); got != test.want {
+			t.Errorf("%q: expected %s, got %s", test.calls, test.want, got)
+		}
+		if got := ops(); fmt.Sprint(got) != fmt.Sprint(test.after) {
+			t.Errorf("%q: expected %v after running, got %v", test.calls, test.after, got)
+		}
+	}
+}
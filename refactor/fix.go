@@ -0,0 +1,122 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package refactor
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// Rule is a mechanical upgrade of the scripts written for an older
+// version of the language, applied by Fix.
+type Rule struct {
+	Name string // selects the rule in Fix, like "curry"
+	Doc  string // what the rule rewrites, for the help of tools
+
+	// Edits returns the edits that upgrade the file f, parsed as root.
+	// The edits must not overlap, and they should only touch the
+	// deprecated syntax so the comments and the layout of the rest
+	// of the file are kept.
+	Edits func(f File, root ast.Node) []Edit
+}
+
+var rules = make(map[string]*Rule)
+
+// Register adds a rule to the ones applied by Fix, it panics if a
+// rule with the same name is registered already.
+func Register(rule *Rule) {
+	if _, ok := rules[rule.Name]; ok {
+		panic(fmt.Sprintf("refactor: rule '%s' registered twice", rule.Name))
+	}
+	rules[rule.Name] = rule
+}
+
+// Rules returns the registered rules sorted by name.
+func Rules() []*Rule {
+	res := make([]*Rule, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, rule)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Fix returns files upgraded by the registered rules named in names, or
+// by all of them if names is empty, applied one after the other in the
+// order of Rules. The files are parsed again after each rule, so the
+// edits of a rule can't overlap the ones of another. The files are
+// returned in the same order, the ones not changed with their own
+// source.
+func Fix(files []File, names ...string) ([]File, error) {
+	selected := Rules()
+	if len(names) > 0 {
+		selected = selected[:0]
+		for _, name := range names {
+			rule, ok := rules[name]
+			if !ok {
+				return nil, fmt.Errorf("no rule named '%s'", name)
+			}
+			selected = append(selected, rule)
+		}
+		sort.Slice(selected, func(i, j int) bool { return selected[i].Name < selected[j].Name })
+	}
+
+	for _, rule := range selected {
+		var edits []Edit
+		for _, f := range files {
+			root, err := parse.ParseFile(f.Source, f.Name)
+			if err != nil {
+				return nil, err
+			}
+			edits = append(edits, rule.Edits(f, root)...)
+		}
+		if len(edits) > 0 {
+			files = Apply(files, edits)
+		}
+	}
+	return files, nil
+}
+
+func init() {
+	Register(&Rule{
+		Name:  "curry",
+		Doc:   "rewrites the curried functions 'func(a) ^(b) -> a + b' as 'func(a) -> func(b) -> a + b'",
+		Edits: curryEdits,
+	})
+}
+
+// curryEdits replaces each '^' before the arguments of a curried
+// function with '-> func'. The parser desugars the '^' into a body
+// returning the function, both starting at the '^'.
+func curryEdits(f File, root ast.Node) []Edit {
+	var edits []Edit
+	ast.Inspect(root, func(node ast.Node) bool {
+		fn, ok := node.(*ast.Function)
+		if !ok {
+			return true
+		}
+		body, ok := fn.Body.(*ast.Block)
+		if !ok || len(body.Nodes) != 1 {
+			return true
+		}
+		ret, ok := body.Nodes[0].(*ast.ReturnStmt)
+		if !ok || len(ret.Values) != 1 {
+			return true
+		}
+		curried, ok := ret.Values[0].(*ast.Function)
+		start := body.NodeInfo.Start
+		if !ok || curried.Name != nil || ast.Info(curried).Start != start {
+			return true
+		}
+		i := offset(f.Source, start)
+		if i < len(f.Source) && f.Source[i] == '^' {
+			end := ast.Position{Line: start.Line, Column: start.Column + 1}
+			edits = append(edits, Edit{f.Name, start, end, "-> func"})
+		}
+		return true
+	})
+	return edits
+}
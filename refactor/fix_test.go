@@ -0,0 +1,50 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package refactor
+
+import (
+	"testing"
+)
+
+func TestFix(t *testing.T) {
+	source := `// adds three numbers
+var add = func(a) ^(b) ^(c) -> a + b + c // curried
+
+func scale(n) ^(by) {
+	return n * by   // keeps the layout
+}
+var short = func(x) -> func(y) -> x * y
+`
+	want := `// adds three numbers
+var add = func(a) -> func(b) -> func(c) -> a + b + c // curried
+
+func scale(n) -> func(by) {
+	return n * by   // keeps the layout
+}
+var short = func(x) -> func(y) -> x * y
+`
+	files := []File{{"main.yo", []byte(source)}, {"other.yo", []byte("println(1)\n")}}
+	fixed, err := Fix(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fixed[0].Source) != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, fixed[0].Source)
+	}
+	if string(fixed[1].Source) != "println(1)\n" {
+		t.Errorf("expected other.yo to stay the same, got:\n%s", fixed[1].Source)
+	}
+
+	// the fixed source is fixed already
+	again, err := Fix(fixed, "curry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again[0].Source) != want {
+		t.Errorf("expected no more changes, got:\n%s", again[0].Source)
+	}
+
+	if _, err := Fix(files, "nope"); err == nil {
+		t.Errorf("expected an error for an unknown rule")
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+//
+// Source transformations of scripts that keep their meaning,
+// for editors and tools
+
+package refactor
+
+import (
+	"fmt"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/glhrmfrts/yo"
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+// File is a source file of a program. The top-level names
+// of the files of a program are visible to each other, as
+// in a yo.Builder.
+type File struct {
+	Name   string
+	Source []byte
+}
+
+// Edit replaces the text between Start and End of File with NewText.
+type Edit struct {
+	File       string
+	Start, End ast.Position
+	NewText    string
+}
+
+// RenameSymbol returns the edits that rename the symbol at pos in the
+// file named file to newName, in all of files, sorted by file and
+// position. A top-level name is renamed in all the files that use it,
+// a local only in it's scope. The keyword arguments of the calls to
+// a named function are renamed along with it's parameters.
+//
+// The rename fails, without edits, if newName is not a valid name
+// or if it would change what any name of the program refers to: when
+// newName is already declared in the same scope, when a use of the
+// symbol would refer to another declaration of newName, or when a
+// use of another newName would refer to the renamed symbol.
+func RenameSymbol(files []File, file string, pos ast.Position, newName string) ([]Edit, error) {
+	if err := checkName(newName); err != nil {
+		return nil, err
+	}
+	units := make([]*unit, len(files))
+	var target *unit
+	for i, f := range files {
+		root, err := parse.ParseFile(f.Source, f.Name)
+		if err != nil {
+			return nil, err
+		}
+		units[i] = &unit{name: f.Name, root: root, table: yo.Symbols(root)}
+		if f.Name == file {
+			target = units[i]
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("%s: no such file", file)
+	}
+	sym := target.table.At(pos)
+	if sym == nil {
+		return nil, fmt.Errorf("%s:%d:%d: no symbol to rename", file, pos.Line, pos.Column)
+	}
+	if sym.Name == newName {
+		return nil, nil
+	}
+
+	// the symbols renamed in each unit
+	if sym.Kind == yo.SymbolGlobal || sym.Scope == target.root {
+		declared := false
+		for _, u := range units {
+			if u.sym = u.topLevel(sym.Name); u.sym != nil && u.sym.Kind != yo.SymbolGlobal {
+				declared = true
+			}
+		}
+		if !declared {
+			return nil, fmt.Errorf("%s:%d:%d: '%s' is not declared by the program", file, pos.Line, pos.Column, sym.Name)
+		}
+		for _, u := range units {
+			if other := u.topLevel(newName); other != nil && other.Kind != yo.SymbolGlobal {
+				line := ast.Info(other.Decl).Start.Line
+				return nil, fmt.Errorf("%s:%d: '%s' is already declared", u.name, line, newName)
+			}
+		}
+	} else {
+		target.sym = sym
+	}
+
+	for _, u := range units {
+		if u.sym == nil {
+			continue
+		}
+		if err := u.check(newName); err != nil {
+			return nil, err
+		}
+		u.pending = append(u.pending, u.edits(newName)...)
+	}
+
+	// the calls to a named function, in all the files if it's top-level
+	if fn, ok := sym.Scope.(*ast.Function); ok && sym.Kind == yo.SymbolParam {
+		if name, ok := fn.Name.(*ast.Id); ok {
+			fnSym := target.table.Lookup(name)
+			for _, u := range units {
+				if u == target {
+					u.pending = append(u.pending, u.callEdits(fnSym, sym.Name, newName)...)
+				} else if fnSym.Scope == target.root {
+					u.pending = append(u.pending, u.callEdits(u.topLevel(name.Value), sym.Name, newName)...)
+				}
+			}
+		}
+	}
+
+	var edits []Edit
+	for _, u := range units {
+		sort.Slice(u.pending, func(i, j int) bool { return before(u.pending[i].Start, u.pending[j].Start) })
+		edits = append(edits, u.pending...)
+	}
+	return edits, nil
+}
+
+// Apply returns files with edits applied to their sources,
+// the edits can be in any order but must not overlap.
+func Apply(files []File, edits []Edit) []File {
+	res := make([]File, len(files))
+	for i, f := range files {
+		var fedits []Edit
+		for _, e := range edits {
+			if e.File == f.Name {
+				fedits = append(fedits, e)
+			}
+		}
+		// from the end, so the offsets of the next edits don't change
+		sort.Slice(fedits, func(i, j int) bool { return before(fedits[j].Start, fedits[i].Start) })
+		source := f.Source
+		for _, e := range fedits {
+			start, end := offset(source, e.Start), offset(source, e.End)
+			edited := make([]byte, 0, len(source)-(end-start)+len(e.NewText))
+			edited = append(edited, source[:start]...)
+			edited = append(edited, e.NewText...)
+			source = append(edited, source[end:]...)
+		}
+		res[i] = File{f.Name, source}
+	}
+	return res
+}
+
+func checkName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	for i, ch := range name {
+		letter := ch == '_' || unicode.IsLetter(ch)
+		if !letter && (i == 0 || !unicode.IsDigit(ch)) {
+			return fmt.Errorf("'%s' is not a valid name", name)
+		}
+	}
+	if _, ok := ast.Keyword(name); ok || name == "this" {
+		return fmt.Errorf("'%s' is a reserved word", name)
+	}
+	return nil
+}
+
+type unit struct {
+	name  string
+	root  ast.Node
+	table *yo.SymbolTable
+	sym   *yo.Symbol // the symbol renamed in the unit, if any
+
+	pending []Edit
+}
+
+// topLevel returns the symbol named name declared at the top level
+// of the unit, or the global if it's not declared by the unit
+func (u *unit) topLevel(name string) *yo.Symbol {
+	var global *yo.Symbol
+	for _, sym := range u.table.Symbols {
+		if sym.Name != name {
+			continue
+		}
+		if sym.Scope == u.root {
+			return sym
+		}
+		if sym.Kind == yo.SymbolGlobal {
+			global = sym
+		}
+	}
+	return global
+}
+
+// check renames the symbol in the tree and resolves the names again,
+// the uses of the symbol must refer to it alone and all the other
+// names must refer to the same declarations as before
+func (u *unit) check(newName string) error {
+	ids := u.ids()
+	oldName := u.sym.Name
+	for _, id := range ids {
+		id.Value = newName
+	}
+	decl := u.sym.Decl
+	kw, isKw := decl.(*ast.KwArg)
+	if isKw {
+		kw.Key = newName
+	}
+	field, isField := decl.(*ast.ObjectField)
+	if isField {
+		// {name} becomes {name: newName}
+		decl = &ast.Id{Value: newName, NodeInfo: field.NodeInfo}
+		field.Value = decl
+	}
+	renamed := yo.Symbols(u.root)
+	for _, id := range ids {
+		id.Value = oldName
+	}
+	if isKw {
+		kw.Key = oldName
+	}
+	if isField {
+		field.Value = nil
+	}
+
+	for _, sym := range renamed.Symbols {
+		if sym.Name == newName && sym.Kind != yo.SymbolGlobal && sym.Scope == u.sym.Scope && sym.Decl != decl {
+			line := ast.Info(sym.Decl).Start.Line
+			return fmt.Errorf("%s:%d: '%s' is already declared", u.name, line, newName)
+		}
+	}
+	mapped := make(map[*yo.Symbol]*yo.Symbol)
+	origin := make(map[*yo.Symbol]*yo.Symbol)
+	var err error
+	ast.Inspect(u.root, func(node ast.Node) bool {
+		id, ok := node.(*ast.Id)
+		if !ok || err != nil {
+			return err == nil
+		}
+		old, sym := u.table.Lookup(id), renamed.Lookup(id)
+		if old == nil {
+			return true
+		}
+		if m, ok := mapped[old]; ok && m != sym || origin[sym] != nil && origin[sym] != old {
+			pos := ast.Info(id).Start
+			err = fmt.Errorf("%s:%d:%d: renaming '%s' to '%s' changes what '%s' refers to", u.name, pos.Line, pos.Column, oldName, newName, old.Name)
+			return false
+		}
+		mapped[old], origin[sym] = sym, old
+		return true
+	})
+	return err
+}
+
+// ids returns the ids of the declaration and the uses of the symbol
+func (u *unit) ids() []*ast.Id {
+	var ids []*ast.Id
+	if id, ok := u.sym.Decl.(*ast.Id); ok {
+		ids = append(ids, id)
+	}
+	for _, ref := range u.sym.Refs {
+		ids = append(ids, ref.Id)
+	}
+	return ids
+}
+
+func (u *unit) edits(newName string) []Edit {
+	var edits []Edit
+	for _, id := range u.ids() {
+		info := ast.Info(id)
+		edits = append(edits, Edit{u.name, info.Start, info.End, newName})
+	}
+	switch decl := u.sym.Decl.(type) {
+	case *ast.KwArg:
+		edits = append(edits, u.keyEdit(decl, decl.Key, newName))
+	case *ast.ObjectField:
+		// the key stays, bound to the new name
+		end := u.keyEdit(decl, decl.Key, "").End
+		edits = append(edits, Edit{u.name, end, end, ": " + newName})
+	}
+	return edits
+}
+
+// callEdits returns the edits of the keyword arguments named key
+// of the calls to the function of the symbol fn, by it's name
+func (u *unit) callEdits(fn *yo.Symbol, key, newName string) []Edit {
+	var edits []Edit
+	if fn == nil {
+		return nil
+	}
+	ast.Inspect(u.root, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		if id, ok := call.Left.(*ast.Id); !ok || u.table.Lookup(id) != fn {
+			return true
+		}
+		for _, arg := range call.Args {
+			if kw, ok := arg.(*ast.KwArg); ok && kw.Key == key {
+				edits = append(edits, u.keyEdit(kw, key, newName))
+			}
+		}
+		return true
+	})
+	return edits
+}
+
+// keyEdit renames key, at the start of node
+func (u *unit) keyEdit(node ast.Node, key, newName string) Edit {
+	start := ast.Info(node).Start
+	end := ast.Position{Line: start.Line, Column: start.Column + utf8.RuneCountInString(key)}
+	return Edit{u.name, start, end, newName}
+}
+
+func before(a, b ast.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+// offset returns the index in source of the position pos
+func offset(source []byte, pos ast.Position) int {
+	i := 0
+	for line := 1; line < pos.Line && i < len(source); i++ {
+		if source[i] == '\n' {
+			line++
+		}
+	}
+	for col := 1; col < pos.Column && i < len(source); col++ {
+		_, size := utf8.DecodeRune(source[i:])
+		i += size
+	}
+	return i
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package refactor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/glhrmfrts/yo/ast"
+)
+
+func TestRenameSymbol(t *testing.T) {
+	lib := `var count = 0
+func scale(n, factor = 2) {
+	count++
+	var count = n * factor
+	return count
+}
+`
+	main := `println(scale(1, factor = 3), count)
+func other(factor) -> factor
+`
+	files := []File{{"lib.yo", []byte(lib)}, {"main.yo", []byte(main)}}
+
+	tests := []struct {
+		file    string
+		pos     ast.Position
+		newName string
+		lib     string // the expected sources, or the error
+		main    string
+	}{
+		// the local count in line 4, not the top-level one
+		{"lib.yo", ast.Position{Line: 5, Column: 9}, "total",
+			"var count = 0\nfunc scale(n, factor = 2) {\n\tcount++\n\tvar total = n * factor\n\treturn total\n}\n", main},
+		// the top-level count, in both files
+		{"main.yo", ast.Position{Line: 1, Column: 31}, "calls",
+			"var calls = 0\nfunc scale(n, factor = 2) {\n\tcalls++\n\tvar count = n * factor\n\treturn count\n}\n",
+			"println(scale(1, factor = 3), calls)\nfunc other(factor) -> factor\n"},
+		// a parameter and the keyword arguments of the calls
+		{"lib.yo", ast.Position{Line: 2, Column: 15}, "k",
+			"var count = 0\nfunc scale(n, k = 2) {\n\tcount++\n\tvar count = n * k\n\treturn count\n}\n",
+			"println(scale(1, k = 3), count)\nfunc other(factor) -> factor\n"},
+		{"lib.yo", ast.Position{Line: 2, Column: 12}, "factor", "lib.yo:2: 'factor' is already declared", ""},
+		{"lib.yo", ast.Position{Line: 4, Column: 18}, "count", "changes what", ""},
+		{"lib.yo", ast.Position{Line: 2, Column: 6}, "other", "main.yo:2: 'other' is already declared", ""},
+		{"main.yo", ast.Position{Line: 1, Column: 1}, "print", "'println' is not declared by the program", ""},
+		{"main.yo", ast.Position{Line: 1, Column: 8}, "x", "no symbol to rename", ""},
+		{"lib.yo", ast.Position{Line: 1, Column: 5}, "for", "'for' is a reserved word", ""},
+		{"lib.yo", ast.Position{Line: 1, Column: 5}, "1x", "'1x' is not a valid name", ""},
+	}
+	for i, tt := range tests {
+		edits, err := RenameSymbol(files, tt.file, tt.pos, tt.newName)
+		if tt.main == "" {
+			if err == nil || !strings.Contains(err.Error(), tt.lib) {
+				t.Errorf("(%d) expected error %q, got %v", i, tt.lib, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(%d) %v", i, err)
+			continue
+		}
+		res := Apply(files, edits)
+		if string(res[0].Source) != tt.lib {
+			t.Errorf("(%d) expected lib.yo:\n%s\ngot:\n%s", i, tt.lib, res[0].Source)
+		}
+		if string(res[1].Source) != tt.main {
+			t.Errorf("(%d) expected main.yo:\n%s\ngot:\n%s", i, tt.main, res[1].Source)
+		}
+	}
+	// a name bound by a pattern like {name} keeps the key
+	source := "match p { {x, y} { return x + y } }\n"
+	edits, err := RenameSymbol([]File{{"p.yo", []byte(source)}}, "p.yo", ast.Position{Line: 1, Column: 12}, "px")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "match p { {x: px, y} { return px + y } }\n"
+	if res := Apply([]File{{"p.yo", []byte(source)}}, edits); string(res[0].Source) != want {
+		t.Errorf("expected %q, got %q", want, res[0].Source)
+	}
+}
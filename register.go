@@ -0,0 +1,100 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// register is a Value as stored in the VM's register stack. Nil, bools
+// and numbers are kept unboxed so arithmetic, comparisons and moves
+// never allocate, and the GC only has to look at ref. Values are boxed
+// with get only when they leave the VM (native calls, globals, etc).
+type register struct {
+	kind ValueType
+	num  float64 // numbers, and bools as 0 or 1
+	ref  Value   // any other kind of value
+}
+
+// the zero register is nil
+var nilRegister = register{}
+
+// boxed small integers, so the most common numbers don't
+// allocate when they leave the VM
+var smallNumbers [smallNumbersMax - smallNumbersMin + 1]Value
+
+const (
+	smallNumbersMin = -128
+	smallNumbersMax = 1023
+)
+
+func init() {
+	for i := range smallNumbers {
+		smallNumbers[i] = Number(i + smallNumbersMin)
+	}
+}
+
+func (r *register) get() Value {
+	switch r.kind {
+	case ValueNil:
+		return Nil{}
+	case ValueBool:
+		return Bool(r.num != 0)
+	case ValueNumber:
+		if i := int(r.num); float64(i) == r.num && i >= smallNumbersMin && i <= smallNumbersMax {
+			return smallNumbers[i-smallNumbersMin]
+		}
+		return Number(r.num)
+	}
+	return r.ref
+}
+
+func (r *register) set(v Value) {
+	switch t := v.(type) {
+	case nil, Nil:
+		*r = nilRegister
+	case Bool:
+		r.setBool(bool(t))
+	case Number:
+		r.setNumber(float64(t))
+	default:
+		*r = register{kind: v.Type(), ref: v}
+	}
+}
+
+func (r *register) setNumber(n float64) {
+	*r = register{kind: ValueNumber, num: n}
+}
+
+func (r *register) setBool(b bool) {
+	*r = register{kind: ValueBool}
+	if b {
+		r.num = 1
+	}
+}
+
+// same as get().ToBool() without boxing
+func (r *register) truthy() bool {
+	switch r.kind {
+	case ValueNil:
+		return false
+	case ValueBool:
+		return r.num != 0
+	}
+	return true
+}
+
+// rk returns the value of RK(x) of the current instruction
+func (cf *callFrame) rk(x uint) Value {
+	if x >= OpConstOffset {
+		return cf.fn.Bytecode.Consts[x-OpConstOffset]
+	}
+	return cf.r[x].get()
+}
+
+// rkNumber returns RK(x) if it is a number, without boxing it
+func (cf *callFrame) rkNumber(x uint) (float64, bool) {
+	var r *register
+	if x >= OpConstOffset {
+		r = &cf.fn.Bytecode.consts[x-OpConstOffset]
+	} else {
+		r = &cf.r[x]
+	}
+	return r.num, r.kind == ValueNumber
+}
@@ -3,16 +3,47 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/glhrmfrts/yo"
+	"github.com/glhrmfrts/yo/ast"
 	"github.com/glhrmfrts/yo/parse"
 	"github.com/glhrmfrts/yo/pretty"
+	"github.com/glhrmfrts/yo/refactor"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
+var optLevel = flag.Int("O", 0, "optimization level")
+var jsonErrors = flag.Bool("json-errors", false, "print syntax errors as JSON")
+var printAst = flag.Bool("ast", false, "print the syntax tree")
+var astDepth = flag.Int("ast-depth", 0, "maximum depth of the printed syntax tree, 0 for no limit")
+var astDump = flag.Bool("ast-dump", false, "print the syntax tree with source ranges and folded constants")
+var frontMatter = flag.Bool("front-matter", false, "print the front matter of the script as JSON")
+var fix = flag.Bool("fix", false, "upgrade the syntax of the files in place, see refactor.Fix")
+var fixRules = flag.String("fix-rules", "", "comma-separated rules applied by -fix, all of them if empty")
+var kernel = flag.Bool("kernel", false, "run cells read as JSON from the standard input, see Kernel.Serve")
+
 func main() {
-	filename := os.Args[1]
+	flag.Parse()
+	if *kernel {
+		if err := yo.NewKernel(yo.NewVM()).Serve(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *fix {
+		if err := fixFiles(flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	filename := flag.Arg(0)
 	source, err := ioutil.ReadFile(filename)
 	if err != nil {
 		panic(err)
@@ -20,13 +51,44 @@ func main() {
 
 	root, err := parse.ParseFile(source, filename)
 	if err != nil {
+		if perr, ok := err.(*parse.ParseError); ok {
+			if *jsonErrors {
+				b, _ := json.Marshal(perr)
+				fmt.Println(string(b))
+			} else {
+				fmt.Println(perr.Detail())
+			}
+			return
+		}
 		fmt.Println(err.Error())
 		return
 	}
 
-	//fmt.Println(pretty.SyntaxTree(root, 2))
+	if *frontMatter {
+		b, _ := json.Marshal(root.(*ast.Block).FrontMatter)
+		fmt.Println(string(b))
+	}
+
+	if *printAst || *astDump {
+		// colors only when writing to a terminal
+		stat, _ := os.Stdout.Stat()
+		printer := pretty.Printer{
+			IndentSize: 2,
+			Color:      stat != nil && stat.Mode()&os.ModeCharDevice != 0,
+			MaxDepth:   *astDepth,
+			Dump:       *astDump,
+			File:       filename,
+		}
+		printer.Fprint(os.Stdout, root)
+		fmt.Println()
+	}
 
-	code, err := yo.Compile(root, filename)
+	code, err := yo.CompileWithOptions(root, filename, yo.CompileOptions{
+		Warn: func(w *yo.CompileWarning) {
+			fmt.Fprintln(os.Stderr, w)
+		},
+		OptLevel: *optLevel,
+	})
 	if err != nil {
 		fmt.Println(err.Error())
 		return
@@ -37,3 +99,33 @@ func main() {
 	vm := yo.NewVM()
 	vm.RunBytecode(code)
 }
+
+// fixFiles rewrites the files changed by the rules of -fix-rules
+func fixFiles(names []string) error {
+	var files []refactor.File
+	for _, name := range names {
+		source, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		files = append(files, refactor.File{Name: name, Source: source})
+	}
+	var rules []string
+	if *fixRules != "" {
+		rules = strings.Split(*fixRules, ",")
+	}
+	fixed, err := refactor.Fix(files, rules...)
+	if err != nil {
+		return err
+	}
+	for i, f := range fixed {
+		if string(f.Source) == string(files[i].Source) {
+			continue
+		}
+		if err := ioutil.WriteFile(f.Name, f.Source, 0644); err != nil {
+			return err
+		}
+		fmt.Println(f.Name)
+	}
+	return nil
+}
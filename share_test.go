@@ -0,0 +1,98 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestShare(t *testing.T) {
+	res, err := DoString(`
+		const factor = 3
+		var names = ["a", "b"]
+		var count = 0
+		func scale(x) -> x * factor
+		func twice(x) -> scale(scale(x))
+		func first() -> names[0]
+		func next() { count++; return count }
+		return twice, first, next, names`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := Share(res[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if twice != res[0] {
+		t.Errorf("expected the function itself")
+	}
+	for i, want := range []string{"variable 'names': cannot share a array value", "assigns the variables", "cannot share a array value"} {
+		if _, err := Share(res[i+1]); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("(%d) expected %q, got %v", i+1, want, err)
+		}
+	}
+
+	pool := &VMPool{New: func() *VM {
+		vm := NewVM()
+		vm.Define("twice", twice)
+		return vm
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vm := pool.Get()
+			defer pool.Put(vm)
+			code, err := CompileReader(strings.NewReader("var n = 0\nfor i = 0; i < 100; i++ { n = twice(2) }\nreturn n"), "<test>", CompileOptions{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if res, err := vm.run(code); err != nil || res[0].String() != "18" {
+				t.Errorf("expected 18, got %v %v", res, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// many VMs read the code, so it's never changed
+	fn := twice.(*Func).Bytecode
+	code := append([]uint32(nil), fn.Code...)
+	runString(t, pool.Get(), "twice(\"a\")")
+	if !fn.frozen || fmt.Sprint(fn.Code) != fmt.Sprint(code) {
+		t.Errorf("expected the shared code not to change")
+	}
+
+	vm := NewVM()
+	var inScope error
+	vm.Define("share", GoFunc(func(call *FuncCall) {
+		_, inScope = Share(call.Args[0])
+	}))
+	runString(t, vm, "var x = 1\nshare(func() -> x)")
+	if inScope == nil || !strings.Contains(inScope.Error(), "in scope") {
+		t.Errorf("expected the variable to be in scope, got %v", inScope)
+	}
+}
+
+func TestShareableAssigned(t *testing.T) {
+	tests := map[string]bool{
+		"var n = 0\nreturn func() -> n":         true,
+		"var n = 0\nn += 1\nreturn func() -> n": false,
+		"var n = 0\nn++\nreturn func() -> n":    false,
+		"var n = 0\n++n\nreturn func() -> n":    false,
+		"var n = 0\n--n\nreturn func() -> n":    false,
+	}
+	for source, want := range tests {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := code.Funcs[0].Shareable; got != want {
+			t.Errorf("%q: expected shareable %v, got %v", source, want, got)
+		}
+	}
+}
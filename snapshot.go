@@ -0,0 +1,595 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Snapshots of the globals of a VM, so a session (like a REPL) can
+// be saved and resumed later with a new VM:
+//
+//   err := vm.SaveGlobals(w)
+//   ...
+//   vm := yo.NewVM()
+//   err := vm.LoadGlobals(r)
+//
+// Values are saved deeply, keeping the values shared by different
+// globals shared when loaded. Script functions are saved with their
+// compiled code and the values of their free variables, so they can
+// only be saved after the variables they capture went out of scope
+// (see Transfer). Native values (GoFuncs and GoObjects) can't
+// be saved, the globals holding them are skipped since the host defines
+// them again in the new session, like NewVM does with the builtins.
+
+const snapshotMagic = "yosnap\x04"
+
+// ErrBadSnapshot is returned by LoadGlobals when the data
+// is not a snapshot, or is corrupted.
+var ErrBadSnapshot = errors.New("invalid snapshot")
+
+// value tags
+const (
+	snapNil byte = iota
+	snapFalse
+	snapTrue
+	snapNumber
+	snapString
+	snapArray      // *Array
+	snapArrayValue // Array
+	snapObject
+	snapProto // an object with a schema
+	snapFunc
+	snapRef   // a value already saved, by it's index
+	snapRange // followed by the start, the end and the step as numbers
+)
+
+// SaveGlobals writes a snapshot of the globals of vm to w.
+func (vm *VM) SaveGlobals(w io.Writer) error {
+	names := make([]string, 0, len(vm.Globals))
+	for name, v := range vm.Globals {
+		if !hasNative(v, make(map[interface{}]bool)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	e := snapEncoder{
+		w:         bufio.NewWriter(w),
+		refs:      make(map[interface{}]int),
+		bytecodes: make(map[*Bytecode]int),
+		upvalues:  make(map[*upvalue]int),
+	}
+	e.w.WriteString(snapshotMagic)
+	e.uint(len(names))
+	for _, name := range names {
+		e.string(name)
+		if err := e.value(vm.Globals[name]); err != nil {
+			return err
+		}
+	}
+	return e.w.Flush()
+}
+
+// LoadGlobals defines the globals saved by SaveGlobals in vm,
+// replacing the ones with the same names.
+func (vm *VM) LoadGlobals(r io.Reader) (err error) {
+	d := snapDecoder{r: bufio.NewReader(r)}
+	defer func() {
+		if e := recover(); e != nil {
+			if e != errSnapshotData {
+				panic(e)
+			}
+			err = ErrBadSnapshot
+		}
+	}()
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != snapshotMagic {
+		return ErrBadSnapshot
+	}
+	globals := make(map[string]Value)
+	for n := d.uint(); n > 0; n-- {
+		name := d.string()
+		globals[name] = d.value()
+	}
+
+	// define them only if the whole snapshot could be read
+	for _, b := range d.bytecodes {
+		b.prepare(vm.strings)
+	}
+	for name, v := range globals {
+		vm.Define(name, v)
+	}
+	return nil
+}
+
+// hasNative tells if v is or refers to a value that can't be saved
+func hasNative(v Value, seen map[interface{}]bool) bool {
+	switch o := v.(type) {
+	case GoFunc, *GoObject:
+		return true
+	case *Array:
+		if seen[o] {
+			return false
+		}
+		seen[o] = true
+		return hasNative(*o, seen)
+	case Array:
+		for _, elem := range o {
+			if hasNative(elem, seen) {
+				return true
+			}
+		}
+	case *Object:
+		for ; o != nil && !seen[o]; o = o.Parent {
+			seen[o] = true
+			for _, field := range o.Fields {
+				if hasNative(field, seen) {
+					return true
+				}
+			}
+		}
+	case *Func:
+		if seen[o] {
+			return false
+		}
+		seen[o] = true
+		for _, u := range o.upvalues {
+			if u != nil && !u.open && hasNative(u.value.get(), seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type snapEncoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+
+	// the indices of the values already saved
+	refs      map[interface{}]int
+	bytecodes map[*Bytecode]int
+	upvalues  map[*upvalue]int
+}
+
+func (e *snapEncoder) uint(n int) {
+	e.w.Write(e.buf[:binary.PutUvarint(e.buf[:], uint64(n))])
+}
+
+func (e *snapEncoder) int(n int) {
+	e.w.Write(e.buf[:binary.PutVarint(e.buf[:], int64(n))])
+}
+
+func (e *snapEncoder) string(s string) {
+	e.uint(len(s))
+	e.w.WriteString(s)
+}
+
+// ref saves a reference to key if it was already saved,
+// otherwise it gives key the next index
+func (e *snapEncoder) ref(key interface{}) bool {
+	if index, ok := e.refs[key]; ok {
+		e.w.WriteByte(snapRef)
+		e.uint(index)
+		return true
+	}
+	e.refs[key] = len(e.refs)
+	return false
+}
+
+func (e *snapEncoder) value(v Value) error {
+	switch o := v.(type) {
+	case nil, Nil:
+		e.w.WriteByte(snapNil)
+	case Bool:
+		if o {
+			e.w.WriteByte(snapTrue)
+		} else {
+			e.w.WriteByte(snapFalse)
+		}
+	case Number:
+		e.w.WriteByte(snapNumber)
+		binary.LittleEndian.PutUint64(e.buf[:8], math.Float64bits(float64(o)))
+		e.w.Write(e.buf[:8])
+	case String:
+		e.w.WriteByte(snapString)
+		e.string(string(o))
+	case *Array:
+		if e.ref(o) {
+			return nil
+		}
+		e.w.WriteByte(snapArray)
+		return e.array(*o)
+	case Array:
+		e.w.WriteByte(snapArrayValue)
+		return e.array(o)
+	case *Object:
+		return e.object(o)
+	case *Func:
+		return e.function(o)
+	case Range:
+		e.w.WriteByte(snapRange)
+		for _, n := range []float64{o.Start, o.End, o.Step} {
+			e.value(Number(n))
+		}
+	default:
+		return fmt.Errorf("cannot save a %s value", v.Type())
+	}
+	return nil
+}
+
+func (e *snapEncoder) array(a Array) error {
+	e.uint(len(a))
+	for _, elem := range a {
+		if err := e.value(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *snapEncoder) object(o *Object) error {
+	if e.ref(o) {
+		return nil
+	}
+	if s := o.schema; s != nil {
+		e.w.WriteByte(snapProto)
+		e.string(s.name)
+		e.uint(len(s.fields))
+		for i, field := range s.fields {
+			e.string(field)
+			e.int(int(s.types[i]))
+		}
+	} else {
+		e.w.WriteByte(snapObject)
+	}
+
+	// the parent goes first so a nil one doesn't need a tag
+	if o.Parent != nil {
+		if err := e.object(o.Parent); err != nil {
+			return err
+		}
+	} else {
+		e.w.WriteByte(snapNil)
+	}
+	keys := o.Keys()
+	e.uint(len(keys))
+	for _, key := range keys {
+		e.string(key)
+		if err := e.value(o.Fields[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *snapEncoder) function(fn *Func) error {
+	if e.ref(fn) {
+		return nil
+	}
+	e.w.WriteByte(snapFunc)
+	e.bytecode(fn.Bytecode)
+	for i, desc := range fn.Bytecode.Upvals {
+		var u *upvalue
+		if fn.upvalues != nil {
+			u = fn.upvalues[i]
+		}
+		if u == nil || u.open {
+			return fmt.Errorf("cannot save a closure while it's variable '%s' is in scope", desc.Name)
+		}
+		if index, ok := e.upvalues[u]; ok {
+			e.uint(index + 1)
+			continue
+		}
+		e.upvalues[u] = len(e.upvalues)
+		e.uint(0)
+		if err := e.value(u.value.get()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bytecode saves b and it's functions, or it's index if it was already
+// saved, with 0 meaning it's new
+func (e *snapEncoder) bytecode(b *Bytecode) {
+	if index, ok := e.bytecodes[b]; ok {
+		e.uint(index + 1)
+		return
+	}
+	e.bytecodes[b] = len(e.bytecodes)
+	e.uint(0)
+
+	e.string(b.Source)
+	e.string(b.Name)
+	e.uint(b.Line)
+	e.uint(int(b.NumRegs))
+	e.uint(int(b.NumStmts))
+	e.uint(int(b.MaxDepth))
+	if b.Shareable {
+		e.uint(1)
+	} else {
+		e.uint(0)
+	}
+
+	// constants are only nil, bools, numbers and strings
+	e.uint(len(b.Consts))
+	for _, c := range b.Consts {
+		e.value(c)
+	}
+	e.uint(len(b.Code))
+	for _, instr := range b.Code {
+		e.uint(int(instr))
+	}
+	e.uint(len(b.Lines))
+	for _, l := range b.Lines {
+		e.uint(int(l.Instr))
+		e.uint(int(l.Line))
+	}
+	e.uint(len(b.Upvals))
+	for _, u := range b.Upvals {
+		e.string(u.Name)
+		e.uint(int(u.Kind))
+		e.uint(u.Index)
+	}
+	e.uint(len(b.Locals))
+	for _, l := range b.Locals {
+		e.string(l.Name)
+		e.uint(l.Reg)
+		e.uint(int(l.StartPC))
+		e.uint(int(l.EndPC))
+	}
+	e.uint(len(b.Params))
+	for _, name := range b.Params {
+		e.string(name)
+	}
+	if b.Variadic {
+		e.uint(1)
+	} else {
+		e.uint(0)
+	}
+	e.uint(len(b.Keywords))
+	for _, k := range b.Keywords {
+		e.uint(int(k.Instr))
+		e.uint(len(k.Names))
+		for _, name := range k.Names {
+			e.string(name)
+		}
+	}
+	e.uint(len(b.Funcs))
+	for _, f := range b.Funcs {
+		e.bytecode(f)
+	}
+}
+
+// errSnapshotData is the panic of the decoder when
+// the data doesn't make sense
+var errSnapshotData = errors.New("bad snapshot data")
+
+type snapDecoder struct {
+	r *bufio.Reader
+
+	refs      []Value
+	bytecodes []*Bytecode
+	upvalues  []*upvalue
+}
+
+func (d *snapDecoder) byte() byte {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		panic(errSnapshotData)
+	}
+	return b
+}
+
+func (d *snapDecoder) uint() int {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil || n > math.MaxInt32 {
+		panic(errSnapshotData)
+	}
+	return int(n)
+}
+
+func (d *snapDecoder) int() int {
+	n, err := binary.ReadVarint(d.r)
+	if err != nil || n > math.MaxInt32 || n < math.MinInt32 {
+		panic(errSnapshotData)
+	}
+	return int(n)
+}
+
+// count reads the length of a sequence, the sequences are allocated
+// at most with this capacity so corrupted data doesn't make huge
+// allocations before running out of data
+func (d *snapDecoder) count() (n, capacity int) {
+	n = d.uint()
+	return n, minInt(n, 1024)
+}
+
+func (d *snapDecoder) string() string {
+	n, capacity := d.count()
+	buf := bytes.NewBuffer(make([]byte, 0, capacity))
+	if _, err := io.CopyN(buf, d.r, int64(n)); err != nil {
+		panic(errSnapshotData)
+	}
+	return buf.String()
+}
+
+func (d *snapDecoder) value() Value {
+	switch tag := d.byte(); tag {
+	case snapNil:
+		return Nil{}
+	case snapFalse:
+		return Bool(false)
+	case snapTrue:
+		return Bool(true)
+	case snapNumber:
+		var buf [8]byte
+		if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+			panic(errSnapshotData)
+		}
+		return Number(math.Float64frombits(binary.LittleEndian.Uint64(buf[:])))
+	case snapString:
+		return String(d.string())
+	case snapArray:
+		arr := &Array{}
+		d.refs = append(d.refs, arr)
+		*arr = d.array()
+		return arr
+	case snapArrayValue:
+		return d.array()
+	case snapObject, snapProto:
+		return d.object(tag)
+	case snapFunc:
+		return d.function()
+	case snapRange:
+		var bounds [3]float64
+		for i := range bounds {
+			n, ok := d.value().(Number)
+			if !ok {
+				panic(errSnapshotData)
+			}
+			bounds[i] = float64(n)
+		}
+		return Range{Start: bounds[0], End: bounds[1], Step: bounds[2]}
+	case snapRef:
+		index := d.uint()
+		if index >= len(d.refs) {
+			panic(errSnapshotData)
+		}
+		return d.refs[index]
+	}
+	panic(errSnapshotData)
+}
+
+func (d *snapDecoder) array() Array {
+	n, capacity := d.count()
+	arr := make(Array, 0, capacity)
+	for ; n > 0; n-- {
+		arr = append(arr, d.value())
+	}
+	return arr
+}
+
+func (d *snapDecoder) object(tag byte) *Object {
+	obj := NewObject(nil, make(map[string]Value))
+	d.refs = append(d.refs, obj)
+	if tag == snapProto {
+		obj.schema = &protoSchema{name: d.string()}
+		for n := d.uint(); n > 0; n-- {
+			obj.schema.fields = append(obj.schema.fields, d.string())
+			obj.schema.types = append(obj.schema.types, ValueType(d.int()))
+		}
+	}
+
+	switch parent := d.value().(type) {
+	case Nil:
+	case *Object:
+		obj.Parent = parent
+	default:
+		panic(errSnapshotData)
+	}
+	for n := d.uint(); n > 0; n-- {
+		key := d.string()
+		obj.Fields[key] = d.value()
+	}
+	return obj
+}
+
+func (d *snapDecoder) function() *Func {
+	fn := &Func{}
+	d.refs = append(d.refs, fn)
+	fn.Bytecode = d.bytecode()
+	if len(fn.Bytecode.Upvals) > 0 {
+		fn.upvalues = make([]*upvalue, len(fn.Bytecode.Upvals))
+	}
+	for i := range fn.upvalues {
+		if index := d.uint(); index > 0 {
+			if index > len(d.upvalues) {
+				panic(errSnapshotData)
+			}
+			fn.upvalues[i] = d.upvalues[index-1]
+			continue
+		}
+		u := &upvalue{}
+		d.upvalues = append(d.upvalues, u)
+		u.value.set(d.value())
+		fn.upvalues[i] = u
+	}
+	return fn
+}
+
+func (d *snapDecoder) bytecode() *Bytecode {
+	if index := d.uint(); index > 0 {
+		if index > len(d.bytecodes) {
+			panic(errSnapshotData)
+		}
+		return d.bytecodes[index-1]
+	}
+	b := newBytecode(d.string())
+	d.bytecodes = append(d.bytecodes, b)
+
+	b.Name = d.string()
+	b.Line = d.uint()
+	b.NumRegs = uint32(d.uint())
+	b.NumStmts = uint32(d.uint())
+	b.MaxDepth = uint32(d.uint())
+	b.Shareable = d.uint() == 1
+	if b.NumRegs > MaxRegisters+1 {
+		panic(errSnapshotData)
+	}
+
+	for n := d.uint(); n > 0; n-- {
+		switch c := d.value().(type) {
+		case Nil, Bool, Number, String:
+			b.Consts = append(b.Consts, c)
+		default:
+			panic(errSnapshotData)
+		}
+	}
+	for n := d.uint(); n > 0; n-- {
+		instr := uint32(d.uint())
+		if int(OpGetOpcode(instr)) >= kOpCount {
+			panic(errSnapshotData)
+		}
+		b.Code = append(b.Code, instr)
+	}
+	for n := d.uint(); n > 0; n-- {
+		b.Lines = append(b.Lines, LineInfo{Instr: uint32(d.uint()), Line: uint16(d.uint())})
+	}
+	for n := d.uint(); n > 0; n-- {
+		b.Upvals = append(b.Upvals, UpvalueDesc{Name: d.string(), Kind: UpvalueKind(d.uint()), Index: d.uint()})
+	}
+	for n := d.uint(); n > 0; n-- {
+		b.Locals = append(b.Locals, LocalInfo{Name: d.string(), Reg: d.uint(), StartPC: uint32(d.uint()), EndPC: uint32(d.uint())})
+	}
+	for n := d.uint(); n > 0; n-- {
+		b.Params = append(b.Params, d.string())
+	}
+	b.Variadic = d.uint() == 1
+	for n := d.uint(); n > 0; n-- {
+		k := KeywordInfo{Instr: uint32(d.uint())}
+		for m := d.uint(); m > 0; m-- {
+			k.Names = append(k.Names, d.string())
+		}
+		b.Keywords = append(b.Keywords, k)
+	}
+	for n := d.uint(); n > 0; n-- {
+		b.Funcs = append(b.Funcs, d.bytecode())
+	}
+
+	b.NumConsts = uint32(len(b.Consts))
+	b.NumCode = uint32(len(b.Code))
+	b.NumLines = uint32(len(b.Lines))
+	b.NumFuncs = uint32(len(b.Funcs))
+	return b
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	vm := NewVM()
+	res := runString(t, vm, `
+		func counter() {
+			var n = 10
+			return func() {
+				n = n + 1
+				return n
+			}
+		}
+		proto Point {
+			x: number = 0
+			y: number = 0
+		}
+		func Point.sum() { return this.x + this.y }
+		func pack(a, rest...) -> rest
+
+		var shared = [1, "two"]
+		var cycle = {items: shared}
+		cycle.self = cycle
+		var c = counter()
+		c()
+		return c, Point(3, 4), cycle, shared, Point, pack
+	`)
+	names := []string{"counter", "point", "cycle", "shared", "Point", "pack"}
+	for i, name := range names {
+		vm.Define(name, res[i])
+	}
+	vm.Define("native", GoFunc(func(call *FuncCall) {}))
+
+	var buf bytes.Buffer
+	if err := vm.SaveGlobals(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewVM()
+	if err := restored.LoadGlobals(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.Globals["native"]; ok {
+		t.Errorf("native function was saved")
+	}
+	res = runString(t, restored, `
+		append(shared, 3)
+		return counter(), counter(), point.sum(), point is Point, cycle.items, Point(1).x, pack(1, 2, 3)
+	`)
+	want := []string{"12", "13", "7", "true", "[1 two 3]", "1", "[2 3]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+	cycle := restored.Globals["cycle"].(*Object)
+	if cycle.Fields["self"] != cycle || cycle.Fields["items"] != restored.Globals["shared"] {
+		t.Errorf("shared values were copied")
+	}
+
+	// the original session is not affected
+	res = runString(t, vm, "return counter(), shared")
+	if res[0].String() != "12" || res[1].String() != "[1 two]" {
+		t.Errorf("unexpected results %v", res)
+	}
+
+	for _, data := range [][]byte{nil, []byte("not a snapshot"), buf.Bytes()[:buf.Len()/2]} {
+		if err := NewVM().LoadGlobals(bytes.NewReader(data)); !errors.Is(err, ErrBadSnapshot) {
+			t.Errorf("expected ErrBadSnapshot, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+)
+
+// "did you mean" suggestions for misspelled names
+
+// suggestName returns the candidate closest to name, "" if none is
+// close enough to be a likely misspelling. Ties go to the first one.
+func suggestName(name string, candidates []string) string {
+	// allow one edit for every 3 characters, at least one
+	max := len(name) / 3
+	if max < 1 {
+		max = 1
+	}
+	best, bestDist := "", max+1
+	for _, c := range candidates {
+		if c == name {
+			continue
+		}
+		if d := editDistance(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// didYouMean formats the suggestion for name to be appended
+// to an error message, "" if there's none
+func didYouMean(name string, candidates []string) string {
+	if s := suggestName(name, candidates); s != "" {
+		return fmt.Sprintf(" (did you mean '%s'?)", s)
+	}
+	return ""
+}
+
+// enclosingLocals returns the names of the locals of the functions
+// enclosing b, from the innermost, that were in scope where b was
+// defined. A misspelled name would have been an upvalue of b.
+func enclosingLocals(root, b *Bytecode) ([]string, bool) {
+	for index, fn := range root.Funcs {
+		var names []string
+		if fn != b {
+			var ok bool
+			if names, ok = enclosingLocals(fn, b); !ok {
+				continue
+			}
+		}
+		for pc, instr := range root.Code {
+			if OpGetOpcode(instr) == OpFunc && OpGetBx(instr) == uint(index) {
+				for _, l := range root.LocalsAt(pc) {
+					names = append(names, l.Name)
+				}
+				break
+			}
+		}
+		return names, true
+	}
+	return nil, false
+}
+
+// editDistance is the Damerau-Levenshtein distance between a and b
+// (insertions, deletions, substitutions and transpositions)
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	// three rows of the distance matrix
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,414 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"sort"
+
+	"github.com/glhrmfrts/yo/ast"
+)
+
+// SymbolKind tells what declared a Symbol.
+type SymbolKind int
+
+const (
+	SymbolVar    SymbolKind = iota // var, := and the variables of for, match and with
+	SymbolConst                    // const
+	SymbolFunc                     // a named function
+	SymbolParam                    // a parameter of a function
+	SymbolProto                    // a proto declaration
+	SymbolGlobal                   // a name not declared by the script, a global of the VM
+)
+
+var symbolKindStrings = [...]string{"var", "const", "func", "param", "proto", "global"}
+
+func (k SymbolKind) String() string {
+	return symbolKindStrings[k]
+}
+
+// Symbol is a name declared by a script, or a global it uses.
+type Symbol struct {
+	Name string
+	Kind SymbolKind
+
+	// Decl is the *ast.Id of the declaration, the *ast.KwArg of a
+	// parameter with a default value or the *ast.ObjectField of a name
+	// bound by a pattern like {name}. Nil for globals.
+	Decl ast.Node
+
+	// Scope is the node whose body the name is visible in: the root,
+	// a *ast.Block, a *ast.Function, a loop, a match or a with
+	// statement, the pattern of a match case or a comprehension.
+	// Nil for globals.
+	Scope ast.Node
+
+	Refs []SymbolRef // in source order, not counting the declaration
+}
+
+// pos returns the position of the declaration of sym,
+// or of it's first use if it's a global
+func (sym *Symbol) pos() ast.Position {
+	if sym.Decl != nil {
+		return ast.Info(sym.Decl).Start
+	}
+	return ast.Info(sym.Refs[0].Id).Start
+}
+
+// SymbolRef is a use of a Symbol.
+type SymbolRef struct {
+	Id    *ast.Id
+	Write bool // the name is assigned, by =, an operator like += or ++ and --
+}
+
+// SymbolTable has the symbols of a script.
+type SymbolTable struct {
+	Symbols []*Symbol // in source order, of the declarations or the first use of globals
+
+	ids map[*ast.Id]*Symbol
+}
+
+// Symbols resolves the names of root with the scoping rules of the
+// compiler, to find the declaration of each name and all the places
+// where it's used. The names that are not declared anywhere are the
+// globals the script depends on. 'this', 'super', 'result' in the
+// ensures clauses and the names of fields are not symbols.
+func Symbols(root ast.Node) *SymbolTable {
+	x := indexer{table: &SymbolTable{ids: make(map[*ast.Id]*Symbol)}}
+	x.scoped(root, func() { x.node(root) })
+
+	// the hoisting of functions and the assignments, whose right side
+	// is visited first, don't follow the source
+	for _, sym := range x.table.Symbols {
+		refs := sym.Refs
+		sort.SliceStable(refs, func(i, j int) bool {
+			return positionLess(ast.Info(refs[i].Id).Start, ast.Info(refs[j].Id).Start)
+		})
+	}
+	syms := x.table.Symbols
+	sort.SliceStable(syms, func(i, j int) bool {
+		return positionLess(syms[i].pos(), syms[j].pos())
+	})
+	return x.table
+}
+
+// Lookup returns the symbol declared or referred to by id.
+func (t *SymbolTable) Lookup(id *ast.Id) *Symbol {
+	return t.ids[id]
+}
+
+// At returns the symbol declared or referred to at pos in the source,
+// for editors (go to definition, find references, rename).
+func (t *SymbolTable) At(pos ast.Position) *Symbol {
+	for id, sym := range t.ids {
+		info := ast.Info(id)
+		if positionLess(pos, info.Start) || !positionLess(pos, info.End) {
+			continue
+		}
+		return sym
+	}
+	// the names declared by a key
+	for _, sym := range t.Symbols {
+		var key string
+		switch decl := sym.Decl.(type) {
+		case *ast.KwArg:
+			key = decl.Key
+		case *ast.ObjectField:
+			key = decl.Key
+		default:
+			continue
+		}
+		start := ast.Info(sym.Decl).Start
+		end := ast.Position{Line: start.Line, Column: start.Column + len([]rune(key))}
+		if !positionLess(pos, start) && positionLess(pos, end) {
+			return sym
+		}
+	}
+	return nil
+}
+
+// Globals returns the symbols of the globals used by the script.
+func (t *SymbolTable) Globals() []*Symbol {
+	var res []*Symbol
+	for _, sym := range t.Symbols {
+		if sym.Kind == SymbolGlobal {
+			res = append(res, sym)
+		}
+	}
+	return res
+}
+
+func positionLess(a, b ast.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+type symbolScope struct {
+	node   ast.Node
+	names  map[string]*Symbol
+	parent *symbolScope
+}
+
+type indexer struct {
+	table   *SymbolTable
+	scope   *symbolScope
+	globals map[string]*Symbol
+	ensures bool // whether 'result' is the result of a function
+}
+
+// scoped calls fn in a new scope for node
+func (x *indexer) scoped(node ast.Node, fn func()) {
+	x.scope = &symbolScope{node: node, names: make(map[string]*Symbol), parent: x.scope}
+	fn()
+	x.scope = x.scope.parent
+}
+
+func (x *indexer) declare(id *ast.Id, decl ast.Node, kind SymbolKind) {
+	sym := &Symbol{Name: id.Value, Kind: kind, Decl: decl, Scope: x.scope.node}
+	x.scope.names[id.Value] = sym
+	x.table.Symbols = append(x.table.Symbols, sym)
+	if decl == id {
+		x.table.ids[id] = sym
+	}
+}
+
+func (x *indexer) ref(id *ast.Id, write bool) {
+	if id.Value == "this" || id.Value == "super" || x.ensures && id.Value == "result" {
+		return
+	}
+	var sym *Symbol
+	for scope := x.scope; scope != nil && sym == nil; scope = scope.parent {
+		sym = scope.names[id.Value]
+	}
+	if sym == nil {
+		if sym = x.globals[id.Value]; sym == nil {
+			if x.globals == nil {
+				x.globals = make(map[string]*Symbol)
+			}
+			sym = &Symbol{Name: id.Value, Kind: SymbolGlobal}
+			x.globals[id.Value] = sym
+			x.table.Symbols = append(x.table.Symbols, sym)
+		}
+	}
+	sym.Refs = append(sym.Refs, SymbolRef{id, write})
+	x.table.ids[id] = sym
+}
+
+// write visits the left side of an assignment
+func (x *indexer) write(node ast.Node) {
+	if id, ok := node.(*ast.Id); ok {
+		x.ref(id, true)
+	} else {
+		x.node(node)
+	}
+}
+
+func (x *indexer) nodes(nodes []ast.Node) {
+	for _, n := range nodes {
+		x.node(n)
+	}
+}
+
+func (x *indexer) node(node ast.Node) {
+	switch n := node.(type) {
+	case nil:
+	case *ast.Id:
+		if n != nil {
+			x.ref(n, false)
+		}
+	case *ast.Selector:
+		// the field name is not a symbol
+		x.node(n.Left)
+	case *ast.Block:
+		if n == nil {
+			return
+		}
+		body := func() {
+			// functions are visible in the whole block
+			for _, stmt := range n.Nodes {
+				if fn, ok := stmt.(*ast.Function); ok {
+					if id, ok := fn.Name.(*ast.Id); ok {
+						x.declare(id, id, SymbolFunc)
+					}
+				}
+			}
+			x.nodes(n.Nodes)
+		}
+		if x.scope.node == node {
+			body()
+		} else {
+			x.scoped(n, body)
+		}
+	case *ast.Function:
+		switch name := n.Name.(type) {
+		case *ast.Id:
+			if x.scope.names[name.Value] == nil || x.scope.names[name.Value].Decl != name {
+				// a function expression, visible to itself
+				x.declare(name, name, SymbolFunc)
+			}
+		case nil:
+		default:
+			x.write(name)
+		}
+		x.scoped(n, func() {
+			for _, arg := range n.Args {
+				switch arg := arg.(type) {
+				case *ast.Id:
+					x.declare(arg, arg, SymbolParam)
+				case *ast.KwArg:
+					x.node(arg.Value)
+					x.declare(&ast.Id{Value: arg.Key, NodeInfo: arg.NodeInfo}, arg, SymbolParam)
+				case *ast.VarArg:
+					if id, ok := arg.Arg.(*ast.Id); ok {
+						x.declare(id, id, SymbolParam)
+					}
+				}
+			}
+			x.nodes(n.Requires)
+			x.ensures = true
+			x.nodes(n.Ensures)
+			x.ensures = false
+			x.node(n.Body)
+		})
+	case *ast.Declaration:
+		x.nodes(n.Right)
+		kind := SymbolVar
+		if n.IsConst {
+			kind = SymbolConst
+		}
+		for _, id := range n.Left {
+			x.declare(id, id, kind)
+		}
+	case *ast.Assignment:
+		x.nodes(n.Right)
+		for _, left := range n.Left {
+			if id, ok := left.(*ast.Id); ok && n.Op == ast.TokenColoneq {
+				x.declare(id, id, SymbolVar)
+			} else {
+				x.write(left)
+			}
+		}
+	case *ast.PostfixExpr:
+		x.write(n.Left)
+	case *ast.ProtoDecl:
+		x.node(n.Parent)
+		x.declare(n.Name, n.Name, SymbolProto)
+		for _, f := range n.Fields {
+			x.node(f.Value)
+		}
+	case *ast.IfStmt:
+		x.scoped(n, func() {
+			if n.Init != nil {
+				x.node(n.Init)
+			}
+			x.node(n.Cond)
+			x.node(n.Body)
+			x.node(n.Else)
+		})
+	case *ast.ForStmt:
+		x.scoped(n, func() {
+			if n.Init != nil {
+				x.node(n.Init)
+			}
+			x.node(n.Cond)
+			x.node(n.Body)
+			x.node(n.Step)
+		})
+	case *ast.ForIteratorStmt:
+		x.forIterator(n, func() { x.node(n.Body) })
+	case *ast.Comprehension:
+		x.forIterator(n.Loop, func() {
+			x.node(n.Key)
+			x.node(n.Value)
+		})
+	case *ast.MatchStmt:
+		x.node(n.Value)
+		x.scoped(n, func() {
+			if n.Name != nil {
+				x.declare(n.Name, n.Name, SymbolVar)
+			}
+			for _, mc := range n.Cases {
+				if len(mc.Values) == 1 && isPattern(mc.Values[0]) {
+					// the names bound are visible in the body
+					x.scoped(mc.Values[0], func() {
+						x.pattern(mc.Values[0])
+						x.node(mc.Body)
+					})
+					continue
+				}
+				for _, v := range mc.Values {
+					// the type names of a type switch are not symbols
+					if id, ok := v.(*ast.Id); ok && n.IsType && x.lookup(id.Value) == nil {
+						continue
+					}
+					x.node(v)
+				}
+				x.node(mc.Body)
+			}
+		})
+	case *ast.WithStmt:
+		x.node(n.Value)
+		x.scoped(n, func() {
+			x.declare(n.Name, n.Name, SymbolVar)
+			x.node(n.Body)
+		})
+	case *ast.RecoverBlock:
+		x.scoped(n, func() {
+			if n.Id != nil {
+				x.declare(n.Id, n.Id, SymbolVar)
+			}
+			x.node(n.Block)
+		})
+	default:
+		x.nodes(ast.Children(node))
+	}
+}
+
+// pattern declares the names bound by a pattern of a match case,
+// the other values in it are uses
+func (x *indexer) pattern(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Id:
+		if n.Value != "_" {
+			x.declare(n, n, SymbolVar)
+		}
+	case *ast.ArrayPattern:
+		for _, el := range n.Elements {
+			x.pattern(el)
+		}
+		if n.Rest != nil {
+			x.pattern(n.Rest)
+		}
+	case *ast.ObjectPattern:
+		for _, f := range n.Fields {
+			if f.Value != nil {
+				x.pattern(f.Value)
+			} else if f.Key != "_" {
+				x.declare(&ast.Id{Value: f.Key, NodeInfo: f.NodeInfo}, f, SymbolVar)
+			}
+		}
+	default:
+		x.node(node)
+	}
+}
+
+// forIterator visits the loop of n with body in the scope of the
+// loop variables, the collection is outside of it
+func (x *indexer) forIterator(n *ast.ForIteratorStmt, body func()) {
+	x.node(n.Collection)
+	x.scoped(n, func() {
+		x.declare(n.Key, n.Key, SymbolVar)
+		if n.Value != nil {
+			x.declare(n.Value, n.Value, SymbolVar)
+		}
+		x.node(n.When)
+		body()
+	})
+}
+
+func (x *indexer) lookup(name string) *Symbol {
+	for scope := x.scope; scope != nil; scope = scope.parent {
+		if sym, ok := scope.names[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
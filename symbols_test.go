@@ -0,0 +1,95 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/glhrmfrts/yo/ast"
+	"github.com/glhrmfrts/yo/parse"
+)
+
+func TestSymbols(t *testing.T) {
+	source := `const limit = 10
+var total = 0
+func add(n, step = limit) {
+	total += n * step
+	return total
+}
+for i := 0; i < limit; i++ {
+	var total = add(i)
+	println(total)
+}
+proto Point { x = limit, y = 0 }
+func Point.norm() -> sqrt(this.x * this.x)
+for k, v in {a: 1} {
+	total = total + v
+}
+x := [v * 2 for v in [1, 2] if v > limit]
+match x { [a, {b}] { println(a + b + limit) } }
+`
+	root, err := parse.ParseFile([]byte(source), "test.yo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := Symbols(root)
+
+	// name kind decl-line: ref-lines (w for writes)
+	var got []string
+	for _, sym := range table.Symbols {
+		s := fmt.Sprintf("%s %s", sym.Name, sym.Kind)
+		if sym.Decl != nil {
+			s += fmt.Sprintf(" %d", ast.Info(sym.Decl).Start.Line)
+		}
+		s += ":"
+		for _, ref := range sym.Refs {
+			s += fmt.Sprintf(" %d", ast.Info(ref.Id).Start.Line)
+			if ref.Write {
+				s += "w"
+			}
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		"limit const 1: 3 7 11 16 17",
+		"total var 2: 4w 5 14w 14",
+		"add func 3: 8",
+		"n param 3: 4",
+		"step param 3: 4",
+		"i var 7: 7 7w 8",
+		"total var 8: 9",
+		"println global: 9 17",
+		"Point proto 11: 12",
+		"sqrt global: 12",
+		"k var 13:",
+		"v var 13: 14",
+		"x var 16: 17",
+		"v var 16: 16 16",
+		"a var 17: 17",
+		"b var 17: 17",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected symbols:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	globals := table.Globals()
+	if len(globals) != 2 || globals[0].Name != "println" || globals[1].Name != "sqrt" {
+		t.Errorf("unexpected globals %v", globals)
+	}
+
+	// the 'total' in line 9, and the declaration of 'step'
+	if sym := table.At(ast.Position{Line: 9, Column: 12}); sym == nil || ast.Line(sym.Decl) != 8 {
+		t.Errorf("expected the inner total, got %v", sym)
+	}
+	if sym := table.At(ast.Position{Line: 3, Column: 15}); sym == nil || sym.Name != "step" {
+		t.Errorf("expected step, got %v", sym)
+	}
+	if sym := table.At(ast.Position{Line: 17, Column: 16}); sym == nil || sym.Name != "b" {
+		t.Errorf("expected b, got %v", sym)
+	}
+	if sym := table.At(ast.Position{Line: 3, Column: 1}); sym != nil {
+		t.Errorf("expected no symbol, got %v", sym)
+	}
+}
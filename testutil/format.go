@@ -0,0 +1,132 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/glhrmfrts/yo/ast"
+)
+
+// Source formats the nodes created by a Generator as source code,
+// so the programs that make a test fail can be run by hand.
+func Source(node ast.Node) string {
+	var buf bytes.Buffer
+	block, ok := node.(*ast.Block)
+	if !ok {
+		block = &ast.Block{Nodes: []ast.Node{node}}
+	}
+	for _, n := range block.Nodes {
+		formatStmt(&buf, n, 0)
+	}
+	return buf.String()
+}
+
+func formatStmt(buf *bytes.Buffer, node ast.Node, indent int) {
+	buf.WriteString(strings.Repeat("\t", indent))
+	switch t := node.(type) {
+	case *ast.Declaration:
+		keyword := "var"
+		if t.IsConst {
+			keyword = "const"
+		}
+		var left []string
+		for _, id := range t.Left {
+			left = append(left, id.Value)
+		}
+		fmt.Fprintf(buf, "%s %s", keyword, strings.Join(left, ", "))
+		if len(t.Right) > 0 {
+			buf.WriteString(" = " + formatList(t.Right))
+		}
+	case *ast.Assignment:
+		buf.WriteString(formatAssignment(t))
+	case *ast.IfStmt:
+		formatIf(buf, t, indent)
+	case *ast.ForStmt:
+		buf.WriteString("for ")
+		if t.Init != nil {
+			buf.WriteString(formatAssignment(t.Init) + "; ")
+		}
+		if t.Cond != nil {
+			buf.WriteString(formatExpr(t.Cond))
+		}
+		if t.Step != nil {
+			buf.WriteString("; " + formatAssignment(t.Step.(*ast.Assignment)))
+		}
+		buf.WriteString(" ")
+		formatBlock(buf, t.Body, indent)
+	case *ast.Function:
+		fmt.Fprintf(buf, "func %s(%s) ", formatExpr(t.Name), formatList(t.Args))
+		formatBlock(buf, t.Body, indent)
+	case *ast.ReturnStmt:
+		buf.WriteString("return " + formatList(t.Values))
+	case *ast.BranchStmt:
+		buf.WriteString(t.Type.String())
+	default:
+		buf.WriteString(formatExpr(node))
+	}
+	buf.WriteString("\n")
+}
+
+func formatBlock(buf *bytes.Buffer, node ast.Node, indent int) {
+	buf.WriteString("{\n")
+	for _, n := range node.(*ast.Block).Nodes {
+		formatStmt(buf, n, indent+1)
+	}
+	buf.WriteString(strings.Repeat("\t", indent) + "}")
+}
+
+func formatIf(buf *bytes.Buffer, node *ast.IfStmt, indent int) {
+	buf.WriteString("if " + formatExpr(node.Cond) + " ")
+	formatBlock(buf, node.Body, indent)
+	switch e := node.Else.(type) {
+	case *ast.IfStmt:
+		buf.WriteString(" else ")
+		formatIf(buf, e, indent)
+	case *ast.Block:
+		buf.WriteString(" else ")
+		formatBlock(buf, e, indent)
+	}
+}
+
+func formatAssignment(node *ast.Assignment) string {
+	return fmt.Sprintf("%s %s %s", formatList(node.Left), node.Op, formatList(node.Right))
+}
+
+func formatList(nodes []ast.Node) string {
+	var res []string
+	for _, n := range nodes {
+		res = append(res, formatExpr(n))
+	}
+	return strings.Join(res, ", ")
+}
+
+// expressions are fully parenthesized, so the precedence doesn't matter
+func formatExpr(node ast.Node) string {
+	switch t := node.(type) {
+	case nil:
+		return ""
+	case *ast.Nil:
+		return "nil"
+	case *ast.Bool:
+		return strconv.FormatBool(t.Value)
+	case *ast.Number:
+		return strconv.FormatFloat(t.Value, 'g', -1, 64)
+	case *ast.String:
+		return strconv.Quote(t.Value)
+	case *ast.Id:
+		return t.Value
+	case *ast.CallExpr:
+		return fmt.Sprintf("%s(%s)", formatExpr(t.Left), formatList(t.Args))
+	case *ast.UnaryExpr:
+		return fmt.Sprintf("(%s(%s))", t.Op, formatExpr(t.Right))
+	case *ast.BinaryExpr:
+		return fmt.Sprintf("(%s %s %s)", formatExpr(t.Left), t.Op, formatExpr(t.Right))
+	case *ast.TernaryExpr:
+		return fmt.Sprintf("(%s ? %s : %s)", formatExpr(t.Cond), formatExpr(t.Then), formatExpr(t.Else))
+	}
+	return fmt.Sprintf("<%T>", node)
+}
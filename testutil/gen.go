@@ -0,0 +1,348 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+// Package testutil has helpers to test the compiler and the VM.
+package testutil
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/glhrmfrts/yo/ast"
+)
+
+// GenOptions limits the programs created by a Generator.
+type GenOptions struct {
+	MaxDepth int // nesting of blocks and expressions
+	MaxStmts int // statements in each block
+	MaxLoop  int // iterations of each loop
+
+	Loops     bool // for statements, with break and continue
+	Functions bool // function declarations and calls
+	Closures  bool // functions using the variables of enclosing functions
+
+	// Sink is the name of a global function that the program
+	// calls at the end with the values of all it's top-level
+	// variables, so different runs can be compared.
+	Sink string
+}
+
+// DefaultGenOptions enables all the features.
+var DefaultGenOptions = GenOptions{
+	MaxDepth:  4,
+	MaxStmts:  6,
+	MaxLoop:   4,
+	Loops:     true,
+	Functions: true,
+	Closures:  true,
+	Sink:      "check",
+}
+
+// Generator creates random programs which are valid and terminate.
+// They only operate on numbers, so they never fail at runtime, and
+// the same seed always gives the same program.
+type Generator struct {
+	opts  GenOptions
+	rand  *rand.Rand
+	scope *genScope
+	names int
+	depth int
+	loops int // loops enclosing the current statement in the function
+}
+
+type genScope struct {
+	vars     []string // assignable variables
+	readOnly []string // loop variables
+	funcs    []genFunc
+	function bool // the body of a function
+	parent   *genScope
+}
+
+type genFunc struct {
+	name  string
+	nargs int
+}
+
+func NewGenerator(seed int64, opts GenOptions) *Generator {
+	return &Generator{opts: opts, rand: rand.New(rand.NewSource(seed))}
+}
+
+// Program returns a new random program.
+func (g *Generator) Program() *ast.Block {
+	g.names, g.depth, g.loops = 0, 0, 0
+	g.scope = &genScope{}
+	top := g.scope
+
+	// there's at least one variable
+	decl := g.declaration()
+	top.vars = append(top.vars, decl.Left[0].Value)
+	block := g.block()
+	block.Nodes = append([]ast.Node{decl}, block.Nodes...)
+
+	if g.opts.Sink != "" {
+		var args []ast.Node
+		for _, name := range top.vars {
+			args = append(args, &ast.Id{Value: name})
+		}
+		block.Nodes = append(block.Nodes, &ast.CallExpr{Left: &ast.Id{Value: g.opts.Sink}, Args: args})
+	}
+	return block
+}
+
+func (g *Generator) name(prefix string) string {
+	g.names++
+	return fmt.Sprintf("%s%d", prefix, g.names)
+}
+
+func (g *Generator) chance(n int) bool {
+	return g.rand.Intn(n) == 0
+}
+
+// the names visible from the current scope, the ones of
+// enclosing functions only if closures are enabled
+func (g *Generator) visible(f func(s *genScope)) {
+	for s := g.scope; s != nil; s = s.parent {
+		f(s)
+		if s.function && !g.opts.Closures {
+			break
+		}
+	}
+}
+
+func (g *Generator) pickVar(assignable bool) (string, bool) {
+	var names []string
+	g.visible(func(s *genScope) {
+		names = append(names, s.vars...)
+		if !assignable {
+			names = append(names, s.readOnly...)
+		}
+	})
+	if len(names) == 0 {
+		return "", false
+	}
+	return names[g.rand.Intn(len(names))], true
+}
+
+func (g *Generator) pickFunc() (genFunc, bool) {
+	var funcs []genFunc
+	g.visible(func(s *genScope) {
+		funcs = append(funcs, s.funcs...)
+	})
+	if len(funcs) == 0 {
+		return genFunc{}, false
+	}
+	return funcs[g.rand.Intn(len(funcs))], true
+}
+
+// statements
+
+// block generates statements in the current scope
+func (g *Generator) block() *ast.Block {
+	block := &ast.Block{}
+	n := 1 + g.rand.Intn(g.opts.MaxStmts)
+	for i := 0; i < n; i++ {
+		block.Nodes = append(block.Nodes, g.stmt())
+	}
+	return block
+}
+
+func (g *Generator) scopedBlock() *ast.Block {
+	g.scope = &genScope{parent: g.scope}
+	block := g.block()
+	g.scope = g.scope.parent
+	return block
+}
+
+func (g *Generator) stmt() ast.Node {
+	g.depth++
+	defer func() { g.depth-- }()
+
+	nested := g.depth < g.opts.MaxDepth
+	for {
+		switch g.rand.Intn(7) {
+		case 0, 1:
+			decl := g.declaration()
+			g.scope.vars = append(g.scope.vars, decl.Left[0].Value)
+			return decl
+		case 2:
+			if name, ok := g.pickVar(true); ok {
+				ops := [...]ast.Token{ast.TokenEq, ast.TokenPluseq, ast.TokenMinuseq, ast.TokenTimeseq}
+				return &ast.Assignment{
+					Op:    ops[g.rand.Intn(len(ops))],
+					Left:  []ast.Node{&ast.Id{Value: name}},
+					Right: []ast.Node{g.expr()},
+				}
+			}
+		case 3:
+			if nested {
+				return g.ifStmt()
+			}
+		case 4:
+			if nested && g.opts.Loops {
+				return g.forStmt()
+			}
+		case 5:
+			if nested && g.opts.Functions {
+				return g.function()
+			}
+		case 6:
+			if g.loops > 0 && g.chance(3) {
+				typ := ast.TokenBreak
+				if g.chance(2) {
+					typ = ast.TokenContinue
+				}
+				return &ast.IfStmt{
+					Cond: g.boolExpr(),
+					Body: &ast.Block{Nodes: []ast.Node{&ast.BranchStmt{Type: typ}}},
+				}
+			}
+			if call, ok := g.call(); ok {
+				return call
+			}
+		}
+	}
+}
+
+func (g *Generator) declaration() *ast.Declaration {
+	// the name is not visible in it's initializer
+	value := g.expr()
+	return &ast.Declaration{
+		Left:  []*ast.Id{{Value: g.name("v")}},
+		Right: []ast.Node{value},
+	}
+}
+
+func (g *Generator) ifStmt() *ast.IfStmt {
+	node := &ast.IfStmt{Cond: g.boolExpr(), Body: g.scopedBlock()}
+	if g.chance(2) {
+		node.Else = g.scopedBlock()
+	}
+	return node
+}
+
+// for i := 0; i < n; i += 1 { ... }
+func (g *Generator) forStmt() *ast.ForStmt {
+	i := g.name("i")
+	node := &ast.ForStmt{
+		Init: &ast.Assignment{
+			Op:    ast.TokenColoneq,
+			Left:  []ast.Node{&ast.Id{Value: i}},
+			Right: []ast.Node{&ast.Number{Value: 0}},
+		},
+		Cond: &ast.BinaryExpr{
+			Op:    ast.TokenLt,
+			Left:  &ast.Id{Value: i},
+			Right: &ast.Number{Value: float64(1 + g.rand.Intn(g.opts.MaxLoop))},
+		},
+		Step: &ast.Assignment{
+			Op:    ast.TokenPluseq,
+			Left:  []ast.Node{&ast.Id{Value: i}},
+			Right: []ast.Node{&ast.Number{Value: 1}},
+		},
+	}
+
+	g.scope = &genScope{readOnly: []string{i}, parent: g.scope}
+	g.loops++
+	node.Body = g.block()
+	g.loops--
+	g.scope = g.scope.parent
+	return node
+}
+
+// func f(a, b) { ...; return x }
+func (g *Generator) function() *ast.Function {
+	name := g.name("f")
+	nargs := g.rand.Intn(3)
+	loops := g.loops
+
+	g.scope = &genScope{function: true, parent: g.scope}
+	g.loops = 0
+	var args []ast.Node
+	for i := 0; i < nargs; i++ {
+		arg := g.name("a")
+		args = append(args, &ast.Id{Value: arg})
+		g.scope.vars = append(g.scope.vars, arg)
+	}
+	body := g.block()
+	body.Nodes = append(body.Nodes, &ast.ReturnStmt{Values: []ast.Node{g.expr()}})
+	g.scope = g.scope.parent
+	g.loops = loops
+
+	// declared after the body, so there's no recursion
+	g.scope.funcs = append(g.scope.funcs, genFunc{name, nargs})
+	return &ast.Function{Name: &ast.Id{Value: name}, Args: args, Body: body}
+}
+
+// expressions
+
+func (g *Generator) call() (*ast.CallExpr, bool) {
+	if !g.opts.Functions {
+		return nil, false
+	}
+	fn, ok := g.pickFunc()
+	if !ok {
+		return nil, false
+	}
+	call := &ast.CallExpr{Left: &ast.Id{Value: fn.name}}
+	for i := 0; i < fn.nargs; i++ {
+		call.Args = append(call.Args, g.expr())
+	}
+	return call, true
+}
+
+// expr generates an expression that evaluates to a number
+func (g *Generator) expr() ast.Node {
+	g.depth++
+	defer func() { g.depth-- }()
+
+	if g.depth < g.opts.MaxDepth+2 {
+		switch g.rand.Intn(8) {
+		case 0, 1, 2:
+			ops := [...]ast.Token{ast.TokenPlus, ast.TokenMinus, ast.TokenTimes, ast.TokenDiv}
+			return &ast.BinaryExpr{Op: ops[g.rand.Intn(len(ops))], Left: g.expr(), Right: g.expr()}
+		case 3:
+			return &ast.UnaryExpr{Op: ast.TokenMinus, Right: g.expr()}
+		case 4:
+			return &ast.TernaryExpr{Cond: g.boolExpr(), Then: g.expr(), Else: g.expr()}
+		case 5:
+			if call, ok := g.call(); ok {
+				return call
+			}
+		case 6:
+			// numbers are always true, but the operand
+			// that gives the result changes
+			op := ast.TokenAmpamp
+			if g.chance(2) {
+				op = ast.TokenPipepipe
+			}
+			return &ast.BinaryExpr{Op: op, Left: g.expr(), Right: g.expr()}
+		}
+	}
+	if name, ok := g.pickVar(false); ok && g.chance(2) {
+		return &ast.Id{Value: name}
+	}
+	if g.chance(4) {
+		return &ast.Number{Value: float64(g.rand.Intn(100)) / 4}
+	}
+	return &ast.Number{Value: float64(g.rand.Intn(10))}
+}
+
+// boolExpr generates an expression that evaluates to a bool
+func (g *Generator) boolExpr() ast.Node {
+	g.depth++
+	defer func() { g.depth-- }()
+
+	if g.depth < g.opts.MaxDepth+2 {
+		switch g.rand.Intn(4) {
+		case 0:
+			op := ast.TokenAmpamp
+			if g.chance(2) {
+				op = ast.TokenPipepipe
+			}
+			return &ast.BinaryExpr{Op: op, Left: g.boolExpr(), Right: g.boolExpr()}
+		case 1:
+			return &ast.UnaryExpr{Op: ast.TokenNot, Right: g.boolExpr()}
+		}
+	}
+	ops := [...]ast.Token{ast.TokenLt, ast.TokenLteq, ast.TokenGt, ast.TokenGteq, ast.TokenEqeq, ast.TokenBangeq}
+	return &ast.BinaryExpr{Op: ops[g.rand.Intn(len(ops))], Left: g.expr(), Right: g.expr()}
+}
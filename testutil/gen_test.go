@@ -0,0 +1,58 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package testutil
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/glhrmfrts/yo"
+)
+
+var programs = flag.Int("programs", 200, "number of random programs to test")
+
+// run compiles and runs a generated program, returning
+// the values passed to the sink as strings
+func run(t *testing.T, seed int64, optLevel int) []string {
+	root := NewGenerator(seed, DefaultGenOptions).Program()
+	code, err := yo.CompileWithOptions(root, "gen", yo.CompileOptions{OptLevel: optLevel})
+	if err != nil {
+		t.Fatalf("seed %d: %v\n%s", seed, err, Source(root))
+	}
+
+	var res []string
+	vm := yo.NewVM()
+	vm.Define(DefaultGenOptions.Sink, yo.GoFunc(func(call *yo.FuncCall) {
+		for _, arg := range call.Args {
+			res = append(res, arg.String())
+		}
+	}))
+	if err := vm.RunBytecode(code); err != nil {
+		t.Fatalf("seed %d: %v\n%s", seed, err, Source(root))
+	}
+	return res
+}
+
+func TestGeneratorDeterministic(t *testing.T) {
+	a := NewGenerator(42, DefaultGenOptions).Program()
+	b := NewGenerator(42, DefaultGenOptions).Program()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("programs generated with the same seed are different")
+	}
+}
+
+// the optimizations must not change the results of a program
+func TestOptimizerDifferential(t *testing.T) {
+	for seed := int64(1); seed <= int64(*programs); seed++ {
+		plain, optimized := run(t, seed, 0), run(t, seed, 2)
+		if len(plain) == 0 {
+			t.Fatalf("seed %d: the sink was not called", seed)
+		}
+		if !reflect.DeepEqual(plain, optimized) {
+			root := NewGenerator(seed, DefaultGenOptions).Program()
+			t.Errorf("seed %d: got %v without optimizations and %v with them\n%s",
+				seed, plain, optimized, Source(root))
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"context"
+)
+
+// Tracer opens a span for each call to a script function run by a VM
+// (see VM.SetTracer), so the scripts show up in the distributed traces
+// of the host. The package doesn't depend on a tracing library, an
+// adapter for OpenTelemetry looks like:
+//
+//	type otelTracer struct{ tracer trace.Tracer }
+//
+//	func (t otelTracer) StartSpan(ctx context.Context, call yo.TracedCall) (context.Context, yo.Span) {
+//		ctx, span := t.tracer.Start(ctx, call.Name, trace.WithAttributes(
+//			attribute.String("code.filepath", call.File),
+//			attribute.Int("code.lineno", call.Line),
+//		))
+//		return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ trace.Span }
+//
+//	func (s otelSpan) End(err error) {
+//		if err != nil {
+//			s.RecordError(err)
+//			s.SetStatus(codes.Error, err.Error())
+//		}
+//		s.Span.End()
+//	}
+type Tracer interface {
+	// StartSpan opens the span of call as a child of the span in ctx,
+	// and returns the context of the new span, which is the parent of
+	// the spans of the calls made by the function. A nil Span doesn't
+	// trace the call, to trace only some of the functions.
+	StartSpan(ctx context.Context, call TracedCall) (context.Context, Span)
+}
+
+// Span is the span of a call opened by a Tracer.
+type Span interface {
+	// End closes the span when the function returns, err is the
+	// error that stopped the function, nil if it returned normally.
+	End(err error)
+}
+
+// TracedCall describes a call to a script function.
+type TracedCall struct {
+	Name string // "main" for the main function, empty for anonymous ones
+	File string // where the function is defined
+	Line int    // 0 for main
+
+	CallFile string // where it's called from, empty for main
+	CallLine int
+}
+
+// SetTracer makes the VM open a span with t for each call to a script
+// function, the spans of the outermost calls are children of the span
+// in ctx. A nil Tracer stops tracing.
+func (vm *VM) SetTracer(ctx context.Context, t Tracer) {
+	vm.tracer, vm.traceCtx = t, ctx
+}
+
+// TraceContext returns the context of the span of the function being
+// run, for native functions to link their own spans or requests to
+// it. It's the context given to SetTracer outside of traced calls.
+func (vm *VM) TraceContext() context.Context {
+	for cf := vm.currentFrame; cf != nil; cf = cf.parent {
+		if cf.ctx != nil {
+			return cf.ctx
+		}
+	}
+	if vm.traceCtx != nil {
+		return vm.traceCtx
+	}
+	return context.Background()
+}
+
+// StackFrame is a call being run by a VM.
+type StackFrame struct {
+	Name string // as in TracedCall
+	File string
+	Line int // the line being run
+}
+
+// Stack returns the calls being run by the VM, from the innermost, for
+// native functions and for the subscribers of ErrorRaised events to
+// show where the program is (like in a traceback).
+func (vm *VM) Stack() []StackFrame {
+	var stack []StackFrame
+	for cf := vm.currentFrame; cf != nil; cf = cf.parent {
+		call := tracedCall(cf)
+		stack = append(stack, StackFrame{Name: call.Name, File: call.File, Line: cf.line})
+	}
+	return stack
+}
+
+// tracedCall describes the call of the frame cf
+func tracedCall(cf *callFrame) TracedCall {
+	b := cf.fn.Bytecode
+	call := TracedCall{Name: b.Name, File: b.Source, Line: b.Line}
+	if b.Line == 0 {
+		call.Name = "main"
+	}
+	if cf.parent != nil {
+		call.CallFile, call.CallLine = cf.parent.fn.Bytecode.Source, cf.parent.line
+	}
+	return call
+}
+
+// startSpan opens the span of the call of the frame cf, just pushed
+func (vm *VM) startSpan(cf *callFrame) {
+	ctx, span := vm.tracer.StartSpan(vm.TraceContext(), tracedCall(cf))
+	if span != nil {
+		cf.ctx, cf.span = ctx, span
+	}
+}
+
+// endSpans closes the spans of the frames left by err
+func (vm *VM) endSpans(err error) {
+	for cf := vm.currentFrame; cf != nil; cf = cf.parent {
+		if cf.span != nil {
+			cf.span.End(err)
+			cf.span = nil
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type spanKey struct{}
+
+type testTracer struct {
+	ended []string
+}
+
+type testSpan struct {
+	t      *testTracer
+	call   TracedCall
+	parent string
+}
+
+func (t *testTracer) StartSpan(ctx context.Context, call TracedCall) (context.Context, Span) {
+	if call.Name == "untraced" {
+		return ctx, nil
+	}
+	parent, _ := ctx.Value(spanKey{}).(string)
+	return context.WithValue(ctx, spanKey{}, call.Name), &testSpan{t, call, parent}
+}
+
+func (s *testSpan) End(err error) {
+	desc := fmt.Sprintf("%s:%d %s <- %s:%d %s", s.call.File, s.call.Line, s.call.Name, s.call.CallFile, s.call.CallLine, s.parent)
+	if err != nil {
+		desc += " error"
+	}
+	s.t.ended = append(s.t.ended, desc)
+}
+
+func TestTracer(t *testing.T) {
+	vm := NewVM()
+	tracer := &testTracer{}
+	vm.SetTracer(context.WithValue(context.Background(), spanKey{}, "host"), tracer)
+
+	var native context.Context
+	vm.Define("native", GoFunc(func(call *FuncCall) {
+		native = call.VM.TraceContext()
+	}))
+	source := `func inner(fail) {
+		if fail { panic "boom" }
+		native()
+	}
+	func untraced() -> inner(false)
+	func outer() -> untraced()
+	outer()
+	try { inner(true) } recover e {}
+	inner(true)`
+	code, err := CompileReader(strings.NewReader(source), "t.yo", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.run(code); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	want := []string{
+		"t.yo:1 inner <- t.yo:5 outer",
+		"t.yo:6 outer <- t.yo:7 main",
+		"t.yo:1 inner <- t.yo:8 main error",
+		"t.yo:1 inner <- t.yo:9 main error",
+		"t.yo:0 main <- :0 host error",
+	}
+	if !reflect.DeepEqual(tracer.ended, want) {
+		t.Errorf("expected spans:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(tracer.ended, "\n"))
+	}
+	if native == nil || native.Value(spanKey{}) != "inner" {
+		t.Errorf("expected the context of inner in the native function")
+	}
+
+	vm.Reset()
+	if vm.TraceContext().Value(spanKey{}) != nil {
+		t.Errorf("expected no trace context after Reset")
+	}
+}
+
+func TestFunctionNames(t *testing.T) {
+	vm := NewVM()
+	tracer := &testTracer{}
+	vm.SetTracer(context.Background(), tracer)
+
+	source := `var f = func() -> 1
+	g := func() -> f()
+	var h
+	h = func() -> g()
+	h()`
+	code, err := CompileReader(strings.NewReader(source), "t.yo", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.run(code); err != nil {
+		t.Fatal(err)
+	}
+
+	// the anonymous functions are named after their variables
+	want := []string{
+		"t.yo:1 f <- t.yo:2 g",
+		"t.yo:2 g <- t.yo:4 h",
+		"t.yo:4 h <- t.yo:5 main",
+		"t.yo:0 main <- :0 ",
+	}
+	if !reflect.DeepEqual(tracer.ended, want) {
+		t.Errorf("expected spans:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(tracer.ended, "\n"))
+	}
+}
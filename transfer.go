@@ -0,0 +1,219 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+)
+
+// Transfer returns a copy of v that can be used by a VM other than
+// the one that created it, even if they run in different goroutines.
+//
+// Mutable values (arrays, objects and the free variables of closures)
+// are copied deeply, keeping the values shared by different parts of v
+// shared in the copy. Immutable values (nil, bools, numbers, strings,
+// compiled functions) are not copied. Native functions, channels and
+// the Data of GoObjects are shared as they are, they must be safe for
+// concurrent use by the host.
+//
+// Closures can only be transferred after the variables they capture
+// went out of scope in the VM that created them, otherwise they still
+// refer to the registers of that VM and an error is returned.
+func Transfer(v Value) (Value, error) {
+	t := transfer{copies: make(map[interface{}]Value)}
+	return t.value(v)
+}
+
+type transfer struct {
+	// the copies already made, keyed by the identity of the original
+	copies   map[interface{}]Value
+	upvalues map[*upvalue]*upvalue
+}
+
+func (t *transfer) value(v Value) (Value, error) {
+	switch o := v.(type) {
+	case *Array:
+		if c, ok := t.copies[o]; ok {
+			return c, nil
+		}
+		c := &Array{}
+		t.copies[o] = c
+		elems, err := t.array(*o)
+		if err != nil {
+			return nil, err
+		}
+		*c = elems
+		return c, nil
+	case Array:
+		return t.array(o)
+	case *Object:
+		return t.object(o)
+	case *GoObject:
+		if c, ok := t.copies[o]; ok {
+			return c, nil
+		}
+		c := &GoObject{Data: o.Data}
+		t.copies[o] = c
+		if err := t.fields(&c.Object, &o.Object); err != nil {
+			return nil, err
+		}
+		return c, nil
+	case *Func:
+		return t.function(o)
+	}
+	return v, nil
+}
+
+func (t *transfer) array(a Array) (Array, error) {
+	if len(a) == 0 {
+		return Array{}, nil
+	}
+	if c, ok := t.copies[&a[0]]; ok {
+		return c.(Array), nil
+	}
+	c := make(Array, len(a))
+	t.copies[&a[0]] = c
+	for i, elem := range a {
+		v, err := t.value(elem)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = v
+	}
+	return c, nil
+}
+
+func (t *transfer) object(o *Object) (*Object, error) {
+	if c, ok := t.copies[o]; ok {
+		return c.(*Object), nil
+	}
+	c := &Object{}
+	t.copies[o] = c
+	if err := t.fields(c, o); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// fields copies the fields, parent and schema of o into c
+func (t *transfer) fields(c, o *Object) error {
+	c.schema = o.schema // never changes after the declaration
+	if o.Fields != nil {
+		c.Fields = make(map[string]Value, len(o.Fields))
+		for key, field := range o.Fields {
+			v, err := t.value(field)
+			if err != nil {
+				return err
+			}
+			c.Fields[key] = v
+		}
+	}
+	if o.Parent != nil {
+		parent, err := t.object(o.Parent)
+		if err != nil {
+			return err
+		}
+		c.Parent = parent
+	}
+	return nil
+}
+
+func (t *transfer) function(fn *Func) (Value, error) {
+	if len(fn.Bytecode.Upvals) == 0 {
+		return fn, nil
+	}
+	if c, ok := t.copies[fn]; ok {
+		return c, nil
+	}
+
+	c := &Func{Bytecode: fn.Bytecode, upvalues: make([]*upvalue, len(fn.Bytecode.Upvals))}
+	t.copies[fn] = c
+	for i, desc := range fn.Bytecode.Upvals {
+		var u *upvalue
+		if fn.upvalues != nil {
+			u = fn.upvalues[i]
+		}
+		if u == nil || u.open {
+			return nil, fmt.Errorf("cannot transfer a closure while it's variable '%s' is in scope", desc.Name)
+		}
+		if t.upvalues == nil {
+			t.upvalues = make(map[*upvalue]*upvalue)
+		}
+		if cu, ok := t.upvalues[u]; ok {
+			c.upvalues[i] = cu
+			continue
+		}
+		cu := &upvalue{}
+		t.upvalues[u] = cu
+		v, err := t.value(u.value.get())
+		if err != nil {
+			return nil, err
+		}
+		cu.value.set(v)
+		c.upvalues[i] = cu
+	}
+	return c, nil
+}
+
+// Share returns v to be used by many VMs at the same time, without
+// copying it like Transfer does, so a host can create the functions of
+// a library once and define them in all the VMs of a pool:
+//
+//	res, err := yo.DoString(libSource) // returns slugify
+//	slugify, err := yo.Share(res[0])
+//	pool := &yo.VMPool{New: func() *yo.VM {
+//		vm := yo.NewVM()
+//		vm.Define("slugify", slugify)
+//		return vm
+//	}}
+//
+// Only immutable values can be shared: nil, bools, numbers, strings,
+// native functions (which must be safe for concurrent use) and script
+// functions whose free variables are never assigned (see
+// Bytecode.Shareable) and hold shareable values, after they went out
+// of scope. The globals used by a shared function are the ones of the
+// VM calling it.
+//
+// The code of the shared functions is no longer specialized for the
+// values it runs with (see quicken), since many VMs read it, so v must
+// not be running while it's shared.
+func Share(v Value) (Value, error) {
+	seen := make(map[*Func]bool)
+	if err := checkShareable(v, seen); err != nil {
+		return nil, err
+	}
+	for fn := range seen {
+		fn.Bytecode.freeze()
+	}
+	return v, nil
+}
+
+func checkShareable(v Value, seen map[*Func]bool) error {
+	switch v := v.(type) {
+	case Nil, Bool, Number, String, Range, GoFunc:
+		return nil
+	case *Func:
+		if seen[v] {
+			return nil
+		}
+		seen[v] = true
+		b := v.Bytecode
+		if len(b.Upvals) > 0 && !b.Shareable {
+			return fmt.Errorf("cannot share a closure that assigns the variables it captures")
+		}
+		for i, desc := range b.Upvals {
+			var u *upvalue
+			if v.upvalues != nil {
+				u = v.upvalues[i]
+			}
+			if u == nil || u.open {
+				return fmt.Errorf("cannot share a closure while it's variable '%s' is in scope", desc.Name)
+			}
+			if err := checkShareable(u.value.get(), seen); err != nil {
+				return fmt.Errorf("variable '%s': %v", desc.Name, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot share a %s value", v.Type())
+}
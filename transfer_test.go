@@ -0,0 +1,105 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"strings"
+	"testing"
+)
+
+func runString(t *testing.T, vm *VM, source string) []Value {
+	code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := vm.run(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestTransfer(t *testing.T) {
+	res := runString(t, NewVM(), `
+		func counter() {
+			var n = 10
+			return func() {
+				n = n + 1
+				return n
+			}
+		}
+		var list = [1, 2]
+		return [list, list, counter(), "worker"]
+	`)
+	v, err := Transfer(res[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig, copied := *res[0].(*Array), *v.(*Array)
+	if &orig[0] == &copied[0] {
+		t.Fatalf("array was not copied")
+	}
+	a, b := copied[0].(*Array), copied[1].(*Array)
+	if a != b || a == orig[0].(*Array) || (*a)[1] != Number(2) {
+		t.Errorf("shared array was not copied once")
+	}
+	if copied[3] != String("worker") {
+		t.Errorf("unexpected string %v", copied[3])
+	}
+
+	vm := NewVM()
+	vm.Define("next", copied[2])
+	if res := runString(t, vm, `next(); return next()`); res[0] != Number(12) {
+		t.Errorf("expected 12, got %v", res[0])
+	}
+
+	// the original closure keeps it's own variable
+	vm = NewVM()
+	vm.Define("next", orig[2])
+	if res := runString(t, vm, `return next()`); res[0] != Number(11) {
+		t.Errorf("expected 11, got %v", res[0])
+	}
+}
+
+func TestTransferObject(t *testing.T) {
+	parent := NewObject(nil, map[string]Value{"kind": String("base")})
+	child := NewObject(parent, map[string]Value{"self": nil})
+	child.Set("self", child)
+
+	v, err := Transfer(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := v.(*Object)
+	if c == child || c.Parent == parent || c.Get("self") != c {
+		t.Errorf("object was not copied deeply")
+	}
+	if c.Get("kind") != String("base") {
+		t.Errorf("unexpected parent field %v", c.Get("kind"))
+	}
+}
+
+func TestTransferOpenClosure(t *testing.T) {
+	vm := NewVM()
+	var captured Value
+	vm.Define("send", GoFunc(func(call *FuncCall) {
+		_, err := Transfer(call.Args[0])
+		if err == nil {
+			t.Errorf("expected an error transferring an open closure")
+		}
+		captured = call.Args[0]
+	}))
+	runString(t, vm, `
+		func f() {
+			var x = 1
+			var g = func() -> x
+			send(g)
+			return g
+		}
+		f()
+	`)
+	if _, err := Transfer(captured); err != nil {
+		t.Errorf("unexpected error after the variable went out of scope: %v", err)
+	}
+}
@@ -0,0 +1,881 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/glhrmfrts/yo/ast"
+)
+
+// Optional type checking.
+//
+// Function arguments and results may be annotated with the name of a
+// value type (any, nil, bool, number, string, func, array, object, chan):
+//
+//   func add(a: number, b: number): number { return a + b }
+//
+// Before generating code, the compiler walks the tree and reports calls
+// and returns that don't match the annotations of statically known
+// functions, the ones declared and never reassigned. Unannotated values
+// are of type 'any', which matches everything, and the annotations are
+// erased, they have no runtime cost.
+//
+// Calls to known functions are also checked for their arity and keyword
+// names: passing more positional arguments than the function takes or an
+// unknown keyword is an error, leaving out an argument without a default
+// value is a warning.
+//
+// A prototype declared with 'proto' is checked like a function taking
+// it's fields, and the variables initialized with one of it's
+// instances only have the declared fields and the members assigned to
+// the prototype somewhere in the file:
+//
+//   proto Point { x: number = 0, y: number = 0 }
+//   func Point.len() { return math.sqrt(this.x*this.x + this.y*this.y) }
+//   var p = Point(3, 4)
+//   p.len()  // ok
+//   p.z      // error: Point has no field 'z'
+//   p.x = "" // error: the field is a number
+//
+// A prototype inheriting from a known one takes it's fields first,
+// and the members assigned to either.
+
+type (
+	// signature of a function with annotations
+	funcSig struct {
+		names    []string
+		params   []ValueType
+		optional []bool // arguments with a default value, and the variadic one
+		vararg   bool
+		ret      ValueType
+	}
+
+	// fields of a prototype declared with 'proto'
+	checkProto struct {
+		name    string
+		fields  map[string]ValueType
+		members map[string]bool // assigned to the prototype after the declaration
+	}
+
+	checkName struct {
+		typ        ValueType
+		sig        *funcSig    // only set for known functions and prototypes
+		schema     *checkProto // only set for known prototypes
+		instanceOf *checkProto // only set for known instances of a prototype
+	}
+
+	checkScope struct {
+		names  map[string]*checkName
+		parent *checkScope
+	}
+
+	typeChecker struct {
+		filename string
+		warn     func(w *CompileWarning)
+		assigned map[string]bool // names whose signature may be stale
+		members  map[string]map[string]bool
+		scope    *checkScope
+		fn       *funcSig // function being checked
+		last     ValueType
+	}
+)
+
+// the type of unannotated values
+const typeAny ValueType = -1
+
+var typeNames = map[string]ValueType{
+	"any":    typeAny,
+	"nil":    ValueNil,
+	"bool":   ValueBool,
+	"number": ValueNumber,
+	"string": ValueString,
+	"func":   ValueFunc,
+	"array":  ValueArray,
+	"object": ValueObject,
+	"chan":   ValueChan,
+	"range":  ValueRange,
+}
+
+// typeTest returns the type tested by an 'is' expression, false if it
+// tests a prototype. Type names are reserved at the right of 'is'.
+func typeTest(node *ast.BinaryExpr) (ValueType, bool) {
+	return testedType(node.Right)
+}
+
+// testedType returns the type named by the right side of an 'is' or
+// a case of a type switch, false if it's a prototype
+func testedType(node ast.Node) (ValueType, bool) {
+	switch t := node.(type) {
+	case *ast.Id:
+		typ, ok := typeNames[t.Value]
+		return typ, ok
+	case *ast.Nil:
+		return ValueNil, true
+	}
+	return 0, false
+}
+
+// narrowedType returns the type of the value in a case of a
+// type switch, any if the case has many types
+func narrowedType(mc *ast.MatchCase) ValueType {
+	if len(mc.Values) != 1 {
+		return typeAny
+	}
+	if typ, ok := testedType(mc.Values[0]); ok {
+		return typ
+	}
+	// an instance of a prototype
+	return ValueObject
+}
+
+func typeName(t ValueType) string {
+	if t == typeAny {
+		return "any"
+	}
+	return t.String()
+}
+
+// check if a value of type actual can be used where expected is required
+func typeCompatible(expected, actual ValueType) bool {
+	if expected == ValueGoFunc {
+		expected = ValueFunc
+	}
+	if actual == ValueGoFunc {
+		actual = ValueFunc
+	}
+	return expected == typeAny || actual == typeAny || expected == actual
+}
+
+func (c *typeChecker) error(line int, code ErrorCode, msg string) {
+	panic(&CompileError{Code: code, Line: line, File: c.filename, Message: msg})
+}
+
+func (c *typeChecker) warning(line int, msg string) {
+	if c.warn != nil {
+		c.warn(&CompileWarning{Line: line, File: c.filename, Message: msg})
+	}
+}
+
+func (c *typeChecker) enterScope() {
+	c.scope = &checkScope{names: make(map[string]*checkName), parent: c.scope}
+}
+
+func (c *typeChecker) leaveScope() {
+	c.scope = c.scope.parent
+}
+
+func (c *typeChecker) declare(name string, typ ValueType, sig *funcSig) *checkName {
+	info := &checkName{typ: typ, sig: sig}
+	c.scope.names[name] = info
+	return info
+}
+
+// known returns the info of the name if it's never reassigned
+func (c *typeChecker) known(node ast.Node) (*checkName, bool) {
+	if id, ok := node.(*ast.Id); ok && !c.assigned[id.Value] {
+		return c.lookup(id.Value)
+	}
+	return nil, false
+}
+
+// instanceOf returns the prototype of the value of node if it's
+// created by calling a known prototype
+func (c *typeChecker) instanceOf(node ast.Node) *checkProto {
+	if call, ok := node.(*ast.CallExpr); ok {
+		if info, ok := c.known(call.Left); ok {
+			return info.schema
+		}
+	}
+	return nil
+}
+
+// declareVars declares the names at the left of a declaration,
+// the instances of known prototypes are tracked
+func (c *typeChecker) declareVars(left []*ast.Id, right []ast.Node) {
+	for i, id := range left {
+		// unannotated variables may hold anything
+		info := c.declare(id.Value, typeAny, nil)
+		if i < len(right) && len(left) <= len(right) && !c.assigned[id.Value] {
+			info.instanceOf = c.instanceOf(right[i])
+		}
+	}
+}
+
+func (c *typeChecker) lookup(name string) (*checkName, bool) {
+	for scope := c.scope; scope != nil; scope = scope.parent {
+		if info, ok := scope.names[name]; ok {
+			return info, true
+		}
+	}
+	return nil, false
+}
+
+func (c *typeChecker) typeOf(node ast.Node) ValueType {
+	c.last = typeAny
+	node.Accept(c, nil)
+	return c.last
+}
+
+func (c *typeChecker) annotation(id *ast.Id) ValueType {
+	if id == nil {
+		return typeAny
+	}
+	typ, ok := typeNames[id.Value]
+	if !ok {
+		names := make([]string, 0, len(typeNames))
+		for name := range typeNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.error(id.NodeInfo.Line, ErrUnknownType, fmt.Sprintf("unknown type '%s'%s", id.Value, didYouMean(id.Value, names)))
+	}
+	return typ
+}
+
+func (c *typeChecker) signature(node *ast.Function) *funcSig {
+	sig := &funcSig{ret: c.annotation(node.ReturnType)}
+	for i, arg := range node.Args {
+		var typ ValueType = typeAny
+		if i < len(node.ArgTypes) {
+			typ = c.annotation(node.ArgTypes[i])
+		}
+
+		var name string
+		optional := true
+		switch arg := arg.(type) {
+		case *ast.Id:
+			name = arg.Value
+			optional = false
+		case *ast.KwArg:
+			name = arg.Key
+		case *ast.VarArg:
+			name = arg.Arg.(*ast.Id).Value
+			sig.vararg = true
+		}
+		sig.names = append(sig.names, name)
+		sig.params = append(sig.params, typ)
+		sig.optional = append(sig.optional, optional)
+	}
+	return sig
+}
+
+//
+// visitor interface
+//
+
+func (c *typeChecker) VisitNil(node *ast.Nil, data interface{}) {
+	c.last = ValueNil
+}
+
+func (c *typeChecker) VisitBool(node *ast.Bool, data interface{}) {
+	c.last = ValueBool
+}
+
+func (c *typeChecker) VisitNumber(node *ast.Number, data interface{}) {
+	c.last = ValueNumber
+}
+
+func (c *typeChecker) VisitString(node *ast.String, data interface{}) {
+	c.last = ValueString
+}
+
+func (c *typeChecker) VisitId(node *ast.Id, data interface{}) {
+	if info, ok := c.lookup(node.Value); ok {
+		c.last = info.typ
+	} else {
+		c.last = typeAny
+	}
+}
+
+func (c *typeChecker) VisitArray(node *ast.Array, data interface{}) {
+	for _, el := range node.Elements {
+		c.typeOf(el)
+	}
+	c.last = ValueArray
+}
+
+func (c *typeChecker) VisitObjectField(node *ast.ObjectField, data interface{}) {
+	if node.Value != nil {
+		c.typeOf(node.Value)
+	}
+}
+
+func (c *typeChecker) VisitObject(node *ast.Object, data interface{}) {
+	for _, field := range node.Fields {
+		field.Accept(c, nil)
+	}
+	c.last = ValueObject
+}
+
+func (c *typeChecker) VisitComprehension(node *ast.Comprehension, data interface{}) {
+	c.forIterator(node.Loop, func() {
+		if node.Key != nil {
+			c.typeOf(node.Key)
+		}
+		c.typeOf(node.Value)
+	})
+	if node.Key == nil {
+		c.last = ValueArray
+	} else {
+		c.last = ValueObject
+	}
+}
+
+func (c *typeChecker) VisitFunction(node *ast.Function, data interface{}) {
+	sig := c.signature(node)
+	if name, ok := node.Name.(*ast.Id); ok {
+		// declared before the body, so recursive calls are checked too
+		c.declare(name.Value, ValueFunc, sig)
+	} else if node.Name != nil {
+		c.typeOf(node.Name)
+	}
+
+	c.enterScope()
+	defer c.leaveScope()
+	for i, arg := range node.Args {
+		typ := sig.params[i]
+		switch arg := arg.(type) {
+		case *ast.KwArg:
+			if vtyp := c.typeOf(arg.Value); !typeCompatible(typ, vtyp) {
+				c.error(arg.NodeInfo.Line, ErrTypeMismatch, fmt.Sprintf("cannot use %s as default value of argument '%s' of type %s",
+					typeName(vtyp), arg.Key, typeName(typ)))
+			}
+		case *ast.VarArg:
+			// the variadic argument is always an array of the values
+			typ = ValueArray
+		}
+		c.declare(sig.names[i], typ, nil)
+	}
+
+	fn := c.fn
+	c.fn = sig
+	node.Body.Accept(c, nil)
+	c.fn = fn
+
+	c.last = ValueFunc
+}
+
+func (c *typeChecker) VisitSelector(node *ast.Selector, data interface{}) {
+	c.typeOf(node.Left)
+	c.last = c.fieldType(node.Left, node.Value, node.NodeInfo.Line)
+}
+
+// fieldType returns the type of the field key of the value of left,
+// checking that it exists if left is an instance of a known prototype
+func (c *typeChecker) fieldType(left ast.Node, key string, line int) ValueType {
+	info, ok := c.known(left)
+	if !ok || info.instanceOf == nil {
+		return typeAny
+	}
+	proto := info.instanceOf
+	if typ, ok := proto.fields[key]; ok {
+		return typ
+	}
+	if !proto.members[key] {
+		names := make([]string, 0, len(proto.fields)+len(proto.members))
+		for name := range proto.fields {
+			names = append(names, name)
+		}
+		for name := range proto.members {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.error(line, ErrUnknownField, fmt.Sprintf("%s has no field '%s'%s",
+			proto.name, key, didYouMean(key, names)))
+	}
+	return typeAny
+}
+
+func (c *typeChecker) VisitSubscript(node *ast.Subscript, data interface{}) {
+	c.typeOf(node.Left)
+	c.typeOf(node.Right)
+	c.last = typeAny
+}
+
+func (c *typeChecker) VisitSlice(node *ast.Slice, data interface{}) {
+	if node.Start != nil {
+		c.typeOf(node.Start)
+	}
+	if node.End != nil {
+		c.typeOf(node.End)
+	}
+	c.last = typeAny
+}
+
+func (c *typeChecker) VisitRange(node *ast.Range, data interface{}) {
+	c.typeOf(node.Start)
+	c.typeOf(node.End)
+	if node.Step != nil {
+		c.typeOf(node.Step)
+	}
+	c.last = ValueRange
+}
+
+func (c *typeChecker) VisitKwArg(node *ast.KwArg, data interface{}) {
+	c.typeOf(node.Value)
+}
+
+func (c *typeChecker) VisitVarArg(node *ast.VarArg, data interface{}) {
+	c.typeOf(node.Arg)
+	c.last = typeAny
+}
+
+func (c *typeChecker) VisitObjectUnpack(node *ast.ObjectUnpack, data interface{}) {
+	c.typeOf(node.Value)
+	for _, key := range node.Keys {
+		c.fieldType(node.Value, key, node.NodeInfo.Line)
+	}
+	c.last = typeAny
+}
+
+func (c *typeChecker) VisitCallExpr(node *ast.CallExpr, data interface{}) {
+	var sig *funcSig
+	var fname string
+	if id, ok := node.Left.(*ast.Id); ok {
+		// the signature of a reassigned name may be stale
+		if info, ok := c.known(id); ok {
+			sig, fname = info.sig, id.Value
+		}
+	} else {
+		c.typeOf(node.Left)
+	}
+
+	for i, arg := range node.Args {
+		param := -1
+		var value ast.Node = arg
+		switch arg := arg.(type) {
+		case *ast.KwArg:
+			value = arg.Value
+			if sig != nil {
+				for j, name := range sig.names {
+					if name == arg.Key {
+						param = j
+					}
+				}
+			}
+		case *ast.VarArg:
+			// can't know which arguments it expands to
+		default:
+			if sig != nil && i < len(sig.params) && !(sig.vararg && i >= len(sig.params)-1) {
+				param = i
+			}
+		}
+
+		typ := c.typeOf(value)
+		if param >= 0 && !typeCompatible(sig.params[param], typ) {
+			c.error(node.NodeInfo.Line, ErrTypeMismatch, fmt.Sprintf("cannot use %s as type %s in argument '%s' to %s",
+				typeName(typ), typeName(sig.params[param]), sig.names[param], fname))
+		}
+	}
+
+	if sig != nil {
+		c.checkArity(node, sig, fname)
+		c.last = sig.ret
+	} else {
+		c.last = typeAny
+	}
+}
+
+// checkArity checks the count of positional arguments and the keyword
+// names of a call to a known function
+func (c *typeChecker) checkArity(node *ast.CallExpr, sig *funcSig, fname string) {
+	line := node.NodeInfo.Line
+	given := make([]bool, len(sig.names))
+	positional := 0
+	expanded := false
+	for _, arg := range node.Args {
+		switch arg := arg.(type) {
+		case *ast.KwArg:
+			param := -1
+			for j, name := range sig.names {
+				if name == arg.Key && !(sig.vararg && j == len(sig.names)-1) {
+					param = j
+				}
+			}
+			if param < 0 {
+				c.error(line, ErrBadKeyword, fmt.Sprintf("unknown keyword argument '%s' in call to %s%s",
+					arg.Key, fname, didYouMean(arg.Key, sig.names)))
+			}
+			if given[param] {
+				c.error(line, ErrBadKeyword, fmt.Sprintf("argument '%s' given twice in call to %s", arg.Key, fname))
+			}
+			given[param] = true
+		case *ast.VarArg:
+			// can't know how many arguments it expands to
+			expanded = true
+		default:
+			if positional < len(given) {
+				given[positional] = true
+			}
+			positional++
+		}
+	}
+	if expanded {
+		return
+	}
+
+	if !sig.vararg && positional > len(sig.names) {
+		c.error(line, ErrArgCount, fmt.Sprintf("too many arguments in call to %s: expected %d, got %d",
+			fname, len(sig.names), positional))
+	}
+	for j, name := range sig.names {
+		if given[j] || sig.optional[j] {
+			continue
+		}
+		if typ := sig.params[j]; !typeCompatible(typ, ValueNil) {
+			c.error(line, ErrTypeMismatch, fmt.Sprintf("missing argument '%s' of type %s in call to %s", name, typeName(typ), fname))
+		}
+		c.warning(line, fmt.Sprintf("missing argument '%s' in call to %s, it will be nil", name, fname))
+	}
+}
+
+func (c *typeChecker) VisitTemplate(node *ast.Template, data interface{}) {
+	if node.Tag != nil {
+		c.VisitCallExpr(templateCall(node), data)
+		return
+	}
+	for _, expr := range node.Exprs {
+		c.typeOf(expr)
+	}
+	c.last = ValueString
+}
+
+func (c *typeChecker) VisitPostfixExpr(node *ast.PostfixExpr, data interface{}) {
+	c.typeOf(node.Left)
+	c.last = ValueNumber
+}
+
+func (c *typeChecker) VisitUnaryExpr(node *ast.UnaryExpr, data interface{}) {
+	c.typeOf(node.Right)
+	switch node.Op {
+	case ast.TokenNot, ast.TokenBang:
+		c.last = ValueBool
+	default:
+		c.last = ValueNumber
+	}
+}
+
+func (c *typeChecker) VisitBinaryExpr(node *ast.BinaryExpr, data interface{}) {
+	left := c.typeOf(node.Left)
+	right := c.typeOf(node.Right)
+	switch node.Op {
+	case ast.TokenEqeq, ast.TokenBangeq, ast.TokenLt, ast.TokenLteq, ast.TokenGt, ast.TokenGteq, ast.TokenIn, ast.TokenIs:
+		c.last = ValueBool
+	case ast.TokenAmpamp, ast.TokenPipepipe:
+		if left == right {
+			c.last = left
+		} else {
+			c.last = typeAny
+		}
+	case ast.TokenPlus:
+		if left == ValueString && right == ValueString {
+			c.last = ValueString
+		} else if left == ValueNumber && right == ValueNumber {
+			c.last = ValueNumber
+		} else {
+			c.last = typeAny
+		}
+	default:
+		if left == ValueObject || right == ValueObject {
+			// overloaded (see meta.go)
+			c.last = typeAny
+		} else {
+			c.last = ValueNumber
+		}
+	}
+}
+
+func (c *typeChecker) VisitTernaryExpr(node *ast.TernaryExpr, data interface{}) {
+	c.typeOf(node.Cond)
+	then := c.typeOf(node.Then)
+	else_ := c.typeOf(node.Else)
+	if then == else_ {
+		c.last = then
+	} else {
+		c.last = typeAny
+	}
+}
+
+func (c *typeChecker) VisitDeclaration(node *ast.Declaration, data interface{}) {
+	for _, v := range node.Right {
+		c.typeOf(v)
+	}
+	c.declareVars(node.Left, node.Right)
+}
+
+func (c *typeChecker) VisitAssignment(node *ast.Assignment, data interface{}) {
+	var types []ValueType
+	for _, v := range node.Right {
+		types = append(types, c.typeOf(v))
+	}
+	if node.Op == ast.TokenColoneq {
+		var ids []*ast.Id
+		for _, left := range node.Left {
+			if id, ok := left.(*ast.Id); ok {
+				ids = append(ids, id)
+			}
+		}
+		c.declareVars(ids, node.Right)
+		return
+	}
+	for i, left := range node.Left {
+		typ := c.typeOf(left)
+		if sel, ok := left.(*ast.Selector); ok && node.Op == ast.TokenEq && i < len(types) && !typeCompatible(typ, types[i]) {
+			c.error(node.NodeInfo.Line, ErrTypeMismatch, fmt.Sprintf("cannot assign %s to field '%s' of type %s",
+				typeName(types[i]), sel.Value, typeName(typ)))
+		}
+	}
+}
+
+func (c *typeChecker) VisitBranchStmt(node *ast.BranchStmt, data interface{}) {
+
+}
+
+func (c *typeChecker) VisitReturnStmt(node *ast.ReturnStmt, data interface{}) {
+	var typ ValueType = ValueNil
+	for i, v := range node.Values {
+		t := c.typeOf(v)
+		if i == 0 {
+			typ = t
+		}
+	}
+	if c.fn != nil && !typeCompatible(c.fn.ret, typ) {
+		c.error(node.NodeInfo.Line, ErrTypeMismatch, fmt.Sprintf("cannot return %s in function returning %s",
+			typeName(typ), typeName(c.fn.ret)))
+	}
+}
+
+func (c *typeChecker) VisitPanicStmt(node *ast.PanicStmt, data interface{}) {
+	c.typeOf(node.Err)
+}
+
+func (c *typeChecker) VisitIfStmt(node *ast.IfStmt, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	if node.Init != nil {
+		node.Init.Accept(c, nil)
+	}
+	c.typeOf(node.Cond)
+	node.Body.Accept(c, nil)
+	if node.Else != nil {
+		node.Else.Accept(c, nil)
+	}
+	// the value of an if expression isn't tracked
+	c.last = typeAny
+}
+
+func (c *typeChecker) VisitForIteratorStmt(node *ast.ForIteratorStmt, data interface{}) {
+	c.forIterator(node, func() {
+		node.Body.Accept(c, nil)
+	})
+}
+
+// forIterator checks the head of node and then body, in the scope
+// of the loop variables
+func (c *typeChecker) forIterator(node *ast.ForIteratorStmt, body func()) {
+	c.enterScope()
+	defer c.leaveScope()
+	c.typeOf(node.Collection)
+	c.declare(node.Key.Value, typeAny, nil)
+	if node.Value != nil {
+		c.declare(node.Value.Value, typeAny, nil)
+	}
+	if node.When != nil {
+		c.typeOf(node.When)
+	}
+	body()
+}
+
+func (c *typeChecker) VisitForStmt(node *ast.ForStmt, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	if node.Init != nil {
+		node.Init.Accept(c, nil)
+	}
+	if node.Cond != nil {
+		c.typeOf(node.Cond)
+	}
+	if node.Step != nil {
+		c.typeOf(node.Step)
+	}
+	node.Body.Accept(c, nil)
+}
+
+func (c *typeChecker) VisitArrayPattern(node *ast.ArrayPattern, data interface{}) {
+	for _, el := range node.Elements {
+		c.pattern(el)
+	}
+	if node.Rest != nil {
+		c.declare(node.Rest.Value, ValueArray, nil)
+	}
+	c.last = ValueArray
+}
+
+func (c *typeChecker) VisitObjectPattern(node *ast.ObjectPattern, data interface{}) {
+	for _, field := range node.Fields {
+		if field.Value == nil {
+			c.declare(field.Key, typeAny, nil)
+		} else {
+			c.pattern(field.Value)
+		}
+	}
+	c.last = ValueObject
+}
+
+// pattern declares the names bound by a pattern,
+// which may hold anything
+func (c *typeChecker) pattern(node ast.Node) {
+	if id, ok := node.(*ast.Id); ok {
+		c.declare(id.Value, typeAny, nil)
+	} else {
+		c.typeOf(node)
+	}
+}
+
+func (c *typeChecker) VisitMatchStmt(node *ast.MatchStmt, data interface{}) {
+	c.typeOf(node.Value)
+	for _, mc := range node.Cases {
+		c.enterScope()
+		for _, v := range mc.Values {
+			if _, isType := testedType(v); !node.IsType || !isType {
+				c.typeOf(v)
+			}
+		}
+		if node.Name != nil {
+			c.declare(node.Name.Value, narrowedType(mc), nil)
+		}
+		mc.Body.Accept(c, nil)
+		c.leaveScope()
+	}
+	// the value of a match expression isn't tracked
+	c.last = typeAny
+}
+
+func (c *typeChecker) VisitWithStmt(node *ast.WithStmt, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	c.typeOf(node.Value)
+	c.declare(node.Name.Value, typeAny, nil)
+	node.Body.Accept(c, nil)
+}
+
+func (c *typeChecker) VisitProtoDecl(node *ast.ProtoDecl, data interface{}) {
+	name := node.Name.Value
+	proto := &checkProto{name: name, fields: make(map[string]ValueType), members: c.members[name]}
+	sig := &funcSig{ret: ValueObject}
+	if node.Parent != nil {
+		c.typeOf(node.Parent)
+		parent, ok := c.known(node.Parent)
+		if !ok || parent.schema == nil {
+			// the fields of the parent are unknown
+			c.declare(name, ValueObject, nil)
+			return
+		}
+		proto.inherit(parent.schema)
+		sig.names = append(sig.names, parent.sig.names...)
+		sig.params = append(sig.params, parent.sig.params...)
+		sig.optional = append(sig.optional, parent.sig.optional...)
+	}
+	for _, field := range node.Fields {
+		typ := c.annotation(field.Type)
+		if field.Value != nil {
+			if vtyp := c.typeOf(field.Value); !typeCompatible(typ, vtyp) {
+				c.error(field.NodeInfo.Line, ErrTypeMismatch, fmt.Sprintf("cannot use %s as default value of field '%s' of type %s",
+					typeName(vtyp), field.Name.Value, typeName(typ)))
+			}
+		}
+		if _, inherited := proto.fields[field.Name.Value]; inherited {
+			// redeclared, in the position of the parent
+			for i, name := range sig.names {
+				if name == field.Name.Value {
+					sig.params[i], sig.optional[i] = typ, sig.optional[i] || field.Value != nil || typ == typeAny
+				}
+			}
+		} else {
+			sig.names = append(sig.names, field.Name.Value)
+			sig.params = append(sig.params, typ)
+			sig.optional = append(sig.optional, field.Value != nil || typ == typeAny)
+		}
+		proto.fields[field.Name.Value] = typ
+	}
+	c.declare(name, ValueObject, sig).schema = proto
+}
+
+// inherit adds the fields and the members of parent to proto
+func (proto *checkProto) inherit(parent *checkProto) {
+	for name, typ := range parent.fields {
+		proto.fields[name] = typ
+	}
+	members := make(map[string]bool, len(proto.members)+len(parent.members))
+	for name := range parent.members {
+		members[name] = true
+	}
+	for name := range proto.members {
+		members[name] = true
+	}
+	proto.members = members
+}
+
+func (c *typeChecker) VisitRecoverBlock(node *ast.RecoverBlock, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	if node.Id != nil {
+		c.declare(node.Id.Value, typeAny, nil)
+	}
+	node.Block.Accept(c, nil)
+}
+
+func (c *typeChecker) VisitTryRecoverStmt(node *ast.TryRecoverStmt, data interface{}) {
+	node.Try.Accept(c, nil)
+	if node.Recover != nil {
+		node.Recover.Accept(c, nil)
+	}
+	if node.Finally != nil {
+		node.Finally.Accept(c, nil)
+	}
+}
+
+func (c *typeChecker) VisitBlock(node *ast.Block, data interface{}) {
+	c.enterScope()
+	defer c.leaveScope()
+	for _, stmt := range node.Nodes {
+		c.typeOf(stmt)
+	}
+}
+
+// typecheck panics with a CompileError at the first mismatch
+func typecheck(root ast.Node, filename string, warn func(w *CompileWarning)) {
+	c := typeChecker{filename: filename, warn: warn, assigned: assignedNames(root), members: protoMembers(root)}
+	c.enterScope()
+	root.Accept(&c, nil)
+}
+
+// protoMembers returns the fields assigned to each name after it's
+// declaration, e.g. the methods of prototypes
+func protoMembers(root ast.Node) map[string]map[string]bool {
+	members := make(map[string]map[string]bool)
+	add := func(node ast.Node) {
+		if sel, ok := node.(*ast.Selector); ok {
+			if id, ok := sel.Left.(*ast.Id); ok {
+				if members[id.Value] == nil {
+					members[id.Value] = make(map[string]bool)
+				}
+				members[id.Value][sel.Value] = true
+			}
+		}
+	}
+	ast.Inspect(root, func(node ast.Node) bool {
+		switch t := node.(type) {
+		case *ast.Function:
+			add(t.Name)
+		case *ast.Assignment:
+			for _, left := range t.Left {
+				add(left)
+			}
+		}
+		return true
+	})
+	return members
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTypecheck(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string // empty if the source is valid
+	}{
+		// annotations of the arguments
+		{"func f(a: number) {}\nf(1)", ""},
+		{"func f(a: number) {}\nf(\"x\")", "cannot use string as type number in argument 'a' to f"},
+		{"func f(a: string, b: bool) {}\nf(\"x\", b = 1)", "cannot use number as type bool in argument 'b' to f"},
+		{"func f(a: any) {}\nf(nil)", ""},
+		{"func f(a: func) {}\nf(len)", ""},
+		{"func f(a: numbr) {}", "unknown type 'numbr' (did you mean 'number'?)"},
+		{"func f(a: number = \"x\") {}", "cannot use string as default value of argument 'a' of type number"},
+		{"func f(a: number) {}\nf()", "missing argument 'a' of type number in call to f"},
+
+		// the types of the arguments are inferred from the expressions
+		{"func f(a: number) {}\nf(1 + 2 * 3)", ""},
+		{"func f(a: string) {}\nf(1 < 2)", "cannot use bool as type string"},
+		{"func f(a: number) {}\nf(`x${1}`)", "cannot use string as type number"},
+		{"func f(a: array) {}\nf([1, 2])", ""},
+		{"func f(a: array) {}\nf({})", "cannot use object as type array"},
+		{"func g(): string { return \"x\" }\nfunc f(a: number) {}\nf(g())", "cannot use string as type number"},
+		{"func f(a: number) {}\nvar x = \"s\"\nf(x)", ""},
+
+		// a reassigned name may hold another function
+		{"func f(a: number) {}\nf = func(a) {}\nf(\"x\")", ""},
+		{"func g(): string { return \"x\" }\ng = func() -> 1\nfunc f(a: number) {}\nf(g())", ""},
+		{"func f(a: number) {}\nvar g = f\ng(\"x\")", ""},
+
+		// return types
+		{"func f(): number { return 1 }", ""},
+		{"func f(): number { return \"x\" }", "cannot return string in function returning number"},
+		{"func f(): string { return nil }", "cannot return nil in function returning string"},
+		{"func f(): any { return [] }", ""},
+		{"func f(a: number): number { func g(): string { return \"x\" }\nreturn a }", ""},
+
+		// fields of prototypes
+		{"proto P { x: number = 0 }\nvar p = P()\np.x = \"s\"", "cannot assign string to field 'x' of type number"},
+		{"proto P { x: number = \"s\" }", "cannot use string as default value of field 'x' of type number"},
+		{"proto P { x = 0 }\nvar p = P()\nvar y = p.z", "P has no field 'z'"},
+		{"proto P { x = 0 }\nfunc P.len() -> this.x\nvar p = P()\np.len()", ""},
+	}
+	for _, test := range tests {
+		_, err := CompileReader(strings.NewReader(test.source), "<test>", CompileOptions{})
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: unexpected error %v", test.source, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q: expected error %q, got %v", test.source, test.err, err)
+		case err != nil && !errors.Is(err, ErrSemantic):
+			t.Errorf("%q: expected a semantic error, got %v", test.source, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+// upvalue is a variable captured by a closure. While the variable is in
+// scope the upvalue is open and refers to it's register in the stack,
+// so the function that declared it and all the closures see the same
+// value. When it goes out of scope the upvalue is closed and keeps the
+// value itself.
+//
+// Closures that never outlive the call that created them don't use
+// upvalues, they read the registers directly (see UpvalueStack).
+type upvalue struct {
+	index int // absolute index in the register stack while open
+	open  bool
+	value register // the value after closing
+
+	next *upvalue // the next open upvalue, with a lower index
+}
+
+func (u *upvalue) register(vm *VM) *register {
+	if u.open {
+		return &vm.stack[u.index]
+	}
+	return &u.value
+}
+
+// upvalue returns the register of the i-th free variable of fn
+func (fn *Func) upvalue(vm *VM, i uint) *register {
+	if fn.upvalues != nil {
+		if u := fn.upvalues[i]; u != nil {
+			return u.register(vm)
+		}
+	}
+	return &vm.stack[fn.base+fn.Bytecode.Upvals[i].Index]
+}
+
+// makeClosure creates a function from proto inside the call cf
+func (vm *VM) makeClosure(cf *callFrame, proto *Bytecode) *Func {
+	fn := &Func{Bytecode: proto, base: cf.base}
+	for i, desc := range proto.Upvals {
+		if desc.Kind == UpvalueStack {
+			continue
+		}
+		if fn.upvalues == nil {
+			fn.upvalues = make([]*upvalue, len(proto.Upvals))
+		}
+		if desc.Kind == UpvalueRegister {
+			fn.upvalues[i] = vm.findUpvalue(cf.base + desc.Index)
+		} else {
+			fn.upvalues[i] = cf.fn.upvalues[desc.Index]
+		}
+	}
+	return fn
+}
+
+// findUpvalue returns the open upvalue for the register at index,
+// creating it if no closure has captured it yet
+func (vm *VM) findUpvalue(index int) *upvalue {
+	var prev *upvalue
+	u := vm.openUpvalues
+	for u != nil && u.index > index {
+		prev, u = u, u.next
+	}
+	if u != nil && u.index == index {
+		return u
+	}
+
+	u = &upvalue{index: index, open: true, next: u}
+	if prev == nil {
+		vm.openUpvalues = u
+	} else {
+		prev.next = u
+	}
+	return u
+}
+
+// closeUpvalues closes the open upvalues of the registers
+// at level and above in the stack
+func (vm *VM) closeUpvalues(level int) {
+	for u := vm.openUpvalues; u != nil && u.index >= level; u = vm.openUpvalues {
+		u.value = vm.stack[u.index]
+		u.open = false
+		vm.openUpvalues, u.next = u.next, nil
+	}
+}
@@ -5,18 +5,10 @@ package yo
 import (
 	"fmt"
 	"math"
-	"os"
 	"strconv"
 	"strings"
 )
 
-func assert(cond bool, msg string) {
-	if !cond {
-		fmt.Printf("assertion failed: %s\n", msg)
-		os.Exit(1)
-	}
-}
-
 func isInt(n float64) bool {
 	return math.Trunc(n) == n
 }
@@ -0,0 +1,162 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+)
+
+// The uuid module generates UUIDs and random tokens, it always reads
+// from crypto/rand so the values are unpredictable, no matter how
+// any other random source available to the script is seeded.
+//
+//   uuid.v4()                 random UUID
+//   uuid.v7()                 time-ordered UUID
+//   uuid.token(n = 32)        n random bytes encoded as url-safe base64
+//   uuid.hex(n = 16)          n random bytes encoded as hex
+//   uuid.string(n, alphabet)  n characters picked from alphabet (default alphanumeric)
+//   uuid.valid(s)             whether s is a UUID in canonical form
+
+const uuidAlphanumeric = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// the most bytes or characters made by a single call
+const uuidMaxLength = 1 << 20
+
+func uuidModule() *Object {
+	return newModule(map[string]GoFunc{
+		"v4":     uuidV4,
+		"v7":     uuidV7,
+		"token":  uuidToken,
+		"hex":    uuidHex,
+		"string": uuidString,
+		"valid":  uuidValid,
+	})
+}
+
+// uuidLength checks the length n given to the function name
+func uuidLength(name string, n float64) int {
+	if n < 0 || n > uuidMaxLength || n != math.Trunc(n) {
+		panic(fmt.Sprintf("uuid.%s: invalid length %v, expected an integer from 0 to %d", name, n, uuidMaxLength))
+	}
+	return int(n)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("uuid: unable to read random bytes: " + err.Error())
+	}
+	return b
+}
+
+func formatUUID(u []byte) string {
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+// set the version and the RFC 4122 variant bits
+func setUUIDVersion(u []byte, version byte) {
+	u[6] = (u[6] & 0x0f) | (version << 4)
+	u[8] = (u[8] & 0x3f) | 0x80
+}
+
+func uuidV4(call *FuncCall) {
+	u := randomBytes(16)
+	setUUIDVersion(u, 4)
+	call.PushReturnValue(String(formatUUID(u)))
+}
+
+func uuidV7(call *FuncCall) {
+	u := randomBytes(16)
+
+	// the first 48 bits are the unix timestamp in milliseconds
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixNano()/int64(time.Millisecond)))
+	copy(u[0:6], ms[2:])
+
+	setUUIDVersion(u, 7)
+	call.PushReturnValue(String(formatUUID(u)))
+}
+
+func uuidToken(call *FuncCall) {
+	n := uuidLength("token", call.optNumberArg(0, 32))
+	token := base64.RawURLEncoding.EncodeToString(randomBytes(n))
+	call.PushReturnValue(String(token))
+}
+
+func uuidHex(call *FuncCall) {
+	n := uuidLength("hex", call.optNumberArg(0, 16))
+	call.PushReturnValue(String(hex.EncodeToString(randomBytes(n))))
+}
+
+func uuidString(call *FuncCall) {
+	n := uuidLength("string", call.numberArg(0))
+	alphabet := []rune(call.optStringArg(1, uuidAlphanumeric))
+	if len(alphabet) == 0 {
+		panic("uuid.string: empty alphabet")
+	}
+
+	// rand.Int gives a uniform distribution, unlike taking a random byte modulo len(alphabet)
+	max := big.NewInt(int64(len(alphabet)))
+	res := make([]rune, n)
+	for i := range res {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic("uuid: unable to read random bytes: " + err.Error())
+		}
+		res[i] = alphabet[idx.Int64()]
+	}
+	call.PushReturnValue(String(string(res)))
+}
+
+func uuidValid(call *FuncCall) {
+	s := call.stringArg(0)
+	call.PushReturnValue(Bool(isUUID(s)))
+}
+
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if hexDigit(s[i]) < 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func hexDigit(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int(c - 'A' + 10)
+	}
+	return -1
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestUUID(t *testing.T) {
+	versions := map[string]GoFunc{"4": uuidV4, "7": uuidV7}
+	for version, fn := range versions {
+		var call FuncCall
+		fn(&call)
+		u := call.results[0].String()
+		if !isUUID(u) {
+			t.Errorf("v%s: invalid uuid %s", version, u)
+		}
+		if string(u[14]) != version {
+			t.Errorf("v%s: wrong version in %s", version, u)
+		}
+		if u[19] != '8' && u[19] != '9' && u[19] != 'a' && u[19] != 'b' {
+			t.Errorf("v%s: wrong variant in %s", version, u)
+		}
+	}
+
+	call := FuncCall{Args: []Value{Number(8), String("ab")}, NumArgs: 2}
+	uuidString(&call)
+	s := call.results[0].String()
+	if len(s) != 8 {
+		t.Errorf("uuid.string: expected 8 characters, got %q", s)
+	}
+	for _, r := range s {
+		if r != 'a' && r != 'b' {
+			t.Errorf("uuid.string: %q is not in the alphabet", r)
+		}
+	}
+
+	for _, fn := range []GoFunc{uuidString, uuidToken, uuidHex} {
+		for _, n := range []float64{-1, 1.5, uuidMaxLength + 1, math.Inf(1)} {
+			func() {
+				defer func() {
+					if msg, ok := recover().(string); !ok || !strings.HasPrefix(msg, "uuid.") {
+						t.Errorf("%v: expected a uuid error, got %v", n, msg)
+					}
+				}()
+				fn(&FuncCall{Args: []Value{Number(n)}, NumArgs: 1})
+			}()
+		}
+	}
+}
@@ -4,6 +4,8 @@ package yo
 
 import (
 	"fmt"
+	"math"
+	"sort"
 )
 
 type (
@@ -28,7 +30,10 @@ type (
 		String() string
 
 		// ToBool converts the value to a boolean value.
-		// If it's is nil or false it returns false, otherwise returns true.
+		// If it's is nil or false it returns false, otherwise returns true,
+		// so 0, "", empty arrays and empty objects are all true.
+		// Every conditional (if, for, not, &&, ||, ?:) and bool()
+		// follow this definition.
 		ToBool() bool
 	}
 
@@ -51,6 +56,9 @@ type (
 	// Func is a function defined in the script.
 	Func struct {
 		Bytecode *Bytecode
+
+		upvalues []*upvalue // nil entries are read from the stack at base
+		base     int        // base of the call that created the function
 	}
 
 	// Array is a collection of Values stored contiguously in memory,
@@ -62,6 +70,7 @@ type (
 	Object struct {
 		Fields  map[string]Value
 		Parent  *Object
+		schema  *protoSchema // only in prototypes declared with 'proto'
 	}
 
 	// GoObject is an object that allows the host application to maintain
@@ -75,6 +84,13 @@ type (
 	// Chan is an object that allows goroutines to
 	// communicate/send Values to one another.
 	Chan chan Value
+
+	// Range is the sequence of numbers from Start to End, both
+	// included, in steps of Step, created by start..end by step.
+	// The numbers are computed as they are iterated, never stored.
+	Range struct {
+		Start, End, Step float64
+	}
 )
 
 const (
@@ -87,10 +103,11 @@ const (
 	ValueArray
 	ValueObject
 	ValueChan
+	ValueRange
 )
 
 var (
-	valueTypeNames = [9]string{"nil", "bool", "number", "string", "func", "func", "array", "object", "chan"}
+	valueTypeNames = [10]string{"nil", "bool", "number", "string", "func", "func", "array", "object", "chan", "range"}
 )
 
 func (t ValueType) String() string {
@@ -177,7 +194,7 @@ func (v Array) assertString() (string, bool) { return "", false }
 func (v Array) Type() ValueType { return ValueArray }
 func (v Array) ToBool() bool    { return true }
 func (v Array) String() string  {
-	return fmt.Sprintf("%v", []Value(v))
+	return (&Formatter{}).Format(v)
 }
 
 // Object
@@ -189,7 +206,42 @@ func (v *Object) assertString() (string, bool) { return "", false }
 func (v *Object) Type() ValueType { return ValueObject }
 func (v *Object) ToBool() bool    { return true }
 func (v *Object) String() string  {
-	return fmt.Sprintf("%v", v.Fields)
+	return (&Formatter{}).Format(v)
+}
+
+// Range
+
+func (v Range) assertFloat64() (float64, bool) { return 0, false }
+func (v Range) assertBool() (bool, bool)       { return false, false }
+func (v Range) assertString() (string, bool)   { return "", false }
+
+func (v Range) Type() ValueType { return ValueRange }
+func (v Range) ToBool() bool    { return true }
+func (v Range) String() string {
+	if v.Step == 1 {
+		return fmt.Sprintf("%v..%v", v.Start, v.End)
+	}
+	return fmt.Sprintf("%v..%v by %v", v.Start, v.End, v.Step)
+}
+
+// Len returns the count of numbers in the range, 0 if the step
+// goes away from the end, and at most math.MaxInt32.
+func (v Range) Len() int {
+	// the tolerance keeps the end of ranges like 0..0.3 by 0.1,
+	// whose steps don't add up exactly
+	n := math.Floor((v.End-v.Start)/v.Step+1e-9) + 1
+	if n < 1 || math.IsNaN(n) {
+		return 0
+	}
+	if n > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(n)
+}
+
+// At returns the i-th number of the range, from 0.
+func (v Range) At(i int) float64 {
+	return v.Start + float64(i)*v.Step
 }
 
 func NewObject(parent *Object, fields map[string]Value) *Object {
@@ -198,3 +250,104 @@ func NewObject(parent *Object, fields map[string]Value) *Object {
 		Fields: fields,
 	}
 }
+
+// Get returns the value associated with key, looking it up in the
+// parent chain if this object doesn't have it. Returns Nil if the key
+// is not found anywhere.
+func (v *Object) Get(key string) Value {
+	for obj := v; obj != nil; obj = obj.Parent {
+		if val, ok := obj.Fields[key]; ok {
+			return val
+		}
+	}
+	return Nil{}
+}
+
+// Has tells if key is in the object or in it's parent chain.
+func (v *Object) Has(key string) bool {
+	for obj := v; obj != nil; obj = obj.Parent {
+		if _, ok := obj.Fields[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Set associates key with val in this object's own fields.
+func (v *Object) Set(key string, val Value) {
+	v.Fields[key] = val
+}
+
+// Keys returns the keys of the object's own fields in sorted order,
+// which is the order for-in iterates over them. Sorting rather than
+// following the map keeps the output of scripts the same across runs.
+func (v *Object) Keys() []string {
+	keys := make([]string, 0, len(v.Fields))
+	for key := range v.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// valuesEqual compares nil, bools, numbers and strings by
+// value and the rest by reference
+func valuesEqual(a, b Value) bool {
+	switch a.(type) {
+	case Nil:
+		_, ok := b.(Nil)
+		return ok
+	case Bool, Number, String, Range, *Array, *Object, *GoObject, *Func:
+		return a == b
+	}
+	return false
+}
+
+// retrieve the elements of both Array and *Array values
+func toArray(v Value) (Array, bool) {
+	switch a := v.(type) {
+	case *Array:
+		return *a, true
+	case Array:
+		return a, true
+	}
+	return nil, false
+}
+
+// retrieve the underlying object of both *Object and *GoObject values
+func toObject(v Value) (*Object, bool) {
+	switch o := v.(type) {
+	case *Object:
+		return o, true
+	case *GoObject:
+		return &o.Object, true
+	}
+	return nil, false
+}
+
+// length returns the length of strings (in bytes, the same way
+// they are indexed), arrays, objects (their own fields) and ranges
+func length(v Value) (int, bool) {
+	if str, ok := v.(String); ok {
+		return len(str), true
+	}
+	if arr, ok := toArray(v); ok {
+		return len(arr), true
+	}
+	if obj, ok := toObject(v); ok {
+		return len(obj.Fields), true
+	}
+	if r, ok := v.(Range); ok {
+		return r.Len(), true
+	}
+	return 0, false
+}
+
+// hasLength tells if the values of kind have a length
+func hasLength(kind ValueType) bool {
+	switch kind {
+	case ValueString, ValueArray, ValueObject, ValueRange:
+		return true
+	}
+	return false
+}
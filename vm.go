@@ -1,7 +1,15 @@
 package yo
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 	"github.com/glhrmfrts/yo/parse"
 )
 
@@ -14,55 +22,172 @@ type opHandler func(*VM, *callFrame, uint32) int
 
 var opTable [kOpCount]opHandler
 
+// callFrame is the state of a function call. The registers of all the
+// calls live in a single stack owned by the VM, each frame sees it's
+// own window of it starting at base.
 type callFrame struct {
 	pc         int
 	line       int
 	canRecover bool
 	fn         *Func
-	r          [MaxRegisters]Value
-}
+	base       int        // index of R(0) in the VM's register stack
+	r          []register // the frame's window of the register stack
 
-type callFrameStack struct {
-	sp    int
-	stack [CallStackSize]callFrame
-}
+	// where the caller expects the results, relative to it's base,
+	// nret is 0 if the caller collects them in an array at ret
+	ret, nret int
 
-func (stack *callFrameStack) New() *callFrame {
-	stack.sp += 1
-	return &stack.stack[stack.sp-1]
+	// the caller, or the next free frame when in the freelist
+	parent *callFrame
+
+	// the span of the call and it's context, nil if not traced
+	ctx  context.Context
+	span Span
 }
 
-func (stack *callFrameStack) Last() *callFrame {
-	if stack.sp == 0 {
-		return nil
-	}
-	return &stack.stack[stack.sp-1]
+// handler is where the execution continues when an error is raised
+// inside of a try block, pushed by OpPushHandler
+type handler struct {
+	depth     int  // of the frame running the try block
+	pc        int  // of the recover block
+	reg       uint // receives the error, and true in the next register
+	resources int  // the number of resources opened before the try block
 }
 
+// initial size of the register stack, it grows as needed
+const registerStackSize = 1024
+
 type FuncCall struct {
+	VM            *VM // the VM calling the function
 	Args          []Value
+	This          Value // the receiver in method calls, nil otherwise
 	ExpectResults uint
 	NumArgs       uint
 	NumResults    uint
 
+	// the keyword arguments by name, they are not in Args
+	Keywords map[string]Value
+
 	results []Value
 }
 
 func (c *FuncCall) PushReturnValue(v Value) {
+	if v == nil {
+		v = Nil{}
+	}
 	c.results = append(c.results, v)
 	c.NumResults++
 }
 
+// Call calls fn, a script or a native function, from the native function
+// of c with args and returns it's results, so native functions can take
+// callbacks:
+//
+//	vm.Define("each", yo.GoFunc(func(call *yo.FuncCall) {
+//		for _, v := range items {
+//			if _, err := call.Call(call.Args[0], v); err != nil {
+//				panic(err)
+//			}
+//		}
+//	}))
+//
+// fn runs in the same VM, on top of the frames of the running program,
+// with it's own try blocks: an error not recovered by fn, including the
+// ones raised with a panic by the native functions it calls, stops fn
+// alone and is returned as a *RuntimeError, with the resources of it's
+// with statements closed. Raised again with panic by the native function,
+// the error reaches the program as it is, with it's original position.
+// The calls can be nested up to CallStackSize frames.
+func (c *FuncCall) Call(fn Value, args ...Value) (res []Value, err error) {
+	switch fn := fn.(type) {
+	case *Func:
+		return c.VM.invoke(fn, nil, args)
+	case GoFunc:
+		defer func() {
+			if r := recover(); r != nil {
+				rerr := c.VM.nativeError(r)
+				if rerr == nil {
+					panic(r)
+				}
+				res, err = nil, rerr
+			}
+		}()
+		call := FuncCall{VM: c.VM, Args: args, NumArgs: uint(len(args))}
+		fn(&call)
+		c.VM.usage.NativeCalls++
+		return call.results, nil
+	}
+	if fn == nil {
+		fn = Nil{}
+	}
+	return nil, fmt.Errorf("cannot call a %s value", fn.Type())
+}
+
 type VM struct {
-	Globals      map[string]Value
+	Globals map[string]Value
 
 	currentFrame *callFrame
-	calls        callFrameStack
+	freeFrames   *callFrame // frames are reused to avoid allocations
+	depth        int        // number of active frames
+	stack        []register // registers of all active frames
+	openUpvalues *upvalue   // sorted by index, from the top of the stack
 	error        error
+
+	resources []Value   // opened by 'with' statements, from the innermost
+	handlers  []handler // pushed by try blocks, from the innermost
+
+	strings  map[string]Value // interned string constants
+	results  []Value          // returned by the main function
+	userData map[interface{}]interface{}
+	caps     *Capabilities // nil if not limited
+	usage    Usage
+	profile  *Profile // nil if not profiling
+	intOverflow IntOverflow
+	tracer   Tracer   // nil if not tracing
+	formatter *Formatter // nil for the zero Formatter
+	traceCtx context.Context
+	subscribers []*subscriber // nil if no one listens to the events
+	interrupted atomic.Bool   // set by Interrupt, from any goroutine
+
+	baseline map[string]Value    // the globals restored by Reset
+	changed  map[string]struct{} // the globals defined since the checkpoint
 }
 
 func (vm *VM) Define(name string, v Value) {
 	vm.Globals[name] = v
+	vm.changed[name] = struct{}{}
+}
+
+// SetUserData stores host data in the VM under key, so native functions
+// can reach it through FuncCall.VM without global variables. Keys should
+// be of an unexported type of the host package to avoid collisions,
+// like the keys of a context.Context. A nil value removes the key.
+func (vm *VM) SetUserData(key, value interface{}) {
+	if value == nil {
+		delete(vm.userData, key)
+		return
+	}
+	if vm.userData == nil {
+		vm.userData = make(map[interface{}]interface{})
+	}
+	vm.userData[key] = value
+}
+
+// UserData returns the value stored under key by SetUserData, nil if none.
+func (vm *VM) UserData(key interface{}) interface{} {
+	return vm.userData[key]
+}
+
+// ErrInterrupted is the error of the programs stopped by VM.Interrupt.
+var ErrInterrupted = errors.New("interrupted")
+
+// Interrupt stops the program running in the VM before it's next
+// instruction, with a *RuntimeError wrapping ErrInterrupted that try
+// statements don't recover. It's safe to call from other goroutines,
+// like the handler of a timeout or of Ctrl+C, and does nothing if
+// the VM is not running.
+func (vm *VM) Interrupt() {
+	vm.interrupted.Store(true)
 }
 
 func (vm *VM) RunString(source []byte, filename string) error {
@@ -80,18 +205,512 @@ func (vm *VM) RunString(source []byte, filename string) error {
 }
 
 func (vm *VM) RunBytecode(b *Bytecode) error {
-	vm.currentFrame = vm.calls.New()
-	vm.currentFrame.fn = &Func{b}
+	_, err := vm.run(b)
+	return err
+}
 
-	return mainLoop(vm)
+// run executes b as the main function and returns it's results
+func (vm *VM) run(b *Bytecode) (res []Value, err error) {
+	defer func() {
+		// the errors of native functions outside of a try
+		// stop the program, the bugs are re-raised
+		if r := recover(); r != nil {
+			rerr := vm.nativeError(r)
+			if rerr == nil {
+				panic(r)
+			}
+			vm.error = rerr
+			if vm.subscribers != nil {
+				vm.permissionDenied(rerr)
+				vm.emit(ErrorRaised{Err: vm.error})
+			}
+			vm.endSpans(vm.error)
+			vm.closeResources()
+			res, err = nil, vm.error
+		}
+	}()
+	b.prepare(vm.strings)
+	vm.interrupted.Store(false)
+	vm.currentFrame = nil
+	vm.openUpvalues = nil
+	vm.depth = 0
+	vm.error = nil
+	vm.results = nil
+	vm.resources = nil
+	vm.handlers = nil
+	vm.pushFrame(&Func{Bytecode: b}, 0, 0, 0)
+
+	if err := mainLoop(vm); err != nil {
+		vm.endSpans(err)
+		vm.closeResources()
+		return nil, err
+	}
+	return vm.results, nil
+}
+
+// call runs fn to completion from a native function, on top of the
+// frames of the running program, and returns it's results. The frames
+// of the program are left as they were, even if fn fails.
+func (vm *VM) call(fn *Func, args []Value) ([]Value, error) {
+	return vm.invoke(fn, nil, args)
+}
+
+// invoke is like call, with this as the receiver. The errors raised
+// with a panic by the native functions called by fn are returned like
+// the ones of fn, and the resources it left open are closed.
+func (vm *VM) invoke(fn *Func, this Value, args []Value) (res []Value, err error) {
+	if vm.depth >= CallStackSize {
+		err := fmt.Errorf("stack overflow")
+		vm.stackOverflow(err)
+		return nil, err
+	}
+	outer, depth, results := vm.currentFrame, vm.depth, vm.results
+	handlers, resources := len(vm.handlers), len(vm.resources)
+	defer func() {
+		var rerr *RuntimeError
+		r := recover()
+		if r != nil {
+			rerr = vm.nativeError(r)
+			vm.error = rerr
+		}
+		for vm.currentFrame != nil {
+			vm.popFrame()
+		}
+		vm.currentFrame, vm.depth, vm.results = outer, depth, results
+		vm.handlers = vm.handlers[:handlers]
+
+		// the stack may have grown while the outer frames were detached
+		for cf := outer; cf != nil; cf = cf.parent {
+			cf.r = vm.stack[cf.base:]
+		}
+		vm.closeSince(resources)
+		vm.error = nil
+
+		if r != nil && rerr == nil {
+			panic(r)
+		}
+		if rerr != nil {
+			res, err = nil, rerr
+		}
+	}()
+
+	cf := vm.pushFrame(fn, 0, 0, len(args))
+	// without a parent the loop stops when fn returns, with the
+	// results in vm.results like the main function
+	cf.parent = nil
+	cf.r[0].set(this)
+	for i := 1; i < int(fn.Bytecode.NumRegs); i++ {
+		cf.r[i] = nilRegister
+	}
+	if fn.Bytecode.Variadic {
+		n := len(fn.Bytecode.Params)
+		if n > len(args) {
+			n = len(args)
+		}
+		rest := append(Array{}, args[n:]...)
+		cf.r[1+len(fn.Bytecode.Params)].set(&rest)
+		args = args[:n]
+	}
+	for i, arg := range args {
+		cf.r[i+1].set(arg)
+	}
+
+	vm.results = nil
+	if err := mainLoop(vm); err != nil {
+		return nil, err
+	}
+	return vm.results, nil
+}
+
+// closeMethod returns the close method of a resource of a 'with' statement
+func closeMethod(v Value) (Value, bool) {
+	return method(v, "close")
+}
+
+// method returns the function in the field name of v if it's an object
+func method(v Value, name string) (Value, bool) {
+	obj, ok := toObject(v)
+	if !ok {
+		return nil, false
+	}
+	switch fn := obj.Get(name).(type) {
+	case GoFunc, *Func:
+		return fn, true
+	}
+	return nil, false
+}
+
+// closeResources calls the close method of the resources left open when
+// the program stopped with an error, from the innermost. The errors of
+// the close methods are ignored, the program's error is the one reported.
+func (vm *VM) closeResources() {
+	err := vm.error
+	defer func() { vm.error = err }()
+
+	// the frames of the program are gone, but the closures
+	// may still reference their variables
+	vm.closeUpvalues(0)
+	for len(vm.resources) > 0 {
+		last := len(vm.resources) - 1
+		res := vm.resources[last]
+		vm.resources = vm.resources[:last]
+
+		switch fn, _ := closeMethod(res); fn := fn.(type) {
+		case GoFunc:
+			fn(&FuncCall{VM: vm, This: res})
+		case *Func:
+			vm.currentFrame = nil
+			vm.depth = 0
+			cf := vm.pushFrame(fn, 0, 0, 0)
+			cf.r[0].set(res)
+			for i := 1; i < int(fn.Bytecode.NumRegs); i++ {
+				cf.r[i] = nilRegister
+			}
+			mainLoop(vm)
+			vm.closeUpvalues(0)
+		}
+	}
+	vm.currentFrame = nil
+	vm.depth = 0
+}
+
+// unwind continues the execution at the innermost handler pushed
+// since base, the frames and the resources of the with statements
+// opened since it was pushed are left, from the innermost. The errors
+// of the close methods are ignored. It returns false if there's no
+// handler, the error stops the program then.
+func (vm *VM) unwind(base int) bool {
+	if len(vm.handlers) <= base {
+		return false
+	}
+	err := vm.error
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	for vm.depth > h.depth {
+		vm.popFrame()
+	}
+	vm.closeSince(h.resources)
+
+	cf := vm.currentFrame
+	cf.r[h.reg].set(errorValue(err))
+	cf.r[h.reg+1].set(Bool(true))
+	cf.pc = h.pc
+	vm.error = nil
+	return true
+}
+
+// closeSince calls the close method of the resources opened after
+// the first n, from the innermost, ignoring their errors
+func (vm *VM) closeSince(n int) {
+	for len(vm.resources) > n {
+		last := len(vm.resources) - 1
+		res := vm.resources[last]
+		vm.resources = vm.resources[:last]
+
+		switch fn, _ := closeMethod(res); fn := fn.(type) {
+		case GoFunc:
+			fn(&FuncCall{VM: vm, This: res})
+		case *Func:
+			vm.invoke(fn, res, nil)
+		}
+	}
+}
+
+// errorValue returns the value of err seen by a recover block: the
+// value given to panic, or an object with the message and the position
+// of the error, which panic raises again as the same error
+func errorValue(err error) Value {
+	rerr, ok := err.(*RuntimeError)
+	if !ok {
+		rerr = &RuntimeError{Message: err.Error(), Err: err}
+	}
+	if rerr.Value != nil {
+		return rerr.Value
+	}
+	fields := map[string]Value{
+		"message": String(rerr.Message),
+		"file":    String(rerr.File),
+		"line":    Number(rerr.Line),
+	}
+	return &GoObject{Object: Object{Fields: fields}, Data: rerr}
+}
+
+// protectedDispatch is dispatch for the instructions inside of try
+// blocks, the errors raised by native functions with a panic are
+// converted to errors of the program, which the try can recover
+func (vm *VM) protectedDispatch(cf *callFrame, instr uint32) (status int) {
+	defer func() {
+		if r := recover(); r != nil {
+			rerr := nativeError(r, cf.fn.Bytecode.Source, cf.line)
+			if rerr == nil {
+				panic(r)
+			}
+			vm.error = rerr
+			if vm.subscribers != nil {
+				vm.permissionDenied(rerr)
+			}
+			status = 1
+		}
+	}()
+	return dispatch(vm, cf, instr)
+}
+
+// nativeError returns the error of the program raised by a native
+// function with the value r of a panic, at line of file. It returns
+// nil for the runtime errors, which keep panicking as bugs of the host.
+// The other errors, like a *PermissionError, are it's Err.
+// A *RuntimeError is the error of a script function called by the
+// native function (see FuncCall.Call), raised again as it is.
+func nativeError(r interface{}, file string, line int) *RuntimeError {
+	switch r := r.(type) {
+	case *RuntimeError:
+		return r
+	case string:
+		return &RuntimeError{File: file, Line: line, Message: r}
+	case runtime.Error:
+		return nil
+	case error:
+		return &RuntimeError{File: file, Line: line, Message: r.Error(), Err: r}
+	}
+	return &RuntimeError{File: file, Line: line, Message: fmt.Sprint(r)}
+}
+
+// nativeError is nativeError at the line of the current frame
+func (vm *VM) nativeError(r interface{}) *RuntimeError {
+	if cf := vm.currentFrame; cf != nil {
+		return nativeError(r, cf.fn.Bytecode.Source, cf.line)
+	}
+	return nativeError(r, "", 0)
+}
+
+// pushFrame makes a frame for a call to fn, with it's registers right
+// after the ones of the current frame, and makes it the current frame
+func (vm *VM) pushFrame(fn *Func, ret, nret int, nargs int) *callFrame {
+	base := 0
+	if parent := vm.currentFrame; parent != nil {
+		base = parent.base + int(parent.fn.Bytecode.NumRegs)
+	}
+	vm.growStack(base + int(fn.Bytecode.NumRegs) + nargs + 1)
+
+	cf := vm.freeFrames
+	if cf != nil {
+		vm.freeFrames = cf.parent
+	} else {
+		cf = &callFrame{}
+	}
+	if top := base + int(fn.Bytecode.NumRegs); top > vm.usage.PeakRegisters {
+		vm.usage.PeakRegisters = top
+	}
+	*cf = callFrame{
+		fn:     fn,
+		base:   base,
+		r:      vm.stack[base:],
+		ret:    ret,
+		nret:   nret,
+		parent: vm.currentFrame,
+	}
+	vm.currentFrame = cf
+	vm.depth++
+	if vm.tracer != nil {
+		vm.startSpan(cf)
+	}
+	if vm.subscribers != nil {
+		vm.emit(CallEntered{Call: tracedCall(cf), Depth: vm.depth})
+	}
+	return cf
+}
+
+// popFrame returns the current frame to the freelist and
+// makes it's caller the current frame
+func (vm *VM) popFrame() {
+	cf := vm.currentFrame
+	vm.currentFrame = cf.parent
+	vm.depth--
+	vm.closeUpvalues(cf.base)
+	if cf.span != nil {
+		cf.span.End(vm.error)
+	}
+	if vm.subscribers != nil {
+		vm.emit(CallExited{Call: tracedCall(cf), Depth: vm.depth + 1, Err: vm.error})
+	}
+
+	// clear the registers so they don't hold references to garbage
+	regs := cf.r[:cf.fn.Bytecode.NumRegs]
+	for i := range regs {
+		regs[i] = nilRegister
+	}
+	*cf = callFrame{parent: vm.freeFrames}
+	vm.freeFrames = cf
+}
+
+// growStack makes sure the register stack has at least size registers,
+// moving the windows of the active frames if it's reallocated
+func (vm *VM) growStack(size int) {
+	if size <= len(vm.stack) {
+		return
+	}
+	newSize := len(vm.stack) * 2
+	if newSize < registerStackSize {
+		newSize = registerStackSize
+	}
+	for newSize < size {
+		newSize *= 2
+	}
+	stack := make([]register, newSize)
+	copy(stack, vm.stack)
+	vm.stack = stack
+
+	for cf := vm.currentFrame; cf != nil; cf = cf.parent {
+		cf.r = vm.stack[cf.base:]
+	}
+}
+
+// setError sets the error that stops the execution, with
+// the position of the current instruction
+func (vm *VM) setError(format string, args ...interface{}) {
+	cf := vm.currentFrame
+	msg := fmt.Sprintf(format, args...)
+	vm.error = &RuntimeError{File: cf.fn.Bytecode.Source, Line: cf.line, Message: msg}
+}
+
+// callError reports an attempt to call the value in R(reg)
+func (vm *VM) callError(cf *callFrame, reg uint) int {
+	kind := cf.r[reg].kind
+	if what := describeReg(cf.fn.Bytecode, cf.pc-1, int(reg)); what != "" {
+		vm.setError("cannot call %s (a %s value)", what, kind)
+	} else {
+		vm.setError("cannot call a %s value", kind)
+	}
+	return 1
+}
+
+// index returns the position in a sequence of length n of the index
+// RK(c), negative indices count from the end (-1 is the last element)
+func (vm *VM) index(cf *callFrame, c uint, n int) (int, bool) {
+	f, ok := cf.rkNumber(c)
+	if !ok {
+		vm.setError("cannot index with a %s value", cf.rk(c).Type())
+		return 0, false
+	}
+	i := int(f)
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		vm.setError("index %d out of range with length %d", int(f), n)
+		return 0, false
+	}
+	return i, true
+}
+
+// sliceBounds returns the positions in a sequence of length n of the
+// bounds RK(b) and RK(c) of a slice. Nil bounds are the start and the
+// end of the sequence, negative bounds count from the end and the
+// bounds are clamped to the sequence, so a slice is never out of range
+// (it's empty if the end comes before the start).
+func (vm *VM) sliceBounds(cf *callFrame, b, c uint, n int) (start, end int, ok bool) {
+	bound := func(x uint, def int) (int, bool) {
+		if cf.rk(x).Type() == ValueNil {
+			return def, true
+		}
+		f, ok := cf.rkNumber(x)
+		if !ok {
+			vm.setError("cannot slice with a %s value", cf.rk(x).Type())
+			return 0, false
+		}
+		i := int(f)
+		if i < 0 {
+			i += n
+		}
+		if i < 0 {
+			i = 0
+		} else if i > n {
+			i = n
+		}
+		return i, true
+	}
+	if start, ok = bound(b, 0); !ok {
+		return
+	}
+	if end, ok = bound(c, n); !ok {
+		return
+	}
+	if end < start {
+		end = start
+	}
+	return
+}
+
+// undefinedGlobal reports a load of the undefined global name, suggesting
+// a similar name among the variables visible from the current instruction
+func (vm *VM) undefinedGlobal(cf *callFrame, name string) int {
+	var candidates []string
+	b := cf.fn.Bytecode
+	for _, l := range b.LocalsAt(cf.pc - 1) {
+		candidates = append(candidates, l.Name)
+	}
+	for _, u := range b.Upvals {
+		candidates = append(candidates, u.Name)
+	}
+	root := cf
+	for root.parent != nil {
+		root = root.parent
+	}
+	outer, _ := enclosingLocals(root.fn.Bytecode, b)
+	candidates = append(candidates, outer...)
+	globals := make([]string, 0, len(vm.Globals))
+	for g := range vm.Globals {
+		globals = append(globals, g)
+	}
+	sort.Strings(globals)
+	candidates = append(candidates, globals...)
+
+	vm.setError("undefined global '%s'%s", name, didYouMean(name, candidates))
+	return 1
+}
+
+// describeReg tells where the value of the register reg used by the
+// instruction at pc came from, by looking at the instruction that
+// loaded it (e.g. "local 'x'", "global 'y'"), "" if it's not known
+func describeReg(b *Bytecode, pc, reg int) string {
+	for i := pc - 1; i >= 0; i-- {
+		op, a, bx, c := OpDecode(b.Code[i])
+		if a != reg || op.Info().A != OperandReg {
+			continue
+		}
+		switch op {
+		case OpMove:
+			if name, ok := b.LocalName(bx, i); ok {
+				return fmt.Sprintf("local '%s'", name)
+			}
+		case OpLoadglobal:
+			return fmt.Sprintf("global '%s'", b.Consts[bx])
+		case OpLoadFree:
+			return fmt.Sprintf("upvalue '%s'", b.Upvals[bx].Name)
+		case OpGetIndex:
+			if c >= OpConstOffset {
+				return fmt.Sprintf("field '%s'", b.Consts[c-OpConstOffset])
+			}
+		case OpGetField:
+			return fmt.Sprintf("field '%s'", b.Consts[c])
+		}
+		break
+	}
+	if name, ok := b.LocalName(reg, pc); ok {
+		return fmt.Sprintf("local '%s'", name)
+	}
+	return ""
 }
 
 func NewVM() *VM {
 	vm := &VM{
 		Globals: make(map[string]Value, 128),
+		strings: make(map[string]Value),
+		changed: make(map[string]struct{}),
 	}
 
 	defineBuiltins(vm)
+	vm.Checkpoint()
 
 	return vm
 }
@@ -101,78 +720,66 @@ func init() {
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpLoadNil
 			a, b := OpGetA(instr), OpGetB(instr)
 			for a <= b {
-				cf.r[a] = Nil{}
+				cf.r[a] = nilRegister
 				a++
 			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpLoadConst
 			a, bx := OpGetA(instr), OpGetBx(instr)
-			cf.r[a] = cf.fn.Bytecode.Consts[bx]
+			cf.r[a] = cf.fn.Bytecode.consts[bx]
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpLoadGlobal
 			a, bx := OpGetA(instr), OpGetBx(instr)
 			str := cf.fn.Bytecode.Consts[bx].String()
 			if g, ok := vm.Globals[str]; ok {
-				cf.r[a] = g
+				cf.r[a].set(g)
 			} else {
-				//vm.setError("undefined global %s", str)
-				return 1
+				return vm.undefinedGlobal(cf, str)
 			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetGlobal
-			// TODO: remove this instruction
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			str := cf.fn.Bytecode.Consts[bx].String()
+			vm.Globals[str] = cf.r[a].get()
+			vm.changed[str] = struct{}{}
 			return 0
 		},
-		func(vm *VM, cf *callFrame, instr uint32) int { // OpLoadRef
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpLoadFree
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			cf.r[a] = *cf.fn.upvalue(vm, bx)
 			return 0
 		},
-		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetRef
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetFree
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			*cf.fn.upvalue(vm, bx) = cf.r[a]
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpUnm
 			a, bx := OpGetA(instr), OpGetBx(instr)
-			var bv Value
-			if bx >= OpConstOffset {
-				bv = cf.fn.Bytecode.Consts[bx-OpConstOffset]
-			} else {
-				bv = cf.r[bx]
-			}
-			f, ok := bv.assertFloat64()
+			f, ok := cf.rkNumber(bx)
 			if !ok {
-				//vm.setError("cannot perform unary minus on %s", bv.Type())
+				vm.setError("cannot perform unary minus on %s", cf.rk(bx).Type())
 				return 1
 			}
-			cf.r[a] = Number(-f)
+			cf.r[a].setNumber(-f)
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpNot
 			a, bx := OpGetA(instr), OpGetBx(instr)
-			var bv Value
-			if bx >= OpConstOffset {
-				bv = cf.fn.Bytecode.Consts[bx-OpConstOffset]
-			} else {
-				bv = cf.r[bx]
-			}
-			cf.r[a] = Bool(!bv.ToBool())
+			cf.r[a].setBool(!cf.rk(bx).ToBool())
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpCmpl
 			a, bx := OpGetA(instr), OpGetBx(instr)
-			var bv Value
-			if bx >= OpConstOffset {
-				bv = cf.fn.Bytecode.Consts[bx-OpConstOffset]
-			} else {
-				bv = cf.r[bx]
-			}
-			f, ok := bv.assertFloat64()
-			if !ok || isInt(f) {
-				//vm.setError("cannot perform complement on %s", bv.Type())
+			f, ok := cf.rkNumber(bx)
+			if !ok || !isInt(f) {
+				vm.setError("cannot perform complement on %s", cf.rk(bx).Type())
 				return 1
 			}
-			cf.r[a] = Number(float64(^int(f)))
+			cf.r[a].setNumber(float64(^int(f)))
 			return 0
 		},
 		opArith, // OpAdd
@@ -189,6 +796,36 @@ func init() {
 		opCmp,   // OpLe
 		opCmp,   // OpEq
 		opCmp,   // opNe
+		opIn,    // OpIn
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpIsType
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			typ := cf.rk(b).Type()
+			if typ == ValueGoFunc {
+				// native and script functions are both "func"
+				typ = ValueFunc
+			}
+			cf.r[a].setBool(typ == ValueType(c))
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpIsProto
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			proto, ok := toObject(cf.rk(c))
+			if !ok {
+				vm.setError("cannot use a %s value as a prototype in 'is'", cf.rk(c).Type())
+				return 1
+			}
+			var res bool
+			if obj, ok := toObject(cf.rk(b)); ok {
+				for parent := obj.Parent; parent != nil; parent = parent.Parent {
+					if parent == proto {
+						res = true
+						break
+					}
+				}
+			}
+			cf.r[a].setBool(res)
+			return 0
+		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpMove
 			a, b := OpGetA(instr), OpGetB(instr)
 			cf.r[a] = cf.r[b]
@@ -196,60 +833,133 @@ func init() {
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpGetIndex
 			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
-			v := cf.r[b]
-			if v.Type() == ValueArray {
-				var index Value
-				if c >= OpConstOffset {
-					index = cf.fn.Bytecode.Consts[c - OpConstOffset]
-				} else {
-					index = cf.r[c]
+			v := cf.r[b].get()
+			if arr, ok := toArray(v); ok {
+				i, ok := vm.index(cf, c, len(arr))
+				if !ok {
+					return 1
 				}
-
-				arr := []Value(v.(Array))
-				n, ok := index.assertFloat64()
+				cf.r[a].set(arr[i])
+			} else if obj, ok := toObject(v); ok {
+				val, status := vm.getKey(obj, cf.rk(c).String())
+				if status != 0 {
+					return status
+				}
+				cf.r[a].set(val)
+			} else if str, ok := v.assertString(); ok {
+				i, ok := vm.index(cf, c, len(str))
 				if !ok {
-					// panic
 					return 1
 				}
-
-				cf.r[a] = arr[int(n)]
+				cf.r[a].set(String(str[i : i+1]))
 			}
 
 			return 0
 		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpSlice
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			v := cf.r[a].get()
+			if arr, ok := toArray(v); ok {
+				start, end, ok := vm.sliceBounds(cf, b, c, len(arr))
+				if !ok {
+					return 1
+				}
+				res := make(Array, end-start)
+				copy(res, arr[start:end])
+				cf.r[a].set(&res)
+				vm.usage.Allocations++
+			} else if str, ok := v.assertString(); ok {
+				start, end, ok := vm.sliceBounds(cf, b, c, len(str))
+				if !ok {
+					return 1
+				}
+				cf.r[a].set(String(str[start:end]))
+				vm.usage.Allocations++
+			} else {
+				vm.setError("cannot slice a %s value", v.Type())
+				return 1
+			}
+			return 0
+		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetIndex
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			v := cf.r[a].get()
+			if arr, ok := toArray(v); ok {
+				i, ok := vm.index(cf, b, len(arr))
+				if !ok {
+					return 1
+				}
+				arr[i] = cf.rk(c)
+			} else if obj, ok := toObject(v); ok {
+				obj.Set(cf.rk(b).String(), cf.rk(c))
+			} else {
+				vm.setError("cannot assign to an index of a %s value", v.Type())
+				return 1
+			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpAppend
 			a, b := OpGetA(instr), OpGetB(instr)
 			from := a + 1
 			to := from + b
-			ptr := cf.r[a]
-			arr := ptr.(*Array)
-			*arr = append(*arr, cf.r[from:to]...)
+			arr := cf.r[a].ref.(*Array)
+			for i := from; i < to; i++ {
+				*arr = append(*arr, cf.r[i].get())
+			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpCall
 			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
-			fn := cf.r[a]
-			if fn.Type() == ValueGoFunc {
-				callGoFunc(vm, cf, fn.(GoFunc), a, b, c)
+			args := a + resultRegisters(b)
+			switch fn := cf.r[a].ref.(type) {
+			case GoFunc:
+				callGoFunc(vm, cf, fn, nil, a, b, args, c)
+			case *Func:
+				return callFunc(vm, cf, fn, nil, a, b, args, c)
+			case *Object:
+				if fn.schema != nil {
+					return vm.construct(cf, fn, a, b, args, c)
+				}
+				return vm.callError(cf, a)
+			default:
+				return vm.callError(cf, a)
 			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpCallMethod
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			// the receiver comes before the arguments
+			recv := a + resultRegisters(b)
+			switch fn := cf.r[a].ref.(type) {
+			case GoFunc:
+				callGoFunc(vm, cf, fn, cf.r[recv].get(), a, b, recv+1, c-1)
+			case *Func:
+				return callFunc(vm, cf, fn, cf.r[recv].get(), a, b, recv+1, c-1)
+			case *Object:
+				if fn.schema != nil {
+					return vm.construct(cf, fn, a, b, recv+1, c-1)
+				}
+				return vm.callError(cf, a)
+			default:
+				return vm.callError(cf, a)
+			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpArray
 			arr := Array([]Value{})
-			cf.r[OpGetA(instr)] = &arr
+			cf.r[OpGetA(instr)].set(&arr)
+			vm.usage.Allocations++
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpObject
-			cf.r[OpGetA(instr)] = NewObject(nil, make(map[string]Value))
+			cf.r[OpGetA(instr)].set(NewObject(nil, make(map[string]Value)))
+			vm.usage.Allocations++
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpFunc
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			cf.r[a].set(vm.makeClosure(cf, cf.fn.Bytecode.Funcs[bx]))
+			vm.usage.Allocations++
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpJmp
@@ -258,59 +968,432 @@ func init() {
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpJmpTrue
 			a := OpGetA(instr)
-			var val Value
+			var val bool
 			if a >= OpConstOffset {
-				val = cf.fn.Bytecode.Consts[a-OpConstOffset]
+				val = cf.fn.Bytecode.Consts[a-OpConstOffset].ToBool()
 			} else {
-				val = cf.r[a]
+				val = cf.r[a].truthy()
+			}
+			if vm.profile != nil {
+				vm.profile.countCondition(cf, val)
 			}
-			if val.ToBool() {
+			if val {
 				cf.pc += OpGetsBx(instr)
 			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpJmpFalse
 			a := OpGetA(instr)
-			var val Value
+			var val bool
 			if a >= OpConstOffset {
-				val = cf.fn.Bytecode.Consts[a-OpConstOffset]
+				val = cf.fn.Bytecode.Consts[a-OpConstOffset].ToBool()
 			} else {
-				val = cf.r[a]
+				val = cf.r[a].truthy()
+			}
+			if vm.profile != nil {
+				vm.profile.countCondition(cf, val)
 			}
-			if !val.ToBool() {
+			if !val {
 				cf.pc += OpGetsBx(instr)
 			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpReturn
+			a, b := int(OpGetA(instr)), int(OpGetB(instr))
+			caller := cf.parent
+			if caller != nil && cf.nret == 0 {
+				arr := make(Array, b)
+				for i := range arr {
+					arr[i] = cf.r[a+i].get()
+				}
+				caller.r[cf.ret].set(&arr)
+			} else if caller != nil {
+				for i := 0; i < cf.nret; i++ {
+					if i < b {
+						caller.r[cf.ret+i] = cf.r[a+i]
+					} else {
+						caller.r[cf.ret+i] = nilRegister
+					}
+				}
+			} else {
+				vm.results = make([]Value, b)
+				for i := range vm.results {
+					vm.results[i] = cf.r[a+i].get()
+				}
+			}
+			vm.popFrame()
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpForBegin
+			a, b := OpGetA(instr), OpGetB(instr)
+			v := cf.r[b].get()
+			cf.r[a+2].setNumber(0)
+			if arr, ok := toArray(v); ok {
+				cf.r[a] = cf.r[b]
+				cf.r[a+1].setNumber(float64(len(arr)))
+			} else if r, ok := v.(Range); ok {
+				cf.r[a] = cf.r[b]
+				cf.r[a+1].setNumber(float64(r.Len()))
+			} else if fn, ok := method(v, "__iter"); ok {
+				// iterators have no length, next tells when they're done
+				cf.r[a+1].setNumber(-1)
+				return callMethod(vm, cf, fn, v, a, 1)
+			} else if _, ok := method(v, "next"); ok {
+				cf.r[a] = cf.r[b]
+				cf.r[a+1].setNumber(-1)
+			} else if obj, ok := toObject(v); ok {
+				// objects are iterated in the order of Keys
+				keys := obj.Keys()
+				arr := make(Array, len(keys))
+				for i, key := range keys {
+					arr[i] = String(key)
+				}
+				cf.r[a].set(&arr)
+				cf.r[a+1].setNumber(float64(len(arr)))
+			} else {
+				vm.setError("cannot iterate over a %s value", v.Type())
+				return 1
+			}
 			return 0
 		},
 		func(vm *VM, cf *callFrame, instr uint32) int { // OpForIter
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			idx, n := cf.r[c+2].num, cf.r[c+1].num
+			cf.r[c+2].setNumber(idx + 1)
+			if n < 0 {
+				// the key counts the steps, the value and whether
+				// it's done come from next
+				it := cf.r[c].get()
+				fn, ok := method(it, "next")
+				if !ok {
+					vm.setError("cannot iterate over a %s value, it has no next method", it.Type())
+					return 1
+				}
+				cf.r[a].setNumber(idx)
+				return callMethod(vm, cf, fn, it, a+1, 2)
+			}
+			if idx >= n {
+				cf.r[a+2].setBool(true)
+				return 0
+			}
+			cf.r[a+2].setBool(false)
+			if arr, ok := toArray(cf.r[b].get()); ok {
+				if int(idx) >= len(arr) {
+					vm.setError("index %d out of range with length %d", int(idx), len(arr))
+					return 1
+				}
+				cf.r[a].setNumber(idx)
+				cf.r[a+1].set(arr[int(idx)])
+			} else if r, ok := cf.r[b].ref.(Range); ok {
+				cf.r[a].setNumber(idx)
+				cf.r[a+1].setNumber(r.At(int(idx)))
+			} else {
+				keys, _ := toArray(cf.r[c].ref)
+				obj, _ := toObject(cf.r[b].get())
+				key := keys[int(idx)]
+				cf.r[a].set(key)
+				cf.r[a+1].set(obj.Get(key.String()))
+			}
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpClose
+			vm.closeUpvalues(cf.base + int(OpGetA(instr)))
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpWith
+			v := cf.r[OpGetA(instr)].get()
+			if _, ok := closeMethod(v); !ok && v.Type() != ValueNil {
+				vm.setError("cannot use a %s value in 'with', it has no close method", v.Type())
+				return 1
+			}
+			vm.resources = append(vm.resources, v)
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpEndWith
+			a := OpGetA(instr)
+			last := len(vm.resources) - 1
+			res := vm.resources[last]
+			vm.resources = vm.resources[:last]
+
+			switch fn, _ := closeMethod(res); fn := fn.(type) {
+			case GoFunc:
+				callGoFunc(vm, cf, fn, res, a, 1, a+1, 0)
+			case *Func:
+				return callFunc(vm, cf, fn, res, a, 1, a+1, 0)
+			default:
+				// nil resource
+				cf.r[a] = nilRegister
+			}
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpProto
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			cf.r[a].set(newPrototype(cf.fn.Bytecode.Consts[bx].String()))
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpProtofield
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			proto := cf.r[a].ref.(*Object)
+			if b < OpConstOffset {
+				parent, ok := cf.r[b].get().(*Object)
+				if !ok {
+					vm.setError("%s cannot inherit from a %s value", proto.schema.name, cf.r[b].get().Type())
+					return 1
+				}
+				proto.inherit(parent)
+				return 0
+			}
+			proto.declareField(cf.rk(b).String(), typeNames[cf.rk(c).String()])
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpConcat
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			var buf strings.Builder
+			for r := b; r <= c; r++ {
+				buf.WriteString(cf.r[r].get().String())
+			}
+			cf.r[a].set(String(buf.String()))
+			vm.usage.Allocations++
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpLen
+			a, bx := OpGetA(instr), OpGetBx(instr)
+			v := cf.rk(bx)
+			if fn, ok := method(v, "__len"); ok {
+				return callMethod(vm, cf, fn, v, a, 1)
+			}
+			n, ok := length(v)
+			if !ok {
+				vm.setError("cannot get the length of a %s value", v.Type())
+				return 1
+			}
+			cf.r[a].setNumber(float64(n))
+			return 0
+		},
+		opArithNN, // OpAddNN
+		opArithNN, // OpSubNN
+		opArithNN, // OpMulNN
+		opArithNN, // OpDivNN
+		opCmpNN,   // OpLtNN
+		opCmpNN,   // OpLeNN
+		opForloop, // OpForloop
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpPushHandler
+			vm.handlers = append(vm.handlers, handler{
+				depth:     vm.depth,
+				pc:        cf.pc + OpGetsBx(instr),
+				reg:       OpGetA(instr),
+				resources: len(vm.resources),
+			})
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpPopHandler
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpPanic
+			v := cf.r[OpGetA(instr)].get()
+			if obj, ok := v.(*GoObject); ok {
+				if rerr, ok := obj.Data.(*RuntimeError); ok {
+					// a recovered error raised again
+					vm.error = rerr
+					return 1
+				}
+			}
+			vm.setError("%s", vm.Format(v))
+			vm.error.(*RuntimeError).Value = v
+			return 1
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpGetField
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			if obj, ok := toObject(cf.r[b].ref); ok {
+				val, status := vm.getKey(obj, cf.fn.Bytecode.keys[c])
+				if status != 0 {
+					return status
+				}
+				cf.r[a].set(val)
+				return 0
+			}
+			// the key fits in RK(C), see VisitSelector
+			return opTable[OpGetIndex](vm, cf, OpNewABC(OpGetIndex, int(a), int(b), int(c)+OpConstOffset))
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpSetField
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			if obj, ok := toObject(cf.r[a].ref); ok {
+				obj.Set(cf.fn.Bytecode.keys[b], cf.rk(c))
+				return 0
+			}
+			return opTable[OpSetIndex](vm, cf, OpNewABC(OpSetIndex, int(a), int(b)+OpConstOffset, int(c)))
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpRange
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			if cf.r[a].kind != ValueNumber {
+				vm.setError("cannot make a range from a %s value", cf.r[a].kind)
+				return 1
+			}
+			end, ok := cf.rkNumber(b)
+			if !ok {
+				vm.setError("cannot make a range to a %s value", cf.rk(b).Type())
+				return 1
+			}
+			step, ok := cf.rkNumber(c)
+			if !ok {
+				vm.setError("cannot make a range by a %s value", cf.rk(c).Type())
+				return 1
+			}
+			if step == 0 || math.IsNaN(step) {
+				vm.setError("the step of a range must not be %v", step)
+				return 1
+			}
+			cf.r[a].set(Range{Start: cf.r[a].num, End: end, Step: step})
+			vm.usage.Allocations++
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpUnpack
+			a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+			v := cf.r[c].get()
+			arr, ok := toArray(v)
+			if !ok {
+				vm.setError("cannot unpack a %s value", v.Type())
+				return 1
+			}
+			// R(C) may be one of the targets
+			for i := uint(0); i < b; i++ {
+				if int(i) < len(arr) {
+					cf.r[a+i].set(arr[i])
+				} else {
+					cf.r[a+i] = nilRegister
+				}
+			}
+			return 0
+		},
+		func(vm *VM, cf *callFrame, instr uint32) int { // OpAppendArray
+			a, b := OpGetA(instr), OpGetB(instr)
+			v := cf.r[b].get()
+			elems, ok := toArray(v)
+			if !ok {
+				vm.setError("cannot spread a %s value", v.Type())
+				return 1
+			}
+			arr := cf.r[a].ref.(*Array)
+			*arr = append(*arr, elems...)
 			return 0
 		},
 	}
 }
 
-func opArith(vm *VM, cf *callFrame, instr uint32) int {
-	var vb, vc Value
-	a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
-	if b >= OpConstOffset {
-		vb = cf.fn.Bytecode.Consts[b-OpConstOffset]
-	} else {
-		vb = cf.r[b]
+// quicken replaces the instruction being executed with it's
+// version specialized for numbers
+func quicken(cf *callFrame, instr uint32) {
+	if cf.fn.Bytecode.frozen {
+		return
+	}
+	if op, ok := numberOps[OpGetOpcode(instr)]; ok {
+		setInstr(cf, opSetOpcode(instr, op))
+	}
+}
+
+// numberOperands returns RK(B) and RK(C) if they are both numbers,
+// otherwise it puts back the generic version of the instruction
+// and returns false
+func numberOperands(cf *callFrame, instr uint32) (float64, float64, bool) {
+	nb, okb := cf.rkNumber(OpGetB(instr))
+	nc, okc := cf.rkNumber(OpGetC(instr))
+	if !okb || !okc {
+		if !cf.fn.Bytecode.frozen {
+			setInstr(cf, OpGeneric(instr))
+		}
+		return 0, 0, false
 	}
-	if c >= OpConstOffset {
-		vc = cf.fn.Bytecode.Consts[c-OpConstOffset]
+	return nb, nc, true
+}
+
+func opArithNN(vm *VM, cf *callFrame, instr uint32) int {
+	nb, nc, ok := numberOperands(cf, instr)
+	if !ok {
+		return opArith(vm, cf, OpGeneric(instr))
+	}
+	a := OpGetA(instr)
+	var res float64
+	switch OpGetOpcode(instr) {
+	case OpAddNN:
+		res = nb + nc
+	case OpSubNN:
+		res = nb - nc
+	case OpMulNN:
+		res = nb * nc
+	case OpDivNN:
+		res = nb / nc
+	}
+	if vm.intOverflow != OverflowFloat {
+		var ok bool
+		if res, ok = vm.checkOverflow(genericOps[OpGetOpcode(instr)-OpAddNN], nb, nc, res); !ok {
+			return 1
+		}
+	}
+	cf.r[a].setNumber(res)
+	return 0
+}
+
+func opCmpNN(vm *VM, cf *callFrame, instr uint32) int {
+	nb, nc, ok := numberOperands(cf, instr)
+	if !ok {
+		return opCmp(vm, cf, OpGeneric(instr))
+	}
+	if OpGetOpcode(instr) == OpLtNN {
+		cf.r[OpGetA(instr)].setBool(nb < nc)
 	} else {
-		vc = cf.r[c]
+		cf.r[OpGetA(instr)].setBool(nb <= nc)
+	}
+	return 0
+}
+
+// the same as the step R(A) += 1 and the condition R(A) < RK(B) of
+// the loop, jumping back to it's body while the condition holds
+func opForloop(vm *VM, cf *callFrame, instr uint32) int {
+	a, b := OpGetA(instr), OpGetB(instr)
+	if i, ok := cf.rkNumber(a); ok {
+		i++
+		cf.r[a].setNumber(i)
+		if n, ok := cf.rkNumber(b); ok {
+			if i < n {
+				cf.pc -= int(OpGetC(instr))
+			}
+			return 0
+		}
 	}
-	fb, okb := vb.assertFloat64()
-	fc, okc := vc.assertFloat64()
+
+	// not numbers, as opArith and opCmp do
+	vi, vn := cf.r[a].get(), cf.rk(b)
+	if vi.Type() != vn.Type() {
+		return 0
+	}
+	switch vi.Type() {
+	case ValueNil:
+		// throw error
+		return 1
+	case ValueString:
+		if vi.String() < vn.String() {
+			cf.pc -= int(OpGetC(instr))
+		}
+	}
+	return 0
+}
+
+func opArith(vm *VM, cf *callFrame, instr uint32) int {
+	a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+	fb, okb := cf.rkNumber(b)
+	fc, okc := cf.rkNumber(c)
 	if okb && okc {
-		cf.r[a] = Number(numberArith(OpGetOpcode(instr), fb, fc))
+		res := numberArith(OpGetOpcode(instr), fb, fc)
+		if vm.intOverflow != OverflowFloat {
+			if res, okb = vm.checkOverflow(OpGetOpcode(instr), fb, fc, res); !okb {
+				return 1
+			}
+		}
+		cf.r[a].setNumber(res)
+		quicken(cf, instr)
+	} else if status, ok := vm.binaryMeta(cf, OpGetOpcode(instr), a, cf.rk(b), cf.rk(c)); ok {
+		return status
 	}
 	return 0
 }
@@ -343,25 +1426,26 @@ func numberArith(op Opcode, a, b float64) float64 {
 }
 
 func opCmp(vm *VM, cf *callFrame, instr uint32) int {
-	var vb, vc Value
 	a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
-	if b >= OpConstOffset {
-		vb = cf.fn.Bytecode.Consts[b-OpConstOffset]
-	} else {
-		vb = cf.r[b]
-	}
-	if c >= OpConstOffset {
-		vc = cf.fn.Bytecode.Consts[c-OpConstOffset]
-	} else {
-		vc = cf.r[c]
+	op := OpGetOpcode(instr)
+	if numb, ok := cf.rkNumber(b); ok {
+		if numc, ok := cf.rkNumber(c); ok {
+			quicken(cf, instr)
+			cf.r[a].setBool(numberCmp(op, numb, numc))
+			return 0
+		}
 	}
 
-	if (vb.Type() != ValueNil && vc.Type() != ValueNil) && vb.Type() != vc.Type() {
-		cf.r[a] = Bool(false)
+	vb, vc := cf.rk(b), cf.rk(c)
+	if status, ok := vm.binaryMeta(cf, op, a, vb, vc); ok {
+		return status
+	}
+	if vb.Type() != vc.Type() {
+		// values of different types are never equal
+		cf.r[a].setBool(op == OpNe)
 		return 0
 	}
 
-	op := OpGetOpcode(instr)
 	var res bool
 	switch vb.Type() {
 	case ValueNil:
@@ -398,37 +1482,88 @@ func opCmp(vm *VM, cf *callFrame, instr uint32) int {
 		case OpNe:
 			res = sb != sc
 		}
-	case ValueNumber:
-		numb, _ := vb.assertFloat64()
-		numc, _ := vb.assertFloat64()
-		switch op {
-		case OpLt:
-			res = numb < numc
-		case OpLe:
-			res = numb <= numc
-		case OpEq:
-			res = numb == numc
-		case OpNe:
-			res = numb != numc
+	}
+	cf.r[a].setBool(res)
+	return 0
+}
+
+// R(A) = RK(B) in RK(C): an element of an array,
+// a key of an object or a substring of a string
+func opIn(vm *VM, cf *callFrame, instr uint32) int {
+	a, b, c := OpGetA(instr), OpGetB(instr), OpGetC(instr)
+	vb, vc := cf.rk(b), cf.rk(c)
+	var res bool
+	if arr, ok := toArray(vc); ok {
+		for _, v := range arr {
+			if valuesEqual(vb, v) {
+				res = true
+				break
+			}
 		}
+	} else if obj, ok := toObject(vc); ok {
+		res = obj.Has(vb.String())
+	} else if str, ok := vc.assertString(); ok {
+		sub, ok := vb.assertString()
+		if !ok {
+			vm.setError("cannot look for a %s value in a string", vb.Type())
+			return 1
+		}
+		res = strings.Contains(str, sub)
+	} else {
+		vm.setError("cannot use 'in' with a %s value", vc.Type())
+		return 1
 	}
-	cf.r[a] = Bool(res)
+	cf.r[a].setBool(res)
 	return 0
 }
 
-func callGoFunc(vm *VM, cf *callFrame, fn GoFunc, a, b, c uint) {
-	ab := a + b
-	ac := ab + c - 1
+func numberCmp(op Opcode, a, b float64) bool {
+	switch op {
+	case OpLt:
+		return a < b
+	case OpLe:
+		return a <= b
+	case OpEq:
+		return a == b
+	case OpNe:
+		return a != b
+	default:
+		return false
+	}
+}
+
+// call a native function with the arguments at R(args) ... R(args+nargs-1),
+// storing the results at R(a) ... R(a+b-1)
+func callGoFunc(vm *VM, cf *callFrame, fn GoFunc, this Value, a, b, args, nargs uint) {
+	names := callKeywords(cf, nargs)
+	positional := nargs - uint(len(names))
 	call := FuncCall{
-		Args: make([]Value, c),
-		ExpectResults: ab - a,
-		NumArgs: c,
+		VM:            vm,
+		Args:          make([]Value, positional),
+		This:          this,
+		ExpectResults: b,
+		NumArgs:       positional,
 	}
 
-	for i, r := 0, ab; r <= ac; i, r = i+1, r+1 {
-		call.Args[i] = cf.r[r]
+	for i := range call.Args {
+		call.Args[i] = cf.r[args+uint(i)].get()
+	}
+	if len(names) > 0 {
+		call.Keywords = make(map[string]Value, len(names))
+		for i, name := range names {
+			call.Keywords[name] = cf.r[args+positional+uint(i)].get()
+		}
 	}
+	start := time.Now()
 	fn(&call)
+	vm.usage.NativeTime += time.Since(start)
+	vm.usage.NativeCalls++
+
+	if b == 0 {
+		arr := append(Array{}, call.results...)
+		cf.r[a].set(&arr)
+		return
+	}
 
 	nr := call.NumResults
 	if nr != call.ExpectResults {
@@ -437,31 +1572,179 @@ func callGoFunc(vm *VM, cf *callFrame, fn GoFunc, a, b, c uint) {
 
 	for i := uint(0); i < nr; i++ {
 		if int(i) >= len(call.results) {
-			cf.r[a + 1] = Nil{}
+			cf.r[a+i] = nilRegister
 		} else {
-			cf.r[a + i] = call.results[i]
+			cf.r[a+i].set(call.results[i])
 		}
 	}
 }
 
+// resultRegisters returns the number of registers taken by the results
+// of a call expecting b results, a call expecting none collects all of
+// them in an array
+func resultRegisters(b uint) uint {
+	if b == 0 {
+		return 1
+	}
+	return b
+}
+
+// call a script function with the arguments at R(args) ... R(args+nargs-1),
+// the results are stored at R(a) ... R(a+b-1) when it returns, or in an
+// array at R(a) if b is 0
+// callMethod calls fn without arguments, with this as the receiver
+// and b results in R(A) and above
+func callMethod(vm *VM, cf *callFrame, fn, this Value, a, b uint) int {
+	switch fn := fn.(type) {
+	case GoFunc:
+		callGoFunc(vm, cf, fn, this, a, b, a, 0)
+	case *Func:
+		return callFunc(vm, cf, fn, this, a, b, a, 0)
+	}
+	return 0
+}
+
+func callFunc(vm *VM, cf *callFrame, fn *Func, this Value, a, b, args, nargs uint) int {
+	if vm.depth >= CallStackSize {
+		vm.setError("stack overflow")
+		vm.stackOverflow(vm.error)
+		return 1
+	}
+	if vm.profile != nil {
+		vm.profile.countCall(cf)
+	}
+	names := callKeywords(cf, nargs)
+	positional := nargs - uint(len(names))
+	params := fn.Bytecode.Params
+	if len(names) > 0 && !vm.checkKeywords(funcName(fn.Bytecode), params, names, int(positional)) {
+		return 1
+	}
+	callee := vm.pushFrame(fn, int(a), int(b), int(nargs))
+
+	// R(0) is 'this', followed by the arguments
+	caller := callee.parent
+	named := positional
+	if fn.Bytecode.Variadic && named > uint(len(params)) {
+		named = uint(len(params))
+	}
+	callee.r[0].set(this)
+	copy(callee.r[1:], caller.r[args:args+named])
+	for i := int(named) + 1; i < int(fn.Bytecode.NumRegs); i++ {
+		callee.r[i] = nilRegister
+	}
+	for i, name := range names {
+		callee.r[1+paramIndex(params, name)] = caller.r[args+positional+uint(i)]
+	}
+	if fn.Bytecode.Variadic {
+		rest := make(Array, 0, positional-named)
+		for i := named; i < positional; i++ {
+			rest = append(rest, caller.r[args+i].get())
+		}
+		callee.r[1+len(params)].set(&rest)
+	}
+	return 0
+}
+
+// callKeywords returns the names of the keyword arguments of the call
+// being run in cf, the last of it's nargs arguments
+func callKeywords(cf *callFrame, nargs uint) []string {
+	if nargs == 0 || len(cf.fn.Bytecode.Keywords) == 0 {
+		return nil
+	}
+	return cf.fn.Bytecode.KeywordsAt(cf.pc - 1)
+}
+
+// checkKeywords sets the error of a call to fname if one of the keyword
+// arguments names, given after positional arguments, is not one of
+// params or is given twice
+func (vm *VM) checkKeywords(fname string, params, names []string, positional int) bool {
+	for i, name := range names {
+		j := paramIndex(params, name)
+		if j < 0 {
+			vm.setError("unknown keyword argument '%s' in call to %s%s", name, fname, didYouMean(name, params))
+			return false
+		}
+		if j < positional || paramIndex(names[:i], name) >= 0 {
+			vm.setError("argument '%s' given twice in call to %s", name, fname)
+			return false
+		}
+	}
+	return true
+}
+
+func paramIndex(params []string, name string) int {
+	for i, param := range params {
+		if param == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// funcName returns the name of f for the errors of it's calls
+func funcName(f *Bytecode) string {
+	if f.Name == "" {
+		return "anonymous function"
+	}
+	return f.Name
+}
+
 func mainLoop(vm *VM) error {
 	var currentLine uint32
 	cf := vm.currentFrame
 	proto := cf.fn.Bytecode
 
+	// the handlers of the frames below belong to the
+	// outer loops, when called from a native function
+	base := len(vm.handlers)
+
 	for cf.pc < int(proto.NumCode) {
-		if currentLine+1 < proto.NumLines && (cf.pc >= int(proto.Lines[currentLine].Instr)) {
+		if cf.pc < int(proto.Lines[currentLine].Instr) {
+			// jumped backwards
+			currentLine = 0
+		}
+		for currentLine+1 < proto.NumLines && cf.pc >= int(proto.Lines[currentLine+1].Instr) {
 			currentLine += 1
 		}
 
 		instr := proto.Code[cf.pc]
 		cf.pc++
+		vm.usage.Instructions++
 		cf.line = int(proto.Lines[currentLine].Line)
-		if opTable[int(instr&kOpcodeMask)](vm, cf, instr) == 1 {
+		if vm.interrupted.Load() {
+			vm.error = &RuntimeError{File: proto.Source, Line: cf.line, Message: ErrInterrupted.Error(), Err: ErrInterrupted}
+			if vm.subscribers != nil {
+				vm.emit(ErrorRaised{Err: vm.error})
+			}
 			return vm.error
 		}
+		var status int
+		if len(vm.handlers) > base {
+			status = vm.protectedDispatch(cf, instr)
+		} else {
+			status = dispatch(vm, cf, instr)
+		}
+		if status == 1 {
+			if vm.error == nil {
+				vm.setError("runtime error")
+			}
+			if vm.subscribers != nil {
+				vm.emit(ErrorRaised{Err: vm.error, Handled: len(vm.handlers) > base})
+			}
+			if !vm.unwind(base) {
+				return vm.error
+			}
+			currentLine = 0
+			cf = vm.currentFrame
+			proto = cf.fn.Bytecode
+			continue
+		}
 
 		if vm.currentFrame != cf {
+			if vm.currentFrame == nil {
+				// returned from the main function
+				break
+			}
 			currentLine = 0
 		}
 		cf = vm.currentFrame
@@ -0,0 +1,1479 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type tenantKey struct{}
+
+func TestUserData(t *testing.T) {
+	vm := NewVM()
+	vm.SetUserData(tenantKey{}, "acme")
+	vm.Define("tenant", GoFunc(func(call *FuncCall) {
+		call.PushReturnValue(String(call.VM.UserData(tenantKey{}).(string)))
+	}))
+
+	code, err := CompileReader(strings.NewReader(`return tenant()`), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := vm.run(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != String("acme") {
+		t.Errorf("unexpected results %v", res)
+	}
+
+	vm.SetUserData(tenantKey{}, nil)
+	if v := vm.UserData(tenantKey{}); v != nil {
+		t.Errorf("expected the key to be removed, got %v", v)
+	}
+}
+
+func TestGoFuncResults(t *testing.T) {
+	vm := NewVM()
+	vm.Define("count", GoFunc(func(call *FuncCall) {
+		n := int(call.Args[0].(Number))
+		for i := 1; i <= n; i++ {
+			call.PushReturnValue(Number(i))
+		}
+		if n < 0 {
+			call.PushReturnValue(nil)
+		}
+	}))
+
+	res := runString(t, vm, `
+		var a, b, c = count(2)
+		var d, e = count(3)
+		f, g, h := 0, count(5)
+		var i, j = count(1), count(1)
+		var k, l = count(0)
+		var m = count(-1)
+
+		// the variables are not visible to their initializer
+		var n = 3
+		func scope() {
+			var n, o = count(n)
+			return [n, o]
+		}
+
+		// the variables without a value are not assigned
+		var p, q, r = 7, 8, 9
+		p, q, r = count(2), 10
+		return [a, b, c], [d, e], [f, g, h], [i, j], [k, l], m, scope(), [p, q, r], [count(3)]
+	`)
+	want := []string{"[1 2 nil]", "[1 2]", "[0 1 2]", "[1 1]", "[nil nil]", "nil", "[1 2]", "[1 10 9]", "[1]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+}
+
+func TestForInOrder(t *testing.T) {
+	fields := map[string]Value{}
+	for _, key := range []string{"delta", "alpha", "charlie", "bravo", "echo"} {
+		fields[key] = String(key[:1])
+	}
+	vm := NewVM()
+	vm.Define("obj", NewObject(nil, fields))
+	vm.Define("concat", GoFunc(func(call *FuncCall) {
+		call.PushReturnValue(String(call.Args[0].String() + call.Args[1].String()))
+	}))
+
+	// the order must not depend on the map
+	for i := 0; i < 10; i++ {
+		res := runString(t, vm, `
+			var keys, values = "", ""
+			for k, v in obj {
+				keys = concat(keys, k)
+				values = concat(values, v)
+			}
+			var sum = 0
+			for n in [1, 2, 3] {
+				sum = sum + n
+			}
+			return keys, values, sum
+		`)
+		if res[0] != String("alphabravocharliedeltaecho") || res[1] != String("abcde") || res[2] != Number(6) {
+			t.Fatalf("unexpected results %v", res)
+		}
+	}
+}
+
+func TestIn(t *testing.T) {
+	parent := NewObject(nil, map[string]Value{"inherited": Number(1)})
+	vm := NewVM()
+	vm.Define("cache", NewObject(parent, map[string]Value{"k": Number(2)}))
+	vm.Define("arr", &Array{Number(1), String("two"), Nil{}})
+
+	res := runString(t, vm, `
+		var s = "hello"
+		var inArray = (1 in arr) && ("two" in arr) && !(2 in arr) && !("one" in arr)
+		var inObject = ("k" in cache) && ("inherited" in cache) && !("x" in cache)
+		var inString = ("ell" in s) && !("x" in s) && ("lo" in "hello")
+		var count = 0
+		for k in ["k", "x", "inherited"] {
+			if k in cache {
+				count = count + 1
+			}
+		}
+		return inArray, inObject, inString, count
+	`)
+	if res[0] != Bool(true) || res[1] != Bool(true) || res[2] != Bool(true) || res[3] != Number(2) {
+		t.Errorf("unexpected results %v", res)
+	}
+
+	for _, source := range []string{"return 1 in 2", "return 1 in \"one\""} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewVM().run(code); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+func TestIs(t *testing.T) {
+	proto := NewObject(nil, map[string]Value{})
+	child := NewObject(proto, map[string]Value{})
+	vm := NewVM()
+	vm.Define("Proto", proto)
+	vm.Define("child", child)
+	vm.Define("grandchild", NewObject(child, map[string]Value{}))
+
+	res := runString(t, vm, `
+		func types(v) {
+			return [v is nil, v is bool, v is number, v is string, v is func, v is array, v is object, v is any]
+		}
+		var protos = (child is Proto) && (grandchild is Proto) && !(Proto is Proto) && !(1 is Proto)
+		return types(nil), types(1), types("s"), types(println), types(types), types([]), types(child), protos
+	`)
+	want := []string{
+		"[true false false false false false false true]",
+		"[false false true false false false false true]",
+		"[false false false true false false false true]",
+		"[false false false false true false false true]",
+		"[false false false false true false false true]",
+		"[false false false false false true false true]",
+		"[false false false false false false true true]",
+		"true",
+	}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	code, err := CompileReader(strings.NewReader("return 1 is 2"), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVM().run(code); err == nil {
+		t.Errorf("expected an error for a prototype that is not an object")
+	}
+}
+
+func TestIndexAndSlice(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{"a[0]", "1"},
+		{"a[-1]", "5"},
+		{"a[-5]", "1"},
+		{"a[1:3]", "[2 3]"},
+		{"a[:2]", "[1 2]"},
+		{"a[3:]", "[4 5]"},
+		{"a[:]", "[1 2 3 4 5]"},
+		{"a[-2:]", "[4 5]"},
+		{"a[:-2]", "[1 2 3]"},
+		{"a[-100:100]", "[1 2 3 4 5]"},
+		{"a[4:1]", "[]"},
+		{"s[0]", "h"},
+		{"s[-1]", "o"},
+		{"s[1:-1]", "ell"},
+		{"s[10:]", ""},
+		{"f()[g()]", "8"},
+		{"f()[g():]", "[8 9]"},
+	}
+	for _, test := range tests {
+		res := runString(t, NewVM(), `
+			var a = [1, 2, 3, 4, 5]
+			var s = "hello"
+			func f() { return [7, 8, 9] }
+			func g() { return 1 }
+			return `+test.expr)
+		if res[0].String() != test.want {
+			t.Errorf("%s: expected %s, got %s", test.expr, test.want, res[0])
+		}
+	}
+
+	for _, source := range []string{"return [1][1]", "return [1][-2]", "return \"\"[0]", "return 1[:]", "return [1][\"a\":]"} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewVM().run(code); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	vm := NewVM()
+	vm.Define("native", &GoObject{Object: Object{Fields: map[string]Value{"x": Number(1)}}})
+	res := runString(t, vm, `
+		var o = {a: 1, b: {c: 2}}
+		o.a = o.a + 10
+		o.b.c = "c"
+		o.f = func() -> this.a
+		native.y = native.x + 1
+		proto P { x = 3 }
+		var p = P()
+		p.x = p.x * 2
+		return o.a, o.b.c, o.f(), native.y, p.x, P.x
+	`)
+	want := []string{"11", "c", "11", "2", "6", "3"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	// the selectors of the other values are indexes
+	for _, source := range []string{"return [1].x", "var s = \"s\"\nreturn s.x", "var a = []\na.x = 1"} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, instr := range code.Code {
+			if op := OpGetOpcode(instr); op == OpGetIndex || op == OpSetIndex {
+				t.Errorf("%q: expected getfield and setfield, got %s", source, op.Info().Name)
+			}
+		}
+		if _, err := NewVM().run(code); err == nil || !strings.Contains(err.Error(), "string value") {
+			t.Errorf("%q: expected an error, got %v", source, err)
+		}
+	}
+}
+
+func TestComprehension(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{"[x * 2 for x in a]", "[2 4 6 8]"},
+		{"[x for x in a if x != 2]", "[1 3 4]"},
+		{"[i for i, x in a if x > 2]", "[2 3]"},
+		{"[x for x in []]", "[]"},
+		{"[[y for y in a if y < x] for x in a][2]", "[1 2]"},
+		{"{k: v * 10 for k, v in o}", "map[x:10 y:20]"},
+		{"{v: k for k, v in o if v > 1}", "map[2:y]"},
+		{"[f() for f in [func() { return x } for x in a]]", "[1 2 3 4]"},
+		{"sum(0, [x for x in a])", "10"},
+		{"skip()", "8"},
+	}
+	for _, test := range tests {
+		res := runString(t, NewVM(), `
+			var a = [1, 2, 3, 4]
+			var o = {x: 1, y: 2}
+			func sum(n, xs) {
+				for x in xs {
+					n += x
+				}
+				return n
+			}
+			func skip() {
+				var n = 0
+				for x in a when x != 2 {
+					n += x
+				}
+				return n
+			}
+			return `+test.expr)
+		if res[0].String() != test.want {
+			t.Errorf("%s: expected %s, got %s", test.expr, test.want, res[0])
+		}
+	}
+}
+
+func TestCollectResults(t *testing.T) {
+	vm := NewVM()
+	vm.Define("native", GoFunc(func(call *FuncCall) {
+		for _, arg := range call.Args {
+			call.PushReturnValue(arg)
+		}
+	}))
+	tests := []struct {
+		expr, want string
+	}{
+		{"[three()...]", "[1 2 3]"},
+		{"[nothing()...]", "[]"},
+		{"[native(4, 5)...]", "[4 5]"},
+		{"[native()...]", "[]"},
+		{"[native(three())...][0]", "1"},
+		{"len([three()...]) + 1", "4"},
+		{"[three()...][-1]", "3"},
+		{"[o.pair()...]", "[7 8]"},
+	}
+	for _, test := range tests {
+		res := runString(t, vm, `
+			func three() { return 1, 2, 3 }
+			func nothing() { var x = 1 }
+			var o = {pair: func() { return 7, 8 }}
+			return `+test.expr)
+		if res[0].String() != test.want {
+			t.Errorf("%s: expected %s, got %s", test.expr, test.want, res[0])
+		}
+	}
+
+	// the other values are spread as arrays, see TestSpread
+	if res, err := DoString("var a = [1, 2]; return [a...]"); err != nil || res[0].String() != "[1 2]" {
+		t.Errorf("expected [1 2], got %v, %v", res, err)
+	}
+}
+
+func TestFunctionHoisting(t *testing.T) {
+	source := `
+		func isEven(n) -> n == 0 ? true : isOdd(n - 1)
+		func isOdd(n) -> n == 0 ? false : isEven(n - 1)
+		func count() {
+			func a(n) -> n <= 0 ? 0 : 1 + b(n - 1)
+			func b(n) -> n <= 0 ? 0 : 10 + a(n - 1)
+			return a(5)
+		}
+		return isEven(10), isOdd(7), isEven(7), count()`
+	for _, level := range []int{0, 2} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{OptLevel: level})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := NewVM().run(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(res); got != "[true true false 23]" {
+			t.Errorf("level %d: got %s", level, got)
+		}
+	}
+
+	if _, err := DoString("func f() -> 1\nvar f = 2"); !errors.Is(err, ErrRedeclared) {
+		t.Errorf("expected a redeclaration error, got %v", err)
+	}
+}
+
+func TestLoopCapture(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var fs = []
+		for i := 0; i < 3; i++ {
+			append(fs, func() -> i)
+		}
+		var gs = []
+		for i := 0; i < 6; i++ {
+			append(gs, func() -> i)
+			i++
+		}
+		var hs = []
+		for x in [4, 5, 6] {
+			append(hs, func() -> x)
+		}
+		return [f() for f in fs], [g() for g in gs], [h() for h in hs]`)
+	want := "[[0 1 2] [1 3 5] [4 5 6]]"
+	if got := fmt.Sprint(res); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestIncDec(t *testing.T) {
+	vm := NewVM()
+	vm.Define("hits", Number(0))
+	res := runString(t, vm, `
+		func counter() {
+			var n = 0
+			return func() {
+				n++
+				return n
+			}
+		}
+		var c = counter()
+		c()
+		c()
+		func countdown() {
+			var n = 3
+			return func() -> --n, n--
+		}
+		var d = countdown()
+		var a, b = d()
+		func hit() {
+			hits++
+			++hits
+		}
+		hit()
+		var o = {n: 1}
+		var xs = [5]
+		var x = o.n++
+		var y = ++xs[0]
+		return c(), a, b, d(), hits, x, o.n, y, xs[0]`)
+	want := "[3 2 2 0 2 1 2 6 6]"
+	if got := fmt.Sprint(res); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestNestedBreakContinue(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var out = []
+		for i in [1, 2, 3, 4, 5, 6] {
+			if i > 1 {
+				match i {
+					2 { continue }
+					5 { if i > 0 { if i == 5 { break } } }
+				}
+			}
+			append(out, i)
+		}
+		var pairs = []
+		for a in [1, 2, 3] {
+			for b in [1, 2, 3] {
+				if b == 2 { if a == 2 { break } else { continue } }
+				append(pairs, a * 10 + b)
+			}
+			if a == 3 { break }
+		}
+		var last = 0
+		for m in [1, 2, 3] {
+			last = if m == 2 { break } else { m }
+		}
+
+		// continue from a branch still closes the captured variables
+		var fs = []
+		var n = 0
+		for n < 3 {
+			var v = n
+			append(fs, func() -> v)
+			n++
+			if n > 0 { continue }
+		}
+		return out, pairs, last, [f() for f in fs]`)
+	want := "[[1 3 4] [11 13 21 31 33] 1 [0 1 2]]"
+	if got := fmt.Sprint(res); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	failing := []string{
+		"for x in [1] { func f() { break } }",
+		"if true { match 1 { 1 { continue } } }",
+	}
+	for _, source := range failing {
+		if _, err := DoString(source); !errors.Is(err, ErrOutsideLoop) {
+			t.Errorf("%q: expected %v, got %v", source, ErrOutsideLoop, err)
+		}
+	}
+}
+
+func TestInfiniteLoop(t *testing.T) {
+	code, err := CompileReader(strings.NewReader(`
+		var n = 0
+		var odd = []
+		for {
+			n = n + 1
+			if n > 7 { break }
+			if n == 2 || n == 4 || n == 6 { continue }
+			append(odd, n)
+		}
+		return n, odd
+	`), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the end of the body and the continue jump straight back to
+	// the start, there's no condition to test
+	jumps := 0
+	for _, instr := range code.Code {
+		if OpGetOpcode(instr) == OpJmp && OpGetsBx(instr) < 0 {
+			jumps++
+		}
+	}
+	if jumps != 2 {
+		t.Errorf("expected 2 backward jumps, got %d", jumps)
+	}
+
+	res, err := NewVM().run(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(res); got != "[8 [1 3 5 7]]" {
+		t.Errorf("expected [8 [1 3 5 7]], got %s", got)
+	}
+}
+
+func TestNumericLoop(t *testing.T) {
+	tests := []struct {
+		source string
+		fused  int
+		want   []string
+	}{
+		{"var s = 0\nfor i := 0; i < 10; i++ { s += i }\nreturn s", 1, []string{"45"}},
+		{"const n = 3\nvar s = 0\nfor i := 0; i < n; i++ { s += i }\nreturn s", 1, []string{"3"}},
+		{"var s = 0\nfor i := 5; i < 3; i++ { s += 1 }\nreturn s", 1, []string{"0"}},
+		{"var n, c = 3, 0\nfor i := 0; i < n; i++ { if i == 1 { continue }\nc += 1\nn = 5 }\nreturn c", 1, []string{"4"}},
+		{"var s = []\nfor i := 0; i < 6; i++ { append(s, i)\ni++ }\nreturn s", 1, []string{"[0 2 4]"}},
+		{"var fs = []\nfor i := 0; i < 3; i++ { append(fs, func() -> i) }\nreturn [f() for f in fs]", 1, []string{"[0 1 2]"}},
+		{"var s = 0\nfor i := 0.5; i < 3; i++ { s += i }\nreturn s", 1, []string{"4.5"}},
+
+		// not the canonical shape, or the limit is not a local
+		{"var s = 0\nfor i := 0; i <= 3; i++ { s += i }\nreturn s", 0, []string{"6"}},
+		{"var s = 0\nfor i := 0; i < 6; i += 2 { s += i }\nreturn s", 0, []string{"6"}},
+		{"var j, s = 0, 0\nfor i := 0; j < 3; j++ { s += 1 }\nreturn s", 0, []string{"3"}},
+		{"var i, s = 0, 0\nfor i = 0; i < 3; i++ { s += 1 }\nreturn s, i", 0, []string{"3", "3"}},
+		{"var s = 0\nfor i := 0; i < len([1, 2]); i++ { s += 1 }\nreturn s", 0, []string{"2"}},
+		{"var n = 2\nfunc f() { var s = 0\nfor i := 0; i < n; i++ { s += 1 }\nreturn s }\nreturn f()", 0, []string{"2"}},
+	}
+	for _, test := range tests {
+		code, err := CompileReader(strings.NewReader(test.source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count func(b *Bytecode) int
+		count = func(b *Bytecode) int {
+			n := 0
+			for _, instr := range b.Code {
+				if OpGetOpcode(instr) == OpForloop {
+					n++
+				}
+			}
+			for _, f := range b.Funcs {
+				n += count(f)
+			}
+			return n
+		}
+		if n := count(code); n != test.fused {
+			t.Errorf("%q: expected %d forloop, got %d", test.source, test.fused, n)
+		}
+
+		res, err := NewVM().run(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range test.want {
+			if res[i].String() != w {
+				t.Errorf("%q: (%d) expected %q, got %q", test.source, i, w, res[i])
+			}
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	var closed []string
+	vm := NewVM()
+	vm.Define("closed", GoFunc(func(call *FuncCall) {
+		closed = append(closed, call.Args[0].String())
+	}))
+	prelude := `
+		func res(name) -> {name: name, close: func() { closed(this.name) }}
+	`
+	tests := []struct {
+		source, want string
+		fails        bool
+	}{
+		{`with a := res("a") { with b := res("b") { closed("body") } }`, "body b a", false},
+		{`func f() { with a := res("a") { return closed("ret") } }; f()`, "ret a", false},
+		{`for i := 0; i < 3; i++ { with a := res(str(i)) { if i == 1 { break }; continue } }`, "0 1", false},
+		{`with a := nil { closed("nil") }`, "nil", false},
+		{`with a := res("a") { with b := res("b") { var x = [][1] } }`, "b a", true},
+		{`with a := res("a") { with b := 1 { closed("body") } }`, "a", true},
+	}
+	for _, test := range tests {
+		closed = nil
+		code, err := CompileReader(strings.NewReader(prelude+test.source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = vm.run(code)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.source, err)
+		}
+		if got := strings.Join(closed, " "); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.source, test.want, got)
+		}
+	}
+}
+
+func TestTryRecover(t *testing.T) {
+	var logged []string
+	vm := NewVM()
+	vm.Define("log", GoFunc(func(call *FuncCall) {
+		logged = append(logged, call.Args[0].String())
+	}))
+	prelude := `
+		func res(name) -> {name: name, close: func() { log(this.name) }}
+		func fail(n) { if n == 0 { panic "deep" }; return fail(n - 1) }
+	`
+	tests := []struct {
+		source, want string
+		fails        bool
+	}{
+		{`try { var x = nil; x() } recover e { log(e.message); log(e.line) }`, "cannot call local 'x' (a nil value) 4", false},
+		{`try { panic "boom" } recover e { log(e) }`, "boom", false},
+		{`try { log("try") } recover e { log("recover") } finally { log("finally") }`, "try finally", false},
+		{`try { panic 1 } recover e { log("recover") } finally { log("finally") }`, "recover finally", false},
+		{`try { fail(5) } recover e { log(e) }`, "deep", false},
+		{`try { try { panic "inner" } finally { log("inner") } } recover e { log(e) }`, "inner inner", false},
+		{"try { try { var x = [][1] } recover e {\n panic e } } recover e { log(e.message); log(e.line) }", "index 1 out of range with length 0 4", false},
+		{`try { panic "a" } recover e { panic "b" } finally { log("finally") }`, "finally", true},
+		{`func f() { try { return 1 } finally { log("finally") } }; log(f())`, "finally 1", false},
+		{`for i := 0; i < 3; i++ { try { if i == 1 { break } } finally { log(str(i)) } }`, "0 1", false},
+		{`try { len(1, 2) } recover e { log("native") }`, "native", false},
+		{`try { with a := res("a") { with b := res("b") { fail(1) } } } recover e { log(e) }`, "b a deep", false},
+		{`with a := res("a") { try { with b := res("b") { fail(1) } } recover e { log(e) } }`, "b deep a", false},
+	}
+	for _, test := range tests {
+		logged = nil
+		code, err := CompileReader(strings.NewReader(prelude+test.source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = vm.run(code)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error %v", test.source, err)
+		}
+		if got := strings.Join(logged, " "); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.source, test.want, got)
+		}
+	}
+
+	// the errors not recovered are returned with their position and value
+	_, err := DoString(`
+		try {
+			panic "a"
+		} recover e {
+			panic [e]
+		}
+	`)
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected a *RuntimeError, got %v", err)
+	}
+	if rerr.Line != 5 || rerr.Message != "[a]" || rerr.Value.Type() != ValueArray {
+		t.Errorf("unexpected error %#v", rerr)
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	// outside of a try the errors stop the program, not the host
+	for _, source := range []string{`len(5)`, `int("abc")`, `number("x")`, `compress.gunzip("xx")`} {
+		err := NewVM().RunString([]byte("var x = 1\n"+source), "<test>")
+		rerr, ok := err.(*RuntimeError)
+		if !ok || rerr.File != "<test>" || rerr.Line != 2 {
+			t.Errorf("%s: expected a runtime error at line 2, got %v", source, err)
+		}
+	}
+}
+
+func TestCallback(t *testing.T) {
+	var logged []string
+	vm := NewVM()
+	vm.Define("log", GoFunc(func(call *FuncCall) {
+		logged = append(logged, call.Args[0].String())
+	}))
+	vm.Define("apply", GoFunc(func(call *FuncCall) {
+		res, err := call.Call(call.Args[0], call.Args[1:]...)
+		if err != nil {
+			panic(err)
+		}
+		for _, v := range res {
+			call.PushReturnValue(v)
+		}
+	}))
+	vm.Define("safe", GoFunc(func(call *FuncCall) {
+		_, err := call.Call(call.Args[0])
+		if err == nil {
+			call.PushReturnValue(String("ok"))
+			return
+		}
+		call.PushReturnValue(String(err.Error()))
+	}))
+	prelude := `
+		func res(name) -> {name: name, close: func() { log(this.name) }}
+	`
+	tests := []struct {
+		source, want string
+	}{
+		{`var s = 0; apply(func(v) { s = s + v }, 2); return s`, "2"},
+		{`return apply((func(a, b) -> a + b), 1, 2)`, "3"},
+		{`return apply(len, [1, 2])`, "2"},
+		{`return apply((func(n) -> apply((func(m) -> m * 2), n) + 1), 3)`, "7"},
+		{`return safe(func() { log("called") })`, "ok"},
+		{`return safe(func() { panic "boom" })`, "<test>:3: boom"},
+		{`return safe(func() { len(1) })`, "<test>:3: bad argument #1 (expected string, array or object, got number)"},
+		{`return safe(1)`, "cannot call a number value"},
+		{`return safe(func() { with a := res("a") { panic "x" } })`, "<test>:3: x"},
+		{"try { apply(func() {\n var x = [][1] }) } recover e { return e.message, e.line }", "index 1 out of range with length 0"},
+		{`safe(func() { panic "x" }); return apply(func() -> "after")`, "after"},
+	}
+	for _, test := range tests {
+		res := runString(t, vm, prelude+test.source)
+		if len(res) == 0 || res[0].String() != test.want {
+			t.Errorf("%s: expected %s, got %v", test.source, test.want, res)
+		}
+		if len(res) > 1 && res[1].String() != "4" {
+			t.Errorf("%s: expected the error at line 4, got %s", test.source, res[1])
+		}
+	}
+	if got := strings.Join(logged, " "); got != "called a" {
+		t.Errorf("expected the callback and the close method to log, got %q", got)
+	}
+}
+
+func TestIfChain(t *testing.T) {
+	res := runString(t, NewVM(), `
+		func id(v) { return v }
+		func classify(n) {
+			var r = nil
+			if x := id(n); x > 10 {
+				var v = x * 2
+				r = ["big", v]
+			} else if y := x + 1; y > 5 {
+				var v = y
+				r = ["mid", x, v]
+			} else if x > 0 {
+				r = ["small", x, y]
+			} else {
+				var v = -x
+				r = ["neg", v, y]
+			}
+			return r
+		}
+		func sign(n) {
+			return if x := id(n); x > 0 { 1 } else if y := -x; y > 0 { -y / y } else { 0 }
+		}
+		return [classify(20), classify(6), classify(2), classify(-3)], [sign(5), sign(-5), sign(0)]
+	`)
+	want := []string{"[[big 40] [mid 6 7] [small 2 3] [neg 3 -2]]", "[1 -1 0]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	// the init variable is scoped to the chain
+	if _, err := DoString("if x := 1; x > 0 {} else {}\nreturn x"); err == nil {
+		t.Errorf("expected x to be undefined after the if")
+	}
+}
+
+func TestIfAndMatchExpr(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var a = 3
+		var x = if a > 2 { 10 } else { 20 }
+		x = if x > 5 {
+			var double = x * 2
+			double
+		} else if x > 1 { 0 } else { -1 }
+		var kind = match a {
+			1 { "one" }
+			3 { if a > 0 { "three" } else { "negative" } }
+		}
+		var init = if n := a * 2; n > 5 { n }
+		var missing = [if a > 5 { 1 }, match a { 1 { 1 } }, if a > 5 { 1 } else { var y = 2 }]
+		var sum = 0
+		for i in [1, 2, 3] {
+			sum = sum + match i { 2 { 10 } else { i } }
+		}
+		return x, kind, init, missing, sum
+	`)
+	want := []string{"20", "three", "6", "[nil nil nil]", "14"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+}
+
+func TestProto(t *testing.T) {
+	res := runString(t, NewVM(), `
+		proto Point {
+			x: number = 0
+			y: number = 0
+			label
+		}
+		func Point.pair() { return [this.label, this.y] }
+
+		var p = Point(3)
+		var q = Point(1, 2, "q")
+		return [p.x, p.y, p.label], q.pair(), q is Point, [k for k, v in q]
+	`)
+	want := []string{"[3 0 nil]", "[q 2]", "true", "[label x y]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	// the schema is checked when constructing, even if the
+	// prototype isn't known at compile time
+	failing := []string{
+		"proto P { x: number }\nvar f = P\nf()",
+		"proto P { x: number }\nvar f = P\nf(1, 2)",
+		"proto P { x: string = \"\" }\nvar f = P\nf(1)",
+	}
+	for _, source := range failing {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewVM().run(code); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+func TestProtoInherit(t *testing.T) {
+	res := runString(t, NewVM(), `
+		proto Point { x: number = 0, y: number = 0, label }
+		func Point.len() { return this.x + this.y }
+		func Point.name() { return "point" }
+
+		proto Point3 : Point { z: number = 0, y = 5 }
+		func Point3.len() { return super.len() + this.z }
+		func Point3.name() { return [super.name(), super.x] }
+
+		var p = Point3(1, 2, "p", 3)
+		var q = Point3(1)
+		return [p.x, p.y, p.label, p.z], p.len(), q.len(), p.name(), p is Point, [k for k, v in q]
+	`)
+	want := []string{"[1 2 p 3]", "6", "6", "[point 0]", "true", "[label x y z]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	// 'super' is a name like any other outside of methods
+	res = runString(t, NewVM(), "var super = 1\nproto P { x }\nfunc P.f() { return super }\nreturn P().f()")
+	if res[0].String() != "1" {
+		t.Errorf("expected 1, got %s", res[0])
+	}
+
+	for _, source := range []string{
+		"proto P { x }\nproto Q : P { y: number }\nvar f = Q\nf(1)",
+		"var o = 1\nproto P : o { x }",
+	} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewVM().run(code); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+func TestMetamethods(t *testing.T) {
+	vm := NewVM()
+	vm.Define("gomul", GoFunc(func(call *FuncCall) {
+		call.PushReturnValue(Number(call.Args[1].(Number) * 10))
+	}))
+	res := runString(t, vm, `
+		proto Vec { x = 0, y = 0 }
+		func Vec.__add(a, b) -> Vec(a.x + b.x, a.y + b.y)
+		func Vec.__mul(a, b) -> b is Vec ? Vec(a * b.x, a * b.y) : Vec(a.x * b, a.y * b)
+		func Vec.__eq(a, b) -> a.x == b.x && a.y == b.y
+		func Vec.__lt(a, b) -> a.x < b.x
+		func Vec.__sub(a, b) { panic "no sub" }
+
+		var sum = Vec(1, 2) + Vec(3, 4)
+		var scaled = [(Vec(1, 2) * 2).y, (3 * Vec(1, 2)).x]
+		var cmp = [sum == Vec(4, 6), sum != Vec(4, 6), Vec(1) < Vec(2), Vec(1) > Vec(2), sum == 1]
+
+		var defaults = {a: 1, __index: func(key) -> "no ${key}"}
+		var proxy = {__index: func(key) -> func() -> key}
+		var looked = [defaults.a, defaults["b"], proxy.hello()]
+
+		var failed = nil
+		try { Vec() - Vec() } recover e { failed = e }
+
+		var native = {__mul: gomul} * 2
+		return [sum.x, sum.y], scaled, cmp, looked, failed, native
+	`)
+	want := []string{"[4 6]", "[4 3]", "[true false true false false]", "[1 no b hello]", "no sub", "20"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+}
+
+func TestContracts(t *testing.T) {
+	const lib = `
+		func div(a, b) requires b != 0 ensures result * b == a -> a / b
+		func sign(x) ensures result != nil { if x > 0 { return 1 } else if x < 0 { return -1 } }
+		func check(x) { assert(x > 0, x) }
+	`
+	tests := []struct {
+		source   string
+		want     string // the error, or the result
+		stripped string
+	}{
+		{"return div(6, 3)", "2", "2"},
+		{"return div(1, 0)", "<test>:2: precondition of div failed", "+Inf"},
+		{"return sign(-2)", "-1", "-1"},
+		{"return sign(0)", "<test>:3: postcondition of sign failed", "nil"},
+		{"check(1)\nreturn 1", "1", "1"},
+		{"check(-1)", "<test>:4: assertion failed: -1", ""},
+		{"assert(false)", "<test>:5: assertion failed", ""},
+		{"return assert(true)", "nil", "nil"},
+		{"try { assert(false) } recover e { return e }", "assertion failed", ""},
+	}
+	for _, test := range tests {
+		for _, strip := range []bool{false, true} {
+			want := test.want
+			if strip {
+				want = test.stripped
+			}
+			code, err := CompileReader(strings.NewReader(lib+test.source), "<test>", CompileOptions{StripAssertions: strip})
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := NewVM().run(code)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			} else if len(res) > 0 {
+				got = res[0].String()
+			}
+			if got != want {
+				t.Errorf("%q (stripped: %v): expected %q, got %q", test.source, strip, want, got)
+			}
+		}
+	}
+}
+
+func TestMatchPatterns(t *testing.T) {
+	res := runString(t, NewVM(), `
+		func describe(v) -> match v {
+			[] { "empty" }
+			[1, y] { "one then ${y}" }
+			[a, [b, c]] { "nested ${a} ${b} ${c}" }
+			[first, ...rest] { "first ${first} rest ${len(rest)}" }
+			{x, y: 0} { "x axis ${x}" }
+			{kind: "circle", r} { "circle ${r}" }
+			else { "other" }
+		}
+		var fs = []
+		for v in [[1, 2], [3, 4]] {
+			match v { [a, _] { append(fs, func() -> a) } }
+		}
+		return describe([]), describe([1, 2]), describe([3, [4, 5]]), describe([3, 4, 5]),
+			describe({x: 2, y: 0}), describe({kind: "circle", r: 3}), describe({x: 2}),
+			describe("s"), describe(nil), [f() for f in fs], match "ab" { [a] { a } else { "const" } }`)
+	want := []string{"empty", "one then 2", "nested 3 4 5", "first 3 rest 2",
+		"x axis 2", "circle 3", "other", "other", "other", "[1 3]", "const"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+
+	if _, err := DoString("match [1, 2] { [a, a] { } }"); !errors.Is(err, ErrRedeclared) {
+		t.Errorf("expected %v, got %v", ErrRedeclared, err)
+	}
+}
+
+func TestTypeSwitch(t *testing.T) {
+	res := runString(t, NewVM(), `
+		proto Point { x = 0, y = 0 }
+		func describe(v) {
+			return match n := type(v) {
+				number { n * 2 }
+				string, bool { [n] }
+				nil { "nothing" }
+				Point { n.x }
+				func { "func" }
+				else { "other" }
+			}
+		}
+		var kinds = [describe(21), describe("s"), describe(false), describe(nil), describe(Point(7)), describe([1]), describe(len)]
+
+		var count = 0
+		for v in [1, "a", 2] {
+			match type(v) {
+				number { count++ }
+			}
+		}
+		return kinds, count, nil is nil
+	`)
+	want := []string{"[42 [s] [false] nothing 7 other func]", "2", "true"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+}
+
+func TestIterator(t *testing.T) {
+	res := runString(t, NewVM(), `
+		proto Range { from = 0, to = 0 }
+		func Range.__iter() {
+			var i = this.from
+			var to = this.to
+			return {
+				next: func() {
+					if i >= to {
+						return nil, true
+					}
+					i = i + 1
+					return i - 1, false
+				},
+			}
+		}
+		func count(n) {
+			var c = 0
+			return {
+				next: func() {
+					c = c + 1
+					return c, c > n
+				},
+			}
+		}
+
+		var values = []
+		for v in Range(2, 5) {
+			append(values, v)
+		}
+		var keys = [k for k, v in Range(5, 8)]
+		var some = [v for v in count(10) if v > 2 && v < 6]
+		var steps = 0
+		for v in count(100) {
+			if v == 3 {
+				break
+			}
+			steps++
+		}
+		var fns = [func() -> v for v in count(2)]
+		return values, keys, some, steps, [fns[0](), fns[1]()]
+	`)
+	want := []string{"[2 3 4]", "[0 1 2]", "[3 4 5]", "2", "[1 2]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var n = 4
+		var r = 1..n
+		var sum = 0
+		for x in r {
+			sum += x
+		}
+		var steps = [i * 10 + x for i, x in 10..0 by -3]
+		var fractions = [x for x in 0..0.3 by 0.1]
+		return r, sum, #r, #(5..1), steps, len(fractions), r is range, 2..8 by 2
+	`)
+	want := []string{"1..4", "10", "4", "0", "[10 17 24 31]", "4", "true", "2..8 by 2"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	for _, source := range []string{"return 1..\"a\"", "return nil..2", "var s = 0\nreturn 1..2 by s"} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewVM().run(code); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var o = {}
+		var pair = [1, 2]
+		var a, b = pair...
+		[c, d, e] := [3, 4]; [o.x, pair[0]] = [5, 6]
+		f, g := 7, [8, 9]...
+		a, b = b, a
+		return a, b, c, d, e, o.x, pair[0], f, g
+	`)
+	want := []string{"2", "1", "3", "4", "nil", "5", "6", "7", "8"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	code, err := CompileReader(strings.NewReader("[a, b] := 1"), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVM().run(code); err == nil || !strings.Contains(err.Error(), "cannot unpack a number") {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	res := runString(t, NewVM(), `
+		func pair() -> 3, 4
+		var rest = [2, 3]
+		var empty = []
+		var many = [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11]
+		return [1, rest..., 5], [empty..., 1, empty...], [0, pair()..., 5], [rest...], [many..., 12, many[0]]
+	`)
+	want := []string{"[1 2 3 5]", "[1]", "[0 3 4 5]", "[2 3]", "[0 1 2 3 4 5 6 7 8 9 10 11 12 0]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	code, err := CompileReader(strings.NewReader("var n = 1; return [0, n...]"), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewVM().run(code); err == nil || !strings.Contains(err.Error(), "cannot spread a number") {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
+
+func TestObjectUnpack(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var person = {name: "ana", age: 30, city: "rio"}
+		{name, age} := person
+		var years = 0
+		{age: years, missing} = person
+		{city, age: next} := {city: "rio", age: 31}
+		return name, age, years, missing, city, next
+	`)
+	want := []string{"ana", "30", "30", "nil", "rio", "31"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+}
+
+func TestKeywordArgs(t *testing.T) {
+	vm := NewVM()
+	vm.Define("native", GoFunc(func(call *FuncCall) {
+		call.PushReturnValue(Number(len(call.Args)))
+		call.PushReturnValue(call.Keywords["sep"])
+	}))
+	res := runString(t, vm, `
+		func f(a, b = 2, c = a + 1) -> [a, b, c]
+		var o = {sub: func(x, y = 10) -> x - y}
+		proto Point { x = 0, y = 0 }
+		var p = Point(y = 3)
+		var n, sep = native(1, 2, sep = ", ")
+		return f(1), f(1, 5), f(1, c = 9), f(c = 9, a = 4), f(1, b = nil),
+			o.sub(y = 1, x = 5), [p.x, p.y], [n, sep]
+	`)
+	want := []string{"[1 2 2]", "[1 5 2]", "[1 2 9]", "[4 2 9]", "[1 2 2]", "4", "[0 3]", "[2 , ]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	// the functions not known by the compiler are checked by the VM
+	tests := []struct {
+		source, err string
+	}{
+		{"g(1, d = 2)", "unknown keyword argument 'd' in call to f (did you mean 'a'?)"},
+		{"g(1, a = 2)", "argument 'a' given twice in call to f"},
+		{"g(1, b = 2, b = 3)", "argument 'b' given twice in call to f"},
+		{"(func(x) {})(y = 1)", "unknown keyword argument 'y' in call to anonymous function"},
+		{"Q(z = 1)", "unknown keyword argument 'z' in call to Point"},
+	}
+	for _, test := range tests {
+		_, err := DoString(`
+			func f(a, b = 2) {}
+			proto Point { x = 0 }
+			var g = nil; g = f
+			var Q = nil; Q = Point
+			` + test.source)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.source, test.err, err)
+		}
+	}
+	if _, err := DoString("print(sep = 1, 2)"); err == nil || !strings.Contains(err.Error(), "positional argument after keyword argument") {
+		t.Errorf("expected a syntax error, got %v", err)
+	}
+}
+
+func TestVariadicArgs(t *testing.T) {
+	vm := NewVM()
+	vm.Define("apply", GoFunc(func(call *FuncCall) {
+		res, err := call.Call(call.Args[0], call.Args[1:]...)
+		if err != nil {
+			panic(err)
+		}
+		for _, v := range res {
+			call.PushReturnValue(v)
+		}
+	}))
+	res := runString(t, vm, `
+		func f(a, rest...) -> [a, rest, #rest]
+		func g(a, b = 2, rest...) -> [a, b, rest]
+		var o = {join: func(sep, parts...) {
+			var s = ""
+			for p in parts { s = s == "" ? p : "${s}${sep}${p}" }
+			return s
+		}}
+		func counter(step...) {
+			return func() -> step
+		}
+		return f(), f(1), f(1, 2, 3),
+			g(1), g(1, b = 5), g(1, 5, 6, 7), o.join("-", "a", "b", "c"),
+			counter(1, 2)(), apply(f, 1, 2), apply(g)
+	`)
+	want := []string{"[nil [] 0]", "[1 [] 0]", "[1 [2 3] 2]", "[1 2 []]", "[1 5 []]", "[1 5 [6 7]]", "a-b-c", "[1 2]", "[1 [2] 1]", "[nil 2 []]"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	// the variadic parameter is not a keyword
+	if _, err := DoString("func f(a, rest...) {}\nvar g = nil; g = f\ng(1, rest = 2)"); err == nil || !strings.Contains(err.Error(), "unknown keyword argument 'rest'") {
+		t.Errorf("expected an unknown keyword error, got %v", err)
+	}
+}
+
+func TestLen(t *testing.T) {
+	res := runString(t, NewVM(), `
+		proto Set { items = nil }
+		func Set.__len() -> #this.items
+
+		var s = Set([1, 2, 3])
+		var str = "héllo"
+		return #str, #[1, 2], #{a: 1, b: 2}, #s, len(str), len({}), #"" + 1
+	`)
+	want := []string{"6", "2", "2", "3", "6", "0", "1"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %s, got %s", i, w, res[i])
+		}
+	}
+
+	for _, source := range []string{"var n = 1\nreturn #n", "var f = func() -> 1\nreturn #f"} {
+		code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewVM().run(code); err == nil {
+			t.Errorf("%q: expected an error", source)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	// Go raw strings can't have backticks
+	res := runString(t, NewVM(), strings.Join([]string{
+		"var name = \"yo\"",
+		"var n = 2",
+		"func tag(parts, values) { return [len(parts), len(values), values[1]] }",
+		"var html = {escape: func(parts, values) { return parts }}",
+		"return `hello ${name}!`, `${n} + ${n} = ${n * 2}`, `\\${name} ${[1, 2]}`, ``,",
+		"	tag`a${n}b${name}`, html.escape`<p>${name}</p>`, `a${`b${n}`}c`,",
+		"	`multiple",
+		"lines`",
+	}, "\n"))
+	want := []string{"hello yo!", "2 + 2 = 4", "${name} [1 2]", "", "[3 2 yo]", "[<p> </p>]", "ab2c", "multiple\nlines"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+}
+
+func TestStringInterpolation(t *testing.T) {
+	res := runString(t, NewVM(), `
+		var name = "yo"
+		var n = 2
+		return "hello ${name}!", "${n} + ${n} = ${n * 2}", "\${name} $name", "a${"b${n}"}c", "a${`+"`b${n}`"+`}c",
+			"${[n, "${n}"]}", "\x41${n}\u{e7}"
+	`)
+	want := []string{"hello yo!", "2 + 2 = 4", "${name} $name", "ab2c", "ab2c", "[2 2]", "A2ç"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+}
+
+func TestTemplateFolding(t *testing.T) {
+	source := strings.Join([]string{
+		"const name = \"yo\"",
+		"var x = 1",
+		"return `hi ${name} ${1 + 1}`, \"a\" \"b\" `c`, `${name}-${x}-${\"z\"}`",
+	}, "\n")
+	code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the last template is concatenated at runtime,
+	// the constants around x are folded into "yo-" and "-z"
+	var concats []uint32
+	for _, instr := range code.Code {
+		if OpGetOpcode(instr) == OpConcat {
+			concats = append(concats, instr)
+		}
+	}
+	if len(concats) != 1 || OpGetC(concats[0])-OpGetB(concats[0]) != 2 {
+		t.Errorf("expected one concat of 3 values, got %d concats", len(concats))
+	}
+	consts := make(map[string]bool)
+	for _, c := range code.Consts {
+		consts[c.String()] = true
+	}
+	for _, want := range []string{"hi yo 2", "abc", "yo-", "-z"} {
+		if !consts[want] {
+			t.Errorf("expected the constant %q", want)
+		}
+	}
+
+	res, err := NewVM().run(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"hi yo 2", "abc", "yo-1-z"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+}
+
+func TestLogicFolding(t *testing.T) {
+	source := strings.Join([]string{
+		"const debug = false",
+		"const level = 2",
+		"var x = 1",
+		"return debug ? \"dbg\" : \"rel\", debug && f(), level > 1 || f(), !debug && x, level == 2 ? x : f(), 1 && 2",
+	}, "\n")
+	code, err := CompileReader(strings.NewReader(source), "<test>", CompileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// f is never called, there are no jumps left
+	for _, instr := range code.Code {
+		switch OpGetOpcode(instr) {
+		case OpLoadglobal, OpCall, OpJmp, OpJmptrue, OpJmpfalse:
+			t.Errorf("unexpected instruction %s", OpGetOpcode(instr))
+		}
+	}
+
+	res, err := NewVM().run(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"rel", "false", "true", "1", "1", "2"}
+	for i, w := range want {
+		if res[i].String() != w {
+			t.Errorf("(%d) expected %q, got %q", i, w, res[i])
+		}
+	}
+}
+
+func TestLoadnilElimination(t *testing.T) {
+	tests := []struct {
+		source  string
+		loadnil int
+		want    []string
+	}{
+		{"var a\nvar b, c\nreturn a, b, c", 1, []string{"nil", "nil", "nil"}},
+		{"var x\nx = 5\nreturn x", 0, []string{"5"}},
+		{"var x, y\nx, y = 1, x\nreturn x, y", 1, []string{"1", "nil"}},
+		{"var y\ny = y\nreturn y", 1, []string{"nil"}},
+		{"var out = []\nfor i in [1, 2] {\nvar w\nif i == 1 { w = i }\nappend(out, w)\n}\nreturn out[0], out[1]", 1, []string{"1", "nil"}},
+	}
+	for _, test := range tests {
+		code, err := CompileReader(strings.NewReader(test.source), "<test>", CompileOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, instr := range code.Code {
+			if OpGetOpcode(instr) == OpLoadnil {
+				count++
+			}
+		}
+		if count != test.loadnil {
+			t.Errorf("%q: expected %d loadnil, got %d", test.source, test.loadnil, count)
+		}
+
+		res, err := NewVM().run(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, w := range test.want {
+			if res[i].String() != w {
+				t.Errorf("%q: (%d) expected %q, got %q", test.source, i, w, res[i])
+			}
+		}
+	}
+}
+
+func TestUndefinedGlobalSuggestion(t *testing.T) {
+	tests := []struct {
+		source, suggestion string
+	}{
+		{"var counter = 1\ncountr", "counter"},
+		{"func f(value) { return valeu }\nf(1)", "value"},
+		{"var total = 1\nfunc f() { return totl + 1 }\nf()", "total"},
+		{"pritnln(1)", "println"},
+		{"var a = 1\nxyz", ""},
+	}
+	for _, test := range tests {
+		_, err := DoString(test.source)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.source)
+			continue
+		}
+		msg := err.Error()
+		hint := fmt.Sprintf("(did you mean '%s'?)", test.suggestion)
+		if test.suggestion == "" && strings.Contains(msg, "did you mean") {
+			t.Errorf("%q: unexpected suggestion in %q", test.source, msg)
+		} else if test.suggestion != "" && !strings.HasSuffix(msg, hint) {
+			t.Errorf("%q: expected %q in %q", test.source, hint, msg)
+		}
+	}
+
+	_, err := DoString("func f(x: nubmer) {}")
+	if err == nil || !strings.Contains(err.Error(), "(did you mean 'number'?)") {
+		t.Errorf("expected a suggestion for the unknown type, got %v", err)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		dist int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"kitten", "sitting", 3},
+		{"valeu", "value", 1},
+		{"ação", "acao", 2},
+	}
+	for _, test := range tests {
+		if d := editDistance(test.a, test.b); d != test.dist {
+			t.Errorf("editDistance(%q, %q) = %d, expected %d", test.a, test.b, d, test.dist)
+		}
+	}
+}
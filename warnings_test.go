@@ -0,0 +1,98 @@
+// Copyright 2016 Guilherme Nemeth <guilherme.nemeth@gmail.com>
+
+package yo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// compileWarnings returns the warnings of source as "line: message"
+func compileWarnings(t *testing.T, source string) []string {
+	var warns []string
+	opts := CompileOptions{Warn: func(w *CompileWarning) {
+		warns = append(warns, fmt.Sprintf("%d: %s", w.Line, w.Message))
+	}}
+	if _, err := CompileReader(strings.NewReader(source), "<test>", opts); err != nil {
+		t.Fatalf("%q: %v", source, err)
+	}
+	return warns
+}
+
+func TestInferWarnings(t *testing.T) {
+	tests := []struct {
+		source string
+		warns  []string
+	}{
+		{"var n = 1\nn()", []string{"2: calling a number value"}},
+		{"var x\nvar y = x.name", []string{"2: accessing field 'name' of a nil value"}},
+		{"var s = \"a\"\nvar y = s * 2", []string{"2: invalid operation: string * number"}},
+		{"var b = true\nvar y = -b", []string{"2: invalid operation: - on bool value"}},
+		{"var n = 1\nfor x in n {}", []string{"2: cannot iterate over a number value"}},
+		{"var x = nil\nvar y = x[0]", []string{"2: indexing a nil value"}},
+
+		// the kind is only known when every path agrees
+		{"var x = 1\nif cond { x = \"a\" }\nx()", nil},
+		{"var x = 1\nif cond { x = 2 } else { x = 3 }\nx()", []string{"3: calling a number value"}},
+
+		// nor when a nested function may change it
+		{"var x = 1\nfunc f() { x = g }\nx()", nil},
+	}
+	for _, test := range tests {
+		if warns := compileWarnings(t, test.source); !reflect.DeepEqual(warns, test.warns) {
+			t.Errorf("%q: expected warnings %q, got %q", test.source, test.warns, warns)
+		}
+	}
+}
+
+func TestFlowWarnings(t *testing.T) {
+	tests := []struct {
+		source string
+		warns  []string
+	}{
+		{"var x = 1\nif 1 < 2 {\nx = 2\n}", []string{"2: if condition is always true"}},
+		{"var n = 0\nfor i := 0; 1 > 2; i++ {\nn += i\n}", []string{"2: loop condition is always false"}},
+		{"func f(x) {\nreturn x\nx = 2\n}", []string{"3: unreachable code"}},
+		{"for x in [1] {\nbreak\nprintln(x)\n}", []string{"3: unreachable code"}},
+		{"var a = 1\nvar b = a > 0 ? a + 1 : a + 1", []string{"2: both branches of the ternary are the same"}},
+
+		// constants are conditions on purpose
+		{"const debug = false\nif debug {\nprintln(1)\n}", nil},
+		{"var a = 1\nvar b = a > 0 ? a + 1 : a - 1\nfor {\nbreak\n}", nil},
+	}
+	for _, test := range tests {
+		if warns := compileWarnings(t, test.source); !reflect.DeepEqual(warns, test.warns) {
+			t.Errorf("%q: expected warnings %q, got %q", test.source, test.warns, warns)
+		}
+	}
+}
+
+func TestMatchWarnings(t *testing.T) {
+	tests := []struct {
+		source string
+		warns  []string
+	}{
+		{"var x = 1\nmatch x {\n1 { }\n2, 1 { }\n}", []string{"4: duplicate case 1 in match (previous at line 3)"}},
+		{"var x = 1\nmatch x {\n\"a\" { }\n\"a\" { }\n}", []string{"4: duplicate case \"a\" in match (previous at line 3)"}},
+		{"var b = x > 1\nmatch b {\ntrue { }\n}", []string{"2: match is not exhaustive, missing case false"}},
+		{"var b = x > 1\nmatch b {\ntrue { }\nfalse { }\nelse { }\n}", []string{"5: else case of match is never taken, the other cases cover every value"}},
+
+		// type switches
+		{"match type(x) {\nnumber { }\nstring, number { }\n}", []string{"3: duplicate case number in match (previous at line 2)"}},
+		{"match type(x) {\nany { }\nelse { }\n}", []string{"3: else case of match is never taken, the other cases cover every value"}},
+		{"match type(x) {\nnil, bool, number, string { }\nfunc, array, object { }\nchan, range { }\nelse { }\n}", []string{"5: else case of match is never taken, the other cases cover every value"}},
+
+		// an open set of values, or a type switch handling some types
+		{"var x = 1\nmatch x {\n1 { }\n2 { }\n}", nil},
+		{"var b = x > 1\nmatch b {\ntrue { }\nelse { }\n}", nil},
+		{"match type(x) {\nnumber { }\n}", nil},
+		{"proto P {}\nmatch type(x) {\nP { }\nP { }\nobject { }\nelse { }\n}", nil},
+	}
+	for _, test := range tests {
+		if warns := compileWarnings(t, test.source); !reflect.DeepEqual(warns, test.warns) {
+			t.Errorf("%q: expected warnings %q, got %q", test.source, test.warns, warns)
+		}
+	}
+}